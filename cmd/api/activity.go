@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// recordLogin records a successful login on the user record. It's written in the
+// background, so that logging in doesn't wait for another write, and a failure is only
+// logged: the login itself has already succeeded.
+func (app *application) recordLogin(r *http.Request, user *data.User) {
+	ip, _ := tokenClient(r)
+	at := time.Now()
+	app.background(func() {
+		err := app.models.Users.RecordLogin(user.ID, ip, at)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("recording login: %w", err), nil)
+		}
+	})
+}
+
+// The listUsersHandler lists the users for admins, along with their login activity. The
+// dormant_since parameter (an RFC 3339 time, or a date like 2026-01-01) restricts the
+// listing to the users who haven't logged in since then, to find dormant accounts.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", app.userPreferences(r).PageSizeOr(defaultPageSize), v)
+	filters.Sort = app.readString(qs, "sort", "id")
+	filters.SortSafelist = []string{"id", "created_at", "last_login_at", "login_count", "-id", "-created_at", "-last_login_at", "-login_count"}
+	var dormantSince time.Time
+	if s := app.readString(qs, "dormant_since", ""); s != "" {
+		var err error
+		dormantSince, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			// A date starts at midnight in the request's timezone.
+			dormantSince, err = time.ParseInLocation("2006-01-02", s, app.requestLocation(r))
+		}
+		v.Check(err == nil, "dormant_since", "must be an RFC 3339 time or a date")
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	users, metadata, err := app.modelsFor(r).Users.GetAllActivity(dormantSince, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
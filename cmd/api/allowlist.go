@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// restrictedPrefixes are the path prefixes of the routes which are only available to
+// clients in the allowlist: the debug endpoints and the admin API.
+var restrictedPrefixes = []string{"/debug/", "/v1/admin/"}
+
+// parseCIDRs parses a comma-separated list of CIDR ranges. A plain IP address is
+// treated as a range containing just that address.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			item = fmt.Sprintf("%s/%d", item, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// The allowlist() middleware only lets clients whose IP address is in one of the
+// -admin-allow-cidrs ranges through to the restricted routes. Everyone else gets a 404
+// Not Found response, exactly as if the routes didn't exist, so that they don't reveal
+// anything to an attacker. This is in addition to any authentication the routes need.
+func (app *application) allowlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRestricted(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !app.ipAllowed(ip) {
+			app.logSecurityEvent(r, "restricted_route_denied", map[string]string{"path": r.URL.Path})
+			app.notFoundResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isRestricted reports whether a path belongs to one of the restricted routes.
+func isRestricted(path string) bool {
+	for _, prefix := range restrictedPrefixes {
+		if strings.HasPrefix(path, prefix) || path == strings.TrimSuffix(prefix, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether ip is in one of the allowed ranges.
+func (app *application) ipAllowed(ip net.IP) bool {
+	for _, ipNet := range app.config.admin.allowCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
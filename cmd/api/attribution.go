@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The attributedMovie type is a movie along with its links and the users who created
+// and last modified it, which only admins get to see (for everyone else they're zero,
+// and left out).
+type attributedMovie struct {
+	*data.Movie
+	CreatedBy int64 `json:"created_by,omitempty"`
+	UpdatedBy int64 `json:"updated_by,omitempty"`
+	Links     links `json:"_links"`
+}
+
+// The movieResponse() method returns the representation of a movie to send in response
+// to a request (see serializeMovie()): with its attribution if the request was made by
+// an admin (see isOperator()), and without it otherwise.
+func (app *application) movieResponse(r *http.Request, movie *data.Movie) (interface{}, error) {
+	admin, err := app.isOperator(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.serializeMovie(r, movie, admin), nil
+}
+
+// The logMovieChange() method records a change to a movie in the audit log (the security
+// events, which record the user who made the request).
+func (app *application) logMovieChange(r *http.Request, event string, movieID int64) {
+	app.logSecurityEvent(r, event, map[string]string{"movie_id": strconv.FormatInt(movieID, 10)})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/apierror"
+)
+
+// The batch type collects the outcome for each item in a bulk or batch request, so that
+// every batch endpoint (bulk creation, imports, bulk updates etc.) sends its response in
+// the same shape. The response looks like this:
+//
+//	{
+//		"results": [
+//			{"index": 0, "status": 201, "movie": {...}},
+//			{"index": 1, "status": 422, "code": "validation_failed", "errors": {"title": "must be provided"}}
+//		],
+//		"summary": {"total": 2, "succeeded": 1, "failed": 1}
+//	}
+//
+// The resource field holds the key used for the data of each successful item (e.g.
+// "movie").
+type batch struct {
+	resource string
+	results  []envelope
+	failed   int
+}
+
+// newBatch returns a new batch for items of the given resource type.
+func newBatch(resource string) *batch {
+	return &batch{resource: resource}
+}
+
+// succeed records that the item at index was processed successfully, along with the
+// status code and data for that item.
+func (b *batch) succeed(index, status int, data interface{}) {
+	result := envelope{"index": index, "status": status}
+	if data != nil {
+		result[b.resource] = data
+	}
+	b.results = append(b.results, result)
+}
+
+// failValidation records that the item at index failed validation, along with the
+// validation errors for that item.
+func (b *batch) failValidation(index int, errors map[string]string) {
+	b.fail(index, http.StatusUnprocessableEntity, apierror.CodeValidationFailed, errors)
+}
+
+// fail records that the item at index couldn't be processed, along with the status code,
+// error code and error message (or map of messages) for that item.
+func (b *batch) fail(index, status int, code apierror.Code, message interface{}) {
+	key := "error"
+	if _, ok := message.(map[string]string); ok {
+		key = "errors"
+	}
+	b.results = append(b.results, envelope{"index": index, "status": status, "code": code, key: message})
+	b.failed++
+}
+
+// hasFailures returns true if any item in the batch has failed.
+func (b *batch) hasFailures() bool {
+	return b.failed > 0
+}
+
+// The writeBatchJSON() helper sends the results of a batch to the client. If every item
+// succeeded the response has the given success status code; if every item failed it has
+// a 422 Unprocessable Entity status code; and if the results are mixed it has a 207
+// Multi-Status status code, so the client knows that it needs to check the individual
+// results.
+func (app *application) writeBatchJSON(w http.ResponseWriter, r *http.Request, b *batch, successStatus int) {
+	status := successStatus
+	switch {
+	case len(b.results) > 0 && b.failed == len(b.results):
+		status = http.StatusUnprocessableEntity
+	case b.hasFailures():
+		status = http.StatusMultiStatus
+	}
+	env := envelope{
+		"results": b.results,
+		"summary": map[string]int{
+			"total":     len(b.results),
+			"succeeded": len(b.results) - b.failed,
+			"failed":    b.failed,
+		},
+	}
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
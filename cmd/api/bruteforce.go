@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The loginGuard type tracks failed login attempts by IP address and by email address,
+// to slow down password guessing. It's separate from the generic rate limiter, which
+// allows far more requests than anyone needs to log in, and it tracks email addresses
+// too so that an attack spread across many IPs is still caught.
+//
+// After a few free failures, each further failure locks the key out for twice as long
+// as the last (up to a maximum), and once there have been enough failures a CAPTCHA has
+// to be solved as well. Successful logins reset the count for the email address; the
+// count for an IP address only decays, so that a single IP can't hide its guesses by
+// logging in to its own account every so often.
+type loginGuard struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// The login guard settings. The first loginFreeFailures failures for a key aren't
+// delayed, and the delay starts at loginBaseDelay.
+const (
+	loginFreeFailures = 3
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 15 * time.Minute
+	loginForgetAfter  = time.Hour
+)
+
+func newLoginGuard() *loginGuard {
+	g := &loginGuard{attempts: make(map[string]*loginAttempts)}
+	// Forget about keys which haven't failed for a while, in the same way as the rate
+	// limiter does for its clients.
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			g.mu.Lock()
+			for key, a := range g.attempts {
+				if time.Since(a.lastFailure) > loginForgetAfter {
+					delete(g.attempts, key)
+				}
+			}
+			g.mu.Unlock()
+		}
+	}()
+	return g
+}
+
+// check returns how long the caller must wait before any of the keys can try again (or
+// zero if they can try now), and the highest number of failures for any of them.
+func (g *loginGuard) check(keys ...string) (time.Duration, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	var failures int
+	for _, key := range keys {
+		a, ok := g.attempts[key]
+		if !ok {
+			continue
+		}
+		if d := time.Until(a.lockedUntil); d > wait {
+			wait = d
+		}
+		if a.failures > failures {
+			failures = a.failures
+		}
+	}
+	return wait, failures
+}
+
+// fail records a failed attempt for each of the keys, and returns the highest number of
+// failures for any of them.
+func (g *loginGuard) fail(keys ...string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var failures int
+	now := time.Now()
+	for _, key := range keys {
+		a, ok := g.attempts[key]
+		if !ok {
+			a = &loginAttempts{}
+			g.attempts[key] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		if a.failures > loginFreeFailures {
+			delay := time.Duration(float64(loginBaseDelay) * math.Pow(2, float64(a.failures-loginFreeFailures-1)))
+			if delay > loginMaxDelay || delay <= 0 {
+				delay = loginMaxDelay
+			}
+			a.lockedUntil = now.Add(delay)
+		}
+		if a.failures > failures {
+			failures = a.failures
+		}
+	}
+	return failures
+}
+
+// succeed forgets the failed attempts for a key.
+func (g *loginGuard) succeed(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.attempts, key)
+}
+
+// loginKeys returns the loginGuard keys for a login attempt.
+func loginKeys(ip, email string) (string, string) {
+	return "ip:" + ip, "email:" + strings.ToLower(email)
+}
+
+// The captchaVerifier interface is the hook which checks the CAPTCHA token sent by a
+// client once it has failed to log in too many times.
+type captchaVerifier interface {
+	Verify(ctx context.Context, token, ip string) (bool, error)
+}
+
+// The siteVerifyCaptcha type is a captchaVerifier for the services which use the
+// "siteverify" API that was popularized by reCAPTCHA, which includes hCaptcha and
+// Cloudflare Turnstile.
+type siteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (c *siteVerifyCaptcha) Verify(ctx context.Context, token, ip string) (bool, error) {
+	form := url.Values{"secret": {c.secret}, "response": {token}, "remoteip": {ip}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/apierror"
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// bulkUpdateMaxMovies is the maximum number of movies in a bulk update.
+const bulkUpdateMaxMovies = 100
+
+// The movieChanges type is a partial update to a movie, as sent to PATCH /v1/movies/:id
+// and in each item of PATCH /v1/movies. The fields are pointers (and slices and maps,
+// which can be nil already), so that we can tell a field which wasn't sent from one
+// which was sent with its zero value.
+type movieChanges struct {
+	Title   *string       `json:"title"`
+	Year    *int32        `json:"year"`
+	Runtime *data.Runtime `json:"runtime"`
+	Genres  []string      `json:"genres"`
+	// Attributes is a partial update: the attributes in it are set, or removed if
+	// they're null, and the others are left as they are.
+	Attributes map[string]*string `json:"attributes"`
+}
+
+// The apply() method makes the changes to a movie, leaving the fields which weren't sent
+// as they are.
+func (c movieChanges) apply(movie *data.Movie) {
+	if c.Title != nil {
+		movie.Title = *c.Title
+	}
+	if c.Year != nil {
+		movie.Year = *c.Year
+	}
+	if c.Runtime != nil {
+		movie.Runtime = *c.Runtime
+	}
+	if c.Genres != nil {
+		movie.Genres = c.Genres
+	}
+	if c.Attributes != nil {
+		movie.Attributes = movie.Attributes.Patch(c.Attributes)
+	}
+}
+
+// The itemFailure type is the reason that one item of a batch failed.
+type itemFailure struct {
+	status  int
+	code    apierror.Code
+	message interface{}
+}
+
+// The bulkUpdateMoviesHandler() applies partial updates to several movies at once, for
+// curators fixing the same mistake across many records. Each item has the ID and version
+// of a movie and the changes to make to it, like PATCH /v1/movies/:id. The updates are
+// made in one transaction: if any item is invalid or conflicts with another update, none
+// of the movies are changed, and the batch response says which items failed and why.
+func (app *application) bulkUpdateMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Movies []struct {
+			ID      int64        `json:"id"`
+			Version int32        `json:"version"`
+			Changes movieChanges `json:"changes"`
+		} `json:"movies"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Movies) >= 1, "movies", "must contain at least 1 movie")
+	v.Check(len(input.Movies) <= bulkUpdateMaxMovies, "movies", "must not contain more than 100 movies")
+	ids := make([]int64, len(input.Movies))
+	seen := make(map[int64]bool)
+	for i, item := range input.Movies {
+		ids[i] = item.ID
+		v.Check(!seen[item.ID], "movies", "must not contain the same movie more than once")
+		seen[item.ID] = true
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	existing, err := app.modelsFor(r).Movies.GetMany(ids)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	byID := make(map[int64]*data.Movie, len(existing))
+	for _, movie := range existing {
+		byID[movie.ID] = movie
+	}
+	movies := make([]*data.Movie, len(input.Movies))
+	failures := make(map[int]itemFailure)
+	for i, item := range input.Movies {
+		v := validator.New()
+		v.Check(item.Version > 0, "version", "must be provided")
+		if !v.Valid() {
+			failures[i] = itemFailure{http.StatusUnprocessableEntity, apierror.CodeValidationFailed, v.Errors}
+			continue
+		}
+		movie, ok := byID[item.ID]
+		if !ok {
+			failures[i] = itemFailure{http.StatusNotFound, apierror.CodeNotFound, "the requested resource could not be found"}
+			continue
+		}
+		if movie.Version != item.Version {
+			failures[i] = itemFailure{http.StatusConflict, apierror.CodeEditConflict, "unable to update the record due to an edit conflict, please try again"}
+			continue
+		}
+		item.Changes.apply(movie)
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			failures[i] = itemFailure{http.StatusUnprocessableEntity, apierror.CodeValidationFailed, v.Errors}
+			continue
+		}
+		movies[i] = movie
+	}
+	if len(failures) == 0 {
+		err = app.modelsFor(r).Movies.UpdateMany(movies)
+		var batchErr *data.BatchError
+		switch {
+		case errors.As(err, &batchErr):
+			for i, err := range batchErr.Errors {
+				switch {
+				case errors.Is(err, data.ErrDuplicateMovie):
+					failures[i] = itemFailure{http.StatusUnprocessableEntity, apierror.CodeValidationFailed, map[string]string{"title": "a movie with this title and year already exists"}}
+				default:
+					failures[i] = itemFailure{http.StatusConflict, apierror.CodeEditConflict, "unable to update the record due to an edit conflict, please try again"}
+				}
+			}
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	b := newBatch("movie")
+	for i, movie := range movies {
+		switch failure, ok := failures[i]; {
+		case ok:
+			b.fail(i, failure.status, failure.code, failure.message)
+		case len(failures) > 0:
+			b.fail(i, http.StatusFailedDependency, apierror.CodeBatchAborted, "the movie was not updated, as other movies in the batch could not be")
+		default:
+			app.logMovieChange(r, "movie_updated", movie.ID)
+			b.succeed(i, http.StatusOK, app.serializeMovie(r, movie, false))
+		}
+	}
+	app.writeBatchJSON(w, r, b, http.StatusOK)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The listChangesHandler returns the feed of changes to movies (see data.MovieChange),
+// for systems which keep a copy of the catalog and want to sync it incrementally. The
+// since parameter is a cursor: the next_cursor from the previous response, or zero to
+// read the feed from the beginning. Consumers fetch the movies which were created or
+// updated themselves, as the feed only says which version they've reached.
+func (app *application) listChangesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	since := app.readInt(qs, "since", 0, v)
+	limit := app.readInt(qs, "limit", 100, v)
+	v.Check(since >= 0, "since", "must not be negative")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 1000, "limit", "must be a maximum of 1000")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	changes, err := app.modelsFor(r).Movies.Changes(int64(since), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// With no new changes the cursor stays where it is, so that the consumer can poll
+	// with it again.
+	next := int64(since)
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].ID
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"changes": changes, "next_cursor": next}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+
+	"greenlight.alexedwards.net/internal/apierror"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The fieldConflict type describes one field which differs between the update that a
+// client tried to make and the record as it is now. Base is the value in the version
+// that the client started from, if we still have it, so that a merge UI can tell which
+// side changed the field.
+type fieldConflict struct {
+	Base    interface{} `json:"base,omitempty"`
+	Yours   interface{} `json:"yours"`
+	Current interface{} `json:"current"`
+}
+
+// The movieEditConflictResponse() method sends a 409 Conflict response for an update to
+// a movie which lost the race with another update. As well as the usual error message,
+// the response holds the movie as it is now and a diff of the fields which differ from
+// the attempted update, so that the client can merge the changes (or show them to the
+// user) rather than blindly retrying.
+func (app *application) movieEditConflictResponse(w http.ResponseWriter, r *http.Request, attempted *data.Movie) {
+	current, err := app.modelsFor(r).Movies.Get(attempted.ID)
+	if err != nil {
+		switch {
+		// If the movie has gone altogether, there's nothing to merge with.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The update which won the race saved the version that the client started from as
+	// a revision, so we can include the base values in the diff too.
+	base, err := app.modelsFor(r).Movies.GetRevision(attempted.ID, attempted.Version)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{
+		"error":   "unable to update the record due to an edit conflict, please try again",
+		"code":    apierror.CodeEditConflict,
+		"current": current,
+		"diff":    movieDiff(base, attempted, current),
+	}
+	err = app.writeJSON(w, http.StatusConflict, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieDiff returns the fields which differ between two versions of a movie, keyed by
+// their names in the JSON representation. base can be nil.
+func movieDiff(base *data.MovieRevision, yours, current *data.Movie) map[string]fieldConflict {
+	diff := make(map[string]fieldConflict)
+	hasBase := base != nil
+	add := func(name string, baseValue, yoursValue, currentValue interface{}) {
+		if reflect.DeepEqual(yoursValue, currentValue) {
+			return
+		}
+		conflict := fieldConflict{Yours: yoursValue, Current: currentValue}
+		if hasBase {
+			conflict.Base = baseValue
+		}
+		diff[name] = conflict
+	}
+	if base == nil {
+		base = &data.MovieRevision{}
+	}
+	add("title", base.Title, yours.Title, current.Title)
+	add("year", base.Year, yours.Year, current.Year)
+	add("runtime", base.Runtime, yours.Runtime, current.Runtime)
+	add("genres", base.Genres, yours.Genres, current.Genres)
+	add("attributes", base.Attributes, yours.Attributes, current.Attributes)
+	return diff
+}
@@ -20,6 +20,21 @@ func (app *application) contextSetUser(r *http.Request, user *data.User) *http.R
     ctx := context.WithValue(r.Context(), userContextKey, user)
     return r.WithContext(ctx)
 }
+// tokenContextKey holds the token which authenticated the request, so that handlers and
+// middleware can see what it has been restricted to.
+const tokenContextKey = contextKey("token")
+// The contextSetToken() method returns a new copy of the request with the token that
+// authenticated it added to the context.
+func (app *application) contextSetToken(r *http.Request, token *data.Token) *http.Request {
+    ctx := context.WithValue(r.Context(), tokenContextKey, token)
+    return r.WithContext(ctx)
+}
+// The contextGetToken() method returns the token which authenticated the request, or
+// nil for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) *data.Token {
+    token, _ := r.Context().Value(tokenContextKey).(*data.Token)
+    return token
+}
 // The contextGetUser() retrieves the User struct from the request context. The only
 // time that we'll use this helper is when we logically expect there to be User struct
 // value in the context, and if it doesn't exist it will firmly be an 'unexpected' error.
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The names of the cookies used for cookie-based sessions. The session cookie holds the
+// authentication token and can't be read by JavaScript; the CSRF cookie holds the CSRF
+// token, which the client must send back in the X-CSRF-Token header of every unsafe
+// request.
+const (
+	sessionCookieName = "greenlight_session"
+	csrfCookieName    = "greenlight_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// cookieAuthContextKey marks the requests which were authenticated with the session
+// cookie, rather than with an Authorization header.
+const cookieAuthContextKey = contextKey("cookieAuth")
+
+// csrfToken returns the CSRF token for a session. It's derived from the session's
+// authentication token, so there's nothing extra to store, and the CSRF token can't
+// be used to recover the authentication token.
+func csrfToken(sessionToken string) string {
+	sum := sha256.Sum256([]byte("csrf:" + sessionToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// setSessionCookies sets the session and CSRF cookies for an authentication token, and
+// returns the CSRF token. The session cookie is SameSite=Strict, so browsers won't send
+// it with cross-site requests at all; the CSRF token protects against the cases where
+// that isn't enough (like older browsers and attacks from sibling subdomains).
+func (app *application) setSessionCookies(w http.ResponseWriter, token *data.Token) string {
+	csrf := csrfToken(token.Plaintext)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token.Plaintext,
+		Path:     "/",
+		Domain:   app.config.cookies.domain,
+		Expires:  token.Expiry,
+		Secure:   app.config.cookies.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		Domain:   app.config.cookies.domain,
+		Expires:  token.Expiry,
+		Secure:   app.config.cookies.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrf
+}
+
+// sessionToken returns the authentication token from the session cookie, if cookie
+// sessions are enabled and the request has one.
+func (app *application) sessionToken(r *http.Request) (string, bool) {
+	if !app.config.cookies.enabled {
+		return "", false
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// contextSetCookieAuth marks a request as authenticated with the session cookie.
+func (app *application) contextSetCookieAuth(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), cookieAuthContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// The csrfProtect() middleware rejects unsafe requests (anything other than GET, HEAD,
+// OPTIONS and TRACE) which were authenticated with the session cookie, unless their
+// X-CSRF-Token header matches the CSRF token for the session. Requests authenticated
+// with an Authorization header aren't affected, as a browser won't add that header to
+// a forged request. Routes under the prefixes in the -csrf-exempt flag are skipped,
+// for route groups (like webhooks) which are never called from a browser.
+func (app *application) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookieAuth, _ := r.Context().Value(cookieAuthContextKey).(bool); !cookieAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range app.config.cookies.csrfExempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		token, _ := app.sessionToken(r)
+		expected := csrfToken(token)
+		got := r.Header.Get(csrfHeaderName)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+			app.logSecurityEvent(r, "csrf_rejected", nil)
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// deprecatedRequests counts the requests to deprecated routes, keyed by method and route
+// (like "GET /v1/movies/:id/similar"), so that we can see when it's safe to remove one.
+var deprecatedRequests = expvar.NewMap("deprecated_requests")
+
+// The deprecation type marks a route as deprecated. Requests to it are served as usual,
+// with headers which tell the client when the route was deprecated (RFC 9745), when it
+// will be removed (RFC 8594) and what to use instead.
+type deprecation struct {
+	// since is when the route was deprecated.
+	since time.Time
+	// sunset is when the route will be removed, or zero if that hasn't been decided.
+	sunset time.Time
+	// successor is the path of the route which replaces it, if there is one, and docs
+	// is the URL of the documentation for the deprecation.
+	successor string
+	docs      string
+}
+
+// deprecatedRoutes are the deprecated routes, keyed by method and path as they're
+// registered in routes(), like
+//
+//	"GET /v1/movies/:id/similar": {since: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), successor: "/v1/movies/:id?include=similar"},
+//
+// A versioned route (see versionedPaths()) is deprecated under every API version.
+var deprecatedRoutes = map[string]deprecation{}
+
+// The headers() method returns the Deprecation, Sunset and Link headers for a
+// deprecated route.
+func (d deprecation) headers() http.Header {
+	headers := make(http.Header)
+	headers.Set("Deprecation", "@"+strconv.FormatInt(d.since.Unix(), 10))
+	if !d.sunset.IsZero() {
+		headers.Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+	}
+	var links []string
+	if d.successor != "" {
+		links = append(links, "<"+d.successor+`>; rel="successor-version"`)
+	}
+	if d.docs != "" {
+		links = append(links, "<"+d.docs+`>; rel="deprecation"`)
+	}
+	if len(links) > 0 {
+		headers.Set("Link", strings.Join(links, ", "))
+	}
+	return headers
+}
+
+// The deprecated() middleware adds the deprecation headers to the responses for a
+// deprecated route, and records who called it: in the deprecated_requests metric, and
+// in the log entries of the "deprecation" component, which include the user.
+func (app *application) deprecated(method, path string, d deprecation, next http.HandlerFunc) http.HandlerFunc {
+	key := method + " " + path
+	headers := d.headers()
+	logger := app.logger.Component("deprecation")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range headers {
+			w.Header()[name] = values
+		}
+		deprecatedRequests.Add(key, 1)
+		user, _ := r.Context().Value(userContextKey).(*data.User)
+		properties := map[string]string{"route": key}
+		if user != nil && !user.IsAnonymous() {
+			properties["user_id"] = strconv.FormatInt(user.ID, 10)
+		}
+		if info := contextRequestInfo(r); info != nil {
+			properties["request_id"] = info.id
+		}
+		logger.PrintInfo("deprecated route called", properties)
+		next(w, r)
+	}
+}
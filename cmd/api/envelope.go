@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// envelopeHeader is the request header which overrides the -envelope setting for a
+// request, like the envelope query string parameter.
+const envelopeHeader = "X-Envelope"
+
+// The bareResponseWriter type marks a response which should be written without its
+// envelope (see writeJSON()). It doesn't change how the response is written itself.
+type bareResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap lets http.ResponseController get at the underlying ResponseWriter.
+func (w *bareResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isBare reports whether a response should be written without its envelope, looking
+// through any other ResponseWriters that it has been wrapped in.
+func isBare(w http.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case *bareResponseWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// The negotiateEnvelope() middleware works out whether a request wants its response in
+// an envelope, like {"movie": {...}}, or bare. The default is the -envelope setting,
+// and a request can override it with the envelope query string parameter or the
+// X-Envelope header (the query string wins if there are both).
+func (app *application) negotiateEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enveloped := app.config.envelope
+		for _, value := range []string{r.Header.Get(envelopeHeader), r.URL.Query().Get("envelope")} {
+			if value == "" {
+				continue
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				app.failedValidationResponse(w, r, map[string]string{"envelope": "must be a boolean value"})
+				return
+			}
+			enveloped = b
+		}
+		if !enveloped {
+			w = &bareResponseWriter{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The single() method returns the value in an envelope which holds exactly one value.
+func (env envelope) single() (interface{}, bool) {
+	if len(env) != 1 {
+		return nil, false
+	}
+	for _, value := range env {
+		return value, true
+	}
+	return nil, false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The deleteCurrentUserHandler deletes the authenticated user's own account. The user
+// has to confirm their password, so that a stolen token (or an unattended browser) isn't
+// enough to delete an account. All of the user's tokens are revoked straight away and
+// the account stops working, but the personal data is only purged once the grace period
+// (-user-deletion-grace) has passed, by the job started by startUserPurge(). The request
+// and the purge are both recorded as security events, which are our audit log.
+//
+// There are no reviews or comments (or anything else written by users) to anonymize
+// yet; when there are, the purge is the place to do it.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Password confirmations count towards the same login guard as logins, otherwise a
+	// stolen token could be used to guess the password without limit.
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ipKey, emailKey := loginKeys(ip, user.Email)
+	if app.logins != nil {
+		wait, failures := app.logins.check(ipKey, emailKey)
+		if wait > 0 {
+			app.logSecurityEvent(r, "login_throttled", map[string]string{"email": user.Email, "ip": ip, "failures": strconv.Itoa(failures)})
+			app.loginThrottledResponse(w, r, wait)
+			return
+		}
+	}
+	// The authenticated user may have come from the auth cache, which doesn't hold
+	// password hashes, so look the user up again to check the password.
+	stored, err := app.modelsFor(r).Users.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	match, err := stored.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		properties := map[string]string{"email": user.Email, "ip": ip, "reason": "wrong_password"}
+		if app.logins != nil {
+			properties["failures"] = strconv.Itoa(app.logins.fail(ipKey, emailKey))
+		}
+		app.logSecurityEvent(r, "account_deletion_failed", properties)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.models.Users.RequestDeletion(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	purgeAfter := time.Now().Add(app.config.deletion.grace)
+	app.logSecurityEvent(r, "account_deletion_requested", map[string]string{
+		"email":       user.Email,
+		"user_id":     strconv.FormatInt(user.ID, 10),
+		"purge_after": purgeAfter.UTC().Format(time.RFC3339),
+	})
+	env := envelope{
+		"message":     "your account has been deleted, and your personal data will be erased after the grace period",
+		"purge_after": purgeAfter.UTC().Format(time.RFC3339),
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// startUserPurge starts the job which purges the accounts whose deletion grace period
+// has passed. It only runs on the leader, although PurgeDeleted() deletes each account
+// in a transaction anyway, so an account is only ever purged (and recorded as purged)
+// once even if two instances both think they're the leader for a moment.
+func (app *application) startUserPurge() {
+	logger := app.logger.Component("security")
+	go func() {
+		for {
+			app.runSingleton("purge_users", func() {
+				ids, err := app.models.Users.PurgeDeleted(time.Now().Add(-app.config.deletion.grace))
+				if err != nil {
+					app.logger.PrintError(fmt.Errorf("purging deleted users: %w", err), nil)
+				}
+				for _, id := range ids {
+					properties := map[string]string{"event": "account_purged", "user_id": strconv.FormatInt(id, 10)}
+					logger.PrintInfo("security event", properties)
+					err := app.models.SecurityEvents.Insert(&data.SecurityEvent{
+						CreatedAt:  time.Now(),
+						Event:      "account_purged",
+						Properties: map[string]string{"user_id": properties["user_id"]},
+					})
+					if err != nil {
+						app.logger.PrintError(fmt.Errorf("recording security event: %w", err), nil)
+					}
+				}
+				// Expired data exports are personal data we no longer need either.
+				_, err = app.models.UserExports.DeleteExpired()
+				if err != nil {
+					app.logger.PrintError(fmt.Errorf("deleting expired data exports: %w", err), nil)
+				}
+			})
+			time.Sleep(app.config.deletion.purgeInterval)
+		}
+	}()
+}
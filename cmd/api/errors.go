@@ -1,24 +1,30 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/apierror"
+	"greenlight.alexedwards.net/internal/database"
 )
 
 func (app *application) logError(r *http.Request, err error) {
-    // Use the PrintError() method to log the error message, and include the current
-    // request method and URL as properties in the log entry.
-    app.logger.PrintError(err, map[string]string{
-        "request_method": r.Method,
-        "request_url":    r.URL.String(),
-    })
+    // Use the PrintError() method of the request's logger to log the error message,
+    // which includes the request ID, method, URL, route and user in the log entry.
+    app.loggerFrom(r).PrintError(err, nil)
 }
 // The errorResponse() method is a generic helper for sending JSON-formatted error
 // messages to the client with a given status code. Note that we're using an interface{}
 // type for the message parameter, rather than just a string type, as this gives us
-// more flexibility over the values that we can include in the response.
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-    env := envelope{"error": message}
+// more flexibility over the values that we can include in the response. The code
+// parameter is a stable, machine-readable identifier for the error (see the apierror
+// package) which is included alongside the message.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code apierror.Code, message interface{}) {
+    env := envelope{"error": message, "code": code}
     // Write the response using the writeJSON() helper. If this happens to return an
     // error then log it, and fall back to sending the client an empty response with a
     // 500 Internal Server Error status code.
@@ -32,51 +38,127 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 // unexpected problem at runtime. It logs the detailed error message, then uses the
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
 // response (containing a generic error message) to the client.
+//
+// If the database circuit breaker is open, it sends a 503 Service Unavailable response
+// instead. That isn't logged, as the breaker opening already was.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, database.ErrCircuitOpen) {
+        app.databaseUnavailableResponse(w, r)
+        return
+    }
     app.logError(r, err)
     message := "the server encountered a problem and could not process your request"
-    app.errorResponse(w, r, http.StatusInternalServerError, message)
+    app.errorResponse(w, r, http.StatusInternalServerError, apierror.CodeServerError, message)
 }
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
     message := "the requested resource could not be found"
-    app.errorResponse(w, r, http.StatusNotFound, message)
+    app.errorResponse(w, r, http.StatusNotFound, apierror.CodeNotFound, message)
 }
 // The methodNotAllowedResponse() method will be used to send a 405 Method Not Allowed
 // status code and JSON response to the client.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
     message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-    app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+    app.errorResponse(w, r, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, message)
 }
 
+// The badRequestResponse() method sends a 400 Bad Request response for a request
+// which couldn't be parsed. The only exception is when the request body exceeded one of
+// the structural limits enforced by readJSON(), in which case we send a 422
+// Unprocessable Entity response so the client knows that the body was well-formed but
+// too complex to be accepted.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var limitError *jsonLimitError
+	if errors.As(err, &limitError) {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, apierror.CodeBodyLimitExceeded, err.Error())
+		return
+	}
+	app.errorResponse(w, r, http.StatusBadRequest, apierror.CodeBadRequest, err.Error())
 }
 
 // Note that the errors parameter here has the type map[string]string, which is exactly 
 // the same as the errors map contained in our Validator type.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, apierror.CodeValidationFailed, errors)
+}
+
+// The schemaValidationResponse() method is used by the validateRequest() middleware
+// when a request doesn't conform to the OpenAPI specification.
+func (app *application) schemaValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, apierror.CodeSchemaValidationFailed, errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
     message := "unable to update the record due to an edit conflict, please try again"
-    app.errorResponse(w, r, http.StatusConflict, message)
+    app.errorResponse(w, r, http.StatusConflict, apierror.CodeEditConflict, message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
     message := "rate limit exceeded"
-    app.errorResponse(w, r, http.StatusTooManyRequests, message)
+    app.errorResponse(w, r, http.StatusTooManyRequests, apierror.CodeRateLimited, message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
     message := "invalid authentication credentials"
-    app.errorResponse(w, r, http.StatusUnauthorized, message)
+    app.errorResponse(w, r, http.StatusUnauthorized, apierror.CodeInvalidCredentials, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("WWW-Authenticate", "Bearer")
     message := "invalid or missing authentication token"
-    app.errorResponse(w, r, http.StatusUnauthorized, message)
-}
\ No newline at end of file
+    app.errorResponse(w, r, http.StatusUnauthorized, apierror.CodeInvalidAuthenticationToken, message)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+    message := "you must be authenticated to access this resource"
+    app.errorResponse(w, r, http.StatusUnauthorized, apierror.CodeAuthenticationRequired, message)
+}
+
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+    message := "your user account must be activated to access this resource"
+    app.errorResponse(w, r, http.StatusForbidden, apierror.CodeInactiveAccount, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+    message := "your user account or token doesn't have the necessary permissions to access this resource"
+    app.errorResponse(w, r, http.StatusForbidden, apierror.CodeNotPermitted, message)
+}
+
+func (app *application) ownAdminRoleResponse(w http.ResponseWriter, r *http.Request) {
+    message := "you can't remove the admin role from your own user account"
+    app.errorResponse(w, r, http.StatusConflict, apierror.CodeOwnAdminRole, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+    message := "the requested API version is not supported"
+    app.errorResponse(w, r, http.StatusNotAcceptable, apierror.CodeNotAcceptable, message)
+}
+
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+    message := "invalid or missing CSRF token"
+    app.errorResponse(w, r, http.StatusForbidden, apierror.CodeInvalidCSRFToken, message)
+}
+
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+    message := "too many failed login attempts, please try again later"
+    app.errorResponse(w, r, http.StatusTooManyRequests, apierror.CodeLoginThrottled, message)
+}
+
+func (app *application) captchaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+    message := "a valid captcha_token is required after too many failed login attempts"
+    app.errorResponse(w, r, http.StatusUnauthorized, apierror.CodeCaptchaRequired, message)
+}
+
+func (app *application) databaseUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(app.config.db.breaker.cooldown.Seconds()))))
+    message := "the database is unavailable, please try again later"
+    app.errorResponse(w, r, http.StatusServiceUnavailable, apierror.CodeDatabaseUnavailable, message)
+}
+
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Retry-After", "5")
+    message := "the server is overloaded, please try again later"
+    app.errorResponse(w, r, http.StatusServiceUnavailable, apierror.CodeOverloaded, message)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/events"
+)
+
+// eventBatchSize is the most changes that the event relay reads from a feed and
+// publishes at once.
+const eventBatchSize = 500
+
+// The eventFeed type is one of the changes feeds that the event relay publishes: read()
+// returns the events for up to limit of the feed's changes after the position since, and
+// the position of the last of them.
+type eventFeed struct {
+	name string
+	read func(since int64, limit int) ([]events.Event, int64, error)
+}
+
+// startEventRelay starts the job which publishes the movie and user lifecycle events to
+// the -events-publisher broker. The changes feeds (movie_changes and user_changes) are
+// the outbox: they're written by triggers in the same transactions as the changes, so
+// an event is published if and only if its change was committed, and the event cursors
+// record how far through each feed has been published. A batch is published before its
+// cursor is moved on, so after a failure (or a change of leader) the batch is published
+// again; consumers see every event at least once. Like the purges, it only runs on the
+// leader, which keeps the events in order.
+func (app *application) startEventRelay() {
+	if app.publisher == nil {
+		return
+	}
+	feeds := []eventFeed{
+		{name: "movies", read: app.movieEvents},
+		{name: "users", read: app.userEvents},
+	}
+	go func() {
+		for {
+			app.runSingleton("publish_events", func() {
+				for _, feed := range feeds {
+					err := app.relayEvents(feed)
+					if err != nil {
+						app.logger.PrintError(fmt.Errorf("publishing %s events: %w", feed.name, err), nil)
+					}
+				}
+			})
+			time.Sleep(app.config.events.interval)
+		}
+	}()
+}
+
+// relayEvents publishes the events from a feed which haven't been published yet, a
+// batch at a time.
+func (app *application) relayEvents(feed eventFeed) error {
+	position, err := app.models.EventCursors.Get(feed.name)
+	if err != nil {
+		return err
+	}
+	for {
+		batch, last, err := feed.read(position, eventBatchSize)
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.events.timeout)
+		err = app.publisher.Publish(ctx, batch)
+		cancel()
+		if err != nil {
+			return err
+		}
+		err = app.models.EventCursors.Set(feed.name, last)
+		if err != nil {
+			return err
+		}
+		app.logger.PrintDebug("published events", map[string]string{"feed": feed.name, "count": strconv.Itoa(len(batch)), "position": strconv.FormatInt(last, 10)})
+		if len(batch) < eventBatchSize {
+			return nil
+		}
+		position = last
+	}
+}
+
+// movieEvents returns the events for the changes to movies, like movie.created. Like the
+// changes feed, the events only say which version a movie has reached, and consumers
+// fetch the movie if they need it.
+func (app *application) movieEvents(since int64, limit int) ([]events.Event, int64, error) {
+	changes, err := app.models.Movies.Changes(since, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	batch := make([]events.Event, 0, len(changes))
+	for _, change := range changes {
+		event, err := events.New("movies", "movie", change.Operation, change.ID, change.MovieID, change.ChangedAt, map[string]any{
+			"movie_id":  change.MovieID,
+			"tenant_id": change.TenantID,
+			"version":   change.Version,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		batch = append(batch, event)
+		since = change.ID
+	}
+	return batch, since, nil
+}
+
+// userEvents returns the events for the changes to users, like user.activated. They
+// don't carry any of the user's personal data, so that it doesn't end up in the broker
+// (where it would outlive the user's erasure).
+func (app *application) userEvents(since int64, limit int) ([]events.Event, int64, error) {
+	changes, err := app.models.Users.Changes(since, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	batch := make([]events.Event, 0, len(changes))
+	for _, change := range changes {
+		event, err := events.New("users", "user", change.Operation, change.ID, change.UserID, change.ChangedAt, map[string]any{
+			"user_id":   change.UserID,
+			"tenant_id": change.TenantID,
+			"version":   change.Version,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		batch = append(batch, event)
+		since = change.ID
+	}
+	return batch, since, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// csvFormulaPrefixes are the characters which make a spreadsheet treat a cell as a
+// formula when it starts with one of them.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvCell escapes a cell of a CSV export whose value comes from users, so that a
+// spreadsheet opening the export shows it as text rather than running it as a formula
+// (like =HYPERLINK(...)). A cell which starts with a formula character gets a ' in
+// front, which spreadsheets don't show. The import endpoint takes it off again (see
+// csvImportCell()).
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune(csvFormulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// The exportMoviesHandler() streams every movie matching the title, genre, range and
+// sort query string parameters (which work in the same way as for the listing endpoint) to
+// the client, without any pagination. The format parameter controls the output format:
+//
+//   - json: the same shape as the listing endpoint, but without the metadata.
+//   - ndjson: one JSON object per line.
+//   - csv: the same format that the import endpoint accepts, so an export can be
+//     imported into another instance. Cells which a spreadsheet would take for a
+//     formula are escaped (see csvCell()).
+//
+// The movies are written as the rows are read from the database, so memory use stays
+// flat however many movies there are.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string
+		Genres []string
+		Format string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readGenres(qs, &input.Filters)
+	input.Format = app.readString(qs, "format", "json")
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	app.readRanges(qs, &input.Filters, v)
+	app.readAdded(qs, app.requestLocation(r), &input.Filters, v)
+	app.readAttributes(qs, &input.Filters, v)
+	data.ValidateSort(v, input.Filters)
+	data.ValidateRanges(v, input.Filters)
+	v.Check(validator.In(input.Format, "json", "ndjson", "csv"), "format", "must be json, ndjson or csv")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// An export is one very large page.
+	input.Filters.Page = 1
+	input.Filters.PageSize = math.MaxInt32
+
+	var (
+		write   func(movie *data.Movie) error
+		finish  func() error
+		started = func() bool { return false }
+	)
+	switch input.Format {
+	case "json":
+		stream := newJSONStream(w, http.StatusOK, "movies")
+		write = func(movie *data.Movie) error { return stream.write(movie) }
+		finish = func() error { return stream.close(nil) }
+		started = stream.started
+	case "ndjson":
+		e := &exportWriter{w: w, contentType: "application/x-ndjson", filename: "movies.ndjson"}
+		enc := json.NewEncoder(e)
+		write = func(movie *data.Movie) error { return enc.Encode(movie) }
+		finish = e.begin
+		started = e.started
+	case "csv":
+		e := &exportWriter{w: w, contentType: "text/csv", filename: "movies.csv"}
+		cw := csv.NewWriter(e)
+		header := true
+		write = func(movie *data.Movie) error {
+			if header {
+				header = false
+				cw.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+			}
+			cw.Write([]string{
+				strconv.FormatInt(movie.ID, 10),
+				csvCell(movie.Title),
+				strconv.FormatInt(int64(movie.Year), 10),
+				strconv.FormatInt(int64(movie.Runtime), 10),
+				csvCell(strings.Join(movie.Genres, "|")),
+				strconv.FormatInt(int64(movie.Version), 10),
+			})
+			// The csv.Writer buffers internally, so flush every row through to the
+			// exportWriter (the http.Server has its own buffer behind that).
+			cw.Flush()
+			return cw.Error()
+		}
+		finish = func() error {
+			if header {
+				cw.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return e.begin()
+		}
+		started = e.started
+	}
+
+	_, err := app.modelsFor(r).Movies.GetAllFunc(input.Title, input.Genres, input.Filters, write)
+	if err != nil {
+		app.streamErrorResponse(w, r, started(), err)
+		return
+	}
+	err = finish()
+	if err != nil {
+		app.streamErrorResponse(w, r, started(), err)
+	}
+}
+
+// The exportWriter type is an io.Writer which sends the status code and headers for a
+// file download just before the first write, so that a handler can still send a normal
+// error response if something goes wrong before any data is ready.
+type exportWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	begun       bool
+}
+
+func (e *exportWriter) begin() error {
+	if !e.begun {
+		e.begun = true
+		e.w.Header().Set("Content-Type", e.contentType)
+		e.w.Header().Set("Content-Disposition", `attachment; filename="`+e.filename+`"`)
+		e.w.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
+
+func (e *exportWriter) started() bool {
+	return e.begun
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	e.begin()
+	return e.w.Write(p)
+}
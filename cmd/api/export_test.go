@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "Moana", want: "Moana"},
+		{value: "", want: ""},
+		{value: `=HYPERLINK("http://example.com", "Moana")`, want: `'=HYPERLINK("http://example.com", "Moana")`},
+		{value: "+1", want: "'+1"},
+		{value: "-1", want: "'-1"},
+		{value: "@SUM(A1)", want: "'@SUM(A1)"},
+		{value: "\tMoana", want: "'\tMoana"},
+		{value: "\rMoana", want: "'\rMoana"},
+		{value: "'quoted'", want: "'quoted'"},
+		{value: "2+2=4", want: "2+2=4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, csvCell(tt.value), tt.want)
+			assert.Equal(t, csvImportCell(csvCell(tt.value)), tt.value)
+		})
+	}
+}
+
+// TestCSVExportRoundTrip checks that a title which looks like a formula is imported back
+// as it was exported.
+func TestCSVExportRoundTrip(t *testing.T) {
+	columns := map[string]int{"title": 0, "year": 1, "runtime": 2, "genres": 3}
+	movie, v := parseImportRecord([]string{csvCell("=1+1"), "2016", "107", csvCell("-animation|adventure")}, columns)
+	assert.Equal(t, v.Valid(), true)
+	assert.Equal(t, movie.Title, "=1+1")
+	assert.Equal(t, movie.Genres, []string{"-animation", "adventure"})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// movieFields are the fields of a movie which can be asked for with ?fields=, for each
+// API version, in the order that they're written in. The attribution fields are only
+// there for admins (see movieResponse()), so asking for them is harmless for everyone
+// else.
+var movieFields = map[int][]string{
+	apiV1: {"id", "title", "year", "runtime", "genres", "attributes", "version", "created_by", "updated_by", "_links"},
+	apiV2: {"id", "title", "year", "runtime_minutes", "genres", "attributes", "version", "created_by", "updated_by", "_links"},
+}
+
+// The fieldSet type is a sparse fieldset: the fields of a resource that the client
+// asked for with the fields query string parameter. A nil fieldSet means every field.
+type fieldSet []string
+
+// The readFields() helper reads a comma-separated list of fields from the fields query
+// string parameter, checking each of them against the safelist. The fields are returned
+// in safelist order, without duplicates, so that responses don't depend on the order
+// that the client listed them in.
+func (app *application) readFields(qs url.Values, safelist []string, v *validator.Validator) fieldSet {
+	if !qs.Has("fields") {
+		return nil
+	}
+	if strings.TrimSpace(qs.Get("fields")) == "" {
+		v.AddError("fields", "must contain at least 1 field")
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, field := range strings.Split(qs.Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if !validator.In(field, safelist...) {
+			v.AddError("fields", "contains an unknown field "+strconv.Quote(field))
+			continue
+		}
+		wanted[field] = true
+	}
+	fields := fieldSet{}
+	for _, field := range safelist {
+		if wanted[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// The apply() method returns the value to put in an envelope (or write to a jsonStream)
+// for a resource, so that only the fields in the set are written.
+func (f fieldSet) apply(value interface{}) interface{} {
+	if f == nil {
+		return value
+	}
+	return sparseValue{value: value, fields: f}
+}
+
+// The sparseValue type is a resource with the fields of a fieldSet picked out of its
+// JSON object. Fields which the resource leaves out (because they're empty, say) are
+// still left out.
+type sparseValue struct {
+	value  interface{}
+	fields fieldSet
+}
+
+func (s sparseValue) MarshalJSON() ([]byte, error) {
+	js, err := json.Marshal(s.value)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	err = json.Unmarshal(js, &object)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range s.fields {
+		value, ok := object[field]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(field) + ":")
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/storage"
+)
+
+// maxUploadBytes is the largest file that can be uploaded through the API.
+const maxUploadBytes = 5 << 20
+
+// The openStorage() function returns the storage backend for uploaded files. The links
+// to the files in local storage are signed with the same key as the data export links.
+func openStorage(cfg config) (storage.Store, error) {
+	switch cfg.storage.backend {
+	case "local":
+		return storage.NewLocal(cfg.storage.dir, cfg.baseURL, []byte(cfg.exports.signingKey))
+	case "s3":
+		return storage.NewS3(cfg.storage.s3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.storage.backend)
+	}
+}
+
+// readUpload reads the body of an upload, which mustn't be empty or larger than
+// maxUploadBytes.
+func (app *application) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesError):
+		return nil, &jsonLimitError{fmt.Sprintf("body must not be larger than %d bytes", maxUploadBytes)}
+	case err != nil:
+		return nil, err
+	case len(body) == 0:
+		return nil, errors.New("body must not be empty")
+	}
+	return body, nil
+}
+
+// localFileKey returns the key of the file that a request to the local storage routes
+// is for.
+func localFileKey(r *http.Request) string {
+	return strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("key"), "/")
+}
+
+// The serveFileHandler sends a file in local storage, for a URL returned by
+// PresignGet(). It's only routed when the local storage backend is used; with S3, the
+// presigned URLs go straight to the bucket. As with the data export links, the
+// signature is what proves that the client is allowed the file, and a link with a bad
+// signature gets the same 404 Not Found response as a missing file.
+func (app *application) serveFileHandler(w http.ResponseWriter, r *http.Request) {
+	local := app.storage.(*storage.Local)
+	key := localFileKey(r)
+	if !local.Verify(r.Method, key, "", r.URL.Query()) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	f, err := local.Open(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Files are served from the API's origin, so they mustn't ever be rendered as a page
+	// which could run scripts with the session cookie: the Content-Type is always one of
+	// the image types (or a download), browsers aren't allowed to sniff another one, and
+	// the sandbox policy stops anything which does render from running scripts.
+	contentType, err := fileContentType(f)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, no-transform")
+	if contentType == "application/octet-stream" {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// fileContentType returns the type of a file in local storage, sniffed from its first
+// 512 bytes: one of the posterContentTypes, or application/octet-stream for anything
+// else. It leaves the file at its start, ready to be served.
+func fileContentType(f io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+	for _, allowed := range posterContentTypes {
+		if contentType == allowed {
+			return contentType, nil
+		}
+	}
+	return "application/octet-stream", nil
+}
+
+// The uploadFileHandler stores a file in local storage, for a URL returned by
+// PresignPut(). The upload has to have the Content-Type header that the URL was signed
+// for, and its body has to be in that format.
+func (app *application) uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	local := app.storage.(*storage.Local)
+	key := localFileKey(r)
+	if !local.Verify(r.Method, key, r.Header.Get("Content-Type"), r.URL.Query()) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	body, err := app.readUpload(w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if http.DetectContentType(body) != r.Header.Get("Content-Type") {
+		app.failedValidationResponse(w, r, map[string]string{"body": "must be in the format named by the Content-Type header"})
+		return
+	}
+	err = local.Put(r.Context(), key, bytes.NewReader(body), int64(len(body)), r.Header.Get("Content-Type"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "file successfully uploaded"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
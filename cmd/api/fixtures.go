@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/fixtures"
+)
+
+// The fixturesCommand() function implements the "fixtures" subcommand, which loads
+// fixture files into the database. It takes the same -token-pepper and -password-*
+// flags as the API server, which should be given the same values. It's used like this:
+//
+//	$ api fixtures load -db-dsn=$GREENLIGHT_DB_DSN ./testdata/users.json ./testdata/movies.json
+func fixturesCommand(args []string) error {
+	if len(args) == 0 || args[0] != "load" {
+		return errors.New("usage: fixtures load [-db-dsn=<dsn>] <file>...")
+	}
+	var cfg config
+	fs := flag.NewFlagSet("fixtures load", flag.ExitOnError)
+	fs.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
+	credentialFlags(fs, &cfg)
+	fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		return errors.New("no fixture files given")
+	}
+	err := setCredentialHashing(cfg)
+	if err != nil {
+		return err
+	}
+	// We only need a single connection to load the fixtures.
+	cfg.db.maxOpenConns = 1
+	cfg.db.maxIdleConns = 1
+	cfg.db.maxIdleTime = "1m"
+
+	set, err := fixtures.ReadFiles(fs.Args()...)
+	if err != nil {
+		return err
+	}
+	db, err := openDB(cfg, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return set.Load(data.NewModels(db))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// Run the tests with -update to write the golden files from the current responses,
+// after checking that the changes to them are intended:
+//
+//	go test ./cmd/api -run Golden -update
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// timestampRX matches the RFC 3339 timestamps in responses, which change from run to run.
+var timestampRX = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// assertGolden compares a response with the golden file testdata/<name>.golden, or
+// writes the file instead if the tests are run with -update. Timestamps are replaced
+// with <timestamp> first.
+func assertGolden(t *testing.T, name string, code int, body string) {
+	t.Helper()
+	got := fmt.Sprintf("HTTP %d\n%s\n", code, timestampRX.ReplaceAllString(strings.TrimSpace(body), "<timestamp>"))
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		assert.NilError(t, err)
+		err = os.WriteFile(path, []byte(got), 0o644)
+		assert.NilError(t, err)
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the tests with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("response doesn't match %s (run the tests with -update if the change is intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestMovieResponsesGolden(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "movies:read")
+	for _, movie := range []*data.Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"sci-fi", "action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+	} {
+		err := app.models.Movies.Insert(movie)
+		assert.NilError(t, err)
+	}
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name    string
+		urlPath string
+	}{
+		{name: "movie_show", urlPath: "/v1/movies/1"},
+		{name: "movie_list", urlPath: "/v1/movies"},
+		{name: "movie_list_sorted_paginated", urlPath: "/v1/movies?sort=-year,title&page=1&page_size=2"},
+		{name: "movie_list_filtered", urlPath: "/v1/movies?genres=adventure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.request(t, http.MethodGet, tt.urlPath, token, nil)
+			assertGolden(t, tt.name, code, body)
+		})
+	}
+}
+
+// tokenRX matches the plaintext tokens in responses, which are random.
+var tokenRX = regexp.MustCompile(`"token": "[A-Z2-7]{26}"`)
+
+// TestRoutedResponsesGolden makes a series of requests through the router, each of
+// which can depend on the ones before it, so that the middleware and the error
+// handling of the router are covered as well as the handlers.
+func TestRoutedResponsesGolden(t *testing.T) {
+	app := newTestApplication(t)
+	app.mailQueue = &mailQueue{jobs: make(chan mailJob, 1)}
+	_, token := newTestUser(t, app, "movies:read", "movies:write")
+	ts := newTestServer(t, app.routes())
+	// activationToken is issued for the user once they've registered, as the one in the
+	// welcome email is never sent.
+	var activationToken string
+
+	tests := []struct {
+		name    string
+		method  string
+		urlPath string
+		token   string
+		header  http.Header
+		body    string
+	}{
+		{name: "healthcheck", method: http.MethodGet, urlPath: "/v1/healthcheck"},
+		{name: "version", method: http.MethodGet, urlPath: "/v1/version"},
+		{name: "movie_create", method: http.MethodPost, urlPath: "/v1/movies", token: token,
+			body: `{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation", "adventure"]}`},
+		{name: "movie_update", method: http.MethodPatch, urlPath: "/v1/movies/1", token: token,
+			body: `{"runtime": "108 mins"}`},
+		{name: "movie_show_fields", method: http.MethodGet, urlPath: "/v1/movies/1?fields=title,year", token: token},
+		{name: "movie_show_bare", method: http.MethodGet, urlPath: "/v1/movies/1?envelope=false", token: token},
+		{name: "movie_list_bare", method: http.MethodGet, urlPath: "/v1/movies", token: token,
+			header: http.Header{envelopeHeader: {"false"}}},
+		{name: "movie_create_invalid", method: http.MethodPost, urlPath: "/v1/movies", token: token,
+			body: `{"title": "", "year": 1800, "runtime": "107 mins", "genres": ["animation"]}`},
+		{name: "movie_create_wrong_type", method: http.MethodPost, urlPath: "/v1/movies", token: token,
+			body: `{"title": "Moana", "year": "2016", "runtime": "107 mins", "genres": ["animation"]}`},
+		{name: "movie_show_bad_envelope", method: http.MethodGet, urlPath: "/v1/movies/1", token: token,
+			header: http.Header{envelopeHeader: {"maybe"}}},
+		{name: "movie_delete", method: http.MethodDelete, urlPath: "/v1/movies/1", token: token},
+		{name: "movie_show_deleted", method: http.MethodGet, urlPath: "/v1/movies/1", token: token},
+		{name: "route_not_found", method: http.MethodGet, urlPath: "/v1/nowhere"},
+		{name: "route_method_not_allowed", method: http.MethodDelete, urlPath: "/v1/healthcheck"},
+		{name: "user_register", method: http.MethodPost, urlPath: "/v1/users",
+			body: `{"name": "Alice Smith", "email": "alice@example.com", "password": "pa55word1234"}`},
+		{name: "user_activate", method: http.MethodPut, urlPath: "/v1/users/activated",
+			body: `{"token": "<activation_token>"}`},
+		{name: "token_authentication", method: http.MethodPost, urlPath: "/v1/tokens/authentication",
+			body: `{"email": "alice@example.com", "password": "pa55word1234"}`},
+		{name: "token_authentication_invalid", method: http.MethodPost, urlPath: "/v1/tokens/authentication",
+			body: `{"email": "alice@example.com", "password": "wrongpa55word"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(strings.ReplaceAll(tt.body, "<activation_token>", activationToken))
+			}
+			code, _, respBody := ts.requestWithHeader(t, tt.method, tt.urlPath, tt.token, body, tt.header)
+			if tt.name == "user_register" {
+				user, err := app.models.Users.GetByEmail("alice@example.com")
+				assert.NilError(t, err)
+				activation, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeActivation)
+				assert.NilError(t, err)
+				activationToken = activation.Plaintext
+			}
+			assertGolden(t, "routed_"+tt.name, code, tokenRX.ReplaceAllString(respBody, `"token": "<token>"`))
+		})
+	}
+}
+
+func TestErrorEnvelopesGolden(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.db.breaker.cooldown = 30 * time.Second
+
+	tests := []struct {
+		name     string
+		response func(w http.ResponseWriter, r *http.Request)
+	}{
+		{name: "server_error", response: func(w http.ResponseWriter, r *http.Request) {
+			app.serverErrorResponse(w, r, errors.New("boom"))
+		}},
+		{name: "not_found", response: app.notFoundResponse},
+		{name: "method_not_allowed", response: app.methodNotAllowedResponse},
+		{name: "bad_request", response: func(w http.ResponseWriter, r *http.Request) {
+			app.badRequestResponse(w, r, errors.New("body contains badly-formed JSON"))
+		}},
+		{name: "body_limit_exceeded", response: func(w http.ResponseWriter, r *http.Request) {
+			app.badRequestResponse(w, r, &jsonLimitError{"body must not be nested more than 10 levels deep"})
+		}},
+		{name: "validation_failed", response: func(w http.ResponseWriter, r *http.Request) {
+			app.failedValidationResponse(w, r, map[string]string{"title": "must be provided", "year": "must not be in the future"})
+		}},
+		{name: "schema_validation_failed", response: func(w http.ResponseWriter, r *http.Request) {
+			app.schemaValidationResponse(w, r, map[string]string{"runtime": "must be a string"})
+		}},
+		{name: "edit_conflict", response: app.editConflictResponse},
+		{name: "rate_limited", response: app.rateLimitExceededResponse},
+		{name: "invalid_credentials", response: app.invalidCredentialsResponse},
+		{name: "invalid_authentication_token", response: app.invalidAuthenticationTokenResponse},
+		{name: "authentication_required", response: app.authenticationRequiredResponse},
+		{name: "inactive_account", response: app.inactiveAccountResponse},
+		{name: "not_permitted", response: app.notPermittedResponse},
+		{name: "own_admin_role", response: app.ownAdminRoleResponse},
+		{name: "not_acceptable", response: app.notAcceptableResponse},
+		{name: "invalid_csrf_token", response: app.invalidCSRFTokenResponse},
+		{name: "login_throttled", response: func(w http.ResponseWriter, r *http.Request) {
+			app.loginThrottledResponse(w, r, time.Minute)
+		}},
+		{name: "captcha_required", response: app.captchaRequiredResponse},
+		{name: "database_unavailable", response: app.databaseUnavailableResponse},
+		{name: "overloaded", response: app.overloadedResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+			tt.response(rr, r)
+			assertGolden(t, "error_"+tt.name, rr.Code, rr.Body.String())
+		})
+	}
+}
@@ -1,8 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
 )
+
+// processStart is when the process started, for the uptime in the healthcheck.
+var processStart = time.Now()
+
+// The healthcheckHandler shows the environment and version to everyone. Operators (admins
+// authenticated with an unrestricted token) also get the build information, uptime,
+// database pool statistics and the state of the optional subsystems.
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
     env := envelope{
         "status": "available",
@@ -11,8 +26,149 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
             "version":     version,
         },
     }
-    err := app.writeJSON(w, http.StatusOK, env, nil)
+    operator, err := app.isOperator(r)
     if err != nil {
         app.serverErrorResponse(w, r, err)
+        return
     }
-}
\ No newline at end of file
+    if operator {
+        env["details"] = app.systemDetails()
+    }
+    err = app.writeJSON(w, http.StatusOK, env, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// The livezHandler is the liveness probe. It only shows that the process is up and
+// serving requests, so it never checks anything else: a database outage shouldn't get
+// every instance restarted.
+func (app *application) livezHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readyzHandler is the readiness probe. The instance is ready when it isn't
+// shutting down, the database can be reached and the migrations this build needs have
+// been applied; otherwise it sends a 503 Service Unavailable response listing the
+// checks which failed, and the load balancer stops sending it traffic. Anyone can call
+// the probe, so the checks only say what's wrong in general terms, and the errors with
+// the details (host names, ports, driver errors and so on) go in the log.
+func (app *application) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	if app.draining.Load() {
+		checks["shutdown"] = "draining"
+	}
+	if app.db != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := app.db.PingContext(ctx); err != nil {
+			checks["database"] = "unreachable"
+			app.logger.PrintError(fmt.Errorf("readiness check: database: %w", err), nil)
+		} else if !app.schemaReady.Load() {
+			// Once the migrations have been applied they stay applied, so there's no
+			// need to check again.
+			if err := data.CheckSchema(ctx, app.db); err != nil {
+				checks["migrations"] = "migrations pending"
+				if !errors.Is(err, data.ErrSchemaOutdated) {
+					checks["migrations"] = "schema check failed"
+				}
+				app.logger.PrintError(fmt.Errorf("readiness check: migrations: %w", err), nil)
+			} else {
+				app.schemaReady.Store(true)
+			}
+		}
+	}
+	status, env := http.StatusOK, envelope{"status": "ready"}
+	if len(checks) > 0 {
+		status, env = http.StatusServiceUnavailable, envelope{"status": "unavailable", "checks": checks}
+	}
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// isOperator reports whether the request was made by an admin with a token that hasn't
+// been restricted to some of their permissions, in the same way as requireRole().
+func (app *application) isOperator(r *http.Request) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || !user.Activated {
+		return false, nil
+	}
+	if token := app.contextGetToken(r); token != nil && len(token.Permissions) > 0 {
+		return false, nil
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if role == data.RoleAdmin {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// systemDetails returns the detailed system information for operators.
+func (app *application) systemDetails() map[string]any {
+	build := map[string]string{
+		"go_version": runtime.Version(),
+		"commit":     commit,
+		"branch":     branch,
+		"build_time": buildTime,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.modified" {
+				build["modified"] = setting.Value
+			}
+		}
+	}
+	details := map[string]any{
+		"build":          build,
+		"started_at":     processStart.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(processStart).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+	}
+	if app.db != nil {
+		stats := app.db.Stats()
+		details["database"] = map[string]any{
+			"driver":              app.config.db.driver,
+			"max_open":            stats.MaxOpenConnections,
+			"open":                stats.OpenConnections,
+			"in_use":              stats.InUse,
+			"idle":                stats.Idle,
+			"wait_count":          stats.WaitCount,
+			"wait_duration_ms":    stats.WaitDuration.Milliseconds(),
+			"max_idle_closed":     stats.MaxIdleClosed,
+			"max_lifetime_closed": stats.MaxLifetimeClosed,
+		}
+	} else {
+		details["database"] = map[string]any{"driver": app.config.db.driver}
+	}
+	mailer := map[string]any{"enabled": app.config.smtp.host != ""}
+	if app.mailQueue != nil {
+		mailer["queued"] = len(app.mailQueue.jobs)
+		mailer["queue_size"] = cap(app.mailQueue.jobs)
+	}
+	jobs := map[string]any{}
+	if app.jobQueue != nil {
+		jobs["queued"] = len(app.jobQueue.jobs)
+		jobs["queue_size"] = cap(app.jobQueue.jobs)
+	}
+	details["subsystems"] = map[string]any{
+		"mailer":        mailer,
+		"jobs":          jobs,
+		"cache":         map[string]any{"enabled": app.config.db.cache},
+		"auth_cache":    map[string]any{"enabled": app.config.redis.url != ""},
+		"sentry":        map[string]any{"enabled": app.config.log.sentryDSN != ""},
+		"events":        map[string]any{"enabled": app.publisher != nil, "publisher": app.config.events.publisher},
+		"limiter":       map[string]any{"enabled": app.config.limiter.enabled, "backend": "memory"},
+		"load_shedding": map[string]any{"enabled": app.shedder != nil},
+	}
+	return details
+}
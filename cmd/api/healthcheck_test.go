@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+// TestReadyzHidesErrors checks that the readiness probe, which anyone can call, says the
+// database is unreachable without passing on the error with its address in.
+func TestReadyzHidesErrors(t *testing.T) {
+	app := newTestApplication(t)
+	db, err := sql.Open("postgres", "postgres://greenlight@127.0.0.1:1/greenlight?sslmode=disable&connect_timeout=1")
+	assert.NilError(t, err)
+	t.Cleanup(func() { db.Close() })
+	app.db = db
+	ts := newTestServer(t, app.routes())
+
+	code, _, body := ts.get(t, "/readyz")
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.StringContains(t, body, `"database": "unreachable"`)
+	if strings.Contains(body, "127.0.0.1") {
+		t.Errorf("the response includes the database address: %s", body)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,11 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
 )
 
@@ -27,13 +31,65 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 
 // Define an envelope type.
 type envelope map[string]interface{}
+// The bufferPool holds the buffers which we encode JSON responses into. Reusing them
+// (rather than allocating a new byte slice for every response with json.MarshalIndent())
+// saves a lot of garbage when we're handling a high number of requests per second.
+var bufferPool = sync.Pool{
+    New: func() interface{} {
+        return new(bytes.Buffer)
+    },
+}
+
+// The maxPooledBufferSize constant is the capacity above which we don't return a buffer
+// to the pool. Otherwise a single very large response would leave a very large buffer
+// sitting in the pool, taking up memory, forever.
+const maxPooledBufferSize = 64 << 10
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+    buf := bufferPool.Get().(*bytes.Buffer)
+    buf.Reset()
+    return buf
+}
+
+// putBuffer returns a buffer to the pool, unless it has grown too large.
+func putBuffer(buf *bytes.Buffer) {
+    if buf.Cap() <= maxPooledBufferSize {
+        bufferPool.Put(buf)
+    }
+}
+
 // Change the data parameter to have the type envelope instead of interface{}.
+//
+// If the client asked for bare responses (see negotiateEnvelope()), an envelope with a
+// single resource or array in it is written without the envelope. Envelopes with more
+// than one key, which includes every error response, are always written as they are.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-    js, err := json.MarshalIndent(data, "", "\t")
+    // Encode the data into a pooled buffer. Like json.MarshalIndent(), a json.Encoder
+    // escapes HTML characters by default, and its Encode() method appends a newline for
+    // us, so the output is exactly the same as before.
+    buf := getBuffer()
+    defer putBuffer(buf)
+    enc := json.NewEncoder(buf)
+    enc.SetIndent("", "\t")
+    var err error
+    if value, ok := data.single(); ok && isBare(w) {
+        err = enc.Encode(value)
+        if err == nil && buf.Len() > 0 && buf.Bytes()[0] != '{' && buf.Bytes()[0] != '[' {
+            // Bare strings and numbers would mean nothing to the client.
+            buf.Reset()
+            err = enc.Encode(data)
+        }
+    } else {
+        err = enc.Encode(data)
+    }
     if err != nil {
         return err
     }
-    js = append(js, '\n')
+    js := buf.Bytes()
+    if loc := responseLocation(w); loc != nil {
+        js = localizeTimestamps(js, loc)
+    }
     for key, value := range headers {
         w.Header()[key] = value
     }
@@ -43,16 +99,94 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
     return nil
 }
 
+// The jsonOptions type holds the settings which control how strictly a JSON request
+// body is decoded by the readJSON helpers. Different endpoints can use different
+// settings, depending on how much leniency we want to give their clients.
+type jsonOptions struct {
+	// maxBytes is the maximum permitted size of the request body.
+	maxBytes int
+	// allowUnknownFields controls whether fields in the JSON which don't map to the
+	// destination are ignored (true) or rejected with an error (false).
+	allowUnknownFields bool
+	// rejectDuplicateFields controls whether an object containing the same key more
+	// than once is rejected with an error.
+	rejectDuplicateFields bool
+	// maxDepth is the maximum permitted nesting depth of objects and arrays, and
+	// maxArrayLength is the maximum number of elements permitted in any single array.
+	// A value of zero means that there is no limit.
+	maxDepth       int
+	maxArrayLength int
+}
+
+// The jsonLimitError type is returned by the readJSON helpers when a request body
+// exceeds the nesting depth or array length limits. Handlers pass it to
+// badRequestResponse() like any other decoding error, which sends a 422 response
+// for it instead of a 400.
+type jsonLimitError struct {
+	message string
+}
+
+func (e *jsonLimitError) Error() string {
+	return e.message
+}
+
+// defaultJSONOptions are the strict settings used by readJSON(). Unknown and duplicate
+// fields are rejected, the body is limited to 1MB, objects and arrays can be nested at
+// most 10 levels deep, and arrays can contain at most 100 elements.
+var defaultJSONOptions = jsonOptions{
+	maxBytes:              1_048_576,
+	allowUnknownFields:    false,
+	rejectDuplicateFields: true,
+	maxDepth:              10,
+	maxArrayLength:        100,
+}
+
+// lenientJSONOptions are used by endpoints which are called by our mobile clients, which
+// may include extra (analytics) fields in the request body that we want to ignore.
+var lenientJSONOptions = jsonOptions{
+	maxBytes:              1_048_576,
+	allowUnknownFields:    true,
+	rejectDuplicateFields: true,
+	maxDepth:              10,
+	maxArrayLength:        100,
+}
+
+// The readJSON() helper decodes the request body into dst using the strict default
+// options.
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-	maxBytes := 1_048_576
+	return app.readJSONWithOptions(w, r, dst, defaultJSONOptions)
+}
+
+func (app *application) readJSONWithOptions(w http.ResponseWriter, r *http.Request, dst interface{}, opts jsonOptions) error {
+	// Use http.MaxBytesReader() to limit the size of the request body.
+	maxBytes := opts.maxBytes
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-		// Initialize the json.Decoder, and call the DisallowUnknownFields() method on it
-	// before decoding. This means that if the JSON from the client now includes any
-	// field which cannot be mapped to the target destination, the decoder will return
-	// an error instead of just ignoring the field.
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
+	var body io.Reader = r.Body
+	// If we need to inspect the structure of the JSON before decoding it, we read the
+	// whole (size-limited) body into memory first so that we can make two passes over
+	// it.
+	if opts.rejectDuplicateFields || opts.maxDepth > 0 || opts.maxArrayLength > 0 {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+					if err.Error() == "http: request body too large" {
+							return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+					}
+					return err
+			}
+			err = scanJSON(b, opts)
+			if err != nil {
+					return err
+			}
+			body = bytes.NewReader(b)
+	}
+	// Initialize the json.Decoder, and unless we've been told to allow unknown fields,
+	// call the DisallowUnknownFields() method on it before decoding. This means that if
+	// the JSON from the client includes any field which cannot be mapped to the target
+	// destination, the decoder will return an error instead of just ignoring the field.
+	dec := json.NewDecoder(body)
+	if !opts.allowUnknownFields {
+			dec.DisallowUnknownFields()
+	}
 	// Decode the request body to the destination.
 	err := dec.Decode(dst)
 	if err != nil {
@@ -80,9 +214,10 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			case strings.HasPrefix(err.Error(), "json: unknown field "):
 					fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 					return fmt.Errorf("body contains unknown key %s", fieldName)
-			// If the request body exceeds 1MB in size the decode will now fail with the
-			// error "http: request body too large". There is an open issue about turning
-			// this into a distinct error type at https://github.com/golang/go/issues/30715.
+			// If the request body exceeds the maximum size the decode will now fail with
+			// the error "http: request body too large". There is an open issue about
+			// turning this into a distinct error type at
+			// https://github.com/golang/go/issues/30715.
 			case err.Error() == "http: request body too large":
 					return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
 			case errors.As(err, &invalidUnmarshalError):
@@ -102,6 +237,94 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// The scanJSON() helper walks through the tokens in a JSON document and checks it
+// against the structural rules in opts (at the moment, that no object contains the same
+// key twice, that objects and arrays aren't nested too deeply, and that arrays don't
+// contain too many elements). Because this works on the token stream, we can reject a
+// document before any memory is allocated for the decoded values. If the document is
+// malformed we return nil and leave it to the json.Decoder in readJSONWithOptions() to
+// report a helpful error message.
+func scanJSON(b []byte, opts jsonOptions) error {
+	// Each frame on the stack represents an object or array that we're currently
+	// inside. For objects we track the keys that we've seen so far, and whether the next
+	// token is expected to be a key or a value.
+	type frame struct {
+			isObject  bool
+			keys      map[string]bool
+			expectKey bool
+			elements  int
+	}
+	var stack []*frame
+	// valueStart() must be called at the start of every value. If the value is an
+	// element of an array, we check that the array hasn't grown beyond the limit.
+	valueStart := func() error {
+			if len(stack) > 0 && !stack[len(stack)-1].isObject {
+					stack[len(stack)-1].elements++
+					if opts.maxArrayLength > 0 && stack[len(stack)-1].elements > opts.maxArrayLength {
+							return &jsonLimitError{fmt.Sprintf("body must not contain arrays with more than %d elements", opts.maxArrayLength)}
+					}
+			}
+			return nil
+	}
+	// valueDone() must be called after every complete value. If the value was inside an
+	// object, the next token will be a key again.
+	valueDone := func() {
+			if len(stack) > 0 && stack[len(stack)-1].isObject {
+					stack[len(stack)-1].expectKey = true
+			}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+			tok, err := dec.Token()
+			if err != nil {
+					return nil
+			}
+			// Any token other than an object key or a closing delimiter is the start of a
+			// new value.
+			_, isString := tok.(string)
+			isKey := isString && len(stack) > 0 && stack[len(stack)-1].isObject && stack[len(stack)-1].expectKey
+			if !isKey && tok != json.Delim('}') && tok != json.Delim(']') {
+					err = valueStart()
+					if err != nil {
+							return err
+					}
+			}
+			switch t := tok.(type) {
+			case json.Delim:
+					switch t {
+					case '{', '[':
+							if opts.maxDepth > 0 && len(stack) >= opts.maxDepth {
+									return &jsonLimitError{fmt.Sprintf("body must not be nested more than %d levels deep", opts.maxDepth)}
+							}
+							if t == '{' {
+									stack = append(stack, &frame{isObject: true, keys: make(map[string]bool), expectKey: true})
+							} else {
+									stack = append(stack, &frame{})
+							}
+					default:
+							stack = stack[:len(stack)-1]
+							valueDone()
+					}
+			case string:
+					top := (*frame)(nil)
+					if len(stack) > 0 {
+							top = stack[len(stack)-1]
+					}
+					if top != nil && top.isObject && top.expectKey {
+							if opts.rejectDuplicateFields && top.keys[t] {
+									return fmt.Errorf("body contains duplicate key %q", t)
+							}
+							top.keys[t] = true
+							top.expectKey = false
+							continue
+					}
+					valueDone()
+			default:
+					valueDone()
+			}
+	}
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -149,6 +372,90 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+// The readGenres() helper reads the genre filters from the query string. It returns the
+// genres which a movie must have all of, from the genres_all parameter (or the older
+// genres parameter, which has always meant the same thing), and puts the genres_any
+// parameter into the Filters struct.
+func (app *application) readGenres(qs url.Values, f *data.Filters) []string {
+	genres := app.readCSV(qs, "genres", []string{})
+	genres = append(genres, app.readCSV(qs, "genres_all", []string{})...)
+	f.GenresAny = app.readCSV(qs, "genres_any", []string{})
+	return genres
+}
+// The readRanges() helper reads the year_min, year_max, runtime_min and runtime_max
+// query string parameters into the year and runtime limits of a Filters struct.
+func (app *application) readRanges(qs url.Values, f *data.Filters, v *validator.Validator) {
+	f.YearMin = app.readInt(qs, "year_min", 0, v)
+	f.YearMax = app.readInt(qs, "year_max", 0, v)
+	f.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	f.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+}
+// The readAttributes() helper reads the attr.<name> query string parameters, like
+// attr.language=fr, into the attribute filters of a Filters struct, and checks them
+// against the schema in data.MovieAttributes.
+func (app *application) readAttributes(qs url.Values, f *data.Filters, v *validator.Validator) {
+	for key := range qs {
+		name, ok := strings.CutPrefix(key, "attr.")
+		if !ok {
+			continue
+		}
+		if f.Attributes == nil {
+			f.Attributes = make(data.Attributes)
+		}
+		f.Attributes[name] = qs.Get(key)
+	}
+	data.ValidateAttributes(v, "attr.", f.Attributes)
+}
+// The readBool() helper reads a string value from the query string and converts it to a
+// bool. It accepts the same values as strconv.ParseBool() ("1", "t", "true", "0", "f",
+// "false" and so on). If no matching key could be found it returns the provided
+// default value, and if the value couldn't be converted we record an error message in
+// the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+			return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+			v.AddError(key, "must be a boolean value")
+			return defaultValue
+	}
+	return b
+}
+// The readDate() helper reads a string value in the YYYY-MM-DD format from the query
+// string and converts it to a time.Time value (at midnight UTC on that date). If no
+// matching key could be found it returns the provided default value, and if the value
+// couldn't be parsed we record an error message in the provided Validator instance.
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+			return defaultValue
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+			v.AddError(key, "must be a date in the format YYYY-MM-DD")
+			return defaultValue
+	}
+	return t
+}
+// The readTime() helper is like readDate(), except that it also accepts an RFC 3339
+// timestamp, like 2024-06-01T12:00:00Z, for a time other than midnight UTC.
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+			return defaultValue
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+			t, err = time.Parse("2006-01-02", s)
+	}
+	if err != nil {
+			v.AddError(key, "must be a date in the format YYYY-MM-DD or an RFC 3339 timestamp")
+			return defaultValue
+	}
+	return t
+}
 
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
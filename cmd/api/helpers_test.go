@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The jsonShape type describes the structure of a JSON document: how deeply its objects
+// and arrays are nested, the most elements in any one of its arrays, and whether any of
+// its objects contains the same key twice.
+type jsonShape struct {
+	depth        int
+	longestArray int
+	duplicateKey bool
+}
+
+// measureJSON works out the shape of a JSON document independently of scanJSON(), by
+// walking it recursively. It returns false if the document isn't a single valid JSON
+// value.
+func measureJSON(b []byte) (jsonShape, bool) {
+	var shape jsonShape
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var walk func(depth int) error
+	walk = func(depth int) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			return nil
+		}
+		shape.depth = max(shape.depth, depth+1)
+		elements := 0
+		keys := make(map[string]bool)
+		for dec.More() {
+			if delim == '{' {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := tok.(string)
+				shape.duplicateKey = shape.duplicateKey || keys[key]
+				keys[key] = true
+			} else {
+				elements++
+			}
+			err = walk(depth + 1)
+			if err != nil {
+				return err
+			}
+		}
+		shape.longestArray = max(shape.longestArray, elements)
+		_, err = dec.Token()
+		return err
+	}
+	if walk(0) != nil {
+		return shape, false
+	}
+	_, err := dec.Token()
+	return shape, err == io.EOF
+}
+
+// FuzzReadJSON checks that readJSONWithOptions() never panics, whatever the body and
+// destination, and that for a valid JSON document it fails exactly when the document
+// breaks the depth, array length or duplicate key limits, with the matching error.
+func FuzzReadJSON(f *testing.F) {
+	for _, seed := range []string{
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`,
+		`{"title": "Moana", "title": "Moana"}`,
+		`{"a": {"a": {"a": {"a": 1}}}}`,
+		`[[[[]]]]`,
+		`[1, 2, 3, 4]`,
+		`{"genres": ["a", "b", "c", "d"]}`,
+		`{"a": [{"b": 1, "b": 2}]}`,
+		`{"runtime": 107}`,
+		`{} {}`,
+		`{"title": }`,
+		`"Moana"`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	app := newTestApplication(f)
+	opts := jsonOptions{maxBytes: 1_048_576, allowUnknownFields: true, rejectDuplicateFields: true, maxDepth: 3, maxArrayLength: 3}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		read := func(dst any, opts jsonOptions) error {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			return app.readJSONWithOptions(httptest.NewRecorder(), r, dst, opts)
+		}
+		var movie struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+		read(&movie, defaultJSONOptions)
+		read(&movie, opts)
+
+		var dst any
+		err := read(&dst, opts)
+		shape, ok := measureJSON(body)
+		if !ok {
+			return
+		}
+		var limitErr *jsonLimitError
+		switch {
+		case err == nil:
+			if shape.depth > opts.maxDepth || shape.longestArray > opts.maxArrayLength || shape.duplicateKey {
+				t.Fatalf("%q (%+v) was accepted", body, shape)
+			}
+		case errors.As(err, &limitErr):
+			if shape.depth <= opts.maxDepth && shape.longestArray <= opts.maxArrayLength {
+				t.Fatalf("%q (%+v) was rejected: %v", body, shape, err)
+			}
+		case strings.HasPrefix(err.Error(), "body contains duplicate key"):
+			if !shape.duplicateKey {
+				t.Fatalf("%q (%+v) was rejected: %v", body, shape, err)
+			}
+		default:
+			t.Fatalf("%q: unexpected error %v", body, err)
+		}
+	})
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	app := newTestApplication(b)
+	movie := &data.Movie{ID: 1, CreatedAt: time.Now(), Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}, Version: 1}
+	movies := make([]*data.Movie, 20)
+	for i := range movies {
+		movies[i] = movie
+	}
+	for _, bm := range []struct {
+		name string
+		env  envelope
+	}{
+		{name: "error", env: envelope{"error": "the requested resource could not be found", "code": "not_found"}},
+		{name: "movie", env: envelope{"movie": movie}},
+		{name: "movies", env: envelope{"movies": movies, "metadata": data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 5, TotalRecords: 100}}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := app.writeJSON(httptest.NewRecorder(), http.StatusOK, bm.env, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/apierror"
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// importMaxBytes is the maximum size of a CSV import request body. It's much larger than
+// the limit for JSON request bodies, so that imports of 100k+ rows fit in one request.
+const importMaxBytes = 64 << 20
+
+// importMaxErrors is the maximum number of invalid rows that we report in a response.
+const importMaxErrors = 100
+
+// errImportDuplicate is why an import fails if it has a movie with the same title and
+// year as a movie in the catalog.
+var errImportDuplicate = errors.New("contains a movie with the same title and year as an existing movie")
+
+// The importMoviesHandler() imports movies from a CSV request body. The first row of the
+// CSV must be a header row containing the columns title, year, runtime and genres (in
+// any order). The runtime can be in any of the formats accepted in JSON, and multiple
+// genres are separated with a | character. For example:
+//
+//	title,year,runtime,genres
+//	Moana,2016,107 mins,animation|adventure
+//
+// An import is all-or-nothing: if any row is invalid (including a row with the same
+// title and year as an earlier row) then nothing is imported and the errors for the
+// invalid rows are returned, keyed by their line number in the CSV. The
+// valid movies are inserted with InsertMany(), which uses COPY rather than individual
+// INSERT statements.
+//
+// With ?async=true the CSV is still read and validated before responding, but the movies
+// are inserted by a job: the response is a 202 Accepted with the job, which can be
+// polled at GET /v1/jobs/:id until it has finished.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	async := false
+	if s := r.URL.Query().Get("async"); s != "" {
+		var err error
+		async, err = strconv.ParseBool(s)
+		if err != nil {
+			app.failedValidationResponse(w, r, map[string]string{"async": "must be a boolean value"})
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+
+	cr := csv.NewReader(r.Body)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("body must not be empty")
+		}
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			app.badRequestResponse(w, r, fmt.Errorf("header row is missing the %q column", name))
+			return
+		}
+	}
+
+	var movies []*data.Movie
+	rowErrors := make(map[string]map[string]string)
+	identities := make(map[string]int)
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				err = &jsonLimitError{fmt.Sprintf("body must not be larger than %d bytes", importMaxBytes)}
+			}
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		movie, v := parseImportRecord(record, columns)
+		if v.Valid() {
+			identity := data.MovieIdentity(movie.Title, movie.Year)
+			if first, ok := identities[identity]; ok {
+				v.AddError("title", fmt.Sprintf("a movie with this title and year is already on line %d", first))
+			} else {
+				identities[identity] = line
+			}
+		}
+		if !v.Valid() {
+			if len(rowErrors) < importMaxErrors {
+				rowErrors[strconv.Itoa(line)] = v.Errors
+			}
+			continue
+		}
+		movies = append(movies, movie)
+	}
+	if len(rowErrors) > 0 {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, apierror.CodeValidationFailed, rowErrors)
+		return
+	}
+	if len(movies) == 0 {
+		app.failedValidationResponse(w, r, map[string]string{"body": "must contain at least 1 movie"})
+		return
+	}
+
+	if async {
+		models := app.modelsFor(r)
+		job, err := app.enqueueJob(r, "movies_import", len(movies), func(progress func(done int)) (interface{}, error) {
+			err := models.Movies.InsertMany(movies)
+			if err != nil {
+				if errors.Is(err, data.ErrDuplicateMovie) {
+					err = errImportDuplicate
+				}
+				return nil, err
+			}
+			progress(len(movies))
+			app.logSecurityEvent(r, "movies_imported", map[string]string{"count": strconv.Itoa(len(movies))})
+			return envelope{"imported": len(movies)}, nil
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, errJobQueueFull):
+				app.overloadedResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		app.acceptedJobResponse(w, r, job)
+		return
+	}
+
+	err = app.modelsFor(r).Movies.InsertMany(movies)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.failedValidationResponse(w, r, map[string]string{"body": errImportDuplicate.Error()})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "movies_imported", map[string]string{"count": strconv.Itoa(len(movies))})
+	err = app.writeJSON(w, http.StatusCreated, envelope{"imported": len(movies)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// csvImportCell undoes csvCell(), so that a CSV export can be imported again: a ' in
+// front of a formula character is taken off.
+func csvImportCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// parseImportRecord converts a single CSV record into a movie, returning the movie along
+// with a validator holding any errors for the record.
+func parseImportRecord(record []string, columns map[string]int) (*data.Movie, *validator.Validator) {
+	v := validator.New()
+	field := func(name string) string {
+		i := columns[name]
+		if i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(csvImportCell(record[i]))
+	}
+
+	movie := &data.Movie{Title: field("title")}
+	if s := field("year"); s != "" {
+		year, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			v.AddError("year", "must be an integer value")
+		}
+		movie.Year = int32(year)
+	}
+	if s := field("runtime"); s != "" {
+		raw := []byte(s)
+		if _, err := strconv.ParseInt(s, 10, 32); err != nil {
+			raw = []byte(strconv.Quote(s))
+		}
+		if err := movie.Runtime.UnmarshalJSON(raw); err != nil {
+			v.AddError("runtime", "must be a valid runtime")
+		}
+	}
+	if s := field("genres"); s != "" {
+		for _, genre := range strings.Split(s, "|") {
+			movie.Genres = append(movie.Genres, strings.TrimSpace(genre))
+		}
+	}
+	// AddError() keeps the first error for each key, so any parsing errors above take
+	// precedence over the errors from ValidateMovie().
+	data.ValidateMovie(v, movie)
+	return movie, v
+}
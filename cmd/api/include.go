@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// includeSimilarLimit is how many similar movies ?include=similar adds to a movie, which
+// is the default for GET /v1/movies/:id/similar.
+const includeSimilarLimit = 10
+
+// The movieInclude type loads a movie's related resources of one kind.
+type movieInclude func(app *application, r *http.Request, movie *data.Movie) (interface{}, error)
+
+// movieIncludes are the related resources which can be added to the response for a
+// movie with ?include=, saving the client a request to their own endpoints. Each loads
+// its resources for the movie in a single query.
+var movieIncludes = map[string]movieInclude{
+	"revisions": func(app *application, r *http.Request, movie *data.Movie) (interface{}, error) {
+		return app.modelsFor(r).Movies.GetRevisions(movie.ID)
+	},
+	"similar": func(app *application, r *http.Request, movie *data.Movie) (interface{}, error) {
+		return app.modelsFor(r).Movies.Similar(movie.ID, includeSimilarLimit)
+	},
+}
+
+// The readIncludes() helper reads a comma-separated list of related resources from the
+// include query string parameter, checking each of them against the includes. It
+// returns nil if there's no include parameter.
+func (app *application) readIncludes(qs url.Values, includes map[string]movieInclude, v *validator.Validator) []string {
+	var names []string
+	for _, name := range app.readCSV(qs, "include", []string{}) {
+		name = strings.TrimSpace(name)
+		if _, ok := includes[name]; !ok {
+			v.AddError("include", "contains an unknown relationship "+strconv.Quote(name))
+			continue
+		}
+		names = append(names, name)
+	}
+	v.Check(validator.Unique(names), "include", "must not contain duplicate values")
+	return names
+}
+
+// The includedResponse() method loads the related resources named by readIncludes() for
+// a movie, keyed by name. It returns nil if there aren't any, so that the included key
+// can be left out of the response.
+func (app *application) includedResponse(r *http.Request, movie *data.Movie, names []string) (envelope, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	included := make(envelope, len(names))
+	for _, name := range names {
+		resources, err := movieIncludes[name](app, r, movie)
+		if err != nil {
+			return nil, err
+		}
+		included[name] = resources
+	}
+	return included, nil
+}
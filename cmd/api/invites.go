@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The maximum lifetime of an invite. Invites which need to last longer can be minted
+// again when they expire.
+const maxInviteTTL = 90 * 24 * time.Hour
+
+// The createInviteHandler mints a new invite code. The code is only ever included in
+// this response, so it has to be passed on to the invitee straight away. An invite can
+// be used max_uses times (once, by default) until it expires.
+func (app *application) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MaxUses *int    `json:"max_uses"`
+		TTL     *string `json:"ttl"`
+		Note    string  `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	maxUses := 1
+	if input.MaxUses != nil {
+		maxUses = *input.MaxUses
+	}
+	ttl := 7 * 24 * time.Hour
+	v := validator.New()
+	if input.TTL != nil {
+		ttl, err = time.ParseDuration(*input.TTL)
+		v.Check(err == nil, "ttl", "must be a duration like 72h")
+	}
+	v.Check(maxUses > 0, "max_uses", "must be greater than zero")
+	v.Check(maxUses <= 10_000, "max_uses", "must not be more than 10000")
+	if v.Valid() {
+		v.Check(ttl > 0, "ttl", "must be greater than zero")
+		v.Check(ttl <= maxInviteTTL, "ttl", fmt.Sprintf("must not be more than %s", maxInviteTTL))
+	}
+	v.Check(len(input.Note) <= 500, "note", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	invite, err := data.NewInvite(user.ID, ttl, maxUses, input.Note)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Invites.Insert(invite)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logSecurityEvent(r, "invite_created", map[string]string{
+		"email":     user.Email,
+		"invite_id": strconv.FormatInt(invite.ID, 10),
+		"max_uses":  strconv.Itoa(maxUses),
+	})
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invite": invite}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listInvitesHandler lists every invite, without their codes.
+func (app *application) listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	invites, err := app.models.Invites.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"invites": invites}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteInviteHandler revokes an invite. Users who have already registered with it
+// aren't affected.
+func (app *application) deleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Invites.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "invite_revoked", map[string]string{
+		"email":     app.contextGetUser(r).Email,
+		"invite_id": strconv.FormatInt(id, 10),
+	})
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invite successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// consumeInvite uses up one of the uses of the invite with the given code, when
+// registration is invite-only, and returns its ID. If the code is missing or can't be
+// used it sends an error response and returns false. In open registration mode the code
+// is ignored.
+func (app *application) consumeInvite(w http.ResponseWriter, r *http.Request, code string) (int64, bool) {
+	if app.config.registration.mode != "invite" {
+		return 0, true
+	}
+	v := validator.New()
+	if data.ValidateInviteCode(v, code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return 0, false
+	}
+	id, err := app.models.Invites.Consume(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.logSecurityEvent(r, "invite_rejected", nil)
+			v.AddError("invite_code", "invalid, expired or already used invite code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return 0, false
+	}
+	return id, true
+}
+
+// releaseInvite gives back the use of an invite taken by consumeInvite, when the
+// registration fails after all.
+func (app *application) releaseInvite(id int64) {
+	if id == 0 {
+		return
+	}
+	err := app.models.Invites.Release(id)
+	if err != nil {
+		app.logger.PrintError(fmt.Errorf("releasing invite: %w", err), nil)
+	}
+}
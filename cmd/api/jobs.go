@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// errJobQueueFull is returned by enqueueJob() when there's no space in the job queue.
+var errJobQueueFull = errors.New("job queue is full")
+
+// The jobFunc type is the work of a job. It can report how much of the work it has done
+// with progress, and it returns the job's result, which is stored as JSON.
+type jobFunc func(progress func(done int)) (interface{}, error)
+
+// The queuedJob type is a job waiting in the job queue for a worker.
+type queuedJob struct {
+	id   int64
+	kind string
+	run  jobFunc
+}
+
+// The jobQueue type is a bounded queue of jobs, which is consumed by a fixed number of
+// worker goroutines, in the same way as the mail queue. The status of each job is kept
+// in the jobs table, so that clients can poll GET /v1/jobs/:id for it. The queue itself
+// is only in memory, so a job is run by the instance which accepted it; on shutdown the
+// workers finish the jobs which are already queued before serve() returns.
+type jobQueue struct {
+	jobs   chan queuedJob
+	mu     sync.RWMutex
+	closed bool
+}
+
+// startJobQueue creates the job queue and starts its workers, which are tracked by the
+// application WaitGroup like the mail workers.
+func (app *application) startJobQueue() {
+	app.jobQueue = &jobQueue{jobs: make(chan queuedJob, app.config.jobs.queueSize)}
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			for job := range app.jobQueue.jobs {
+				app.runJob(job)
+			}
+		}()
+	}
+}
+
+// runJob runs a queued job, recording its progress and its result (or error) in the jobs
+// table. A panic fails the job rather than bringing down the worker.
+func (app *application) runJob(job queuedJob) {
+	logger := app.logger.Component("jobs")
+	properties := map[string]string{"job_id": strconv.FormatInt(job.id, 10), "kind": job.kind}
+	err := app.models.Jobs.Start(job.id)
+	if err != nil {
+		logger.PrintError(err, properties)
+		return
+	}
+	progress := func(done int) {
+		err := app.models.Jobs.Progress(job.id, done)
+		if err != nil {
+			logger.PrintError(err, properties)
+		}
+	}
+	var encoded json.RawMessage
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%s", p)
+			}
+		}()
+		return job.run(progress)
+	}()
+	if err == nil {
+		encoded, err = json.Marshal(result)
+	}
+	jobErr := err
+	err = app.models.Jobs.Finish(job.id, encoded, jobErr)
+	if err != nil {
+		logger.PrintError(err, properties)
+		return
+	}
+	// A job failing is usually down to its input, like an import of a movie which is
+	// already in the catalog, rather than a bug, so it isn't logged as an error.
+	if jobErr != nil {
+		properties["error"] = jobErr.Error()
+		logger.PrintInfo("job failed", properties)
+		return
+	}
+	logger.PrintInfo("job finished", properties)
+}
+
+// enqueueJob records a job for the authenticated user, with the total amount of work to
+// do, and adds it to the job queue. If the queue is full the job is recorded as failed,
+// and errJobQueueFull is returned.
+func (app *application) enqueueJob(r *http.Request, kind string, total int, run jobFunc) (*data.Job, error) {
+	job := &data.Job{UserID: app.contextGetUser(r).ID, Kind: kind, Total: total}
+	err := app.models.Jobs.Insert(job)
+	if err != nil {
+		return nil, err
+	}
+	q := app.jobQueue
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.closed {
+		select {
+		case q.jobs <- queuedJob{id: job.ID, kind: kind, run: run}:
+			return job, nil
+		default:
+		}
+	}
+	err = app.models.Jobs.Start(job.ID)
+	if err == nil {
+		err = app.models.Jobs.Finish(job.ID, nil, errJobQueueFull)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errJobQueueFull
+}
+
+// The acceptedJobResponse() method sends a 202 Accepted response for a job which has
+// been queued, with the URL to poll for its status in the Location header.
+func (app *application) acceptedJobResponse(w http.ResponseWriter, r *http.Request, job *data.Job) {
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// close stops the job queue from accepting any more jobs. The workers exit once they
+// have run everything that's already in the queue.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
+
+// The showJobHandler() returns the status of one of the authenticated user's jobs, and
+// its result once it has succeeded.
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	job, err := app.models.Jobs.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
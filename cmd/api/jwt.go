@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/jwt"
+)
+
+// newJWT returns a signed JWT for a user, which can be used in place of an opaque
+// authentication token. It expires at the same time as an opaque token would, and any
+// permissions that it's restricted to are carried in its scope claim.
+func (app *application) newJWT(user *data.User, ttl time.Duration, permissions data.Permissions) (*data.Token, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
+	token, err := app.jwtKeys.Sign(jwt.Claims{
+		Issuer:    app.config.jwt.issuer,
+		Subject:   strconv.FormatInt(user.ID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiry.Unix(),
+		Scope:     strings.Join(permissions, " "),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: token, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication, Permissions: permissions}, nil
+}
+
+// userForJWT verifies a JWT and returns the user it was issued to, along with a token
+// record holding its expiry and permissions. It returns data.ErrRecordNotFound if the
+// token isn't valid, so that the authenticate() middleware can treat it exactly like an
+// unknown opaque token. Like opaque tokens, JWTs are only accepted for the users of the
+// request's tenant.
+func (app *application) userForJWT(r *http.Request, token string) (*data.User, *data.Token, error) {
+	claims, err := app.jwtKeys.Verify(token)
+	if err != nil || claims.Issuer != app.config.jwt.issuer {
+		return nil, nil, data.ErrRecordNotFound
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, data.ErrRecordNotFound
+	}
+	user, err := app.modelsFor(r).Users.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &data.Token{
+		UserID:      user.ID,
+		Expiry:      time.Unix(claims.ExpiresAt, 0),
+		Scope:       data.ScopeAuthentication,
+		Permissions: strings.Fields(claims.Scope),
+	}, nil
+}
+
+// The jwksHandler publishes the public keys which tokens can be verified with, so that
+// other services can check them without calling the API.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if app.jwtKeys == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": app.jwtKeys.JWKS()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reloadJWTKeysOnHangup reloads the key rotation schedule each time that the process
+// gets a SIGHUP signal, so that keys can be added and retired without a restart.
+func (app *application) reloadJWTKeysOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			err := app.jwtKeys.Reload()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+			app.logger.PrintInfo("jwt keys reloaded", map[string]string{
+				"keys": strconv.Itoa(len(app.jwtKeys.JWKS())),
+			})
+		}
+	}()
+}
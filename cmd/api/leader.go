@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// runSingleton runs one of the periodic jobs which should only run on one instance at a
+// time, if this instance is the leader (see data.LeaderModel), and skips it otherwise.
+// Changes in leadership are logged, so that it's easy to see which instance was running
+// the jobs at any time.
+func (app *application) runSingleton(job string, fn func()) {
+	leader, err := app.models.Leader.IsLeader()
+	if err != nil {
+		app.logger.PrintError(fmt.Errorf("electing leader for %s: %w", job, err), nil)
+	}
+	if app.leader.Swap(leader) != leader {
+		app.logger.PrintInfo("leadership changed", map[string]string{"leader": strconv.FormatBool(leader)})
+	}
+	if !leader {
+		app.logger.PrintDebug("skipping singleton job", map[string]string{"job": job})
+		return
+	}
+	fn()
+}
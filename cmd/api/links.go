@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The routeTable type records the paths of the GET routes which are registered in
+// routes(), so that the links in responses are built from the routes as they really
+// are, rather than from URL templates which could drift out of date.
+type routeTable map[string]bool
+
+// The link type is a link in the _links object of a response, in the style of HAL.
+type link struct {
+	Href string `json:"href"`
+}
+
+// The links type holds the links of a resource or listing, keyed by relation.
+type links map[string]link
+
+// The routeLink() method returns the link to a GET route, given its path as it's
+// registered in routes() (like /v1/movies/:id/similar) and values for its parameters
+// as name/value pairs. The link is for the request's API version if the route is
+// versioned. Asking for a route which isn't registered is a bug, so it panics (and
+// recoverPanic() sends a 500 Internal Server Error response).
+func (app *application) routeLink(r *http.Request, path string, params ...string) link {
+	if !app.routeTable[path] {
+		panic(fmt.Sprintf("no GET route is registered for %s", path))
+	}
+	if paths := versionedPaths(path); paths != nil {
+		path = paths[app.contextAPIVersion(r)]
+	}
+	segments := strings.Split(path, "/")
+	for i := 0; i+1 < len(params); i += 2 {
+		for j, segment := range segments {
+			if segment == ":"+params[i] {
+				segments[j] = params[i+1]
+			}
+		}
+	}
+	return link{Href: strings.Join(segments, "/")}
+}
+
+// The movieLinks() method returns the links of a movie: to itself, to its related
+// resources and to the collection that it's in.
+func (app *application) movieLinks(r *http.Request, movie *data.Movie) links {
+	id := strconv.FormatInt(movie.ID, 10)
+	return links{
+		"self":       app.routeLink(r, "/v1/movies/:id", "id", id),
+		"similar":    app.routeLink(r, "/v1/movies/:id/similar", "id", id),
+		"revisions":  app.routeLink(r, "/v1/movies/:id/revisions", "id", id),
+		"collection": app.routeLink(r, "/v1/movies"),
+	}
+}
+
+// The pageLinks() method returns the links for a page of a listing: to the page itself
+// and to the first, previous, next and last pages, keeping the rest of the request's
+// query string (the filters and sort order) the same.
+func (app *application) pageLinks(r *http.Request, path string, metadata data.Metadata) links {
+	page := func(n int) link {
+		l := app.routeLink(r, path)
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(n))
+		l.Href += "?" + qs.Encode()
+		return l
+	}
+	result := links{"self": page(metadata.CurrentPage)}
+	if metadata.TotalRecords == 0 {
+		// With no records there's only one page, and the metadata is empty.
+		result["self"] = page(1)
+		return result
+	}
+	result["first"] = page(metadata.FirstPage)
+	result["last"] = page(metadata.LastPage)
+	if metadata.CurrentPage > metadata.FirstPage {
+		result["prev"] = page(min(metadata.CurrentPage-1, metadata.LastPage))
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		result["next"] = page(metadata.CurrentPage + 1)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation (and
+// by handover()); 0, 1 and 2 are stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// inheritedListener returns the listening socket passed to the process with the systemd
+// socket activation protocol, or nil if there isn't one. The LISTEN_* variables are
+// unset afterwards, so that they aren't passed on to anything we start in turn.
+func inheritedListener() (net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// systemd sets LISTEN_PID so that a child process which inherits the environment
+	// doesn't take the sockets too. handover() doesn't know the PID of the process it
+	// starts, so it leaves it unset.
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("expected one inherited socket, got %d", fds)
+	}
+	f := os.NewFile(listenFDsStart, "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// listen returns the listener for the API server: the inherited one if there is one,
+// or a new one on the configured port otherwise. With -reuse-port a new listener sets
+// SO_REUSEPORT, so that a new instance can bind the port while the old one drains.
+func (app *application) listen() (net.Listener, error) {
+	ln, err := inheritedListener()
+	if err != nil || ln != nil {
+		if ln != nil {
+			app.logger.PrintInfo("using inherited listener", map[string]string{"addr": ln.Addr().String()})
+		}
+		return ln, err
+	}
+	var lc net.ListenConfig
+	if app.config.reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", app.config.port))
+}
+
+// handover starts a new copy of the current binary, with the same arguments, and
+// passes the listening socket to it with the systemd socket activation protocol. The
+// new process starts accepting connections on the same socket straight away, and the
+// kernel shares the incoming connections between both processes until this one stops
+// accepting, so none are refused while this one drains.
+func (app *application) handover(ln net.Listener) error {
+	tl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("listener can't be handed over")
+	}
+	f, err := tl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	app.logger.PrintInfo("handed over listener", map[string]string{"pid": strconv.Itoa(cmd.Process.Pid)})
+	// The new process isn't our concern any more, but reap it if it exits before we do.
+	go cmd.Wait()
+	return nil
+}
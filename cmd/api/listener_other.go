@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// There's no handover signal on this platform.
+var handoverSignals []os.Signal
+
+// reusePortControl always fails, as SO_REUSEPORT isn't available on this platform.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("-reuse-port isn't supported on this platform")
+}
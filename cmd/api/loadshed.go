@@ -0,0 +1,166 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedRequests counts the requests rejected by the load shedder, for /debug/vars.
+var shedRequests = expvar.NewInt("load_shed_requests")
+
+// The load shedder settings. The p99 latency is worked out over the last
+// shedLatencyWindow of requests, and only once there are at least shedMinSamples of
+// them, so that a handful of slow requests can't start the shedding on their own.
+const (
+	shedSampleSize    = 1000
+	shedLatencyWindow = 10 * time.Second
+	shedMinSamples    = 50
+)
+
+// lowPriorityRoutes are the method and path prefixes of the requests which are
+// rejected first under overload: the listings and exports, which are expensive and
+// can be retried later. Everything else (authentication, health checks and single
+// records) is never shed.
+var lowPriorityRoutes = []struct {
+	method string
+	path   string
+	prefix bool
+}{
+	{http.MethodGet, "/v1/movies", false},
+	{http.MethodGet, "/v1/movies/export", false},
+	{http.MethodGet, "/v1/movies/trending", false},
+	{http.MethodGet, "/v2/movies", false},
+	{http.MethodGet, "/v2/movies/export", false},
+	{http.MethodGet, "/v2/movies/trending", false},
+	{http.MethodGet, "/v1/admin/users", false},
+	{http.MethodGet, "/v1/admin/invites", false},
+	{http.MethodPost, "/v1/users/me/export", false},
+	{http.MethodGet, "/v1/exports/", true},
+}
+
+// isLowPriority reports whether a request can be shed.
+func isLowPriority(r *http.Request) bool {
+	for _, route := range lowPriorityRoutes {
+		if r.Method != route.method {
+			continue
+		}
+		if r.URL.Path == route.path || (route.prefix && strings.HasPrefix(r.URL.Path, route.path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The loadShedder type tracks the number of requests in flight and the recent p99
+// latency. The latency is only measured for the requests which are never shed, as
+// they're the ones we're trying to keep fast, and the exports are slow anyway.
+type loadShedder struct {
+	maxInFlight int64
+	targetP99   time.Duration
+	inFlight    atomic.Int64
+	p99         atomic.Int64
+
+	mu      sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+func newLoadShedder(maxInFlight int, targetP99 time.Duration) *loadShedder {
+	s := &loadShedder{
+		maxInFlight: int64(maxInFlight),
+		targetP99:   targetP99,
+		samples:     make([]latencySample, 0, shedSampleSize),
+	}
+	// Work out the p99 latency once a second, rather than on every request.
+	if targetP99 > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				s.p99.Store(int64(s.percentile(0.99)))
+			}
+		}()
+	}
+	return s
+}
+
+// record adds a latency sample, replacing the oldest once the buffer is full.
+func (s *loadShedder) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := latencySample{at: time.Now(), duration: d}
+	if len(s.samples) < shedSampleSize {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % shedSampleSize
+}
+
+// percentile returns the latency at percentile p of the samples within the latency
+// window, or zero if there aren't enough of them.
+func (s *loadShedder) percentile(p float64) time.Duration {
+	cutoff := time.Now().Add(-shedLatencyWindow)
+	s.mu.Lock()
+	durations := make([]time.Duration, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if sample.at.After(cutoff) {
+			durations = append(durations, sample.duration)
+		}
+	}
+	s.mu.Unlock()
+	if len(durations) < shedMinSamples {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[int(float64(len(durations)-1)*p)]
+}
+
+// overloaded reports whether the service is overloaded, and why.
+func (s *loadShedder) overloaded() (bool, string) {
+	if s.maxInFlight > 0 && s.inFlight.Load() > s.maxInFlight {
+		return true, "in_flight"
+	}
+	if s.targetP99 > 0 && time.Duration(s.p99.Load()) > s.targetP99 {
+		return true, "latency"
+	}
+	return false, ""
+}
+
+// The shedLoad() middleware rejects low-priority requests with a 503 Service Unavailable
+// response while the service is overloaded: when there are more than -shed-max-in-flight
+// requests in flight, or the p99 latency of the other requests is over -shed-p99. It
+// comes before the rate limiter and authentication, so that a shed request costs as
+// little as possible.
+func (app *application) shedLoad(next http.Handler) http.Handler {
+	s := app.shedder
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		if !isLowPriority(r) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			s.record(time.Since(start))
+			return
+		}
+		if overloaded, reason := s.overloaded(); overloaded {
+			shedRequests.Add(1)
+			app.loggerFrom(r).PrintInfo("shedding request", map[string]string{"reason": reason})
+			app.overloadedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The loadtestCommand() function implements the "loadtest" subcommand, which drives the
+// movie listing, show and create endpoints of a running API at a fixed request rate and
+// reports the latency percentiles for each. It's used like this:
+//
+//	$ api loadtest -target=http://localhost:4000 -rps=50 -duration=30s -token=<token>
+//
+// The token is sent as a bearer token with every request, so that the load test also
+// works once the movie endpoints require authentication.
+func loadtestCommand(args []string) error {
+	var (
+		target      string
+		rps         float64
+		duration    time.Duration
+		token       string
+		maxInFlight int
+	)
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.StringVar(&target, "target", "http://localhost:4000", "Base URL of the API to load test")
+	fs.Float64Var(&rps, "rps", 10, "Requests per second")
+	fs.DurationVar(&duration, "duration", 10*time.Second, "Duration of the load test")
+	fs.StringVar(&token, "token", "", "Authentication token to send with each request")
+	fs.IntVar(&maxInFlight, "max-in-flight", 100, "Maximum number of concurrent requests")
+	fs.Parse(args)
+	// The target is checked up front, as the workers can't do anything useful with a
+	// malformed one. The rate is limited so that the interval between requests is at
+	// least a microsecond (time.NewTicker() panics on an interval of zero).
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("target must be an http:// or https:// URL, not %q", target)
+	}
+	if !(rps > 0 && rps <= maxLoadtestRPS) {
+		return fmt.Errorf("rps must be greater than zero and at most %d", maxLoadtestRPS)
+	}
+	if duration <= 0 {
+		return errors.New("duration must be greater than zero")
+	}
+	if maxInFlight <= 0 {
+		return errors.New("max-in-flight must be greater than zero")
+	}
+
+	lt := &loadtest{
+		target: strings.TrimSuffix(target, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+		stats:  make(map[string]*endpointStats),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	// Send requests at a steady rate until the duration has elapsed. A semaphore
+	// channel limits the number of requests in flight, so that a slow server doesn't
+	// cause us to spawn an unbounded number of goroutines. If the limit is reached, the
+	// request is counted as dropped.
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	sem := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	start := time.Now()
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			select {
+			case sem <- struct{}{}:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					lt.do()
+				}()
+			default:
+				lt.mu.Lock()
+				lt.dropped++
+				lt.mu.Unlock()
+			}
+		}
+	}
+	wg.Wait()
+	lt.report(os.Stdout, time.Since(start))
+	return nil
+}
+
+// maxLoadtestRPS is the highest request rate that the loadtest subcommand accepts.
+const maxLoadtestRPS = 1_000_000
+
+// The loadtest type holds the state for a running load test.
+type loadtest struct {
+	target  string
+	token   string
+	client  *http.Client
+	mu      sync.Mutex
+	stats   map[string]*endpointStats
+	ids     []int64
+	dropped int
+	rand    *rand.Rand
+}
+
+// The endpointStats type records the outcome of every request to a single endpoint.
+type endpointStats struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+var (
+	loadtestWords  = []string{"the", "last", "night", "city", "return", "shadow", "river", "summer", "king", "star", "lost", "road", "iron", "dream", "secret", "garden"}
+	loadtestGenres = []string{"action", "adventure", "animation", "comedy", "crime", "drama", "horror", "romance", "sci-fi", "thriller"}
+)
+
+// do sends a single request, picking the endpoint at random in roughly the proportions
+// that we see in production: mostly listings and shows, with some creates.
+func (lt *loadtest) do() {
+	lt.mu.Lock()
+	n := lt.rand.Intn(100)
+	var id int64
+	if len(lt.ids) > 0 {
+		id = lt.ids[lt.rand.Intn(len(lt.ids))]
+	}
+	title := lt.randomTitle()
+	genre := loadtestGenres[lt.rand.Intn(len(loadtestGenres))]
+	page := lt.rand.Intn(5) + 1
+	lt.mu.Unlock()
+
+	switch {
+	case n < 50:
+		lt.send("list", http.MethodGet, fmt.Sprintf("/v1/movies?genres=%s&page=%d&sort=-year", genre, page), nil)
+	case n < 85 && id > 0:
+		lt.send("show", http.MethodGet, fmt.Sprintf("/v1/movies/%d", id), nil)
+	default:
+		lt.mu.Lock()
+		body := map[string]interface{}{
+			"title":   title,
+			"year":    1950 + lt.rand.Intn(70),
+			"runtime": fmt.Sprintf("%d mins", 80+lt.rand.Intn(80)),
+			"genres":  []string{genre},
+		}
+		lt.mu.Unlock()
+		lt.send("create", http.MethodPost, "/v1/movies", body)
+	}
+}
+
+// randomTitle returns a random movie title. The caller must hold the mutex.
+func (lt *loadtest) randomTitle() string {
+	words := make([]string, 1+lt.rand.Intn(3))
+	for i := range words {
+		word := loadtestWords[lt.rand.Intn(len(loadtestWords))]
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// statsFor returns the stats for an endpoint, creating them if this is its first
+// request. The caller must hold the mutex.
+func (lt *loadtest) statsFor(endpoint string) *endpointStats {
+	s, ok := lt.stats[endpoint]
+	if !ok {
+		s = &endpointStats{statuses: make(map[int]int)}
+		lt.stats[endpoint] = s
+	}
+	return s
+}
+
+// send makes a request to the API and records the outcome against the endpoint name. A
+// request which can't be made at all is counted as an error, like one which fails.
+func (lt *loadtest) send(endpoint, method, path string, body interface{}) {
+	var reqBody io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			lt.mu.Lock()
+			lt.statsFor(endpoint).errors++
+			lt.mu.Unlock()
+			return
+		}
+		reqBody = bytes.NewReader(js)
+	}
+	req, err := http.NewRequest(method, lt.target+path, reqBody)
+	if err != nil {
+		lt.mu.Lock()
+		lt.statsFor(endpoint).errors++
+		lt.mu.Unlock()
+		return
+	}
+	if lt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+lt.token)
+	}
+
+	start := time.Now()
+	res, err := lt.client.Do(req)
+	latency := time.Since(start)
+
+	var created struct {
+		Movie struct {
+			ID int64 `json:"id"`
+		} `json:"movie"`
+	}
+	status := 0
+	if err == nil {
+		status = res.StatusCode
+		if endpoint == "create" && status == http.StatusCreated {
+			json.NewDecoder(res.Body).Decode(&created)
+		} else {
+			io.Copy(io.Discard, res.Body)
+		}
+		res.Body.Close()
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	s := lt.statsFor(endpoint)
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+	s.statuses[status]++
+	// Remember the IDs of created movies, so that the show endpoint has something to
+	// fetch.
+	if created.Movie.ID > 0 {
+		lt.ids = append(lt.ids, created.Movie.ID)
+	}
+}
+
+// report writes a table of the results for each endpoint to w.
+func (lt *loadtest) report(w io.Writer, elapsed time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tREQUESTS\tERRORS\tP50\tP90\tP95\tP99\tMAX\tSTATUSES")
+	endpoints := make([]string, 0, len(lt.stats))
+	for name := range lt.stats {
+		endpoints = append(endpoints, name)
+	}
+	sort.Strings(endpoints)
+	total := 0
+	for _, name := range endpoints {
+		s := lt.stats[name]
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		var statuses []string
+		for status, count := range s.statuses {
+			statuses = append(statuses, fmt.Sprintf("%d=%d", status, count))
+		}
+		sort.Strings(statuses)
+		total += len(s.latencies) + s.errors
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name, len(s.latencies)+s.errors, s.errors,
+			percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 95),
+			percentile(s.latencies, 99), percentile(s.latencies, 100), strings.Join(statuses, " "))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d requests in %s (%.1f req/s), %d dropped at the in-flight limit\n",
+		total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), lt.dropped)
+}
+
+// percentile returns the p'th percentile of a sorted slice of durations, using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(float64(len(sorted))*p/100+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank].Round(time.Microsecond)
+}
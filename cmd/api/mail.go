@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errMailQueueFull is returned by sendMail() when the mail queue stays full for longer
+// than the enqueue timeout.
+var errMailQueueFull = errors.New("mail queue is full")
+
+// The mailJob type holds the arguments for a single call to app.mailer.Send().
+type mailJob struct {
+	recipient    string
+	templateFile string
+	data         interface{}
+}
+
+// The mailQueue type is a bounded queue of outgoing email, which is consumed by a fixed
+// number of worker goroutines. Previously we sent each email in its own background
+// goroutine, which meant that if the mail provider was slow or down, every request which
+// sent an email left another goroutine behind, with no limit. Now a slow mail provider
+// just means that the queue fills up, and then handlers wait (briefly) for space.
+type mailQueue struct {
+	jobs    chan mailJob
+	timeout time.Duration
+	mu      sync.RWMutex
+	closed  bool
+}
+
+// startMailQueue creates the mail queue and starts its workers. The workers are tracked
+// by the application WaitGroup, so that on shutdown serve() waits for any queued email
+// to be sent once the queue has been closed.
+func (app *application) startMailQueue() {
+	app.mailQueue = &mailQueue{
+		jobs:    make(chan mailJob, app.config.smtp.queueSize),
+		timeout: app.config.smtp.enqueueTimeout,
+	}
+	for i := 0; i < app.config.smtp.workers; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			for job := range app.mailQueue.jobs {
+				app.deliverMail(job)
+			}
+		}()
+	}
+}
+
+// deliverMail sends a queued email, logging (rather than returning) any error as there
+// is nobody left to return it to. A panic is also logged, so that a bad template can't
+// bring down a worker.
+func (app *application) deliverMail(job mailJob) {
+	logger := app.logger.Component("mailer")
+	defer func() {
+		if err := recover(); err != nil {
+			logger.PrintError(fmt.Errorf("%s", err), nil)
+		}
+	}()
+	properties := map[string]string{
+		"recipient": job.recipient,
+		"template":  job.templateFile,
+	}
+	logger.PrintDebug("sending email", properties)
+	start := time.Now()
+	err := app.mailer.Send(job.recipient, job.templateFile, job.data)
+	if err != nil {
+		logger.PrintError(err, properties)
+		return
+	}
+	logger.PrintDebug("email sent", map[string]string{
+		"recipient": job.recipient,
+		"template":  job.templateFile,
+		"duration":  time.Since(start).String(),
+	})
+}
+
+// sendMail adds an email to the mail queue. If the queue is full, it blocks for up to
+// the enqueue timeout waiting for space, and returns errMailQueueFull if there still
+// isn't any.
+func (app *application) sendMail(recipient, templateFile string, data interface{}) error {
+	q := app.mailQueue
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errMailQueueFull
+	}
+	job := mailJob{recipient: recipient, templateFile: templateFile, data: data}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case q.jobs <- job:
+		return nil
+	case <-timer.C:
+		return errMailQueueFull
+	}
+}
+
+// close stops the mail queue from accepting any more email. The workers exit once they
+// have sent everything that's already in the queue.
+func (q *mailQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// mailPreviewData returns the sample data that each email template is rendered with by
+// the preview endpoint. It has the same shape as the data the template is sent with,
+// so a new template needs an entry here to be previewed.
+func (app *application) mailPreviewData() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"user_welcome.tmpl": map[string]interface{}{
+			"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+			"userID":          123,
+		},
+		"user_export.tmpl": map[string]interface{}{
+			"name":   "Alice Smith",
+			"link":   fmt.Sprintf("%s/v1/exports/1/%d.sample-signature", app.config.baseURL, now.Add(24*time.Hour).Unix()),
+			"expiry": now.Add(24 * time.Hour).UTC().Format(time.RFC1123),
+		},
+		"security_alert.tmpl": securityAlert{
+			Event:     "login_failed",
+			Count:     25,
+			Window:    (10 * time.Minute).String(),
+			Threshold: 20,
+			Latest:    &data.SecurityEvent{ID: 1, CreatedAt: now, Event: "login_failed", Email: "alice@example.com", IP: "203.0.113.7"},
+		},
+	}
+}
+
+// The previewMailHandler renders an email template with sample data (see
+// mailPreviewData()), so that templates can be worked on without sending any email.
+// The template can be named with or without its .tmpl extension. By default the HTML
+// body is returned, for viewing in a browser; format=text returns the subject and the
+// plain-text body, and format=json returns all three parts. Together with
+// -smtp-template-dir, which reloads the templates from disk, changes show up on the
+// next refresh.
+func (app *application) previewMailHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("template")
+	if !strings.HasSuffix(name, ".tmpl") {
+		name += ".tmpl"
+	}
+	sample, ok := app.mailPreviewData()[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "html" && format != "text" && format != "json" {
+		app.failedValidationResponse(w, r, map[string]string{"format": "must be html, text or json"})
+		return
+	}
+	message, err := app.mailer.Render(name, sample)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		app.notFoundResponse(w, r)
+		return
+	case err != nil:
+		// A template which doesn't parse or execute is most likely being edited, so
+		// the error is shown rather than hidden behind a 500.
+		app.failedValidationResponse(w, r, map[string]string{"template": err.Error()})
+		return
+	}
+	switch format {
+	case "json":
+		err = app.writeJSON(w, http.StatusOK, envelope{"email": message}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Subject: %s\n\n%s", message.Subject, message.PlainBody)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(message.HTMLBody))
+	}
+}
@@ -2,10 +2,20 @@ package main
 
 import (
 	"context"      // New import
+	"crypto/rand"
 	"database/sql" // New import
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// Import the pq driver so that it can register itself with the database/sql
@@ -13,54 +23,308 @@ import (
 	// compiler complaining that the package isn't being used.
 	// _ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/database"
+	"greenlight.alexedwards.net/internal/events"
+	"greenlight.alexedwards.net/internal/fixtures"
 	"greenlight.alexedwards.net/internal/jsonlog"
+	"greenlight.alexedwards.net/internal/jwt"
 	"greenlight.alexedwards.net/internal/mailer"
+	"greenlight.alexedwards.net/internal/openapi"
+	"greenlight.alexedwards.net/internal/redis"
+	"greenlight.alexedwards.net/internal/storage"
 )
-const version = "1.0.0"
 // Add maxOpenConns, maxIdleConns and maxIdleTime fields to hold the configuration
 // settings for the connection pool.
 type config struct {
 	port int
 	env  string
 	db   struct {
+			driver       string
 			dsn          string
 			maxOpenConns int
 			maxIdleConns int
+			minIdleConns int
+			cache        bool
+			slowQuery    struct {
+					threshold  time.Duration
+					explain    bool
+					sampleRate float64
+			}
 			maxIdleTime  string
+			breaker      struct {
+					threshold int
+					cooldown  time.Duration
+			}
+	}
+	redis struct {
+			url      string
+			poolSize int
+			timeout  time.Duration
+			authTTL  time.Duration
 	}
 	limiter struct {
 			enabled bool
 			rps     float64
 			burst   int
 	}
+	admin struct {
+			allowCIDRs []*net.IPNet
+	}
+	security struct {
+			alertThresholds string
+			alertWebhook    string
+			alertEmail      string
+	}
+	login struct {
+			guard         bool
+			captchaAfter  int
+			captchaURL    string
+			captchaSecret string
+	}
+	jwt struct {
+			keys   string
+			issuer string
+	}
+	cookies struct {
+			enabled    bool
+			secure     bool
+			domain     string
+			csrfExempt []string
+	}
 	smtp struct {
-			host     string
-			port     int
-			username string
-			password string
-			sender   string
+			host           string
+			port           int
+			username       string
+			password       string
+			sender         string
+			queueSize      int
+			workers        int
+			enqueueTimeout time.Duration
+			templateDir    string
+	}
+	jobs struct {
+			queueSize int
+			workers   int
+	}
+	events struct {
+			publisher string
+			url       string
+			prefix    string
+			interval  time.Duration
+			timeout   time.Duration
+	}
+	log struct {
+			output     string
+			format     string
+			level      string
+			debug      string
+			buffer     int
+			overflow   string
+			syslogAddr string
+			file       string
+			maxSize    int
+			maxAge     time.Duration
+			maxBackups int
+			compress   bool
+			sample     string
+			ship       struct {
+					url           string
+					format        string
+					labels        string
+					flushInterval time.Duration
+					batchSize     int
+					retries       int
+			}
+			sentryDSN  string
+	}
+	fixtures      string
+	runtimeFormat string
+	envelope      bool
+	tokenPepper   string
+	password      struct {
+			algorithm         string
+			bcryptCost        int
+			argon2Memory      uint
+			argon2Time        uint
+			argon2Parallelism uint
+	}
+	openapi       struct {
+			validate bool
+	}
+	similar       struct {
+			genreWeight float64
+			yearWeight  float64
+			yearScale   float64
+	}
+	views         struct {
+			sampleRate       float64
+			flushInterval    time.Duration
+			trendingInterval time.Duration
+	}
+	deletion      struct {
+			grace         time.Duration
+			purgeInterval time.Duration
+			movieGrace    time.Duration
+	}
+	partitions    struct {
+			interval               time.Duration
+			securityEventRetention time.Duration
+	}
+	registration  struct {
+			mode string
+	}
+	publicReads   bool
+	usage         struct {
+			flushInterval time.Duration
+	}
+	metering      struct {
+			webhook string
+			secret  string
+	}
+	baseURL       string
+	exports       struct {
+			signingKey string
+	}
+	storage       struct {
+			backend string
+			dir     string
+			urlTTL  time.Duration
+			s3      storage.S3Config
+	}
+	reusePort     bool
+	shutdown      struct {
+			drainDelay time.Duration
+			timeout    time.Duration
+	}
+	shed          struct {
+			maxInFlight int
+			p99         time.Duration
+	}
+	tenancy       struct {
+			mode   string
+			header string
+			domain string
 	}
 }
 // Include a sync.WaitGroup in the application struct. The zero-value for a
 // sync.WaitGroup type is a valid, useable, sync.WaitGroup with a 'counter' value of 0,
 // so we don't need to do anything else to initialize it before we can use it.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *jsonlog.Logger
+	models      data.Models
+	mailer      mailer.Mailer
+	mailQueue   *mailQueue
+	jobQueue    *jobQueue
+	publisher   events.Publisher
+	logins      *loginGuard
+	alerts      *securityAlerts
+	captcha     captchaVerifier
+	jwtKeys     *jwt.KeySet
+	views       *viewCounter
+	usage       *usageCounter
+	spec        *openapi.Spec
+	storage     storage.Store
+	shedder     *loadShedder
+	wg          sync.WaitGroup
+	// db is the connection pool, which the readiness probe checks. It's nil for the
+	// memory driver.
+	db          *sql.DB
+	draining    atomic.Bool
+	// leader is whether this instance was the leader the last time a singleton job
+	// checked.
+	leader      atomic.Bool
+	// quit receives the signals which shut the server down or restart it.
+	quit        chan os.Signal
+	schemaReady atomic.Bool
+	// routeTable is the GET routes, recorded by routes() (see routeLink()).
+	routeTable  routeTable
 }
 func main() {
+	// If the first command-line argument is the name of a subcommand, then run that
+	// instead of starting the API server.
+	if len(os.Args) > 1 {
+			logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+			switch os.Args[1] {
+			case "fixtures":
+					err := fixturesCommand(os.Args[2:])
+					if err != nil {
+							logger.PrintFatal(err, nil)
+					}
+					logger.PrintInfo("fixtures loaded", nil)
+					return
+			case "loadtest":
+					err := loadtestCommand(os.Args[2:])
+					if err != nil {
+							logger.PrintFatal(err, nil)
+					}
+					return
+			}
+	}
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.db.driver, "db-driver", "postgres", "Database driver (postgres|memory)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.IntVar(&cfg.db.minIdleConns, "db-min-idle-conns", 0, "PostgreSQL connections to establish at startup")
+	flag.BoolVar(&cfg.db.cache, "db-cache", false, "Cache movies in memory, invalidated by PostgreSQL notifications")
+	// With a Redis server, the token and permission lookups which authenticate requests
+	// are cached there, shared by every instance.
+	flag.StringVar(&cfg.redis.url, "redis-url", os.Getenv("GREENLIGHT_REDIS_URL"), "Redis URL for the auth cache, like redis://:password@localhost:6379/0 (disabled if empty)")
+	flag.IntVar(&cfg.redis.poolSize, "redis-pool-size", 10, "Maximum idle Redis connections")
+	flag.DurationVar(&cfg.redis.timeout, "redis-timeout", 100*time.Millisecond, "Timeout for each Redis command")
+	flag.DurationVar(&cfg.redis.authTTL, "redis-auth-ttl", 30*time.Second, "How long the auth cache keeps token and permission lookups")
+	// Queries which take longer than the threshold are logged. Optionally, a sample of
+	// them are also run again with EXPLAIN ANALYZE, and the plan is added to the log
+	// entry.
+	flag.DurationVar(&cfg.db.slowQuery.threshold, "db-slow-query-threshold", 500*time.Millisecond, "Log PostgreSQL queries slower than this (0 to disable)")
+	flag.BoolVar(&cfg.db.slowQuery.explain, "db-explain-slow-queries", false, "Capture query plans for slow queries")
+	flag.Float64Var(&cfg.db.slowQuery.sampleRate, "db-explain-sample-rate", 0.01, "Fraction of slow queries to capture query plans for")
+	// After enough consecutive connection failures or timeouts, queries fail straight
+	// away (with 503 responses) until a probe connection succeeds, rather than every
+	// request waiting for its own timeout while the database is down.
+	flag.IntVar(&cfg.db.breaker.threshold, "db-breaker-threshold", 5, "Consecutive PostgreSQL failures before the circuit breaker opens (0 disables)")
+	flag.DurationVar(&cfg.db.breaker.cooldown, "db-breaker-cooldown", 5*time.Second, "How long the PostgreSQL circuit breaker stays open before probing")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	// The debug and admin routes are only available to clients in these ranges.
+	cfg.admin.allowCIDRs, _ = parseCIDRs("127.0.0.1,::1")
+	flag.Func("admin-allow-cidrs", "Comma-separated CIDR ranges allowed to use the debug and admin routes (default 127.0.0.1,::1)", func(val string) error {
+			var err error
+			cfg.admin.allowCIDRs, err = parseCIDRs(val)
+			return err
+	})
+	credentialFlags(flag.CommandLine, &cfg)
+	// Failed logins are tracked by IP and email address, and are progressively delayed.
+	// If a CAPTCHA service is configured, clients have to solve a CAPTCHA as well once
+	// there have been enough failures.
+	flag.BoolVar(&cfg.login.guard, "login-guard", true, "Delay repeated failed logins from the same IP or for the same email")
+	flag.IntVar(&cfg.login.captchaAfter, "login-captcha-after", 5, "Require a CAPTCHA after this many failed logins")
+	flag.StringVar(&cfg.login.captchaURL, "login-captcha-url", "", "CAPTCHA siteverify URL (e.g. https://hcaptcha.com/siteverify)")
+	flag.StringVar(&cfg.login.captchaSecret, "login-captcha-secret", os.Getenv("GREENLIGHT_CAPTCHA_SECRET"), "CAPTCHA secret key")
+	// Security events are recorded in the security_events table, and an alert is sent to
+	// the webhook and/or email address when there are too many of one kind of event.
+	flag.StringVar(&cfg.security.alertThresholds, "security-alert-thresholds", "login_failed=100/5m,login_throttled=20/5m,captcha_failed=50/5m,csrf_rejected=20/5m,token_reuse=1/1h", "Comma-separated event=count/window security alert thresholds")
+	flag.StringVar(&cfg.security.alertWebhook, "security-alert-webhook", "", "URL to post security alerts to")
+	flag.StringVar(&cfg.security.alertEmail, "security-alert-email", "", "Email address to send security alerts to")
+	// Browser clients can ask for their authentication token to be set in a cookie,
+	// rather than returned in the response. Unsafe requests authenticated that way need
+	// a CSRF token, apart from those in the route groups listed in -csrf-exempt.
+	flag.BoolVar(&cfg.cookies.enabled, "cookie-sessions", false, "Allow authentication with session cookies")
+	flag.BoolVar(&cfg.cookies.secure, "cookie-secure", true, "Only send session cookies over HTTPS")
+	flag.StringVar(&cfg.cookies.domain, "cookie-domain", "", "Domain for session cookies (defaults to the host of the request)")
+	flag.Func("csrf-exempt", "Comma-separated route prefixes which don't need a CSRF token (e.g. /v1/webhooks)", func(val string) error {
+			cfg.cookies.csrfExempt = strings.Split(val, ",")
+			return nil
+	})
+	// Clients can ask for a JWT instead of an opaque authentication token, if there's a
+	// key rotation schedule. The schedule is reloaded whenever the process gets SIGHUP.
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", "", "JWT signing key rotation schedule file (enables JWT authentication tokens)")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "greenlight", "Issuer for JWT authentication tokens")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	// Read the SMTP server configuration settings into the config struct, using the
@@ -72,33 +336,415 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "eb6adbcac0cbab", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "75c9348a74ca80", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
+	// In development the email templates can be loaded from disk every time they're
+	// used, rather than from the copies embedded in the binary, so that changes to them
+	// (previewed at /debug/mail/preview/:template) don't need a restart.
+	flag.StringVar(&cfg.smtp.templateDir, "smtp-template-dir", "", "Load email templates from this directory on every send, like internal/mailer/templates (development only)")
+	// Outgoing email goes through a bounded queue, consumed by a fixed number of
+	// workers. If the queue is full, handlers wait for up to the enqueue timeout for
+	// space before giving up on the email.
+	flag.IntVar(&cfg.smtp.queueSize, "smtp-queue-size", 100, "Maximum number of queued emails")
+	flag.IntVar(&cfg.smtp.workers, "smtp-workers", 2, "Number of workers sending queued emails")
+	flag.DurationVar(&cfg.smtp.enqueueTimeout, "smtp-enqueue-timeout", time.Second, "Maximum time to wait for space in the mail queue")
+	// Long operations, like large imports, are run as jobs by a fixed number of
+	// workers. A job is turned away if the queue is full.
+	flag.IntVar(&cfg.jobs.queueSize, "job-queue-size", 100, "Maximum number of queued jobs")
+	flag.IntVar(&cfg.jobs.workers, "job-workers", 2, "Number of workers running queued jobs")
+	// The movie and user lifecycle events are published to a message broker for other
+	// services to consume: NATS, or Kafka through a Kafka REST Proxy.
+	flag.StringVar(&cfg.events.publisher, "events-publisher", "", "Message broker for lifecycle events (nats|kafka, disabled if empty)")
+	flag.StringVar(&cfg.events.url, "events-url", os.Getenv("GREENLIGHT_EVENTS_URL"), "Broker URL, like nats://localhost:4222 or http://localhost:8082 for a Kafka REST proxy")
+	flag.StringVar(&cfg.events.prefix, "events-prefix", "greenlight", "Prefix of the NATS subjects or Kafka topics that events are published on")
+	flag.DurationVar(&cfg.events.interval, "events-interval", time.Second, "Interval between checks for new events to publish")
+	flag.DurationVar(&cfg.events.timeout, "events-timeout", 5*time.Second, "Timeout for publishing each batch of events")
+	// Read the output format for movie runtimes. By default we keep the "<runtime> mins"
+	// string format, but clients which would rather work with plain numbers can have a
+	// raw integer instead.
+	flag.StringVar(&cfg.runtimeFormat, "runtime-format", "mins", "Runtime output format (mins|integer)")
+	// Responses hold their resource in an envelope, like {"movie": {...}}, unless this
+	// is turned off. Clients can choose for themselves with ?envelope= or X-Envelope.
+	flag.BoolVar(&cfg.envelope, "envelope", true, "Wrap resources and arrays in an envelope object in responses")
+	// Read the weights for the similar movies scoring function.
+	flag.Float64Var(&cfg.similar.genreWeight, "similar-genre-weight", 2, "Weight of the genre overlap in similar movie scores")
+	flag.Float64Var(&cfg.similar.yearWeight, "similar-year-weight", 1, "Weight of the release year proximity in similar movie scores")
+	flag.Float64Var(&cfg.similar.yearScale, "similar-year-scale", 10, "Number of years apart at which the year proximity score is halved")
+	// Read the settings for counting movie views. Views are sampled and written in
+	// batches, and the trending movies are worked out from them periodically.
+	flag.Float64Var(&cfg.views.sampleRate, "views-sample-rate", 1, "Fraction of movie views to count, from 0 (disabled) to 1")
+	flag.DurationVar(&cfg.views.flushInterval, "views-flush-interval", 10*time.Second, "How often to write view counts to the database")
+	flag.DurationVar(&cfg.views.trendingInterval, "views-trending-interval", 5*time.Minute, "How often to work out the trending movies")
+	// Read the settings for deleted accounts and movies, which are kept for a grace
+	// period before they're purged.
+	flag.DurationVar(&cfg.deletion.grace, "user-deletion-grace", 30*24*time.Hour, "How long to keep deleted accounts before purging their personal data")
+	flag.DurationVar(&cfg.deletion.purgeInterval, "user-purge-interval", time.Hour, "How often to purge deleted accounts and movies")
+	flag.DurationVar(&cfg.deletion.movieGrace, "movie-deletion-grace", 30*24*time.Hour, "How long to keep deleted movies before purging them")
+	// The security events and view counts are partitioned by month, and old partitions
+	// are moved out of the way into archive tables.
+	flag.DurationVar(&cfg.partitions.interval, "partition-interval", 6*time.Hour, "How often to create upcoming partitions and archive old ones")
+	flag.DurationVar(&cfg.partitions.securityEventRetention, "security-event-retention", 365*24*time.Hour, "How long to keep security events before archiving them (0 keeps them all)")
+	// Registration can be restricted to people with an invite code, for closed betas.
+	flag.StringVar(&cfg.registration.mode, "registration", "open", "Registration mode (open|invite)")
+	// Let anonymous clients read the catalog, while writes still need an account.
+	flag.BoolVar(&cfg.publicReads, "public-reads", false, "Allow unauthenticated GET requests to the movie endpoints")
+	flag.DurationVar(&cfg.usage.flushInterval, "usage-flush-interval", time.Minute, "How often to write per-user API usage counts to the database (0 disables usage counting)")
+	// Each day's API key usage can be pushed to a billing system once the day is over.
+	flag.StringVar(&cfg.metering.webhook, "metering-webhook", "", "URL to POST each day's API key usage rollups to (disabled if empty)")
+	flag.StringVar(&cfg.metering.secret, "metering-webhook-secret", os.Getenv("GREENLIGHT_METERING_WEBHOOK_SECRET"), "Secret used to sign the metering webhook requests")
+	// Links in emails (like the download links for data exports) start with the base URL,
+	// and the download links are signed with the export signing key. So are the links to
+	// the files in local storage.
+	flag.StringVar(&cfg.baseURL, "base-url", "", "Base URL of the API for links in emails (defaults to http://localhost:<port>)")
+	flag.StringVar(&cfg.exports.signingKey, "export-signing-key", os.Getenv("GREENLIGHT_EXPORT_SIGNING_KEY"), "Secret used to sign data export download links and local file links")
+	// Uploaded files, like movie posters, are kept on the local disk, or in an S3 bucket
+	// (or MinIO, or any other S3-compatible object store). Clients download them, and
+	// can upload them, with presigned URLs which expire after the URL TTL.
+	flag.StringVar(&cfg.storage.backend, "storage", "local", "Storage backend for uploaded files (local|s3)")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory for uploaded files with the local storage backend")
+	flag.DurationVar(&cfg.storage.urlTTL, "storage-url-ttl", 15*time.Minute, "How long presigned download and upload URLs are valid for")
+	flag.StringVar(&cfg.storage.s3.Endpoint, "s3-endpoint", os.Getenv("GREENLIGHT_S3_ENDPOINT"), "S3 endpoint URL (defaults to https://s3.<region>.amazonaws.com)")
+	flag.StringVar(&cfg.storage.s3.Region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&cfg.storage.s3.Bucket, "s3-bucket", os.Getenv("GREENLIGHT_S3_BUCKET"), "S3 bucket for uploaded files")
+	flag.StringVar(&cfg.storage.s3.AccessKey, "s3-access-key", os.Getenv("GREENLIGHT_S3_ACCESS_KEY"), "S3 access key ID")
+	flag.StringVar(&cfg.storage.s3.SecretKey, "s3-secret-key", os.Getenv("GREENLIGHT_S3_SECRET_KEY"), "S3 secret access key")
+	flag.BoolVar(&cfg.storage.s3.PathStyle, "s3-path-style", false, "Put the bucket in the path of S3 URLs rather than the host name (for MinIO)")
+	flag.DurationVar(&cfg.storage.s3.Timeout, "s3-timeout", 30*time.Second, "Timeout for each S3 request")
+	// For restarts without refused connections, the listener can be inherited (with
+	// systemd socket activation, or from the old process on SIGUSR2), or bound with
+	// SO_REUSEPORT so that the new process can bind it before the old one exits.
+	flag.BoolVar(&cfg.reusePort, "reuse-port", false, "Set SO_REUSEPORT on the listener")
+	// On shutdown, readiness fails straight away but the server keeps serving for the
+	// drain delay, so that load balancers have time to notice before connections are
+	// closed. Then in-flight requests get up to the shutdown timeout to finish.
+	flag.DurationVar(&cfg.shutdown.drainDelay, "shutdown-drain-delay", 0, "How long to keep serving after failing readiness on shutdown")
+	flag.DurationVar(&cfg.shutdown.timeout, "shutdown-timeout", 5*time.Second, "Maximum time to wait for in-flight requests on shutdown")
+	// Under overload, listings and exports are rejected so that everything else stays
+	// responsive.
+	flag.IntVar(&cfg.shed.maxInFlight, "shed-max-in-flight", 200, "Shed low-priority requests when more than this many requests are in flight (0 disables)")
+	flag.DurationVar(&cfg.shed.p99, "shed-p99", 2*time.Second, "Shed low-priority requests when the p99 latency of the others is over this (0 disables)")
+	// With tenancy enabled, each request only sees the movies and users of the tenant
+	// named by its header or subdomain, so one deployment can serve several catalogs.
+	flag.StringVar(&cfg.tenancy.mode, "tenancy", "off", "How requests identify their tenant (off|header|subdomain)")
+	flag.StringVar(&cfg.tenancy.header, "tenant-header", "X-Tenant", "Request header holding the tenant slug for -tenancy=header")
+	flag.StringVar(&cfg.tenancy.domain, "tenant-domain", "", "Domain whose subdomains are the tenant slugs for -tenancy=subdomain")
+	flag.StringVar(&cfg.fixtures, "fixtures", "", "Comma-separated list of fixture files to load at startup")
+	flag.BoolVar(&cfg.openapi.validate, "openapi-validate", false, "Validate requests against the OpenAPI specification")
+	// By default we write log entries to stdout, but they can be written to a file
+	// instead (which is rotated when it gets too large or too old), or sent to syslog
+	// or the systemd journal.
+	flag.StringVar(&cfg.log.output, "log-output", "", "Log output (stdout|file|syslog|journald), defaults to file if -log-file is set and stdout otherwise")
+	flag.StringVar(&cfg.log.format, "log-format", "", "Log format for stdout and file output (json|pretty), defaults to pretty in development and json otherwise")
+	// Entries written to stdout or a file go through a buffer, which is written out by a
+	// separate goroutine, so that a slow consumer can't hold up requests.
+	flag.IntVar(&cfg.log.buffer, "log-buffer", 4096, "Number of log entries to buffer for stdout and file output (0 to write synchronously)")
+	flag.StringVar(&cfg.log.overflow, "log-overflow", "drop", "What to do when the log buffer is full (drop|block)")
+	flag.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (trace|debug|info|error|fatal)")
+	flag.StringVar(&cfg.log.debug, "log-debug", "", "Comma-separated components to log at the DEBUG level, or another level with component=level (e.g. data,mailer=trace)")
+	flag.StringVar(&cfg.log.syslogAddr, "log-syslog-addr", "", "Syslog server address (udp://host:port or tcp://host:port), defaults to the local syslog daemon")
+	flag.StringVar(&cfg.log.file, "log-file", "", "Write logs to this file instead of stdout")
+	flag.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Rotate the log file when it reaches this size in megabytes (0 for no limit)")
+	flag.DurationVar(&cfg.log.maxAge, "log-max-age", 24*time.Hour, "Rotate the log file after this long (0 for no limit)")
+	flag.IntVar(&cfg.log.maxBackups, "log-max-backups", 7, "Number of rotated log files to keep (0 to keep all)")
+	flag.BoolVar(&cfg.log.compress, "log-compress", true, "Compress rotated log files with gzip")
+	// High-volume log entries can be sampled, so that only 1 in N of them are logged.
+	// Errors are always logged, whatever their message.
+	flag.StringVar(&cfg.log.sample, "log-sample", "rate limit exceeded=100", "Comma-separated message=N pairs of log entries to sample 1 in N of")
+	// Log entries can also be shipped straight to Loki or Elasticsearch, as well as
+	// being written to the log output, for deployments without a log shipper.
+	flag.StringVar(&cfg.log.ship.url, "log-ship-url", "", "Ship logs to this Loki push or Elasticsearch bulk URL")
+	flag.StringVar(&cfg.log.ship.format, "log-ship-format", "loki", "Log shipping format (loki|elasticsearch)")
+	flag.StringVar(&cfg.log.ship.labels, "log-ship-labels", "app=greenlight", "Comma-separated name=value labels to add to shipped logs (env is always added)")
+	flag.DurationVar(&cfg.log.ship.flushInterval, "log-ship-flush-interval", time.Second, "How often to ship batches of logs")
+	flag.IntVar(&cfg.log.ship.batchSize, "log-ship-batch-size", 500, "Maximum number of log entries in each shipped batch")
+	flag.IntVar(&cfg.log.ship.retries, "log-ship-retries", 3, "Number of times to retry shipping a batch of logs")
+	// Errors (everything logged at the ERROR level or above, which includes panics and
+	// the errors behind 500 responses) can be reported to Sentry, or anything else which
+	// accepts Sentry's events.
+	flag.StringVar(&cfg.log.sentryDSN, "sentry-dsn", os.Getenv("SENTRY_DSN"), "Report errors to the Sentry project with this DSN (disabled if empty)")
 	flag.Parse()
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
-	db, err := openDB(cfg)
+	logger, closeLog, err := openLogger(cfg)
+	if err != nil {
+			jsonlog.New(os.Stdout, jsonlog.LevelInfo).PrintFatal(err, nil)
+	}
+	defer closeLog()
+	runtimeFormat, err := data.ParseRuntimeFormat(cfg.runtimeFormat)
 	if err != nil {
 			logger.PrintFatal(err, nil)
 	}
-	defer db.Close()
-	logger.PrintInfo("database connection pool established", nil)
+	data.OutputRuntimeFormat = runtimeFormat
+	if cfg.baseURL == "" {
+			cfg.baseURL = fmt.Sprintf("http://localhost:%d", cfg.port)
+	}
+	cfg.baseURL = strings.TrimSuffix(cfg.baseURL, "/")
+	// Without a signing key, use a random one. The download links then only work on
+	// this instance, and only until it restarts.
+	if cfg.exports.signingKey == "" {
+			key := make([]byte, 32)
+			_, err := rand.Read(key)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			cfg.exports.signingKey = hex.EncodeToString(key)
+			logger.PrintInfo("no -export-signing-key set, data export links will stop working on restart", nil)
+	}
+	if cfg.similar.yearScale <= 0 {
+			logger.PrintFatal(errors.New("-similar-year-scale must be greater than zero"), nil)
+	}
+	if cfg.partitions.interval <= 0 {
+			logger.PrintFatal(errors.New("-partition-interval must be greater than zero"), nil)
+	}
+	if cfg.storage.urlTTL < time.Second || cfg.storage.urlTTL > storage.MaxPresignTTL {
+			logger.PrintFatal(errors.New("-storage-url-ttl must be between 1s and 168h"), nil)
+	}
+	data.MovieSimilarity = data.WeightedSimilarity{
+			GenreWeight: cfg.similar.genreWeight,
+			YearWeight:  cfg.similar.yearWeight,
+			YearScale:   cfg.similar.yearScale,
+	}
+	err = setCredentialHashing(cfg)
+	if err != nil {
+			logger.PrintFatal(err, nil)
+	}
+	// Set up the models for the configured database driver. The memory driver doesn't
+	// need a database at all, but all data is lost when the application exits.
+	var db *sql.DB
+	var models data.Models
+	if cfg.registration.mode != "open" && cfg.registration.mode != "invite" {
+			logger.PrintFatal(fmt.Errorf("unknown registration mode %q", cfg.registration.mode), nil)
+	}
+	switch cfg.tenancy.mode {
+	case "off", "header":
+	case "subdomain":
+			if cfg.tenancy.domain == "" {
+					logger.PrintFatal(errors.New("-tenant-domain must be set for -tenancy=subdomain"), nil)
+			}
+	default:
+			logger.PrintFatal(fmt.Errorf("unknown tenancy mode %q", cfg.tenancy.mode), nil)
+	}
+	switch cfg.db.driver {
+	case "postgres":
+			db, err = openDB(cfg, logger)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			defer db.Close()
+			logger.PrintInfo("database connection pool established", map[string]string{
+					"idle_conns": fmt.Sprint(db.Stats().Idle),
+			})
+			models = data.NewModels(db)
+			// If caching is enabled, use the cached models instead. These listen for
+			// notifications from every instance of the application, so that the caches
+			// stay coherent across all of them.
+			if cfg.db.cache {
+					var listener *data.ChangeListener
+					models, listener, err = data.NewCachedModels(db, cfg.db.dsn, func(err error) {
+							logger.PrintError(err, nil)
+					})
+					if err != nil {
+							logger.PrintFatal(err, nil)
+					}
+					defer listener.Close()
+					logger.PrintInfo("listening for movie changes", nil)
+			}
+	case "memory":
+			logger.PrintInfo("using in-memory models, all data will be lost on exit", nil)
+			models = data.NewMemoryModels()
+	default:
+			logger.PrintFatal(fmt.Errorf("unknown database driver %q", cfg.db.driver), nil)
+	}
+	if cfg.redis.url != "" {
+			client, err := redis.New(cfg.redis.url, cfg.redis.poolSize, cfg.redis.timeout)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			defer client.Close()
+			// The cache is optional, so if Redis is down we start anyway, and the lookups
+			// go to the database until it's back.
+			if err := client.Ping(); err != nil {
+					logger.PrintError(fmt.Errorf("connecting to redis: %w", err), nil)
+			}
+			authLogger := logger.Component("auth_cache")
+			models = models.WithAuthCache(data.NewAuthCache(client, cfg.redis.authTTL, func(err error) {
+					authLogger.PrintError(err, nil)
+			}))
+	}
+	// Load any fixture files given on the command line. This is mostly useful for
+	// seeding the in-memory models for demos and smoke tests.
+	if cfg.fixtures != "" {
+			set, err := fixtures.ReadFiles(strings.Split(cfg.fixtures, ",")...)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			err = set.Load(models)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			logger.PrintInfo("fixtures loaded", nil)
+	}
 	// Initialize a new Mailer instance using the settings from the command line
 	// flags, and add it to the application struct.
 	app := &application{
 			config: cfg,
 			logger: logger,
-			models: data.NewModels(db),
+			models: models,
+			db:     db,
 			mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
 	}
+	// Production always uses the embedded templates, which were built and tested with
+	// the binary.
+	if cfg.smtp.templateDir != "" {
+			if cfg.env != "development" {
+					logger.PrintFatal(errors.New("-smtp-template-dir can only be used in development"), nil)
+			}
+			app.mailer = app.mailer.WithTemplateDir(cfg.smtp.templateDir)
+			logger.PrintInfo("loading email templates from disk", map[string]string{"dir": cfg.smtp.templateDir})
+	}
+	// If request validation is enabled, load the embedded OpenAPI specification for
+	// the validateRequest() middleware to use.
+	if cfg.openapi.validate {
+			app.spec, err = openapi.Load()
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+	}
+	app.storage, err = openStorage(cfg)
+	if err != nil {
+			logger.PrintFatal(err, nil)
+	}
+	if cfg.shed.maxInFlight > 0 || cfg.shed.p99 > 0 {
+			app.shedder = newLoadShedder(cfg.shed.maxInFlight, cfg.shed.p99)
+	}
+	if cfg.login.guard {
+			app.logins = newLoginGuard()
+	}
+	if cfg.security.alertWebhook != "" || cfg.security.alertEmail != "" {
+			thresholds, err := parseAlertThresholds(cfg.security.alertThresholds)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			app.alerts = newSecurityAlerts(thresholds, cfg.security.alertWebhook, cfg.security.alertEmail)
+	}
+	if cfg.login.captchaURL != "" {
+			app.captcha = &siteVerifyCaptcha{url: cfg.login.captchaURL, secret: cfg.login.captchaSecret, client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	if cfg.events.publisher != "" {
+			app.publisher, err = events.Open(cfg.events.publisher, cfg.events.url, cfg.events.prefix, cfg.events.timeout)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			defer app.publisher.Close()
+	}
+	if cfg.jwt.keys != "" {
+			app.jwtKeys, err = jwt.LoadKeySet(cfg.jwt.keys)
+			if err != nil {
+					logger.PrintFatal(err, nil)
+			}
+			app.reloadJWTKeysOnHangup()
+	}
+	app.startMailQueue()
+	app.startJobQueue()
+	app.startViewCounter()
+	app.startUsageCounter()
+	app.startMeteringPush()
+	app.startUserPurge()
+	app.startMoviePurge()
+	app.startPartitionMaintenance()
+	app.startEventRelay()
 	err = app.serve()
 	if err != nil {
 			logger.PrintFatal(err, nil)
 	}
 }
 
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// The credentialFlags() function defines the flags for hashing passwords and tokens on
+// fs. They're shared by the API server and the fixtures subcommand, so that the users
+// and tokens which the fixtures create work against a server run with the same flags.
+func credentialFlags(fs *flag.FlagSet, cfg *config) {
+	// New passwords are hashed with bcrypt by default, or with Argon2id. Existing hashes
+	// which don't match these settings are replaced when their users next log in.
+	fs.StringVar(&cfg.password.algorithm, "password-hash", "bcrypt", "Password hashing algorithm (bcrypt|argon2id)")
+	fs.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", 12, "bcrypt cost factor")
+	fs.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", 64*1024, "Argon2id memory in KiB")
+	fs.UintVar(&cfg.password.argon2Time, "password-argon2-time", 3, "Argon2id number of passes")
+	fs.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", 2, "Argon2id number of threads")
+	fs.StringVar(&cfg.tokenPepper, "token-pepper", os.Getenv("GREENLIGHT_TOKEN_PEPPER"), "Secret mixed into token hashes (changing it invalidates all tokens)")
+}
+
+// The setCredentialHashing() function sets data.PasswordHashing and data.TokenPepper
+// from the flags defined by credentialFlags(). Settings which bcrypt or Argon2id can't
+// hash with are rejected here, rather than failing every registration and login.
+func setCredentialHashing(cfg config) error {
+	if cfg.password.algorithm != "bcrypt" && cfg.password.algorithm != "argon2id" {
+		return fmt.Errorf("unknown password hashing algorithm %q", cfg.password.algorithm)
+	}
+	if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("-password-bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if cfg.password.argon2Time < 1 || cfg.password.argon2Time > math.MaxUint32 {
+		return errors.New("-password-argon2-time must be at least 1")
+	}
+	if cfg.password.argon2Parallelism < 1 || cfg.password.argon2Parallelism > math.MaxUint8 {
+		return errors.New("-password-argon2-parallelism must be between 1 and 255")
+	}
+	// Argon2id needs at least 8KiB of memory for each thread.
+	if cfg.password.argon2Memory < 8*cfg.password.argon2Parallelism || cfg.password.argon2Memory > math.MaxUint32 {
+		return fmt.Errorf("-password-argon2-memory must be at least %d KiB (8 KiB per thread)", 8*cfg.password.argon2Parallelism)
+	}
+	data.PasswordHashing = data.PasswordParams{
+		Algorithm:         cfg.password.algorithm,
+		BcryptCost:        cfg.password.bcryptCost,
+		Argon2Memory:      uint32(cfg.password.argon2Memory),
+		Argon2Time:        uint32(cfg.password.argon2Time),
+		Argon2Parallelism: uint8(cfg.password.argon2Parallelism),
+	}
+	data.TokenPepper = []byte(cfg.tokenPepper)
+	return nil
+}
+
+// The openDB() function returns a connection pool for cfg.db.dsn. If a logger is given,
+// then slow queries are logged with it (and every query, if the data component is being
+// debugged).
+func openDB(cfg config, logger *jsonlog.Logger) (*sql.DB, error) {
+	opts := database.Options{
+			BreakerThreshold: cfg.db.breaker.threshold,
+			BreakerCooldown:  cfg.db.breaker.cooldown,
+	}
+	if logger != nil {
+			opts.OnBreakerChange = func(open bool) {
+					if open {
+							logger.PrintError(database.ErrCircuitOpen, nil)
+					} else {
+							logger.PrintInfo("database circuit breaker closed", nil)
+					}
+			}
+	}
+	var slow *slowQueryLogger
+	if logger != nil && cfg.db.slowQuery.threshold > 0 {
+			slow = newSlowQueryLogger(logger, cfg)
+			opts.SlowThreshold = cfg.db.slowQuery.threshold
+			opts.OnSlow = slow.log
+	}
+	// If the data component is being debugged, log every query. The arguments might
+	// contain personal data, so they're only included at the TRACE level.
+	if logger != nil && logger.Component("data").Enabled(jsonlog.LevelDebug) {
+			dataLogger := logger.Component("data")
+			opts.OnQuery = func(q database.Query) {
+					properties := map[string]string{
+							"query":    q.SQL,
+							"duration": q.Duration.String(),
+					}
+					if dataLogger.Enabled(jsonlog.LevelTrace) {
+							properties["args"] = fmt.Sprint(q.Args...)
+					}
+					dataLogger.PrintDebug("query", properties)
+			}
+	}
+	db, err := database.Open(cfg.db.dsn, opts)
 	if err != nil {
 			return nil, err
 	}
+	if slow != nil {
+			slow.db = db
+	}
 	// Set the maximum number of open (in-use + idle) connections in the pool. Note that
 	// passing a value less than or equal to 0 will mean there is no limit.
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
@@ -119,5 +765,241 @@ func openDB(cfg config) (*sql.DB, error) {
 	if err != nil {
 			return nil, err
 	}
+	// Pre-establish the configured number of idle connections before we return. The
+	// server doesn't start listening until this has happened, so the first burst of
+	// traffic after a deploy doesn't have to wait for new connections to be made (or
+	// queue up waiting for a free connection).
+	err = warmDB(db, cfg)
+	if err != nil {
+			db.Close()
+			return nil, err
+	}
 	return db, nil
-}
\ No newline at end of file
+}
+
+// The warmDB() function opens cfg.db.minIdleConns connections concurrently and then
+// returns them all to the pool, where they sit idle until they're needed. The number is
+// capped by the max open and max idle settings, as any connections beyond those would
+// just be closed again straight away.
+func warmDB(db *sql.DB, cfg config) error {
+	n := cfg.db.minIdleConns
+	if cfg.db.maxIdleConns > 0 && n > cfg.db.maxIdleConns {
+			n = cfg.db.maxIdleConns
+	}
+	if cfg.db.maxOpenConns > 0 && n > cfg.db.maxOpenConns {
+			n = cfg.db.maxOpenConns
+	}
+	if n <= 0 {
+			return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// We need to hold on to every connection until they have all been opened, otherwise
+	// the pool would just keep handing us back the same one.
+	conns := make([]*sql.Conn, n)
+	errs := make(chan error, n)
+	for i := range conns {
+			go func(i int) {
+					conn, err := db.Conn(ctx)
+					if err == nil {
+							err = conn.PingContext(ctx)
+							conns[i] = conn
+					}
+					errs <- err
+			}(i)
+	}
+	var firstErr error
+	for range conns {
+			if err := <-errs; err != nil && firstErr == nil {
+					firstErr = err
+			}
+	}
+	for _, conn := range conns {
+			if conn != nil {
+					conn.Close()
+			}
+	}
+	if firstErr != nil {
+			return fmt.Errorf("warming up connection pool: %w", firstErr)
+	}
+	return nil
+}
+// The openLogger() function returns a logger for the configured log output, along with
+// a function which closes the output.
+func openLogger(cfg config) (*jsonlog.Logger, func() error, error) {
+	output := cfg.log.output
+	if output == "" {
+		output = "stdout"
+		if cfg.log.file != "" {
+			output = "file"
+		}
+	}
+	// The verbosity can be raised for particular components, so the handlers have to
+	// be created with the lowest level of them all. The entries for the other components
+	// are filtered out by the logger returned by WithLevels().
+	def, err := jsonlog.ParseLevel(cfg.log.level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levels, err := jsonlog.ParseLevels(def, cfg.log.debug)
+	if err != nil {
+		return nil, nil, err
+	}
+	minLevel := levels.Min()
+	// In development we default to the pretty format, which is much easier to read in a
+	// terminal, and to JSON everywhere else.
+	format := cfg.log.format
+	if format == "" {
+		format = "json"
+		if cfg.env == "development" {
+			format = "pretty"
+		}
+	}
+	if format != "json" && format != "pretty" {
+		return nil, nil, fmt.Errorf("unknown log format %q", format)
+	}
+	overflow, err := jsonlog.ParseOverflowPolicy(cfg.log.overflow)
+	if err != nil {
+		return nil, nil, err
+	}
+	var async *jsonlog.AsyncWriter
+	newLogger := func(out io.Writer, color bool) *jsonlog.Logger {
+		if cfg.log.buffer > 0 {
+			async = jsonlog.NewAsyncWriter(out, cfg.log.buffer, overflow)
+			out = async
+		}
+		logger := jsonlog.New(out, minLevel)
+		if format == "pretty" {
+			logger = jsonlog.NewWithHandler(jsonlog.NewPrettyHandler(out, minLevel.SlogLevel(), color))
+		}
+		if async != nil {
+			async.ReportDropsTo(logger.Slog().Handler())
+		}
+		return logger
+	}
+	var logger *jsonlog.Logger
+	closeLog := func() error { return nil }
+	switch output {
+	case "stdout":
+		logger = newLogger(os.Stdout, useColor(os.Stdout))
+		if async != nil {
+			closeLog = func() error { return async.Close(5 * time.Second) }
+		}
+	case "file":
+		if cfg.log.file == "" {
+			return nil, nil, errors.New("-log-file must be set for file output")
+		}
+		f, err := jsonlog.OpenRotatingFile(cfg.log.file, jsonlog.RotateOptions{
+			MaxSize:    int64(cfg.log.maxSize) * 1024 * 1024,
+			MaxAge:     cfg.log.maxAge,
+			MaxBackups: cfg.log.maxBackups,
+			Compress:   cfg.log.compress,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		logger, closeLog = newLogger(f, false), f.Close
+		if async != nil {
+			closeLog = func() error {
+				err := async.Close(5 * time.Second)
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				return err
+			}
+		}
+	case "syslog":
+		h, err := jsonlog.NewSyslogHandler(cfg.log.syslogAddr, minLevel.SlogLevel())
+		if err != nil {
+			return nil, nil, err
+		}
+		logger, closeLog = jsonlog.NewWithHandler(h), h.Close
+	case "journald":
+		h, err := jsonlog.NewJournalHandler(minLevel.SlogLevel())
+		if err != nil {
+			return nil, nil, err
+		}
+		logger, closeLog = jsonlog.NewWithHandler(h), h.Close
+	default:
+		return nil, nil, fmt.Errorf("unknown log output %q", output)
+	}
+	if cfg.log.ship.url != "" {
+		labels, err := jsonlog.ParseLabels(cfg.log.ship.labels)
+		if err != nil {
+			closeLog()
+			return nil, nil, err
+		}
+		labels["env"] = cfg.env
+		// Errors from shipping are only written to the log output, as shipping them
+		// would most likely fail too.
+		local := logger
+		h, err := jsonlog.NewShipHandler(jsonlog.ShipOptions{
+			URL:           cfg.log.ship.url,
+			Format:        cfg.log.ship.format,
+			Labels:        labels,
+			FlushInterval: cfg.log.ship.flushInterval,
+			BatchSize:     cfg.log.ship.batchSize,
+			MaxRetries:    cfg.log.ship.retries,
+			OnError: func(err error) {
+				local.PrintError(err, nil)
+			},
+		}, minLevel.SlogLevel())
+		if err != nil {
+			closeLog()
+			return nil, nil, err
+		}
+		logger = jsonlog.NewWithHandler(jsonlog.NewMultiHandler(local.Slog().Handler(), h))
+		closeOutput := closeLog
+		closeLog = func() error {
+			err := h.Close(5 * time.Second)
+			if cerr := closeOutput(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+	}
+	if cfg.log.sentryDSN != "" {
+		hostname, _ := os.Hostname()
+		// Like errors from shipping, errors from reporting are only written to the log
+		// output.
+		local := logger
+		h, err := jsonlog.NewSentryHandler(jsonlog.SentryOptions{
+			DSN:         cfg.log.sentryDSN,
+			Environment: cfg.env,
+			Release:     "greenlight@" + version,
+			ServerName:  hostname,
+			OnError: func(err error) {
+				local.PrintError(err, nil)
+			},
+		}, jsonlog.LevelError.SlogLevel())
+		if err != nil {
+			closeLog()
+			return nil, nil, err
+		}
+		logger = jsonlog.NewWithHandler(jsonlog.NewMultiHandler(local.Slog().Handler(), h))
+		closeOutput := closeLog
+		closeLog = func() error {
+			err := h.Close(5 * time.Second)
+			if cerr := closeOutput(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+	}
+	sampleRates, err := jsonlog.ParseSampleRates(cfg.log.sample)
+	if err != nil {
+		closeLog()
+		return nil, nil, err
+	}
+	return logger.WithSampling(sampleRates).WithLevels(levels), closeLog, nil
+}
+
+// useColor returns true if f is a terminal, and the NO_COLOR environment variable (see
+// https://no-color.org) isn't set.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+func TestSetCredentialHashing(t *testing.T) {
+	hashing := data.PasswordHashing
+	t.Cleanup(func() { data.PasswordHashing = hashing })
+
+	valid := func() config {
+		var cfg config
+		cfg.password.algorithm = "argon2id"
+		cfg.password.bcryptCost = 12
+		cfg.password.argon2Memory = 64 * 1024
+		cfg.password.argon2Time = 3
+		cfg.password.argon2Parallelism = 2
+		return cfg
+	}
+	tests := []struct {
+		name    string
+		change  func(cfg *config)
+		wantErr bool
+	}{
+		{name: "Valid", change: func(cfg *config) {}},
+		{name: "Minimum Argon2id settings", change: func(cfg *config) {
+			cfg.password.argon2Time, cfg.password.argon2Parallelism, cfg.password.argon2Memory = 1, 1, 8
+		}},
+		{name: "Unknown algorithm", change: func(cfg *config) { cfg.password.algorithm = "md5" }, wantErr: true},
+		{name: "bcrypt cost too high", change: func(cfg *config) { cfg.password.bcryptCost = 32 }, wantErr: true},
+		{name: "Zero passes", change: func(cfg *config) { cfg.password.argon2Time = 0 }, wantErr: true},
+		{name: "Zero threads", change: func(cfg *config) { cfg.password.argon2Parallelism = 0 }, wantErr: true},
+		{name: "Threads which don't fit in a uint8", change: func(cfg *config) { cfg.password.argon2Parallelism = 256 }, wantErr: true},
+		{name: "Too little memory for the threads", change: func(cfg *config) { cfg.password.argon2Memory = 15 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(&cfg)
+			err := setCredentialHashing(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error: %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// The settings have to work for hashing a password too.
+			var user data.User
+			err = user.Password.Set("pa55word1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+const (
+	// meteringPushInterval is how often the metering push checks for days to push.
+	meteringPushInterval = time.Hour
+	// meteringBackfillDays is how many days back the metering push goes, so that the
+	// days missed while the webhook was down (or before it was configured) are still
+	// pushed, within reason.
+	meteringBackfillDays = 7
+)
+
+// meteringCSVHeader is the header row of the CSV export of the metering rollups.
+var meteringCSVHeader = []string{"day", "user_id", "tenant_id", "key_id", "key_name", "requests", "errors", "rate_limited", "bytes_in", "bytes_out"}
+
+// meteringCSVRow returns the CSV row for a metering rollup. Users name their own API
+// keys, so the key name is escaped in case it looks like a formula (see csvCell()).
+func meteringCSVRow(rollup *data.MeteringRollup) []string {
+	return []string{
+		rollup.Day,
+		strconv.FormatInt(rollup.UserID, 10),
+		strconv.FormatInt(rollup.TenantID, 10),
+		strconv.FormatInt(rollup.KeyID, 10),
+		csvCell(rollup.KeyName),
+		strconv.FormatInt(rollup.Requests, 10),
+		strconv.FormatInt(rollup.Errors, 10),
+		strconv.FormatInt(rollup.RateLimited, 10),
+		strconv.FormatInt(rollup.BytesIn, 10),
+		strconv.FormatInt(rollup.BytesOut, 10),
+	}
+}
+
+// The listMeteringHandler returns the daily usage of every API key (see
+// data.MeteringRollup) between the from and to dates (in UTC, both included), as JSON
+// or, with format=csv, as a CSV download for the billing spreadsheet. By default it
+// covers the current month so far. As with the user's own usage, the counts are written
+// out every -usage-flush-interval, so today's are still going up.
+func (app *application) listMeteringHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	now := time.Now().UTC()
+	from, to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), now.Truncate(24*time.Hour)
+	readDay := func(key string, day *time.Time) {
+		if s := qs.Get(key); s != "" {
+			t, err := time.Parse("2006-01-02", s)
+			if v.Check(err == nil, key, "must be a date like 2024-01-31"); err == nil {
+				*day = t
+			}
+		}
+	}
+	readDay("from", &from)
+	readDay("to", &to)
+	format := app.readString(qs, "format", "json")
+	v.Check(validator.In(format, "json", "csv"), "format", "must be json or csv")
+	if v.Valid() {
+		v.Check(!to.Before(from), "to", "must not be before from")
+		v.Check(to.Sub(from) < data.UsageRetention, "from", fmt.Sprintf("must be less than %d days before to", int(data.UsageRetention/(24*time.Hour))))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	rollups, err := app.models.Metering.GetRollups(from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if format == "csv" {
+		e := &exportWriter{w: w, contentType: "text/csv", filename: fmt.Sprintf("metering-%s-%s.csv", from.Format("2006-01-02"), to.Format("2006-01-02"))}
+		cw := csv.NewWriter(e)
+		cw.Write(meteringCSVHeader)
+		for _, rollup := range rollups {
+			cw.Write(meteringCSVRow(rollup))
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			app.logError(r, err)
+		}
+		return
+	}
+	env := envelope{"from": from.Format("2006-01-02"), "to": to.Format("2006-01-02"), "rollups": rollups}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// startMeteringPush starts the job which pushes each day's metering rollups to the
+// -metering-webhook once the day is over, for billing systems which would rather be sent
+// the usage than fetch it. A day is pushed once all of the instances have flushed its
+// counts, and then recorded as pushed, oldest first; if the webhook fails the day is
+// tried again on the next run. Like the other periodic jobs, it only runs on the leader.
+func (app *application) startMeteringPush() {
+	if app.config.metering.webhook == "" || app.config.usage.flushInterval <= 0 {
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	logger := app.logger.Component("metering")
+	go func() {
+		for {
+			app.runSingleton("push_metering", func() {
+				err := app.pushMetering(client, time.Now())
+				if err != nil {
+					logger.PrintError(fmt.Errorf("pushing metering rollups: %w", err), nil)
+				}
+			})
+			time.Sleep(meteringPushInterval)
+		}
+	}()
+}
+
+// pushMetering pushes the finished days which haven't been pushed yet.
+func (app *application) pushMetering(client *http.Client, now time.Time) error {
+	today := now.UTC().Truncate(24 * time.Hour)
+	for day := today.AddDate(0, 0, -meteringBackfillDays); day.Before(today); day = day.AddDate(0, 0, 1) {
+		// The counts for a day keep arriving for up to a flush interval after it ends.
+		if now.Before(day.AddDate(0, 0, 1).Add(2 * app.config.usage.flushInterval)) {
+			return nil
+		}
+		pushed, err := app.models.Metering.Pushed(day)
+		if err != nil {
+			return err
+		}
+		if pushed {
+			continue
+		}
+		rollups, err := app.models.Metering.GetRollups(day, day)
+		if err != nil {
+			return err
+		}
+		err = app.postMetering(client, day, rollups)
+		if err != nil {
+			return fmt.Errorf("%s: %w", day.Format("2006-01-02"), err)
+		}
+		err = app.models.Metering.MarkPushed(day, len(rollups))
+		if err != nil {
+			return err
+		}
+		app.logger.Component("metering").PrintInfo("pushed metering rollups", map[string]string{"day": day.Format("2006-01-02"), "count": strconv.Itoa(len(rollups))})
+	}
+	return nil
+}
+
+// postMetering posts a day's rollups to the webhook as JSON. The day is sent as the
+// Idempotency-Key, so that the receiver can ignore a day which is pushed again (if we
+// couldn't record that it had been pushed), and if -metering-webhook-secret is set the
+// body is signed with it, as the hex HMAC-SHA256 in the X-Greenlight-Signature header.
+func (app *application) postMetering(client *http.Client, day time.Time, rollups []*data.MeteringRollup) error {
+	body, err := json.Marshal(map[string]any{"day": day.Format("2006-01-02"), "rollups": rollups})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, app.config.metering.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "metering-"+day.Format("2006-01-02"))
+	if app.config.metering.secret != "" {
+		mac := hmac.New(sha256.New, []byte(app.config.metering.secret))
+		mac.Write(body)
+		req.Header.Set("X-Greenlight-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -88,6 +90,10 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 				clients[ip].lastSeen = time.Now()
 				if !clients[ip].limiter.Allow() {
 						mu.Unlock()
+						// Log the rejection. During an attack there can be a huge number of these,
+						// so they are sampled by default (see the -log-sample flag).
+						app.loggerFrom(r).PrintInfo("rate limit exceeded", map[string]string{"ip": ip})
+						app.usage.recordRateLimited(app.bearerToken(r))
 						app.rateLimitExceededResponse(w, r)
 						return
 				}
@@ -106,6 +112,16 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			// Retrieve the value of the Authorization header from the request. This will
 			// return the empty string "" if there is no such header found.
 			authorizationHeader := r.Header.Get("Authorization")
+			// If there's no Authorization header but there is a session cookie (and cookie
+			// sessions are enabled), we authenticate with the token in the cookie instead,
+			// and mark the request so that the csrfProtect() middleware checks it.
+			if authorizationHeader == "" {
+					w.Header().Add("Vary", "Cookie")
+					if token, ok := app.sessionToken(r); ok {
+							authorizationHeader = "Bearer " + token
+							r = app.contextSetCookieAuth(r)
+					}
+			}
 			// If there is no Authorization header found, use the contextSetUser() helper
 			// that we just made to add the AnonymousUser to the request context. Then we
 			// call the next handler in the chain and return without executing any of the
@@ -132,7 +148,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			// If the token isn't valid, use the invalidAuthenticationTokenResponse()
 			// helper to send a response, rather than the failedValidationResponse() helper
 			// that we'd normally use.
-			if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			if app.jwtKeys == nil || strings.Count(token, ".") != 2 {
+					data.ValidateTokenPlaintext(v, token)
+			}
+			if !v.Valid() {
 					app.invalidAuthenticationTokenResponse(w, r)
 					return
 			}
@@ -140,10 +159,23 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			// again calling the invalidAuthenticationTokenResponse() helper if no
 			// matching record was found. IMPORTANT: Notice that we are using
 			// ScopeAuthentication as the first parameter here.
-			user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			// Tokens with two dots in them are JWTs. They aren't stored anywhere, so we
+			// verify the signature and look up the user that they were issued to.
+			// Authentication tokens and API keys are both accepted, and we keep hold of
+			// the token record so that requirePermission() can see what it has been
+			// restricted to.
+			var user *data.User
+			var authToken *data.Token
+			var err error
+			if app.jwtKeys != nil && strings.Count(token, ".") == 2 {
+					user, authToken, err = app.userForJWT(r, token)
+			} else {
+					user, authToken, err = app.modelsFor(r).Users.GetWithToken(token, data.ScopeAuthentication, data.ScopeAPIKey)
+			}
 			if err != nil {
 					switch {
 					case errors.Is(err, data.ErrRecordNotFound):
+							tokenLookupFailures.Add(data.ScopeAuthentication, 1)
 							app.invalidAuthenticationTokenResponse(w, r)
 					default:
 						app.serverErrorResponse(w, r, err)
@@ -153,7 +185,169 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			// Call the contextSetUser() helper to add the user information to the request
 			// context.
 			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, authToken)
+			contextRequestInfo(r).setUserID(user.ID)
+			app.touchToken(r, authToken)
 			// Call the next handler in the chain.
 			next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
+
+// Create a new requireAuthenticatedUser() middleware to check that a user is not
+// anonymous.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.contextGetUser(r)
+			if user.IsAnonymous() {
+					app.authenticationRequiredResponse(w, r)
+					return
+			}
+			next.ServeHTTP(w, r)
+	})
+}
+
+// Checks that a user is both authenticated and activated.
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	// Rather than returning this http.HandlerFunc we assign it to the variable fn.
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.contextGetUser(r)
+			// Check that a user is activated.
+			if !user.Activated {
+					app.inactiveAccountResponse(w, r)
+					return
+			}
+			next.ServeHTTP(w, r)
+	})
+	// Wrap fn with the requireAuthenticatedUser() middleware before returning it.
+	return app.requireAuthenticatedUser(fn)
+}
+
+// The requirePermission() middleware checks that the user has the permission, and that
+// the token which authenticated the request hasn't been restricted to a set of
+// permissions which leaves it out. Note that the first parameter for the middleware
+// function is the permission code that we require the user to have.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+			// Retrieve the user from the request context.
+			user := app.contextGetUser(r)
+			// Get the slice of permissions for the user.
+			permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+			}
+			// Check if the slice includes the required permission, and that the token
+			// is allowed to use it. If it doesn't, then return a 403 Forbidden
+			// response.
+			token := app.contextGetToken(r)
+			restricted := token != nil && len(token.Permissions) > 0 && !token.Permissions.Include(code)
+			if !permissions.Include(code) || restricted {
+					reason := "user"
+					if permissions.Include(code) {
+							reason = "token"
+					}
+					app.logSecurityEvent(r, "permission_denied", map[string]string{
+							"email":      user.Email,
+							"permission": code,
+							"reason":     reason,
+					})
+					app.notPermittedResponse(w, r)
+					return
+			}
+			// Otherwise they have the required permission so we call the next handler in
+			// the chain.
+			next.ServeHTTP(w, r)
+	}
+	// Wrap this with the requireActivatedUser() middleware before returning it, and let
+	// anonymous reads through ahead of it if they're allowed.
+	return app.allowPublicRead(code, next, app.requireActivatedUser(fn))
+}
+
+// publicReadPermissions are the permissions which anonymous clients are treated as
+// having for GET and HEAD requests when the -public-reads flag is set.
+var publicReadPermissions = data.Permissions{"movies:read"}
+
+// The allowPublicRead() middleware sends anonymous GET and HEAD requests for a public
+// read permission straight to next when the -public-reads flag is set, and everything
+// else to protected. Authenticated users always go through protected, so that tokens
+// which have been restricted to some permissions stay restricted. Anonymous requests
+// are still rate-limited by IP address, as the rate limiter comes first.
+func (app *application) allowPublicRead(code string, next, protected http.HandlerFunc) http.HandlerFunc {
+	if !app.config.publicReads || !publicReadPermissions.Include(code) {
+			return protected
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && app.contextGetUser(r).IsAnonymous() {
+					next.ServeHTTP(w, r)
+					return
+			}
+			protected.ServeHTTP(w, r)
+	}
+}
+
+// The validateRequest() middleware checks the parameters and body of each request
+// against the OpenAPI specification, and rejects requests which don't conform with a
+// 422 Unprocessable Entity response. It only does anything when the -openapi-validate
+// flag is set.
+func (app *application) validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.spec == nil {
+					next.ServeHTTP(w, r)
+					return
+			}
+			// Read the request body (up to the same 1MB limit that readJSON() uses) so that
+			// we can validate it, and then put it back in place for the handler.
+			const maxBytes = 1_048_576
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+			if err != nil {
+					app.badRequestResponse(w, r, err)
+					return
+			}
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			// If the body is too large, skip validation and let the handler reject it.
+			if len(body) > maxBytes {
+					next.ServeHTTP(w, r)
+					return
+			}
+			if validationErrors := app.spec.Validate(r, specPath(r.URL.Path), body); len(validationErrors) > 0 {
+					app.schemaValidationResponse(w, r, validationErrors)
+					return
+			}
+			next.ServeHTTP(w, r)
+	})
+}
+
+// The requireRole() middleware checks that the user has a role (admins pass any role
+// check). Roles can't be delegated to tokens which have been restricted to some of the
+// user's permissions, so requests authenticated with one of those are always refused.
+func (app *application) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+			user := app.contextGetUser(r)
+			roles, err := app.models.Roles.GetAllForUser(user.ID)
+			if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+			}
+			hasRole := false
+			for _, r := range roles {
+					hasRole = hasRole || r == role || r == data.RoleAdmin
+			}
+			token := app.contextGetToken(r)
+			restricted := token != nil && len(token.Permissions) > 0
+			if !hasRole || restricted {
+					reason := "user"
+					if hasRole {
+							reason = "token"
+					}
+					app.logSecurityEvent(r, "permission_denied", map[string]string{
+							"email":  user.Email,
+							"role":   role,
+							"reason": reason,
+					})
+					app.notPermittedResponse(w, r)
+					return
+			}
+			next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedUser(fn)
+}
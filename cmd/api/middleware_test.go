@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// BenchmarkRateLimit measures looking up (or creating) the rate limiter for the client
+// of each request, with a few clients and with many, and with requests in parallel to
+// show the contention on the clients map. The limit is high enough that nothing is
+// rejected.
+func BenchmarkRateLimit(b *testing.B) {
+	for _, clients := range []int{1, 10_000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			app := newTestApplication(b)
+			app.config.limiter.enabled = true
+			app.config.limiter.rps = 1e9
+			app.config.limiter.burst = 1e9
+			h := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			requests := make([]*http.Request, clients)
+			for i := range requests {
+				requests[i] = httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+				requests[i].RemoteAddr = fmt.Sprintf("10.%d.%d.%d:1234", i>>16&255, i>>8&255, i&255)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				w := httptest.NewRecorder()
+				for i := 0; pb.Next(); i++ {
+					h.ServeHTTP(w, requests[i%clients])
+				}
+			})
+		})
+	}
+}
@@ -4,16 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"greenlight.alexedwards.net/internal/apierror"
 	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator" // New import
 )
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-			Title   string       `json:"title"`
-			Year    int32        `json:"year"`
-			Runtime data.Runtime `json:"runtime"`
-			Genres  []string     `json:"genres"`
+			Title      string          `json:"title"`
+			Year       int32           `json:"year"`
+			Runtime    data.Runtime    `json:"runtime"`
+			Genres     []string        `json:"genres"`
+			Attributes data.Attributes `json:"attributes"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -22,10 +26,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Note that the movie variable contains a *pointer* to a Movie struct.
 	movie := &data.Movie{
-			Title:   input.Title,
-			Year:    input.Year,
-			Runtime: input.Runtime,
-			Genres:  input.Genres,
+			Title:      input.Title,
+			Year:       input.Year,
+			Runtime:    input.Runtime,
+			Genres:     input.Genres,
+			Attributes: input.Attributes,
 	}
 	v := validator.New()
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -35,35 +40,171 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.modelsFor(r).Movies.Insert(movie)
 	if err != nil {
-			app.serverErrorResponse(w, r, err)
+			switch {
+			case errors.Is(err, data.ErrDuplicateMovie):
+					v.AddError("title", "a movie with this title and year already exists")
+					app.failedValidationResponse(w, r, v.Errors)
+			default:
+					app.serverErrorResponse(w, r, err)
+			}
 			return
 	}
+	app.logMovieChange(r, "movie_created", movie.ID)
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an 
 	// empty http.Header map and then use the Set() method to add a new Location header,
 	// interpolating the system-generated ID for our new movie in the URL.
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("Location", fmt.Sprintf("%s/movies/%d", app.versionPrefix(r), movie.ID))
 	// Write a JSON response with a 201 Created status code, the movie data in the
 	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	body, err := app.movieResponse(r, movie)
+	if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": body}, headers)
 	if err != nil {
 			app.serverErrorResponse(w, r, err)
 	}
 }
 
+// The bulkCreateMoviesHandler() creates several movies in one request. Each movie is
+// validated and inserted independently, so a problem with one movie doesn't prevent the
+// others from being created, and the outcome for each is reported in a batch response.
+func (app *application) bulkCreateMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+			Movies []struct {
+					Title      string          `json:"title"`
+					Year       int32           `json:"year"`
+					Runtime    data.Runtime    `json:"runtime"`
+					Genres     []string        `json:"genres"`
+					Attributes data.Attributes `json:"attributes"`
+			} `json:"movies"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+	}
+	v := validator.New()
+	v.Check(len(input.Movies) >= 1, "movies", "must contain at least 1 movie")
+	if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+	}
+	b := newBatch("movie")
+	for i, item := range input.Movies {
+			movie := &data.Movie{
+					Title:      item.Title,
+					Year:       item.Year,
+					Runtime:    item.Runtime,
+					Genres:     item.Genres,
+					Attributes: item.Attributes,
+			}
+			v := validator.New()
+			if data.ValidateMovie(v, movie); !v.Valid() {
+					b.failValidation(i, v.Errors)
+					continue
+			}
+			err = app.modelsFor(r).Movies.Insert(movie)
+			if errors.Is(err, data.ErrDuplicateMovie) {
+					b.failValidation(i, map[string]string{"title": "a movie with this title and year already exists"})
+					continue
+			}
+			if err != nil {
+					app.logError(r, err)
+					b.fail(i, http.StatusInternalServerError, apierror.CodeServerError, "the server encountered a problem and could not process this item")
+					continue
+			}
+			app.logMovieChange(r, "movie_created", movie.ID)
+			b.succeed(i, http.StatusCreated, app.serializeMovie(r, movie, false))
+	}
+	app.writeBatchJSON(w, r, b, http.StatusCreated)
+}
+
+// The upsertMovieHandler() creates a movie, or updates the movie with the same title
+// (ignoring case and whitespace) and year, so that importers which sync from external
+// catalogs can send every movie on every run. The response says which it did, with a
+// 201 Created status code if the movie is new and 200 OK otherwise.
+func (app *application) upsertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title      string          `json:"title"`
+		Year       int32           `json:"year"`
+		Runtime    data.Runtime    `json:"runtime"`
+		Genres     []string        `json:"genres"`
+		Attributes data.Attributes `json:"attributes"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	movie := &data.Movie{
+		Title:      input.Title,
+		Year:       input.Year,
+		Runtime:    input.Runtime,
+		Genres:     input.Genres,
+		Attributes: input.Attributes,
+	}
+	v := validator.New()
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	outcome, err := app.modelsFor(r).Movies.Upsert(movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	headers := make(http.Header)
+	switch outcome {
+	case data.UpsertCreated:
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("%s/movies/%d", app.versionPrefix(r), movie.ID))
+		app.logMovieChange(r, "movie_created", movie.ID)
+	case data.UpsertUpdated:
+		app.logMovieChange(r, "movie_updated", movie.ID)
+	}
+	body, err := app.movieResponse(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, status, envelope{"outcome": outcome, "movie": body}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 			app.notFoundResponse(w, r)
 			return
 	}
+	// The as_of parameter asks for the movie as it was at a point in time, from its
+	// revisions, rather than as it is now.
+	v := validator.New()
+	asOf := app.readTime(r.URL.Query(), "as_of", time.Time{}, v)
+	fields := app.readFields(r.URL.Query(), movieFields[app.contextAPIVersion(r)], v)
+	includes := app.readIncludes(r.URL.Query(), movieIncludes, v)
+	if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+	}
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	var movie *data.Movie
+	if asOf.IsZero() {
+			movie, err = app.modelsFor(r).Movies.Get(id)
+	} else {
+			movie, err = app.modelsFor(r).Movies.GetAsOf(id, asOf)
+	}
 	if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -73,7 +214,24 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 			}
 			return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if asOf.IsZero() {
+			app.views.record(movie.ID)
+	}
+	body, err := app.movieResponse(r, movie)
+	if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+	}
+	included, err := app.includedResponse(r, movie, includes)
+	if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+	}
+	env := envelope{"movie": fields.apply(body)}
+	if included != nil {
+			env["included"] = included
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 			app.serverErrorResponse(w, r, err)
 	}
@@ -86,7 +244,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 			return
 	}
 	// Retrieve the movie record as normal.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -96,38 +254,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 			}
 			return
     }
-    // Use pointers for the Title, Year and Runtime fields.
-    var input struct {
-        Title   *string       `json:"title"`
-        Year    *int32        `json:"year"`
-        Runtime *data.Runtime `json:"runtime"`
-        Genres  []string      `json:"genres"`
-    }
+    var input movieChanges
     // Decode the JSON as normal.
     err = app.readJSON(w, r, &input)
     if err != nil {
         app.badRequestResponse(w, r, err)
         return
     }
-    // If the input.Title value is nil then we know that no corresponding "title" key/
-    // value pair was provided in the JSON request body. So we move on and leave the
-    // movie record unchanged. Otherwise, we update the movie record with the new title
-    // value. Importantly, because input.Title is a now a pointer to a string, we need
-    // to dereference the pointer using the * operator to get the underlying value
-    // before assigning it to our movie record.
-    if input.Title != nil {
-        movie.Title = *input.Title
-    }
-    // We also do the same for the other fields in the input struct.
-    if input.Year != nil {
-        movie.Year = *input.Year
-    }
-    if input.Runtime != nil {
-        movie.Runtime = *input.Runtime
-    }
-    if input.Genres != nil {
-        movie.Genres = input.Genres // Note that we don't need to dereference a slice.
-    }
+    input.apply(movie)
     v := validator.New()
    
     if data.ValidateMovie(v, movie); !v.Valid() {
@@ -135,19 +269,28 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
-		// Intercept any ErrEditConflict error and call the new editConflictResponse()
+		// Intercept any ErrEditConflict error and call the movieEditConflictResponse()
     // helper.
-    err = app.models.Movies.Update(movie)
+    err = app.modelsFor(r).Movies.Update(movie)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrEditConflict):
-            app.editConflictResponse(w, r)
+            app.movieEditConflictResponse(w, r, movie)
+        case errors.Is(err, data.ErrDuplicateMovie):
+            v.AddError("title", "a movie with this title and year already exists")
+            app.failedValidationResponse(w, r, v.Errors)
         default:
             app.serverErrorResponse(w, r, err)
         }
         return
     }
-    err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+    app.logMovieChange(r, "movie_updated", movie.ID)
+    body, err := app.movieResponse(r, movie)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+    err = app.writeJSON(w, http.StatusOK, envelope{"movie": body}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
@@ -162,7 +305,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.modelsFor(r).Movies.Delete(id)
 	if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -172,6 +315,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 			}
 			return
 	}
+	app.logMovieChange(r, "movie_deleted", id)
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -179,6 +323,51 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// The deleteMatchingMoviesHandler deletes every movie which matches the listing filters,
+// for clean-ups which would otherwise mean paging through the movies and deleting them
+// one at a time. It's a dry run unless dry_run=false, and only reports how many movies
+// match, so that admins can check the filters first. At least one filter is required,
+// so that a missing query string can't delete the whole catalog.
+func (app *application) deleteMatchingMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+			Title  string
+			Genres []string
+			DryRun bool
+			data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readGenres(qs, &input.Filters)
+	input.DryRun = app.readBool(qs, "dry_run", true, v)
+	app.readRanges(qs, &input.Filters, v)
+	app.readAdded(qs, app.requestLocation(r), &input.Filters, v)
+	app.readAttributes(qs, &input.Filters, v)
+	data.ValidateRanges(v, input.Filters)
+	v.Check(input.Title != "" || len(input.Genres) > 0 || input.Filters.HasLimits(), "filters", "must include at least one filter")
+	if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+	}
+	count, err := app.modelsFor(r).Movies.DeleteMatching(input.Title, input.Genres, input.Filters, input.DryRun)
+	// Batches which were deleted before an error stay deleted, so they're logged either
+	// way.
+	if !input.DryRun && count > 0 {
+			app.logSecurityEvent(r, "movies_deleted", map[string]string{
+					"count":   strconv.FormatInt(count, 10),
+					"filters": r.URL.RawQuery,
+			})
+	}
+	if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"dry_run": input.DryRun, "count": count}, nil)
+	if err != nil {
+			app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 			Title  string
@@ -188,24 +377,32 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	v := validator.New()
 	qs := r.URL.Query()
 	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Genres = app.readGenres(qs, &input.Filters)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", app.userPreferences(r).PageSizeOr(defaultPageSize), v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	app.readRanges(qs, &input.Filters, v)
+	app.readAdded(qs, app.requestLocation(r), &input.Filters, v)
+	app.readAttributes(qs, &input.Filters, v)
+	fields := app.readFields(qs, movieFields[app.contextAPIVersion(r)], v)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 			app.failedValidationResponse(w, r, v.Errors)
 			return
 	}
-	// Accept the metadata struct as a return value.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	// Stream the movies to the client as they are read from the database, rather than
+	// building the whole response in memory first. The metadata is written after the
+	// movies, once we know it.
+	stream := newJSONStream(w, http.StatusOK, "movies")
+	metadata, err := app.modelsFor(r).Movies.GetAllFunc(input.Title, input.Genres, input.Filters, func(movie *data.Movie) error {
+			return stream.write(fields.apply(app.serializeMovie(r, movie, false)))
+	})
 	if err != nil {
-			app.serverErrorResponse(w, r, err)
+			app.streamErrorResponse(w, r, stream.started(), err)
 			return
 	}
-	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = stream.close(envelope{"metadata": metadata, "_links": app.pageLinks(r, "/v1/movies", metadata)})
 	if err != nil {
-			app.serverErrorResponse(w, r, err)
+			app.streamErrorResponse(w, r, stream.started(), err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/assert"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+func TestShowMovie(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "movies:read")
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+	err := app.models.Movies.Insert(movie)
+	assert.NilError(t, err)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		token    string
+		wantCode int
+		wantBody string
+	}{
+		{name: "Valid ID", urlPath: "/v1/movies/1", token: token, wantCode: http.StatusOK, wantBody: `"title": "Moana"`},
+		{name: "Non-existent ID", urlPath: "/v1/movies/2", token: token, wantCode: http.StatusNotFound},
+		{name: "Negative ID", urlPath: "/v1/movies/-1", token: token, wantCode: http.StatusNotFound},
+		{name: "Decimal ID", urlPath: "/v1/movies/1.23", token: token, wantCode: http.StatusNotFound},
+		{name: "String ID", urlPath: "/v1/movies/foo", token: token, wantCode: http.StatusNotFound},
+		{name: "Unauthenticated", urlPath: "/v1/movies/1", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.request(t, http.MethodGet, tt.urlPath, tt.token, nil)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.StringContains(t, body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestCreateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	user, token := newTestUser(t, app, "movies:read")
+	ts := newTestServer(t, app.routes())
+
+	code, _, _ := ts.request(t, http.MethodPost, "/v1/movies", token, []byte(`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`))
+	assert.Equal(t, code, http.StatusForbidden)
+
+	err := app.models.Permissions.AddForUser(user.ID, "movies:write")
+	assert.NilError(t, err)
+	code, headers, body := ts.request(t, http.MethodPost, "/v1/movies", token, []byte(`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`))
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, headers.Get("Location"), "/v1/movies/1")
+	assert.StringContains(t, body, `"runtime": "107 mins"`)
+
+	code, _, body = ts.request(t, http.MethodPost, "/v1/movies", token, []byte(`{"title": "", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, `"title": "must be provided"`)
+}
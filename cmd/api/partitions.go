@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// startPartitionMaintenance starts the job which creates the monthly partitions of the
+// security events and view counts ahead of time, and archives the old ones (see
+// data.PartitionModel). Security events are archived once they're older than
+// -security-event-retention, and view counts once they're too old for any of the
+// trending windows. Like the purges, it only runs on the leader.
+func (app *application) startPartitionMaintenance() {
+	retention := map[string]time.Duration{
+		"security_events": app.config.partitions.securityEventRetention,
+		"movie_views":     data.ViewsRetention(),
+	}
+	go func() {
+		for {
+			app.runSingleton("maintain_partitions", func() {
+				for _, table := range data.PartitionedTables {
+					archived, err := app.models.Partitions.Maintain(table, retention[table], time.Now())
+					if err != nil {
+						app.logger.PrintError(fmt.Errorf("maintaining partitions of %s: %w", table, err), nil)
+					}
+					if len(archived) > 0 {
+						app.logger.PrintInfo("archived partitions", map[string]string{"table": table, "partitions": strings.Join(archived, ",")})
+					}
+				}
+			})
+			time.Sleep(app.config.partitions.interval)
+		}
+	}()
+}
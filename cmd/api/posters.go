@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/storage"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// posterContentTypes are the image formats that posters can be uploaded in.
+var posterContentTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// The posterInfo type is how a poster is shown in responses. The URL is presigned, so
+// it works without authentication until its expiry time.
+type posterInfo struct {
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// The posterUpload type is how a presigned upload URL is shown in responses: the client
+// uploads the poster by sending a request with the method and headers to the URL.
+type posterUpload struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Expiry  time.Time         `json:"expiry"`
+}
+
+// posterKey returns the storage key of a movie's poster. Movie IDs are unique across
+// tenants, so the key doesn't need to include the tenant.
+func posterKey(id int64) string {
+	return fmt.Sprintf("posters/%d", id)
+}
+
+// readPosterMovieID reads the movie ID from the URL and checks that the movie exists,
+// sending the client an error response if it doesn't.
+func (app *application) readPosterMovieID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return 0, false
+	}
+	_, err = app.modelsFor(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return 0, false
+	}
+	return id, true
+}
+
+// writePoster sends a response with a presigned download URL for a movie's poster, or a
+// 404 Not Found response if it doesn't have one.
+func (app *application) writePoster(w http.ResponseWriter, r *http.Request, id int64) {
+	object, err := app.storage.Stat(r.Context(), posterKey(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	expiry := time.Now().Add(app.config.storage.urlTTL)
+	url, err := app.storage.PresignGet(posterKey(id), app.config.storage.urlTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	poster := posterInfo{URL: url, Size: object.Size, UpdatedAt: object.ModTime, Expiry: expiry}
+	err = app.writeJSON(w, http.StatusOK, envelope{"poster": poster}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showMoviePosterHandler returns a presigned URL that a movie's poster can be
+// downloaded from, rather than the image itself, so that it doesn't go through the API.
+func (app *application) showMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readPosterMovieID(w, r)
+	if !ok {
+		return
+	}
+	app.writePoster(w, r, id)
+}
+
+// The uploadMoviePosterHandler stores the image in the request body as a movie's poster,
+// replacing any poster that it already has. The Content-Type header has to name one of
+// the posterContentTypes, and the image has to be in that format. Larger posters can be
+// uploaded directly to storage instead (see createMoviePosterUploadHandler).
+func (app *application) uploadMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readPosterMovieID(w, r)
+	if !ok {
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	v := validator.New()
+	v.Check(validator.In(contentType, posterContentTypes...), "content_type", "must be image/jpeg, image/png or image/webp")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	body, err := app.readUpload(w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v.Check(http.DetectContentType(body) == contentType, "body", "must be an image in the format named by the Content-Type header")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.storage.Put(r.Context(), posterKey(id), bytes.NewReader(body), int64(len(body)), contentType)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writePoster(w, r, id)
+}
+
+// The createMoviePosterUploadHandler returns a presigned URL that a movie's poster can
+// be uploaded to directly, which takes large files off the API. The client has to
+// upload it with a PUT request and the Content-Type header given in the response. Unlike
+// uploads through the API, the size and format of the image can't be checked, as S3
+// doesn't enforce either for presigned PUT requests.
+func (app *application) createMoviePosterUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readPosterMovieID(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		ContentType string `json:"content_type"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(validator.In(input.ContentType, posterContentTypes...), "content_type", "must be image/jpeg, image/png or image/webp")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	expiry := time.Now().Add(app.config.storage.urlTTL)
+	url, err := app.storage.PresignPut(posterKey(id), input.ContentType, app.config.storage.urlTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	upload := posterUpload{
+		URL:     url,
+		Method:  http.MethodPut,
+		Headers: map[string]string{"Content-Type": input.ContentType},
+		Expiry:  expiry,
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"upload": upload}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteMoviePosterHandler deletes a movie's poster.
+func (app *application) deleteMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readPosterMovieID(w, r)
+	if !ok {
+		return
+	}
+	_, err := app.storage.Stat(r.Context(), posterKey(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.storage.Delete(r.Context(), posterKey(id))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "poster successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
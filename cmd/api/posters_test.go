@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// pngHeader is enough of a PNG file for http.DetectContentType() to recognise it.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// pathOf returns the path and query string of a presigned URL, to request it from the
+// test server rather than from the base URL that it was signed for.
+func pathOf(t *testing.T, link string) string {
+	t.Helper()
+	u, err := url.Parse(link)
+	assert.NilError(t, err)
+	return u.RequestURI()
+}
+
+// upload sends a body to the test server with a Content-Type header.
+func (ts *testServer) upload(t *testing.T, method, urlPath, token, contentType string, body []byte) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+urlPath, bytes.NewReader(body))
+	assert.NilError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rs, err := ts.Client().Do(req)
+	assert.NilError(t, err)
+	defer rs.Body.Close()
+	respBody, err := io.ReadAll(rs.Body)
+	assert.NilError(t, err)
+	return rs.StatusCode, string(respBody)
+}
+
+func TestMoviePosters(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "movies:read", "movies:write")
+	err := app.models.Movies.Insert(&data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	assert.NilError(t, err)
+	ts := newTestServer(t, app.routes())
+
+	code, _, _ := ts.request(t, http.MethodGet, "/v1/movies/1/poster", token, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+	code, _ = ts.upload(t, http.MethodPost, "/v1/movies/2/poster", token, "image/png", pngHeader)
+	assert.Equal(t, code, http.StatusNotFound)
+	code, body := ts.upload(t, http.MethodPost, "/v1/movies/1/poster", token, "image/gif", pngHeader)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "content_type")
+	code, body = ts.upload(t, http.MethodPost, "/v1/movies/1/poster", token, "image/jpeg", pngHeader)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "must be an image in the format named by the Content-Type header")
+	code, _ = ts.upload(t, http.MethodPost, "/v1/movies/1/poster", token, "image/png", make([]byte, maxUploadBytes+1))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	code, body = ts.upload(t, http.MethodPost, "/v1/movies/1/poster", token, "image/png", pngHeader)
+	assert.Equal(t, code, http.StatusOK)
+	var response struct {
+		Poster posterInfo `json:"poster"`
+	}
+	err = json.Unmarshal([]byte(body), &response)
+	assert.NilError(t, err)
+	assert.Equal(t, response.Poster.Size, int64(len(pngHeader)))
+
+	// The presigned URL works without authentication, but not once it's been tampered
+	// with.
+	code, headers, body := ts.get(t, pathOf(t, response.Poster.URL))
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, headers.Get("Content-Type"), "image/png")
+	assert.Equal(t, body, string(bytes.TrimSpace(pngHeader)))
+	code, _, _ = ts.get(t, pathOf(t, response.Poster.URL)+"x")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.request(t, http.MethodDelete, "/v1/movies/1/poster", token, nil)
+	assert.Equal(t, code, http.StatusOK)
+	code, _, _ = ts.request(t, http.MethodGet, "/v1/movies/1/poster", token, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestMoviePosterDirectUpload(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "movies:read", "movies:write")
+	err := app.models.Movies.Insert(&data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	assert.NilError(t, err)
+	ts := newTestServer(t, app.routes())
+
+	code, _, _ := ts.request(t, http.MethodPost, "/v1/movies/1/poster/upload", token, []byte(`{"content_type": "text/html"}`))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies/1/poster/upload", token, []byte(`{"content_type": "image/png"}`))
+	assert.Equal(t, code, http.StatusOK)
+	var response struct {
+		Upload posterUpload `json:"upload"`
+	}
+	err = json.Unmarshal([]byte(body), &response)
+	assert.NilError(t, err)
+	assert.Equal(t, response.Upload.Method, http.MethodPut)
+	assert.Equal(t, response.Upload.Headers, map[string]string{"Content-Type": "image/png"})
+
+	// The upload has to have the Content-Type header that the URL was signed for.
+	code, _ = ts.upload(t, http.MethodPut, pathOf(t, response.Upload.URL), "", "image/jpeg", pngHeader)
+	assert.Equal(t, code, http.StatusNotFound)
+	code, _ = ts.upload(t, http.MethodPut, pathOf(t, response.Upload.URL), "", "image/png", pngHeader)
+	assert.Equal(t, code, http.StatusOK)
+	code, _, body = ts.request(t, http.MethodGet, "/v1/movies/1/poster", token, nil)
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, fmt.Sprintf(`"size": %d`, len(pngHeader)))
+}
+
+// TestMoviePosterDirectUploadNotAnImage checks that a direct upload can't store a page
+// with a script in it under an image type, and that whatever is in local storage is
+// never served as anything a browser would render with scripts on the API's origin.
+func TestMoviePosterDirectUploadNotAnImage(t *testing.T) {
+	app := newTestApplication(t)
+	_, token := newTestUser(t, app, "movies:read", "movies:write")
+	err := app.models.Movies.Insert(&data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	assert.NilError(t, err)
+	ts := newTestServer(t, app.routes())
+	page := []byte("<html><script>alert(document.cookie)</script></html>")
+
+	code, _, body := ts.request(t, http.MethodPost, "/v1/movies/1/poster/upload", token, []byte(`{"content_type": "image/png"}`))
+	assert.Equal(t, code, http.StatusOK)
+	var response struct {
+		Upload posterUpload `json:"upload"`
+	}
+	err = json.Unmarshal([]byte(body), &response)
+	assert.NilError(t, err)
+	code, _ = ts.upload(t, http.MethodPut, pathOf(t, response.Upload.URL), "", "image/png", page)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	code, _, _ = ts.request(t, http.MethodGet, "/v1/movies/1/poster", token, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// Even if a page does get into storage, it's served as a download.
+	err = app.storage.Put(context.Background(), posterKey(1), bytes.NewReader(page), int64(len(page)), "image/png")
+	assert.NilError(t, err)
+	link, err := app.storage.PresignGet(posterKey(1), time.Minute)
+	assert.NilError(t, err)
+	code, headers, _ := ts.get(t, pathOf(t, link))
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, headers.Get("Content-Type"), "application/octet-stream")
+	assert.Equal(t, headers.Get("Content-Disposition"), "attachment")
+	assert.Equal(t, headers.Get("X-Content-Type-Options"), "nosniff")
+	assert.Equal(t, headers.Get("Content-Security-Policy"), "sandbox")
+}
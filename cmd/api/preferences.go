@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// defaultPageSize is the page size of listings for users who haven't chosen their own.
+const defaultPageSize = 20
+
+// userPreferences returns the preferences of the user who made the request. Anonymous
+// users have no preferences, so they always get the defaults.
+func (app *application) userPreferences(r *http.Request) data.Preferences {
+	return app.contextGetUser(r).Preferences
+}
+
+// The showPreferencesHandler shows the authenticated user's preferences, with the ones
+// they haven't set filled in with their defaults.
+func (app *application) showPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	preferences := app.userPreferences(r)
+	err := app.writeJSON(w, http.StatusOK, envelope{"preferences": effectivePreferences(preferences)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updatePreferencesHandler changes some of the authenticated user's preferences.
+// Only the keys in the request are changed, and an empty value ("" or 0) resets a
+// preference to its default. Unknown keys are rejected, so that typos don't go unnoticed.
+func (app *application) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var input struct {
+		Locale   *string `json:"locale"`
+		Timezone *string `json:"timezone"`
+		PageSize *int    `json:"page_size"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	preferences := user.Preferences
+	if input.Locale != nil {
+		preferences.Locale = *input.Locale
+	}
+	if input.Timezone != nil {
+		preferences.Timezone = *input.Timezone
+	}
+	if input.PageSize != nil {
+		preferences.PageSize = *input.PageSize
+	}
+	v := validator.New()
+	if data.ValidatePreferences(v, preferences); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Users.UpdatePreferences(user.ID, preferences)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": effectivePreferences(preferences)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// effectivePreferences fills in the preferences which haven't been set with the values
+// that are used instead.
+func effectivePreferences(p data.Preferences) data.Preferences {
+	return data.Preferences{
+		Locale:   p.LocaleOr("en"),
+		Timezone: p.Location().String(),
+		PageSize: p.PageSizeOr(defaultPageSize),
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// startMoviePurge starts the job which permanently deletes the movies which were soft
+// deleted more than -movie-deletion-grace ago, along with their revisions and view
+// counts. Until then a deleted movie can still be restored by hand in the database. Like
+// the user purge, it only runs on the leader.
+func (app *application) startMoviePurge() {
+	go func() {
+		for {
+			app.runSingleton("purge_movies", func() {
+				n, err := app.models.Movies.PurgeDeleted(time.Now().Add(-app.config.deletion.movieGrace))
+				if err != nil {
+					app.logger.PrintError(fmt.Errorf("purging deleted movies: %w", err), nil)
+					return
+				}
+				if n > 0 {
+					app.logger.PrintInfo("purged deleted movies", map[string]string{"count": strconv.FormatInt(n, 10)})
+				}
+			})
+			time.Sleep(app.config.deletion.purgeInterval)
+		}
+	}()
+}
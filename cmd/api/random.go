@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The randomMovieHandler returns a random movie, for "surprise me" features in clients.
+// It takes the same title, genres, year and runtime filters as the listing, and responds
+// with a 404 if nothing matches.
+func (app *application) randomMovieHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	title := app.readString(qs, "title", "")
+	var filters data.Filters
+	genres := app.readGenres(qs, &filters)
+	app.readRanges(qs, &filters, v)
+	app.readAdded(qs, app.requestLocation(r), &filters, v)
+	app.readAttributes(qs, &filters, v)
+	if data.ValidateRanges(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	movie, err := app.modelsFor(r).Movies.Random(title, genres, filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": app.serializeMovie(r, movie, false)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
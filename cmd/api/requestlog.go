@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"greenlight.alexedwards.net/internal/jsonlog"
+)
+
+// requestInfoContextKey is the context key for the requestInfo of a request.
+const requestInfoContextKey = contextKey("requestInfo")
+
+// The requestInfo type holds the details about a request which every log entry for the
+// request should include. It's added to the request context by the requestContext()
+// middleware before anything else happens, and is filled in as the request makes its
+// way through the rest of the middleware chain and the router. We store a pointer, so
+// that the details added further down the chain (like the user) are visible to anything
+// holding the original request (like recoverPanic()).
+type requestInfo struct {
+	mu      sync.Mutex
+	id      string
+	route   string
+	handler string
+	userID  int64
+}
+
+// The requestContext() middleware gives each request an ID and adds a requestInfo to
+// its context. If the client (or a load balancer in front of us) sent a sensible
+// X-Request-ID header we use that ID, so that log entries can be correlated across
+// services; otherwise we generate one. Either way the ID is sent back in the response.
+func (app *application) requestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		info := &requestInfo{id: id}
+		ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRequestID returns a random 16 character hex string.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID returns true if id is a non-empty string of at most 64 letters,
+// digits, hyphens, underscores and dots, which is safe to include in our logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// contextRequestInfo returns the requestInfo for a request, or nil if there isn't one
+// (e.g. for requests which didn't go through the middleware chain).
+func contextRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// setRoute records the route pattern which matched the request, and the name of the
+// handler which is serving it.
+func (info *requestInfo) setRoute(route, handler string) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.route = route
+	info.handler = handler
+}
+
+// setHandler records the name of the handler which is serving the request, for
+// handlers which dispatch to another one (like those returned by staticSegment()).
+func (info *requestInfo) setHandler(handler string) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.handler = handler
+}
+
+// setUserID records the ID of the authenticated user making the request.
+func (info *requestInfo) setUserID(id int64) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.userID = id
+}
+
+// The withRoute() helper wraps a handler so that it records its route pattern and name
+// in the requestInfo before running.
+func (app *application) withRoute(route string, next http.HandlerFunc) http.HandlerFunc {
+	return app.withNamedRoute(route, handlerName(next), next)
+}
+
+// The withNamedRoute() helper is like withRoute(), but with the handler name given, for
+// handlers which are wrapped in middleware (whose name would be no use).
+func (app *application) withNamedRoute(route, name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contextRequestInfo(r).setRoute(route, name)
+		next(w, r)
+	}
+}
+
+// handlerName returns the name of a handler function, like "showMovieHandler" for the
+// app.showMovieHandler method value. This is what lets an error log entry tell us which
+// handler it came from, even when the stack trace is for a goroutine started by it.
+// Anonymous functions (like the ones returned by staticSegment()) don't have a useful
+// name, so the empty string is returned for them.
+func handlerName(h http.HandlerFunc) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(h).Pointer())
+	if fn == nil {
+		return ""
+	}
+	name := strings.TrimSuffix(fn.Name(), "-fm")
+	name = name[strings.LastIndex(name, ".")+1:]
+	if strings.HasPrefix(name, "func") {
+		return ""
+	}
+	return name
+}
+
+// The loggerFrom() method returns a logger whose entries include the request ID,
+// method, URL, route and user ID (once they are known) of the request, so that
+// handlers don't need to build up a properties map for every log call.
+func (app *application) loggerFrom(r *http.Request) *jsonlog.Logger {
+	args := []interface{}{
+		"request_method", r.Method,
+		"request_url", r.URL.String(),
+	}
+	if info := contextRequestInfo(r); info != nil {
+		info.mu.Lock()
+		args = append(args, "request_id", info.id)
+		if info.route != "" {
+			args = append(args, "route", info.route)
+		}
+		if info.handler != "" {
+			args = append(args, "handler", info.handler)
+		}
+		if info.userID > 0 {
+			args = append(args, "user_id", strconv.FormatInt(info.userID, 10))
+		}
+		info.mu.Unlock()
+	}
+	return app.logger.With(args...)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The listMovieRevisionsHandler lists the earlier versions of a movie, newest first, so
+// that bad edits can be tracked down. The current version isn't included; it's the
+// movie itself.
+func (app *application) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.movieForRevisions(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := app.modelsFor(r).Movies.GetRevisions(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"current_version": movie.Version, "revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revertMovieHandler puts a movie back the way it was at an earlier version. The
+// revert is an update like any other, so it gets a new version number and the version
+// it replaces is kept as a revision too; nothing is ever lost by reverting.
+func (app *application) revertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.movieForRevisions(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+	revision, err := app.modelsFor(r).Movies.GetRevision(movie.ID, int32(version))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	movie.Title = revision.Title
+	movie.Year = revision.Year
+	movie.Runtime = revision.Runtime
+	movie.Genres = revision.Genres
+	movie.Attributes = revision.Attributes
+	err = app.modelsFor(r).Movies.Update(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.movieEditConflictResponse(w, r, movie)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			// Another movie has taken the title and year since this version.
+			app.failedValidationResponse(w, r, map[string]string{"title": "a movie with this title and year already exists"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "movie_reverted", map[string]string{
+		"movie_id":   strconv.FormatInt(movie.ID, 10),
+		"to_version": strconv.FormatInt(version, 10),
+	})
+	body, err := app.movieResponse(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": body}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieForRevisions fetches the movie named by the id parameter. If there isn't one, it
+// sends a 404 Not Found response and returns false.
+func (app *application) movieForRevisions(w http.ResponseWriter, r *http.Request) (*data.Movie, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	movie, err := app.modelsFor(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return movie, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The listRolesHandler lists the roles which can be assigned to users, and the
+// permissions that each of them grants.
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserRolesHandler shows a user's roles, and all of the permissions they have
+// (through their roles or granted directly).
+func (app *application) showUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	app.writeUserRoles(w, r, user, http.StatusOK)
+}
+
+// The addUserRoleHandler gives a user a role. It's idempotent, so giving a user a role
+// they already have isn't an error.
+func (app *application) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	role := httprouter.ParamsFromContext(r.Context()).ByName("role")
+	err := app.models.Roles.AddForUser(user.ID, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "role_granted", map[string]string{"role": role, "target_user_id": strconv.FormatInt(user.ID, 10)})
+	app.writeUserRoles(w, r, user, http.StatusOK)
+}
+
+// The removeUserRoleHandler takes a role away from a user. Admins can't take the admin
+// role away from themselves, so that there's always someone left who can put things
+// right.
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	role := httprouter.ParamsFromContext(r.Context()).ByName("role")
+	if role == data.RoleAdmin && user.ID == app.contextGetUser(r).ID {
+		app.ownAdminRoleResponse(w, r)
+		return
+	}
+	err := app.models.Roles.RemoveForUser(user.ID, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "role_revoked", map[string]string{"role": role, "target_user_id": strconv.FormatInt(user.ID, 10)})
+	app.writeUserRoles(w, r, user, http.StatusOK)
+}
+
+// adminTargetUser returns the user named by the id parameter of an admin route. If there
+// isn't one it sends a 404 Not Found response and returns false.
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	user, err := app.modelsFor(r).Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// writeUserRoles sends a response with a user's roles and permissions.
+func (app *application) writeUserRoles(w http.ResponseWriter, r *http.Request, user *data.User, status int) {
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	err = app.writeJSON(w, status, envelope{"user_id": user.ID, "roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
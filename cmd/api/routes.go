@@ -1,24 +1,168 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/storage"
 )
 
 func (app *application) routes() http.Handler {
     router := httprouter.New()
     router.NotFound = http.HandlerFunc(app.notFoundResponse)
     router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
-    router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-    router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
-    router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-    router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-    router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-    router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
-    router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-    router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-    router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-    // Use the authenticate() middleware on all requests.
-    return app.recoverPanic(app.rateLimit(app.authenticate(router)))
-}
\ No newline at end of file
+    app.routeTable = make(routeTable)
+    // Routes under one of the versionedPrefixes are registered for every API version,
+    // with the same handler; withAPIVersion() records which version the request is for.
+    // Routes in deprecatedRoutes are wrapped in deprecated().
+    // The GET routes are recorded in the routeTable too, for the links in responses.
+    register := func(method, path string, handler func(path string) http.HandlerFunc) {
+        if method == http.MethodGet {
+            app.routeTable[path] = true
+        }
+        d, isDeprecated := deprecatedRoutes[method+" "+path]
+        build := func(path string) http.HandlerFunc {
+            if isDeprecated {
+                return app.deprecated(method, path, d, handler(path))
+            }
+            return handler(path)
+        }
+        paths := versionedPaths(path)
+        if paths == nil {
+            router.HandlerFunc(method, path, build(path))
+            return
+        }
+        for version, p := range paths {
+            router.HandlerFunc(method, p, app.withAPIVersion(version, build(p)))
+        }
+    }
+    // Register each route with its pattern recorded in the request context, so that log
+    // entries for the request can include it.
+    handle := func(method, path string, handler http.HandlerFunc) {
+        register(method, path, func(path string) http.HandlerFunc { return app.withRoute(path, handler) })
+    }
+    // Routes which need a permission are wrapped in requirePermission(), inside
+    // withNamedRoute() so that log entries for forbidden requests still name the handler.
+    permitted := func(method, path, permission string, handler http.HandlerFunc) {
+        register(method, path, func(path string) http.HandlerFunc {
+            return app.withNamedRoute(path, handlerName(handler), app.requirePermission(permission, handler))
+        })
+    }
+    withRole := func(method, path, role string, handler http.HandlerFunc) {
+        register(method, path, func(path string) http.HandlerFunc {
+            return app.withNamedRoute(path, handlerName(handler), app.requireRole(role, handler))
+        })
+    }
+    authenticated := func(method, path string, handler http.HandlerFunc) {
+        register(method, path, func(path string) http.HandlerFunc {
+            return app.withNamedRoute(path, handlerName(handler), app.requireAuthenticatedUser(handler))
+        })
+    }
+    activated := func(method, path string, handler http.HandlerFunc) {
+        register(method, path, func(path string) http.HandlerFunc {
+            return app.withNamedRoute(path, handlerName(handler), app.requireActivatedUser(handler))
+        })
+    }
+    handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+    handle(http.MethodGet, "/v1/version", app.versionHandler)
+    handle(http.MethodGet, "/livez", app.livezHandler)
+    handle(http.MethodGet, "/readyz", app.readyzHandler)
+    permitted(http.MethodGet, "/v1/movies", "movies:read", app.listMoviesHandler)
+    permitted(http.MethodPost, "/v1/movies", "movies:write", app.createMovieHandler)
+    permitted(http.MethodPatch, "/v1/movies", "movies:write", app.bulkUpdateMoviesHandler)
+    withRole(http.MethodDelete, "/v1/movies", data.RoleAdmin, app.deleteMatchingMoviesHandler)
+    // POST /v1/movies/:id/revert/:version means that the bulk and import routes have to
+    // go through staticSegment(), and there's nothing to POST to a movie's own URL.
+    permitted(http.MethodPost, "/v1/movies/:id", "movies:write", app.staticSegment("id", app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+        "bulk":   app.bulkCreateMoviesHandler,
+        "import": app.importMoviesHandler,
+    }))
+    permitted(http.MethodGet, "/v1/movies/:id", "movies:read", app.staticSegment("id", app.showMovieHandler, map[string]http.HandlerFunc{
+        "export":   app.exportMoviesHandler,
+        "random":   app.randomMovieHandler,
+        "stats":    app.movieStatsHandler,
+        "suggest":  app.suggestMoviesHandler,
+        "trending": app.trendingMoviesHandler,
+    }))
+    permitted(http.MethodPut, "/v1/movies/by-identity", "movies:write", app.upsertMovieHandler)
+    permitted(http.MethodPatch, "/v1/movies/:id", "movies:write", app.updateMovieHandler)
+    permitted(http.MethodDelete, "/v1/movies/:id", "movies:write", app.deleteMovieHandler)
+    permitted(http.MethodGet, "/v1/movies/:id/similar", "movies:read", app.similarMoviesHandler)
+    permitted(http.MethodGet, "/v1/movies/:id/revisions", "movies:read", app.listMovieRevisionsHandler)
+    permitted(http.MethodPost, "/v1/movies/:id/revert/:version", "movies:write", app.revertMovieHandler)
+    // Posters are uploaded with POST rather than PUT, which would clash with
+    // PUT /v1/movies/by-identity.
+    permitted(http.MethodGet, "/v1/movies/:id/poster", "movies:read", app.showMoviePosterHandler)
+    permitted(http.MethodPost, "/v1/movies/:id/poster", "movies:write", app.uploadMoviePosterHandler)
+    permitted(http.MethodDelete, "/v1/movies/:id/poster", "movies:write", app.deleteMoviePosterHandler)
+    permitted(http.MethodPost, "/v1/movies/:id/poster/upload", "movies:write", app.createMoviePosterUploadHandler)
+    permitted(http.MethodGet, "/v1/changes", "movies:read", app.listChangesHandler)
+    activated(http.MethodGet, "/v1/jobs/:id", app.showJobHandler)
+    handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+    handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+    authenticated(http.MethodDelete, "/v1/users/me", app.deleteCurrentUserHandler)
+    activated(http.MethodGet, "/v1/users/me/tokens", app.listUserTokensHandler)
+    activated(http.MethodPost, "/v1/users/me/tokens", app.createAPIKeyHandler)
+    activated(http.MethodDelete, "/v1/users/me/tokens/:id", app.deleteUserTokenHandler)
+    authenticated(http.MethodGet, "/v1/users/me/preferences", app.showPreferencesHandler)
+    authenticated(http.MethodPatch, "/v1/users/me/preferences", app.updatePreferencesHandler)
+    authenticated(http.MethodGet, "/v1/users/me/usage", app.showUsageHandler)
+    activated(http.MethodPost, "/v1/users/me/export", app.requestUserExportHandler)
+    handle(http.MethodGet, "/v1/exports/:id/:signature", app.downloadUserExportHandler)
+    activated(http.MethodGet, "/v1/users/me/sessions", app.listSessionsHandler)
+    activated(http.MethodDelete, "/v1/users/me/sessions", app.deleteOtherSessionsHandler)
+    activated(http.MethodDelete, "/v1/users/me/sessions/:id", app.deleteSessionHandler)
+    handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+    // The admin routes are for admins only, as well as being hidden by allowlist().
+    withRole(http.MethodGet, "/v1/admin/roles", data.RoleAdmin, app.listRolesHandler)
+    withRole(http.MethodGet, "/v1/admin/users", data.RoleAdmin, app.listUsersHandler)
+    withRole(http.MethodGet, "/v1/admin/metering", data.RoleAdmin, app.listMeteringHandler)
+    withRole(http.MethodGet, "/v1/admin/invites", data.RoleAdmin, app.listInvitesHandler)
+    withRole(http.MethodPost, "/v1/admin/invites", data.RoleAdmin, app.createInviteHandler)
+    withRole(http.MethodDelete, "/v1/admin/invites/:id", data.RoleAdmin, app.deleteInviteHandler)
+    withRole(http.MethodGet, "/v1/admin/users/:id/roles", data.RoleAdmin, app.showUserRolesHandler)
+    withRole(http.MethodPut, "/v1/admin/users/:id/roles/:role", data.RoleAdmin, app.addUserRoleHandler)
+    withRole(http.MethodDelete, "/v1/admin/users/:id/roles/:role", data.RoleAdmin, app.removeUserRoleHandler)
+    handle(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+    // The presigned URLs for files in local storage point here. With S3 they point at
+    // the bucket instead.
+    if _, ok := app.storage.(*storage.Local); ok {
+        handle(http.MethodGet, "/v1/files/*key", app.serveFileHandler)
+        handle(http.MethodHead, "/v1/files/*key", app.serveFileHandler)
+        handle(http.MethodPut, "/v1/files/*key", app.uploadFileHandler)
+    }
+    // The debug routes are only available to the clients allowed by allowlist().
+    handle(http.MethodGet, "/debug/vars", expvar.Handler().ServeHTTP)
+    withRole(http.MethodPost, "/debug/shutdown", data.RoleAdmin, app.remoteShutdownHandler)
+    handle(http.MethodGet, "/debug/mail/preview/:template", app.previewMailHandler)
+    // Use the authenticate() middleware on all requests, followed by recordUsage() and
+    // then csrfProtect() for the requests which were authenticated with a session
+    // cookie. The allowlist() middleware comes first (after shedLoad(), which turns
+    // low-priority requests away when we're overloaded), so that the restricted routes
+    // are hidden from everyone else before anything else happens. Then resolveTenant()
+    // works out which tenant's catalog the request is for. Last of all,
+    // negotiateEnvelope() works out whether the response goes in an envelope, and
+    // localizeTimes() which timezone its timestamps are written in.
+    return app.requestContext(app.recoverPanic(app.shedLoad(app.allowlist(app.resolveTenant(app.rateLimit(app.authenticate(app.recordUsage(app.csrfProtect(app.validateRequest(app.negotiateEnvelope(app.localizeTimes(router))))))))))))
+}
+
+// httprouter doesn't allow a static path segment and a named parameter in the same
+// position for the same method (e.g. GET /v1/movies/export and GET /v1/movies/:id). The
+// staticSegment() helper works around this: we register the route with the named
+// parameter, and it dispatches to the handler for a static segment if the parameter
+// value matches one, or to next otherwise.
+func (app *application) staticSegment(param string, next http.HandlerFunc, static map[string]http.HandlerFunc) http.HandlerFunc {
+    nextName := handlerName(next)
+    return func(w http.ResponseWriter, r *http.Request) {
+        value := httprouter.ParamsFromContext(r.Context()).ByName(param)
+        if handler, ok := static[value]; ok {
+            contextRequestInfo(r).setRoute(r.URL.Path, handlerName(handler))
+            handler(w, r)
+            return
+        }
+        contextRequestInfo(r).setHandler(nextName)
+        next(w, r)
+    }
+}
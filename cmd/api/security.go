@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// logSecurityEvent records a security event, like a failed login. The event is written
+// to the log (with the security component and an event property, so it's easy to pick
+// out), saved in the security_events table in the background, and counted towards the
+// alert thresholds. The email and ip properties are saved in their own columns.
+func (app *application) logSecurityEvent(r *http.Request, event string, properties map[string]string) {
+	if properties == nil {
+		properties = make(map[string]string)
+	}
+	if _, ok := properties["ip"]; !ok {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			properties["ip"] = ip
+		}
+	}
+	properties["event"] = event
+	app.loggerFrom(r).Component("security").PrintInfo("security event", properties)
+
+	e := &data.SecurityEvent{
+		CreatedAt:  time.Now(),
+		Event:      event,
+		Email:      properties["email"],
+		IP:         properties["ip"],
+		Properties: make(map[string]string),
+	}
+	for key, value := range properties {
+		if key != "event" && key != "email" && key != "ip" {
+			e.Properties[key] = value
+		}
+	}
+	if info := contextRequestInfo(r); info != nil {
+		info.mu.Lock()
+		e.UserID = info.userID
+		e.Properties["request_id"] = info.id
+		info.mu.Unlock()
+	}
+	// Insert() sets the ID and creation time of the event from another goroutine, so the
+	// alerts get a copy of their own.
+	latest := *e
+	app.background(func() {
+		err := app.models.SecurityEvents.Insert(e)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("recording security event: %w", err), nil)
+		}
+	})
+	if app.alerts != nil {
+		app.alerts.record(app, &latest)
+	}
+}
+
+// The alertThreshold type is the number of events of one kind within a window which
+// triggers an alert.
+type alertThreshold struct {
+	count  int
+	window time.Duration
+}
+
+// parseAlertThresholds parses a comma-separated list of event=count/window thresholds,
+// like "login_failed=100/5m,token_reuse=1/1h".
+func parseAlertThresholds(s string) (map[string]alertThreshold, error) {
+	thresholds := make(map[string]alertThreshold)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		event, rest, ok := strings.Cut(item, "=")
+		countStr, windowStr, ok2 := strings.Cut(rest, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid alert threshold %q: must be in the format event=count/window", item)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid alert threshold %q: count must be a positive integer", item)
+		}
+		window, err := time.ParseDuration(windowStr)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid alert threshold %q: window must be a positive duration", item)
+		}
+		thresholds[strings.TrimSpace(event)] = alertThreshold{count: count, window: window}
+	}
+	return thresholds, nil
+}
+
+// The securityAlerts type counts security events, and sends an alert to the configured
+// hooks (a webhook and/or an email address) when the number of events of one kind within
+// the threshold's window reaches the threshold's count. Only one alert is sent for each
+// kind of event per window, however many more events there are.
+type securityAlerts struct {
+	thresholds map[string]alertThreshold
+	webhook    string
+	email      string
+	client     *http.Client
+
+	mu      sync.Mutex
+	times   map[string][]time.Time
+	alerted map[string]time.Time
+}
+
+func newSecurityAlerts(thresholds map[string]alertThreshold, webhook, email string) *securityAlerts {
+	return &securityAlerts{
+		thresholds: thresholds,
+		webhook:    webhook,
+		email:      email,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		times:      make(map[string][]time.Time),
+		alerted:    make(map[string]time.Time),
+	}
+}
+
+// The securityAlert type is the payload sent to the webhook, and the data for the
+// alert email template.
+type securityAlert struct {
+	Event     string              `json:"event"`
+	Count     int                 `json:"count"`
+	Window    string              `json:"window"`
+	Threshold int                 `json:"threshold"`
+	Latest    *data.SecurityEvent `json:"latest"`
+}
+
+// record counts an event, and sends an alert in the background if it crosses the
+// threshold.
+func (a *securityAlerts) record(app *application, e *data.SecurityEvent) {
+	threshold, ok := a.thresholds[e.Event]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	times := a.times[e.Event]
+	// Drop the events which have fallen out of the window.
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > threshold.window {
+		i++
+	}
+	times = append(times[i:], now)
+	a.times[e.Event] = times
+	fire := len(times) >= threshold.count && now.Sub(a.alerted[e.Event]) > threshold.window
+	if fire {
+		a.alerted[e.Event] = now
+	}
+	a.mu.Unlock()
+	if !fire {
+		return
+	}
+
+	alert := securityAlert{Event: e.Event, Count: len(times), Window: threshold.window.String(), Threshold: threshold.count, Latest: e}
+	app.logger.Component("security").PrintInfo("security alert", map[string]string{
+		"event": e.Event,
+		"count": strconv.Itoa(alert.Count),
+	})
+	if a.webhook != "" {
+		app.background(func() {
+			err := a.postWebhook(alert)
+			if err != nil {
+				app.logger.PrintError(fmt.Errorf("sending security alert webhook: %w", err), nil)
+			}
+		})
+	}
+	if a.email != "" {
+		err := app.sendMail(a.email, "security_alert.tmpl", alert)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("sending security alert email: %w", err), nil)
+		}
+	}
+}
+
+// postWebhook posts an alert to the webhook as JSON.
+func (a *securityAlerts) postWebhook(alert securityAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
@@ -17,16 +17,56 @@ func (app *application) serve() error {
         IdleTimeout:  time.Minute,
         ReadTimeout:  10 * time.Second,
         WriteTimeout: 30 * time.Second,
+        // Send the http.Server's own error messages (like TLS handshake errors and
+        // panics in handlers that escape recoverPanic()) to our logger, rather than
+        // to the standard logger.
+        ErrorLog: app.logger.ErrorLog(),
     }
+    ln, err := app.listen()
+    if err != nil {
+        return err
+    }
+    // The database was pinged before we got here, so now that the listener is up we're
+    // ready. MAINPID tells systemd which process to watch after a handover.
+    app.notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+    app.startWatchdog(ln)
     shutdownError := make(chan error)
+    // The signals can also be sent by remoteShutdownHandler(), through app.quit.
+    app.quit = make(chan os.Signal, 1)
+    signal.Notify(app.quit, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, handoverSignals...)...)
     go func() {
-        quit := make(chan os.Signal, 1)
-        signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-        s := <-quit
-        app.logger.PrintInfo("caught signal", map[string]string{
-            "signal": s.String(),
-        })
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        for {
+            s := <-app.quit
+            app.logger.PrintInfo("caught signal", map[string]string{
+                "signal": s.String(),
+            })
+            if s == syscall.SIGINT || s == syscall.SIGTERM {
+                app.notify("STOPPING=1")
+                break
+            }
+            // A handover signal starts the new process and then shuts this one down in
+            // the usual way, but without telling systemd that the service is stopping,
+            // as the new process carries on. If the handover fails we carry on as we were.
+            err := app.handover(ln)
+            if err == nil {
+                break
+            }
+            app.logger.PrintError(fmt.Errorf("handing over listener: %w", err), nil)
+        }
+        // Fail the readiness probe from now on, so that the load balancer stops sending
+        // us new requests. It takes a few probes for it to notice, so we carry on
+        // serving (new connections included) for the drain delay before shutting down.
+        app.draining.Store(true)
+        // Close connections after their current request too, so that clients with
+        // keep-alive connections move over to other instances in the meantime.
+        srv.SetKeepAlivesEnabled(false)
+        if app.config.shutdown.drainDelay > 0 {
+            app.logger.PrintInfo("draining", map[string]string{
+                "delay": app.config.shutdown.drainDelay.String(),
+            })
+            time.Sleep(app.config.shutdown.drainDelay)
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdown.timeout)
         defer cancel()
         // Call Shutdown() on the server like before, but now we only send on the
         // shutdownError channel if it returns an error.
@@ -34,6 +74,14 @@ func (app *application) serve() error {
         if err != nil {
             shutdownError <- err
         }
+        // Now that no more requests are being handled, stop accepting new email. The
+        // mail workers then exit once they've sent whatever is left in the queue.
+        app.mailQueue.close()
+        // The same goes for the job queue.
+        app.jobQueue.close()
+        // Stop counting views too, which writes out the last of the view counts.
+        app.views.close()
+        app.usage.close()
         // Log a message to say that we're waiting for any background goroutines to
         // complete their tasks.
         app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -44,13 +92,18 @@ func (app *application) serve() error {
         // the shutdownError channel, to indicate that the shutdown completed without
         // any issues.
         app.wg.Wait()
+        // Let another instance take over the singleton jobs straight away.
+        err = app.models.Leader.Resign()
+        if err != nil {
+            app.logger.PrintError(fmt.Errorf("resigning leadership: %w", err), nil)
+        }
         shutdownError <- nil
     }()
     app.logger.PrintInfo("starting server", map[string]string{
         "addr": srv.Addr,
         "env":  app.config.env,
     })
-    err := srv.ListenAndServe()
+    err = srv.Serve(ln)
     if !errors.Is(err, http.ErrServerClosed) {
         return err
     }
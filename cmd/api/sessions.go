@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// tokenTouchInterval is how often we record that a token has been used. Writing to the
+// token on every request would double the cost of authenticating, so the last-used time
+// is only accurate to within this interval.
+const tokenTouchInterval = time.Minute
+
+// maxUserAgentLength is the length that user agents are truncated to before they're
+// stored with a token.
+const maxUserAgentLength = 512
+
+// tokenClient returns the IP address and user agent of the client which sent a request,
+// for storing with a token.
+func tokenClient(r *http.Request) (string, string) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return ip, userAgent
+}
+
+// touchToken records that a stored token has been used to authenticate a request, if it
+// hasn't been recorded within the last tokenTouchInterval. The write happens in the
+// background, so that it doesn't hold up the request.
+func (app *application) touchToken(r *http.Request, token *data.Token) {
+	if token == nil || token.ID == 0 || time.Since(token.LastUsedAt) < tokenTouchInterval {
+		return
+	}
+	ip, userAgent := tokenClient(r)
+	app.background(func() {
+		err := app.models.Tokens.Touch(token.ID, ip, userAgent)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("recording token use: %w", err), nil)
+		}
+	})
+}
+
+// The sessionInfo type is how the session endpoints show an authentication token.
+type sessionInfo struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current,omitempty"`
+}
+
+// The listSessionsHandler lists the places that the user is logged in: their unexpired
+// authentication tokens, along with when they were last used and by which client. API
+// keys aren't sessions, and are listed by listUserTokensHandler instead.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	current := app.contextGetToken(r)
+	sessions := make([]sessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		session := sessionInfo{
+			ID:        token.ID,
+			CreatedAt: token.CreatedAt,
+			Expiry:    token.Expiry,
+			UserAgent: token.UserAgent,
+			IP:        token.IP,
+			Current:   current != nil && current.ID != 0 && current.ID == token.ID,
+		}
+		if !token.LastUsedAt.IsZero() {
+			lastUsedAt := token.LastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSessionHandler logs the user out of one of their sessions.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Tokens.DeleteForUser(user.ID, id, data.ScopeAuthentication)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "session_revoked", map[string]string{"email": user.Email, "session_id": strconv.FormatInt(id, 10)})
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteOtherSessionsHandler logs the user out everywhere apart from the session
+// which made the request. If the request wasn't authenticated with a session (but with
+// an API key or a JWT, say), every session is logged out.
+func (app *application) deleteOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var currentID int64
+	if current := app.contextGetToken(r); current != nil && current.Scope == data.ScopeAuthentication {
+		currentID = current.ID
+	}
+	revoked, err := app.models.Tokens.DeleteAllForUserExcept(data.ScopeAuthentication, user.ID, currentID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logSecurityEvent(r, "sessions_revoked", map[string]string{"email": user.Email, "count": strconv.FormatInt(revoked, 10)})
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "other sessions successfully revoked", "revoked": revoked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
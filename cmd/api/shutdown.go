@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// The remoteShutdownHandler shuts the server down gracefully, in exactly the same way as
+// a SIGTERM does, for orchestration tooling which can't send signals into the container.
+// With {"restart": true} it hands the listener over to a new process first, like a
+// SIGUSR2. The response is sent before the shutdown starts, as the shutdown waits for
+// in-flight requests (including this one) to finish.
+func (app *application) remoteShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Restart bool `json:"restart"`
+	}
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+	var sig os.Signal = syscall.SIGTERM
+	message := "shutting down"
+	if input.Restart {
+		if len(handoverSignals) == 0 {
+			app.badRequestResponse(w, r, errors.New("restarting isn't supported on this platform"))
+			return
+		}
+		sig = handoverSignals[0]
+		message = "restarting"
+	}
+	app.logSecurityEvent(r, "remote_shutdown", map[string]string{
+		"email":  app.contextGetUser(r).Email,
+		"signal": sig.String(),
+	})
+	// If a shutdown is already under way there's nothing more to do.
+	select {
+	case app.quit <- sig:
+	default:
+	}
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/database"
+	"greenlight.alexedwards.net/internal/jsonlog"
+)
+
+// The slowQueryLogger type logs the queries which the database package reports as slow.
+// If plan capture is enabled, then a sample of the slow queries are run again with
+// EXPLAIN ANALYZE in the background, and the plan is included in the log entry. Only one
+// plan is captured at a time, so that a burst of slow queries (which probably means the
+// database is already struggling) can't turn into a burst of extra load.
+//
+// Note that we don't log the query arguments, as they can contain personal data like
+// email addresses and password hashes.
+type slowQueryLogger struct {
+	logger     *jsonlog.Logger
+	db         *sql.DB
+	explain    bool
+	sampleRate float64
+	explaining chan struct{}
+}
+
+func newSlowQueryLogger(logger *jsonlog.Logger, cfg config) *slowQueryLogger {
+	return &slowQueryLogger{
+		logger:     logger,
+		explain:    cfg.db.slowQuery.explain,
+		sampleRate: cfg.db.slowQuery.sampleRate,
+		explaining: make(chan struct{}, 1),
+	}
+}
+
+// log is the database.Options.OnSlow hook.
+func (l *slowQueryLogger) log(q database.Query) {
+	properties := map[string]string{
+		"query":    strings.Join(strings.Fields(q.SQL), " "),
+		"duration": q.Duration.String(),
+	}
+	if l.explain && l.db != nil && rand.Float64() < l.sampleRate {
+		select {
+		case l.explaining <- struct{}{}:
+			go func() {
+				defer func() { <-l.explaining }()
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				plan, err := database.Explain(ctx, l.db, q.SQL, q.Args...)
+				if err != nil {
+					properties["plan_error"] = err.Error()
+				} else {
+					properties["plan"] = string(plan)
+				}
+				l.logger.PrintInfo("slow query", properties)
+			}()
+			return
+		default:
+		}
+	}
+	l.logger.PrintInfo("slow query", properties)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The movieStatsHandler returns statistics about the whole catalog for dashboards: the
+// number of movies in each genre and decade, the average runtime, and the newest and
+// oldest entries.
+func (app *application) movieStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.modelsFor(r).Movies.Stats()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The jsonStream type writes a JSON response containing a (potentially very large) array
+// one element at a time, instead of building the whole response in memory first like
+// writeJSON() does. The response looks like this:
+//
+//	{
+//		"movies": [
+//			{...},
+//			{...}
+//		],
+//		"metadata": {...}
+//	}
+//
+// The fields after the array (like the pagination metadata) are passed to close(), as
+// we usually only know them once all of the elements have been written.
+//
+// If the client asked for bare responses (see negotiateEnvelope()), the response is just
+// the array, and the trailing fields are left out. The timestamps are written in the
+// request's timezone, like they are by writeJSON().
+//
+// The status code and headers aren't sent until the first element is written (or the
+// stream is closed), so if something goes wrong before then the handler can still send
+// a normal error response. The started() method tells the handler whether that's still
+// possible.
+type jsonStream struct {
+	w      http.ResponseWriter
+	status int
+	key    string
+	n      int
+	begun  bool
+	bare   bool
+	loc    *time.Location
+}
+
+// newJSONStream returns a new jsonStream which writes the array under the given key.
+func newJSONStream(w http.ResponseWriter, status int, key string) *jsonStream {
+	return &jsonStream{w: w, status: status, key: key, bare: isBare(w), loc: responseLocation(w)}
+}
+
+// begin sends the status code and headers, and opens the array.
+func (s *jsonStream) begin() error {
+	if s.begun {
+		return nil
+	}
+	s.begun = true
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(s.status)
+	if s.bare {
+		_, err := s.w.Write([]byte("["))
+		return err
+	}
+	_, err := s.w.Write([]byte("{\n\t" + strconv.Quote(s.key) + ": ["))
+	return err
+}
+
+// started returns true if the status code and headers have already been sent.
+func (s *jsonStream) started() bool {
+	return s.begun
+}
+
+// write encodes v and writes it as the next element of the array.
+func (s *jsonStream) write(v interface{}) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if s.n > 0 {
+		buf.WriteByte(',')
+	}
+	indent := "\t\t"
+	if s.bare {
+		indent = "\t"
+	}
+	buf.WriteString("\n" + indent)
+	enc := json.NewEncoder(buf)
+	enc.SetIndent(indent, "\t")
+	err := enc.Encode(v)
+	if err != nil {
+		return err
+	}
+	// Remove the newline that Encode() adds.
+	buf.Truncate(buf.Len() - 1)
+	err = s.begin()
+	if err != nil {
+		return err
+	}
+	s.n++
+	js := buf.Bytes()
+	if s.loc != nil {
+		js = localizeTimestamps(js, s.loc)
+	}
+	_, err = s.w.Write(js)
+	return err
+}
+
+// close closes the array, writes the trailing fields (in key order, in the same way
+// that encoding/json orders map keys), and finishes the response.
+func (s *jsonStream) close(trailer envelope) error {
+	err := s.begin()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if s.bare {
+		if s.n > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("]\n")
+		_, err = s.w.Write(buf.Bytes())
+		return err
+	}
+	if s.n > 0 {
+		buf.WriteString("\n\t")
+	}
+	buf.WriteByte(']')
+	keys := make([]string, 0, len(trailer))
+	for key := range trailer {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		js, err := json.MarshalIndent(trailer[key], "\t", "\t")
+		if err != nil {
+			return err
+		}
+		buf.WriteString(",\n\t" + strconv.Quote(key) + ": ")
+		buf.Write(js)
+	}
+	buf.WriteString("\n}\n")
+	js := buf.Bytes()
+	if s.loc != nil {
+		js = localizeTimestamps(js, s.loc)
+	}
+	_, err = s.w.Write(js)
+	return err
+}
+
+// The streamErrorResponse() method handles an error which occurs while streaming a
+// response. If nothing has been sent to the client yet, then it sends a normal 500
+// Internal Server Error response. Otherwise it's too late for that, so we just log the
+// error and leave the client with a truncated (and therefore invalid) response body.
+func (app *application) streamErrorResponse(w http.ResponseWriter, r *http.Request, started bool, err error) {
+	if !started {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logError(r, err)
+}
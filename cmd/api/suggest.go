@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// suggestLimit is the number of suggestions returned by GET /v1/movies/suggest.
+const suggestLimit = 10
+
+// The suggestMoviesHandler() returns the movies whose titles best match the q query
+// string parameter, for a typeahead: just their IDs, titles and years, so that it's
+// cheap enough to call on every keystroke. Clients can cache the suggestions briefly.
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	v := validator.New()
+	v.Check(q != "", "q", "must be provided")
+	v.Check(utf8.RuneCountInString(q) <= 100, "q", "must not be more than 100 characters long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	suggestions, err := app.modelsFor(r).Movies.Suggest(q, suggestLimit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state change (like "READY=1") to systemd over the socket in
+// NOTIFY_SOCKET, for units with Type=notify. It does nothing if the variable isn't set,
+// so it's safe to call when we aren't running under systemd. NOTIFY_SOCKET is left set
+// so that a process started by handover() can notify systemd too; that needs
+// NotifyAccess=all in the unit, as the new process isn't the one systemd started.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// A leading @ means a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify calls sdNotify and logs any error, as systemd not hearing from us isn't a
+// reason to stop serving.
+func (app *application) notify(state string) {
+	err := sdNotify(state)
+	if err != nil {
+		app.logger.PrintError(fmt.Errorf("notifying systemd: %w", err), nil)
+	}
+}
+
+// watchdogInterval returns the watchdog timeout systemd has set for the unit with
+// WatchdogSec=, or zero if the watchdog isn't enabled for this process. WATCHDOG_PID is
+// unset afterwards, in the same way as LISTEN_PID, so that the process started by
+// handover() takes over the keepalives once it has become the main process.
+func watchdogInterval() time.Duration {
+	defer os.Unsetenv("WATCHDOG_PID")
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog starts the health loop which keeps the systemd watchdog from restarting
+// the service. Every half of the watchdog timeout it makes a request to /livez through
+// the listener, and only sends WATCHDOG=1 if the server answers, so a server which has
+// stopped handling requests gets restarted even though the process is still running.
+// Any response counts, in the same way as for the liveness probe.
+func (app *application) startWatchdog(ln net.Listener) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		app.logger.PrintError(fmt.Errorf("starting watchdog: %w", err), nil)
+		return
+	}
+	url := "http://" + net.JoinHostPort("localhost", port) + "/livez"
+	client := &http.Client{Timeout: interval / 2}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			resp, err := client.Get(url)
+			if err != nil {
+				app.logger.PrintError(fmt.Errorf("watchdog health check: %w", err), nil)
+				continue
+			}
+			resp.Body.Close()
+			app.notify("WATCHDOG=1")
+		}
+	}()
+}
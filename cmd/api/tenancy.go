@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// tenantCacheTTL is how long resolveTenant() remembers a tenant for, so that most
+// requests don't need to look their tenant up.
+const tenantCacheTTL = time.Minute
+
+// tenantContextKey holds the tenant that the request was made to.
+const tenantContextKey = contextKey("tenant")
+
+// The contextGetTenant() method returns the tenant that the request was made to, or nil
+// if tenancy is off.
+func (app *application) contextGetTenant(r *http.Request) *data.Tenant {
+	tenant, _ := r.Context().Value(tenantContextKey).(*data.Tenant)
+	return tenant
+}
+
+// The modelsFor() method returns the models that a request should use: the models
+// scoped to the request's tenant, or all of the models if tenancy is off (in which case
+// every movie and user is in the one catalog). Once the request is authenticated, the
+// movies that it creates and updates are attributed to the user.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	models := app.models
+	if tenant := app.contextGetTenant(r); tenant != nil {
+		models = models.ForTenant(tenant.ID)
+	}
+	// This is called by the authenticate() middleware too, before there's a user.
+	if user, ok := r.Context().Value(userContextKey).(*data.User); ok && !user.IsAnonymous() {
+		models = models.ActingAs(user.ID)
+	}
+	return models
+}
+
+// requestTenantSlug returns the slug of the tenant that a request names, or "" for the
+// default tenant. With -tenancy=header the slug is the -tenant-header header, and with
+// -tenancy=subdomain it's the label in front of -tenant-domain in the Host header.
+func (app *application) requestTenantSlug(r *http.Request) string {
+	if app.config.tenancy.mode == "header" {
+		return strings.ToLower(strings.TrimSpace(r.Header.Get(app.config.tenancy.header)))
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	slug, ok := strings.CutSuffix(host, "."+strings.ToLower(app.config.tenancy.domain))
+	if !ok {
+		return ""
+	}
+	return slug
+}
+
+// The tenantCache type caches tenants by slug. Only tenants which exist are cached, so
+// that requests for made-up slugs can't fill it up.
+type tenantCache struct {
+	mu      sync.Mutex
+	tenants map[string]cachedTenant
+}
+
+type cachedTenant struct {
+	tenant  *data.Tenant
+	expires time.Time
+}
+
+func (c *tenantCache) get(slug string) (*data.Tenant, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.tenants[slug]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.tenant, true
+}
+
+func (c *tenantCache) set(slug string, tenant *data.Tenant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for s, entry := range c.tenants {
+		if now.After(entry.expires) {
+			delete(c.tenants, s)
+		}
+	}
+	c.tenants[slug] = cachedTenant{tenant: tenant, expires: now.Add(tenantCacheTTL)}
+}
+
+// The resolveTenant() middleware works out which tenant a request was made to, from its
+// header or subdomain (see requestTenantSlug()), and adds it to the request context for
+// modelsFor(). Requests which don't name a tenant go to the default one, and requests
+// which name a tenant which doesn't exist get a 404 Not Found response. It comes before
+// authentication, so that tokens are only accepted for users of the request's tenant.
+func (app *application) resolveTenant(next http.Handler) http.Handler {
+	if app.config.tenancy.mode == "off" {
+		return next
+	}
+	cache := &tenantCache{tenants: make(map[string]cachedTenant)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug := app.requestTenantSlug(r)
+		if slug == "" {
+			slug = data.DefaultTenantSlug
+		}
+		tenant, ok := cache.get(slug)
+		if !ok {
+			v := validator.New()
+			if data.ValidateTenant(v, &data.Tenant{Slug: slug, Name: slug}); !v.Valid() {
+				app.notFoundResponse(w, r)
+				return
+			}
+			var err error
+			tenant, err = app.models.Tenants.GetBySlug(slug)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notFoundResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+			cache.set(slug, tenant)
+		}
+		ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
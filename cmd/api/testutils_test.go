@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/jsonlog"
+	"greenlight.alexedwards.net/internal/storage"
+)
+
+// newTestApplication returns an application for handler tests, with the mock models, a
+// logger which discards everything, local storage in a temporary directory, and the
+// configuration of a development server with rate limiting turned off.
+func newTestApplication(t testing.TB) *application {
+	t.Helper()
+	var cfg config
+	cfg.env = "development"
+	cfg.baseURL = "http://localhost:4000"
+	cfg.envelope = true
+	cfg.registration.mode = "open"
+	cfg.tenancy.mode = "off"
+	cfg.exports.signingKey = "test-signing-key"
+	cfg.admin.allowCIDRs, _ = parseCIDRs("127.0.0.1,::1")
+	cfg.storage.urlTTL = time.Minute
+	store, err := storage.NewLocal(t.TempDir(), cfg.baseURL, []byte(cfg.exports.signingKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &application{
+		config:  cfg,
+		logger:  jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:  data.NewMockModels(),
+		storage: store,
+	}
+}
+
+// newTestUser creates an activated user with the given permissions, and returns them
+// with the plaintext of an authentication token for them.
+func newTestUser(t *testing.T, app *application, permissions ...string) (*data.User, string) {
+	t.Helper()
+	// The lowest bcrypt cost keeps the tests quick; it's restored when the test ends.
+	hashing := data.PasswordHashing
+	data.PasswordHashing.BcryptCost = 4
+	t.Cleanup(func() { data.PasswordHashing = hashing })
+	user := &data.User{Name: "Test User", Email: "test@example.com", Activated: true}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) > 0 {
+		err = app.models.Permissions.AddForUser(user.ID, permissions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.Plaintext
+}
+
+// The testServer type is an httptest.Server with helpers for making requests to it.
+type testServer struct {
+	*httptest.Server
+}
+
+// newTestServer starts a test server for a handler, which is closed when the test ends.
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &testServer{ts}
+}
+
+// request makes a request to the test server and returns the status code, headers and
+// body of the response. If token isn't empty, the request is authenticated with it.
+func (ts *testServer) request(t *testing.T, method, urlPath, token string, body []byte) (int, http.Header, string) {
+	t.Helper()
+	return ts.requestWithHeader(t, method, urlPath, token, body, nil)
+}
+
+// requestWithHeader makes a request like request(), with extra request headers.
+func (ts *testServer) requestWithHeader(t *testing.T, method, urlPath, token string, body []byte, header http.Header) (int, http.Header, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+urlPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+	respBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs.StatusCode, rs.Header, string(bytes.TrimSpace(respBody))
+}
+
+// get makes an unauthenticated GET request to the test server.
+func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, string) {
+	t.Helper()
+	return ts.request(t, http.MethodGet, urlPath, "", nil)
+}
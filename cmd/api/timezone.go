@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// locationContextKey holds the timezone of the request.
+const locationContextKey = contextKey("location")
+
+// The zonedResponseWriter type marks a response whose timestamps should be written in a
+// timezone other than UTC (see localizeTimestamps()), like bareResponseWriter does for
+// responses without an envelope.
+type zonedResponseWriter struct {
+	http.ResponseWriter
+	loc *time.Location
+}
+
+// Unwrap lets http.ResponseController get at the underlying ResponseWriter.
+func (w *zonedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseLocation returns the timezone that a response's timestamps should be written
+// in, or nil for UTC, looking through any other ResponseWriters that it has been wrapped
+// in.
+func responseLocation(w http.ResponseWriter) *time.Location {
+	for {
+		switch rw := w.(type) {
+		case *zonedResponseWriter:
+			return rw.loc
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// The localizeTimes() middleware works out the timezone of a request: the tz query
+// string parameter if there is one, or else the user's timezone preference (UTC if they
+// haven't set one). Timestamps are always stored in UTC; the timezone only changes how
+// they're written in responses, and where the day boundaries fall for date filters like
+// added=today.
+func (app *application) localizeTimes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loc := time.UTC
+		if user, ok := r.Context().Value(userContextKey).(*data.User); ok {
+			loc = user.Preferences.Location()
+		}
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			var err error
+			loc, err = time.LoadLocation(tz)
+			if err != nil {
+				app.failedValidationResponse(w, r, map[string]string{"tz": "must be an IANA timezone like Europe/London"})
+				return
+			}
+		}
+		if loc != time.UTC {
+			w = &zonedResponseWriter{ResponseWriter: w, loc: loc}
+		}
+		ctx := context.WithValue(r.Context(), locationContextKey, loc)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// The requestLocation() method returns the timezone of a request.
+func (app *application) requestLocation(r *http.Request) *time.Location {
+	loc, ok := r.Context().Value(locationContextKey).(*time.Location)
+	if !ok {
+		return time.UTC
+	}
+	return loc
+}
+
+// The readAdded() helper reads the added query string parameter into the added range of
+// a Filters struct. It's a day in the request's timezone: today, yesterday or a date
+// like 2024-01-31.
+func (app *application) readAdded(qs url.Values, loc *time.Location, f *data.Filters, v *validator.Validator) {
+	s := qs.Get("added")
+	if s == "" {
+		return
+	}
+	now := time.Now().In(loc)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch s {
+	case "today":
+	case "yesterday":
+		day = day.AddDate(0, 0, -1)
+	default:
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			v.AddError("added", "must be today, yesterday or a date like 2024-01-31")
+			return
+		}
+	}
+	// AddDate() rather than adding 24 hours, as days with a daylight saving change are
+	// shorter or longer than that.
+	f.AddedFrom, f.AddedBefore = day, day.AddDate(0, 0, 1)
+}
+
+// timestampKeyRX matches the keys of the timestamps in our responses, like created_at,
+// expiry and verify_until.
+var timestampKeyRX = regexp.MustCompile(`(_at|_from|_until|^expiry)$`)
+
+// localizeTimestamps rewrites the timestamps in an encoded JSON response in a timezone.
+// encoding/json always writes a time.Time in its own location, which is UTC for
+// everything we read from the database, so rather than converting every timestamp
+// before it's encoded we convert the string values of the timestamp keys
+// (timestampKeyRX) afterwards. Values which aren't RFC 3339 timestamps are left alone.
+func localizeTimestamps(js []byte, loc *time.Location) []byte {
+	out := make([]byte, 0, len(js)+len(js)/8)
+	key := ""
+	for i := 0; i < len(js); {
+		c := js[i]
+		if c != '"' {
+			if c == '{' || c == '[' {
+				key = ""
+			}
+			out = append(out, c)
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(js) && js[end] != '"' {
+			if js[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		end++
+		s := js[i:min(end, len(js))]
+		next := end
+		for next < len(js) && (js[next] == ' ' || js[next] == '\t' || js[next] == '\n' || js[next] == '\r') {
+			next++
+		}
+		switch {
+		case next < len(js) && js[next] == ':':
+			key = string(s[1 : len(s)-1])
+		case timestampKeyRX.MatchString(key):
+			if t, err := time.Parse(time.RFC3339Nano, string(s[1:len(s)-1])); err == nil {
+				s = []byte(strconv.Quote(t.In(loc).Format(time.RFC3339Nano)))
+			}
+			key = ""
+		default:
+			key = ""
+		}
+		out = append(out, s...)
+		i = end
+	}
+	return out
+}
@@ -2,19 +2,32 @@ package main
 
 import (
 	"errors"
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
 )
+
+// tokenLookupFailures counts the requests with a token which didn't match, by scope.
+// A sudden rise means that someone is probably guessing tokens. It's published at
+// /debug/vars.
+var tokenLookupFailures = expvar.NewMap("token_lookup_failures")
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
     // Parse the email and password from the request body.
     var input struct {
         Email    string `json:"email"`
         Password string `json:"password"`
+        Cookie       bool   `json:"cookie"`
+        Format       string `json:"format"`
+        Permissions  []string `json:"permissions"`
+        CaptchaToken string `json:"captcha_token"`
     }
-    err := app.readJSON(w, r, &input)
+    err := app.readJSONWithOptions(w, r, &input, lenientJSONOptions)
     if err != nil {
         app.badRequestResponse(w, r, err)
         return
@@ -23,18 +36,58 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
     v := validator.New()
     data.ValidateEmail(v, input.Email)
     data.ValidatePasswordPlaintext(v, input.Password)
+    v.Check(!input.Cookie || app.config.cookies.enabled, "cookie", "cookie sessions are not enabled")
+    v.Check(validator.In(input.Format, "", "opaque", "jwt"), "format", "must be opaque or jwt")
+    v.Check(input.Format != "jwt" || app.jwtKeys != nil, "format", "jwt authentication tokens are not enabled")
+    v.Check(input.Format != "jwt" || !input.Cookie, "format", "jwt authentication tokens can't be used with cookie sessions")
     if !v.Valid() {
         app.failedValidationResponse(w, r, v.Errors)
         return
     }
+    // Before checking the password, make sure that neither the client's IP address nor
+    // the email address have failed to log in too many times recently. If they have,
+    // then they must wait, and after even more failures solve a CAPTCHA as well.
+    ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+    ipKey, emailKey := loginKeys(ip, input.Email)
+    loginFailed := func(reason string) {
+        properties := map[string]string{"email": input.Email, "ip": ip, "reason": reason}
+        if app.logins != nil {
+            properties["failures"] = strconv.Itoa(app.logins.fail(ipKey, emailKey))
+        }
+        app.logSecurityEvent(r, "login_failed", properties)
+        app.invalidCredentialsResponse(w, r)
+    }
+    if app.logins != nil {
+        wait, failures := app.logins.check(ipKey, emailKey)
+        if wait > 0 {
+            app.logSecurityEvent(r, "login_throttled", map[string]string{"email": input.Email, "ip": ip, "failures": strconv.Itoa(failures)})
+            app.loginThrottledResponse(w, r, wait)
+            return
+        }
+        if app.captcha != nil && failures >= app.config.login.captchaAfter {
+            ok := false
+            if input.CaptchaToken != "" {
+                ok, err = app.captcha.Verify(r.Context(), input.CaptchaToken, ip)
+                if err != nil {
+                    app.serverErrorResponse(w, r, err)
+                    return
+                }
+            }
+            if !ok {
+                app.logSecurityEvent(r, "captcha_failed", map[string]string{"email": input.Email, "ip": ip, "failures": strconv.Itoa(failures)})
+                app.captchaRequiredResponse(w, r)
+                return
+            }
+        }
+    }
     // Lookup the user record based on the email address. If no matching user was
     // found, then we call the app.invalidCredentialsResponse() helper to send a 401
     // Unauthorized response to the client (we will create this helper in a moment).
-    user, err := app.models.Users.GetByEmail(input.Email)
+    user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
-            app.invalidCredentialsResponse(w, r)
+            loginFailed("unknown_email")
         default:
             app.serverErrorResponse(w, r, err)
         }
@@ -49,20 +102,223 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
     // If the passwords don't match, then we call the app.invalidCredentialsResponse()
     // helper again and return.
     if !match {
-        app.invalidCredentialsResponse(w, r)
+        loginFailed("wrong_password")
         return
     }
+    if app.logins != nil {
+        app.logins.succeed(emailKey)
+    }
+    // Now that we know the plaintext password, upgrade the stored hash if it was made
+    // with an old algorithm or old parameters. This is best effort: if it fails the
+    // user can still log in, and we'll try again next time.
+    if user.Password.NeedsRehash() {
+        err = user.Password.Set(input.Password)
+        if err == nil {
+            err = app.modelsFor(r).Users.Update(user)
+        }
+        if err != nil && !errors.Is(err, data.ErrEditConflict) {
+            app.logError(r, fmt.Errorf("rehashing password: %w", err))
+        }
+    }
     // Otherwise, if the password is correct, we generate a new token with a 24-hour
     // expiry time and the scope 'authentication'.
-    token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+    // The token can be restricted to some of the user's permissions, but it can't be
+    // given any that the user doesn't have.
+    permissions, ok := app.tokenPermissions(w, r, user, input.Permissions)
+    if !ok {
+        return
+    }
+    // If the client asked for a JWT, sign one instead of storing a token.
+    var token *data.Token
+    if input.Format == "jwt" {
+        token, err = app.newJWT(user, 24*time.Hour, permissions)
+    } else {
+        token, err = data.NewToken(user.ID, 24*time.Hour, data.ScopeAuthentication)
+        if err == nil {
+            token.Permissions = permissions
+            token.IP, token.UserAgent = tokenClient(r)
+            err = app.models.Tokens.Insert(token)
+        }
+    }
     if err != nil {
         app.serverErrorResponse(w, r, err)
         return
     }
+    app.recordLogin(r, user)
+    // If the client asked for a cookie session, set the token in the session cookie
+    // instead of returning it, and return the CSRF token that the client needs to send
+    // with unsafe requests.
+    if input.Cookie {
+        csrf := app.setSessionCookies(w, token)
+        err = app.writeJSON(w, http.StatusCreated, envelope{"csrf_token": csrf, "expiry": token.Expiry}, nil)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
     // Encode the token to JSON and send it in the response along with a 201 Created
     // status code.
     err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
-}
\ No newline at end of file
+}
+
+// tokenPermissions checks the permissions that a new token is to be restricted to, which
+// must all be permissions that the user has, and returns them. If they aren't valid it
+// sends a failed validation response and returns false.
+func (app *application) tokenPermissions(w http.ResponseWriter, r *http.Request, user *data.User, requested []string) (data.Permissions, bool) {
+    if len(requested) == 0 {
+        return nil, true
+    }
+    permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return nil, false
+    }
+    v := validator.New()
+    v.Check(validator.Unique(requested), "permissions", "must not contain duplicate values")
+    for _, code := range requested {
+        v.Check(permissions.Include(code), "permissions", fmt.Sprintf("you don't have the %q permission", code))
+    }
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v.Errors)
+        return nil, false
+    }
+    return requested, true
+}
+
+// The tokenInfo type is how the token management endpoints show a token. The plaintext
+// is only ever included in the response which creates the token, as it isn't stored.
+type tokenInfo struct {
+    ID          int64            `json:"id"`
+    Type        string           `json:"type"`
+    Name        string           `json:"name,omitempty"`
+    Token       string           `json:"token,omitempty"`
+    Permissions data.Permissions `json:"permissions,omitempty"`
+    CreatedAt   time.Time        `json:"created_at"`
+    Expiry      time.Time        `json:"expiry"`
+    Current     bool             `json:"current,omitempty"`
+}
+
+func newTokenInfo(token *data.Token, current *data.Token) tokenInfo {
+    return tokenInfo{
+        ID:          token.ID,
+        Type:        token.Scope,
+        Name:        token.Name,
+        Token:       token.Plaintext,
+        Permissions: token.Permissions,
+        CreatedAt:   token.CreatedAt,
+        Expiry:      token.Expiry,
+        Current:     current != nil && current.ID != 0 && current.ID == token.ID,
+    }
+}
+
+// The listUserTokensHandler lists the user's authentication tokens and API keys, so that
+// they can see where they're logged in and revoke anything they don't recognise. JWTs
+// aren't stored, so they aren't listed and can't be revoked: they're only valid until
+// they expire.
+func (app *application) listUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+    tokens, err := app.models.Tokens.GetAllForUser(user.ID, data.ScopeAuthentication, data.ScopeAPIKey)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+    current := app.contextGetToken(r)
+    loc := app.userPreferences(r).Location()
+    infos := make([]tokenInfo, 0, len(tokens))
+    for _, token := range tokens {
+        info := newTokenInfo(token, current)
+        // Show the times in the user's own timezone.
+        info.CreatedAt = info.CreatedAt.In(loc)
+        info.Expiry = info.Expiry.In(loc)
+        infos = append(infos, info)
+    }
+    err = app.writeJSON(w, http.StatusOK, envelope{"tokens": infos}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// The maximum and default lifetimes of an API key.
+const (
+    maxAPIKeyTTL     = 365 * 24 * time.Hour
+    defaultAPIKeyTTL = 90 * 24 * time.Hour
+)
+
+// The createAPIKeyHandler creates a named API key for the user, optionally restricted to
+// some of their permissions. API keys work like authentication tokens, but they're made
+// for scripts and other services rather than by logging in.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+    var input struct {
+        Name        string   `json:"name"`
+        Permissions []string `json:"permissions"`
+        TTL         string   `json:"ttl"`
+    }
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+    ttl := defaultAPIKeyTTL
+    v := validator.New()
+    v.Check(input.Name != "", "name", "must be provided")
+    v.Check(len(input.Name) <= 100, "name", "must not be more than 100 bytes long")
+    if input.TTL != "" {
+        ttl, err = time.ParseDuration(input.TTL)
+        v.Check(err == nil, "ttl", "must be a duration, like 720h")
+        v.Check(err != nil || ttl > 0, "ttl", "must be positive")
+        v.Check(err != nil || ttl <= maxAPIKeyTTL, "ttl", "must not be more than 8760h")
+    }
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v.Errors)
+        return
+    }
+    permissions, ok := app.tokenPermissions(w, r, user, input.Permissions)
+    if !ok {
+        return
+    }
+    token, err := data.NewToken(user.ID, ttl, data.ScopeAPIKey)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+    token.Name = input.Name
+    token.Permissions = permissions
+    token.IP, token.UserAgent = tokenClient(r)
+    err = app.models.Tokens.Insert(token)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+    err = app.writeJSON(w, http.StatusCreated, envelope{"token": newTokenInfo(token, nil)}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// The deleteUserTokenHandler revokes one of the user's authentication tokens or API keys.
+func (app *application) deleteUserTokenHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+    user := app.contextGetUser(r)
+    err = app.models.Tokens.DeleteForUser(user.ID, id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+    err = app.writeJSON(w, http.StatusOK, envelope{"message": "token successfully revoked"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// maxRateLimitedTokens is the most distinct tokens that rate-limited requests are
+// counted for between flushes. Rate-limited requests haven't been authenticated, so
+// without a limit a client could fill the map by sending made-up tokens.
+const maxRateLimitedTokens = 10_000
+
+// The usageCounter type counts the requests made by each user (and with each of their
+// tokens) in memory, and writes the counts to the api_usage table in batches, in the
+// same way that viewCounter does for movie views.
+type usageCounter struct {
+	mu          sync.Mutex
+	counts      map[data.UsageKey]data.UsageCounts
+	rateLimited map[string]int64
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// record counts a request made by an authenticated user, with the sizes of its body and
+// the response body.
+func (c *usageCounter) record(key data.UsageKey, status int, bytesIn, bytesOut int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	counts := c.counts[key]
+	counts.Requests++
+	if status >= 400 {
+		counts.Errors++
+	}
+	counts.BytesIn += bytesIn
+	counts.BytesOut += bytesOut
+	c.counts[key] = counts
+	c.mu.Unlock()
+}
+
+// recordRateLimited counts a request which the rate limiter turned away, by the token it
+// was sent with. Requests without a stored token (anonymous requests, and JWTs) can't be
+// attributed to anyone, so they aren't counted.
+func (c *usageCounter) recordRateLimited(token string) {
+	if c == nil || len(token) != 26 {
+		return
+	}
+	hash := string(data.HashToken(token))
+	c.mu.Lock()
+	if _, ok := c.rateLimited[hash]; ok || len(c.rateLimited) < maxRateLimitedTokens {
+		c.rateLimited[hash]++
+	}
+	c.mu.Unlock()
+}
+
+// take returns the counts since the last call, and resets them.
+func (c *usageCounter) take() (map[data.UsageKey]data.UsageCounts, map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts, rateLimited := c.counts, c.rateLimited
+	c.counts = make(map[data.UsageKey]data.UsageCounts)
+	c.rateLimited = make(map[string]int64)
+	return counts, rateLimited
+}
+
+// close stops the flush goroutine, which writes the counts that haven't been written yet
+// before it exits.
+func (c *usageCounter) close() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// startUsageCounter creates the usage counter and starts the goroutine which flushes the
+// counts to the database, tracked by the application WaitGroup like the view counter's.
+// The counts which are older than data.UsageRetention are deleted once a day.
+func (app *application) startUsageCounter() {
+	if app.config.usage.flushInterval <= 0 {
+		return
+	}
+	app.usage = &usageCounter{
+		counts:      make(map[data.UsageKey]data.UsageCounts),
+		rateLimited: make(map[string]int64),
+		stop:        make(chan struct{}),
+	}
+	logger := app.logger.Component("usage")
+	var pruned time.Time
+	flush := func() {
+		now := time.Now()
+		counts, rateLimited := app.usage.take()
+		err := app.models.Usage.Add(counts, rateLimited, now)
+		if err != nil {
+			logger.PrintError(fmt.Errorf("writing usage counts: %w", err), nil)
+		}
+		if now.Sub(pruned) >= 24*time.Hour {
+			app.runSingleton("prune_usage", func() {
+				err := app.models.Usage.Prune(now.Add(-data.UsageRetention))
+				if err != nil {
+					logger.PrintError(fmt.Errorf("pruning usage counts: %w", err), nil)
+				} else {
+					pruned = now
+				}
+			})
+		}
+	}
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.usage.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-app.usage.stop:
+				flush()
+				return
+			}
+		}
+	}()
+}
+
+// The usageResponseWriter type records the status code and body size of a response for
+// the recordUsage() middleware.
+type usageResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *usageResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *usageResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController get at the underlying ResponseWriter.
+func (w *usageResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// The usageBody type counts the bytes read from a request body for the recordUsage()
+// middleware.
+type usageBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// The recordUsage() middleware counts the requests made by authenticated users, whether
+// they failed, and the bytes they sent and received (the request body as far as the
+// handler read it, and the response body), towards their usage. It comes after
+// authenticate(), so anonymous requests (and the ones whose token was rejected) aren't
+// counted.
+func (app *application) recordUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if app.usage == nil || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := data.UsageKey{UserID: user.ID}
+		if token := app.contextGetToken(r); token != nil {
+			key.TokenID, key.APIKey = token.ID, token.Scope == data.ScopeAPIKey
+		}
+		uw := &usageResponseWriter{ResponseWriter: w}
+		body := &usageBody{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			// A panic is turned into a 500 response by recoverPanic(), further out, so
+			// count it as one and pass it on.
+			if err := recover(); err != nil {
+				app.usage.record(key, http.StatusInternalServerError, body.bytes, uw.bytes)
+				panic(err)
+			}
+			status := uw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			app.usage.record(key, status, body.bytes, uw.bytes)
+		}()
+		next.ServeHTTP(uw, r)
+	})
+}
+
+// bearerToken returns the token that a request was sent with, from its Authorization
+// header or session cookie, without checking it.
+func (app *application) bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if r.Header.Get("Authorization") == "" {
+		if token, ok := app.sessionToken(r); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// The showUsageHandler shows the authenticated user's own API usage over a period
+// (?period=1d, 7d, 30d or 90d), in total, by day and by token, so that heavy users can
+// keep an eye on themselves. The counts are written out every -usage-flush-interval, so
+// the most recent requests might not be included yet.
+func (app *application) showUsageHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	period := app.readString(r.URL.Query(), "period", "30d")
+	days, ok := data.UsagePeriods[period]
+	if v.Check(ok, "period", "must be 1d, 7d, 30d or 90d"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	since := time.Now().UTC().AddDate(0, 0, 1-days)
+	usage, err := app.models.Usage.GetForUser(user.ID, since)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"period": period, "usage": usage}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// userExportTTL is how long a data export can be downloaded for.
+const userExportTTL = 48 * time.Hour
+
+// maxExportedSecurityEvents is the most security events included in a data export.
+const maxExportedSecurityEvents = 10_000
+
+// The requestUserExportHandler starts a data export for the authenticated user. The
+// archive is put together in the background, and the user is emailed a signed link to
+// download it with, which works until the archive expires. Requesting another export
+// replaces the previous one.
+func (app *application) requestUserExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := *app.contextGetUser(r)
+	app.logSecurityEvent(r, "data_export_requested", map[string]string{"email": user.Email})
+	app.background(func() {
+		export, err := app.buildUserExport(&user)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("building data export: %w", err), nil)
+			return
+		}
+		err = app.models.UserExports.Insert(export)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("storing data export: %w", err), nil)
+			return
+		}
+		data := map[string]interface{}{
+			"name":   user.Name,
+			"link":   app.userExportLink(export),
+			"expiry": export.Expiry.UTC().Format(time.RFC1123),
+		}
+		err = app.sendMail(user.Email, "user_export.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("sending data export email: %w", err), nil)
+		}
+	})
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"message": "your data export is being prepared, and a download link will be emailed to you"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The exportedToken type is how a token is shown in a data export.
+type exportedToken struct {
+	tokenInfo
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	IP         string     `json:"ip,omitempty"`
+}
+
+// buildUserExport puts together a ZIP archive of everything we hold about a user, with
+// a JSON file for each kind of data. There are no reviews or watchlists yet; when there
+// are, they belong in here too.
+func (app *application) buildUserExport(user *data.User) (*data.UserExport, error) {
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID, data.ScopeAuthentication, data.ScopeAPIKey)
+	if err != nil {
+		return nil, err
+	}
+	exportedTokens := make([]exportedToken, 0, len(tokens))
+	for _, token := range tokens {
+		t := exportedToken{tokenInfo: newTokenInfo(token, nil), UserAgent: token.UserAgent, IP: token.IP}
+		if !token.LastUsedAt.IsZero() {
+			lastUsedAt := token.LastUsedAt
+			t.LastUsedAt = &lastUsedAt
+		}
+		exportedTokens = append(exportedTokens, t)
+	}
+	usage, err := app.models.Usage.GetForUser(user.ID, time.Now().Add(-data.UsageRetention))
+	if err != nil {
+		return nil, err
+	}
+	events, err := app.models.SecurityEvents.GetAllForUser(user.ID, maxExportedSecurityEvents)
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", envelope{"user": user, "preferences": user.Preferences, "roles": roles, "permissions": permissions}},
+		{"tokens.json", envelope{"tokens": exportedTokens}},
+		{"usage.json", envelope{"usage": usage}},
+		{"security_events.json", envelope{"security_events": events}},
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	for _, file := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(file.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &data.UserExport{UserID: user.ID, Expiry: now.Add(userExportTTL), Archive: buf.Bytes()}, nil
+}
+
+// userExportSignature returns the signature for a download link, which covers the
+// export, its owner and the link's expiry time.
+func (app *application) userExportSignature(id, userID, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(app.config.exports.signingKey))
+	fmt.Fprintf(mac, "user-export:%d:%d:%d", id, userID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userExportLink returns the signed download link for an export. The expiry time and
+// signature go in the path, as "<expires>.<signature>", rather than in the query string,
+// as the mailer's templates would escape the & between them.
+func (app *application) userExportLink(export *data.UserExport) string {
+	expires := export.Expiry.Unix()
+	return fmt.Sprintf("%s/v1/exports/%d/%d.%s", app.config.baseURL, export.ID, expires, app.userExportSignature(export.ID, export.UserID, expires))
+}
+
+// The downloadUserExportHandler sends the archive for a signed download link. It
+// doesn't need authentication, as the link is opened from an email; the signature is
+// what proves that it was sent to the owner of the export.
+func (app *application) downloadUserExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	expiresStr, signature, _ := strings.Cut(httprouter.ParamsFromContext(r.Context()).ByName("signature"), ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		app.notFoundResponse(w, r)
+		return
+	}
+	export, err := app.models.UserExports.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	expected := app.userExportSignature(export.ID, export.UserID, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		app.logSecurityEvent(r, "data_export_signature_invalid", map[string]string{"export_id": strconv.FormatInt(id, 10)})
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Accounts which are waiting to be deleted can't download their data any more.
+	user, err := app.models.Users.Get(export.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.logSecurityEvent(r, "data_export_downloaded", map[string]string{"email": user.Email, "export_id": strconv.FormatInt(id, 10)})
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.zip"`, export.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(export.Archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Archive)
+}
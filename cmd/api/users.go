@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -11,12 +12,13 @@ import (
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
     // Create an anonymous struct to hold the expected data from the request body.
     var input struct {
-        Name     string `json:"name"`
-        Email    string `json:"email"`
-        Password string `json:"password"`
+        Name       string `json:"name"`
+        Email      string `json:"email"`
+        Password   string `json:"password"`
+        InviteCode string `json:"invite_code"`
     }
     // Parse the request body into the anonymous struct.
-    err := app.readJSON(w, r, &input)
+    err := app.readJSONWithOptions(w, r, &input, lenientJSONOptions)
     if err != nil {
         app.badRequestResponse(w, r, err)
         return
@@ -44,8 +46,15 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
         app.failedValidationResponse(w, r, v.Errors)
         return
     }
-		err = app.models.Users.Insert(user)
+		// In invite mode, use up one of the uses of the invite before creating the user,
+		// and give it back if the user can't be created.
+		inviteID, ok := app.consumeInvite(w, r, input.InviteCode)
+		if !ok {
+				return
+		}
+		err = app.modelsFor(r).Users.Insert(user)
 		if err != nil {
+				app.releaseInvite(inviteID)
 				switch {
 				case errors.Is(err, data.ErrDuplicateEmail):
 						v.AddError("email", "a user with this email address already exists")
@@ -55,6 +64,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 				}
 				return
 		}
+		// Give the new user the viewer role, which lets them read movies.
+		err = app.models.Roles.AddForUser(user.ID, data.RoleViewer)
+		if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+		}
 		// After the user record has been created in the database, generate a new activation
 		// token for the user.
 		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
@@ -62,21 +77,21 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 				app.serverErrorResponse(w, r, err)
 				return
 		}
-		app.background(func() {
-				// As there are now multiple pieces of data that we want to pass to our email
-				// templates, we create a map to act as a 'holding structure' for the data. This
-				// contains the plaintext version of the activation token for the user, along
-				// with their ID.
-				data := map[string]interface{}{
-						"activationToken": token.Plaintext,
-						"userID":          user.ID,
-				}
-				// Send the welcome email, passing in the map above as dynamic data.
-				err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-				if err != nil {
-						app.logger.PrintError(err, nil)
-				}
-		})
+		// As there are now multiple pieces of data that we want to pass to our email
+		// templates, we create a map to act as a 'holding structure' for the data. This
+		// contains the plaintext version of the activation token for the user, along
+		// with their ID.
+		data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+		}
+		// Queue the welcome email, passing in the map above as dynamic data. If the mail
+		// queue is full (because the mail provider is struggling) we log the error but
+		// still respond as normal, as the user account has already been created.
+		err = app.sendMail(user.Email, "user_welcome.tmpl", data)
+		if err != nil {
+				app.loggerFrom(r).PrintError(err, map[string]string{"user_id": fmt.Sprint(user.ID)})
+		}
 		err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 		if err != nil {
 				app.serverErrorResponse(w, r, err)
@@ -88,7 +103,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	var input struct {
 			TokenPlaintext string `json:"token"`
 	}
-	err := app.readJSON(w, r, &input)
+	err := app.readJSONWithOptions(w, r, &input, lenientJSONOptions)
 	if err != nil {
 			app.badRequestResponse(w, r, err)
 			return
@@ -102,10 +117,31 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method (which we will create in a minute). If no matching record
 	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+					tokenLookupFailures.Add(data.ScopeActivation, 1)
+					v.AddError("token", "invalid or expired activation token")
+					app.failedValidationResponse(w, r, v.Errors)
+			default:
+					app.serverErrorResponse(w, r, err)
+			}
+			return
+	}
+	// Consume the token before doing anything else, so that it can only be used once
+	// even if the same token is sent in two requests at the same time.
+	_, err = app.models.Tokens.Consume(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
+					// The token was there a moment ago, so it has just been used by another
+					// request.
+					tokenLookupFailures.Add(data.ScopeActivation, 1)
+					app.logSecurityEvent(r, "token_reuse", map[string]string{
+							"email": user.Email,
+							"scope": data.ScopeActivation,
+					})
 					v.AddError("token", "invalid or expired activation token")
 					app.failedValidationResponse(w, r, v.Errors)
 			default:
@@ -117,7 +153,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	user.Activated = true
 	// Save the updated user record in our database, checking for any edit conflicts in
 	// the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	err = app.modelsFor(r).Users.Update(user)
 	if err != nil {
 			switch {
 			case errors.Is(err, data.ErrEditConflict):
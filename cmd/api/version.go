@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// The build information, which is set at build time with the linker's -X flag, like
+// this (see the build/api target in the Makefile):
+//
+//	go build -ldflags="-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)" ./cmd/api
+//
+// Anything which isn't set is filled in from the information the Go toolchain embeds in
+// the binary, where it can: the module version when the binary was built with go
+// install, and the commit and its time when it was built in a git checkout. There's no
+// branch in the embedded information, so that has to be set with the linker flag.
+var (
+	version   string
+	commit    string
+	branch    string
+	buildTime string
+)
+
+// devVersion is the version of a binary which was built without a version.
+const devVersion = "0.0.0-dev"
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		if version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
+	}
+	if version == "" {
+		version = devVersion
+	}
+	// The build time can be set as a Unix timestamp too, as that's the easiest thing to
+	// get from a shell ($(date +%s)).
+	if seconds, err := strconv.ParseInt(buildTime, 10, 64); err == nil {
+		buildTime = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+	}
+}
+
+// The versionHandler shows the build information, so that the versions running across
+// a fleet can be compared.
+func (app *application) versionHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"version":    version,
+		"commit":     commit,
+		"branch":     branch,
+		"build_time": buildTime,
+	}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
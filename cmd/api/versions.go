@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// The API versions. A request's version comes from its path prefix (/v1/movies or
+// /v2/movies), unless its Accept header asks for one with a vendor media type, like
+// application/vnd.greenlight.v2+json. The handlers are the same for every version; only
+// the representations that they respond with differ (see serializeMovie()).
+const (
+	apiV1 = 1
+	apiV2 = 2
+)
+
+// versionedPrefixes are the path prefixes of the routes which are served under every
+// API version. The routes are registered with their /v1 paths, and the other versions
+// get the same path with their own prefix.
+var versionedPrefixes = []string{"/v1/movies"}
+
+// apiVersionContextKey holds the API version of the request.
+const apiVersionContextKey = contextKey("api_version")
+
+// vendorMediaTypeRX matches the media types which ask for an API version in the Accept
+// header.
+var vendorMediaTypeRX = regexp.MustCompile(`^application/vnd\.greenlight\.v([0-9]+)\+json$`)
+
+// versionedPaths returns the path of a route for each API version, or nil if the route
+// isn't versioned.
+func versionedPaths(path string) map[int]string {
+	for _, prefix := range versionedPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			rest := strings.TrimPrefix(path, "/v1")
+			return map[int]string{apiV1: path, apiV2: "/v2" + rest}
+		}
+	}
+	return nil
+}
+
+// specPath returns the path that a request is described by in the OpenAPI spec. The
+// parameters and bodies of requests are the same for every API version, so the spec
+// only lists the /v1 paths, and a request to a versioned route under another version
+// is validated against the /v1 path of the route.
+func specPath(path string) string {
+	for version := apiV1 + 1; version <= apiV2; version++ {
+		rest, ok := strings.CutPrefix(path, "/v"+strconv.Itoa(version)+"/")
+		if ok && versionedPaths("/v1/"+rest) != nil {
+			return "/v1/" + rest
+		}
+	}
+	return path
+}
+
+// acceptedAPIVersion returns the API version asked for by an Accept header, and false if
+// it doesn't list a vendor media type.
+func acceptedAPIVersion(accept string) (int, bool) {
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		matches := vendorMediaTypeRX.FindStringSubmatch(strings.ToLower(strings.TrimSpace(mediaType)))
+		if matches == nil {
+			continue
+		}
+		version, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		return version, true
+	}
+	return 0, false
+}
+
+// The withAPIVersion() middleware adds the API version of a request to its context: the
+// version of the route's path prefix, or the version asked for in the Accept header. A
+// version that we don't have gets a 406 Not Acceptable response.
+func (app *application) withAPIVersion(pathVersion int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		version := pathVersion
+		if accepted, ok := acceptedAPIVersion(r.Header.Get("Accept")); ok {
+			if accepted != apiV1 && accepted != apiV2 {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+			version = accepted
+		}
+		ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// The contextAPIVersion() method returns the API version of a request. Requests to the
+// routes which aren't versioned are version 1.
+func (app *application) contextAPIVersion(r *http.Request) int {
+	version, ok := r.Context().Value(apiVersionContextKey).(int)
+	if !ok {
+		return apiV1
+	}
+	return version
+}
+
+// The versionPrefix() method returns the path prefix of a request's API version, for
+// building the URLs of resources in responses.
+func (app *application) versionPrefix(r *http.Request) string {
+	return "/v" + strconv.Itoa(app.contextAPIVersion(r))
+}
+
+// The movieV2 type is the version 2 representation of a movie, which has the runtime as
+// a plain number of minutes (runtime_minutes) rather than a "<runtime> mins" string.
+type movieV2 struct {
+	ID             int64           `json:"id"`
+	Title          string          `json:"title"`
+	Year           int32           `json:"year,omitempty"`
+	RuntimeMinutes int32           `json:"runtime_minutes,omitempty"`
+	Genres         []string        `json:"genres,omitempty"`
+	Attributes     data.Attributes `json:"attributes,omitempty"`
+	Version        int32           `json:"version"`
+	CreatedBy      int64           `json:"created_by,omitempty"`
+	UpdatedBy      int64           `json:"updated_by,omitempty"`
+	Links          links           `json:"_links"`
+}
+
+// The serializeMovie() method returns the representation of a movie for a request's API
+// version, with its links (see movieLinks()), and with the users who created and last
+// modified it if attributed is true.
+func (app *application) serializeMovie(r *http.Request, movie *data.Movie, attributed bool) interface{} {
+	switch app.contextAPIVersion(r) {
+	case apiV2:
+		body := movieV2{
+			ID:             movie.ID,
+			Title:          movie.Title,
+			Year:           movie.Year,
+			RuntimeMinutes: int32(movie.Runtime),
+			Genres:         movie.Genres,
+			Attributes:     movie.Attributes,
+			Version:        movie.Version,
+			Links:          app.movieLinks(r, movie),
+		}
+		if attributed {
+			body.CreatedBy, body.UpdatedBy = movie.CreatedBy, movie.UpdatedBy
+		}
+		return body
+	default:
+		body := attributedMovie{Movie: movie, Links: app.movieLinks(r, movie)}
+		if attributed {
+			body.CreatedBy, body.UpdatedBy = movie.CreatedBy, movie.UpdatedBy
+		}
+		return body
+	}
+}
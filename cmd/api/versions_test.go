@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/assert"
+	"greenlight.alexedwards.net/internal/openapi"
+)
+
+func TestValidateRequestVersions(t *testing.T) {
+	app := newTestApplication(t)
+	spec, err := openapi.Load()
+	assert.NilError(t, err)
+	app.spec = spec
+	_, token := newTestUser(t, app, "movies:read", "movies:write")
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name     string
+		method   string
+		urlPath  string
+		body     string
+		wantCode int
+	}{
+		{name: "v1 create", method: http.MethodPost, urlPath: "/v1/movies", body: `{"title": 5}`, wantCode: http.StatusUnprocessableEntity},
+		{name: "v2 create", method: http.MethodPost, urlPath: "/v2/movies", body: `{"title": 5}`, wantCode: http.StatusUnprocessableEntity},
+		{name: "v1 list", method: http.MethodGet, urlPath: "/v1/movies?page_size=1000", wantCode: http.StatusUnprocessableEntity},
+		{name: "v2 list", method: http.MethodGet, urlPath: "/v2/movies?page_size=1000", wantCode: http.StatusUnprocessableEntity},
+		{name: "v2 show", method: http.MethodGet, urlPath: "/v2/movies/1?fields=title", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			code, _, respBody := ts.request(t, tt.method, tt.urlPath, token, body)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantCode == http.StatusUnprocessableEntity {
+				assert.StringContains(t, respBody, `"code": "schema_validation_failed"`)
+			}
+		})
+	}
+}
+
+func TestSpecPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/v1/movies", want: "/v1/movies"},
+		{path: "/v2/movies", want: "/v1/movies"},
+		{path: "/v2/movies/1/revisions", want: "/v1/movies/1/revisions"},
+		{path: "/v2/users", want: "/v2/users"},
+		{path: "/v2/moviesx", want: "/v2/moviesx"},
+		{path: "/v3/movies", want: "/v3/movies"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, specPath(tt.path), tt.want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The viewCounter type counts the views of movies in memory, and writes the counts to
+// the database in batches, so that a busy movie doesn't mean a database write on every
+// request. Only a sample of the views are counted (-views-sample-rate), and the counts
+// are scaled back up when they're written, which keeps the cost down further at the
+// expense of some accuracy for movies with few views.
+type viewCounter struct {
+	sampleRate float64
+	mu         sync.Mutex
+	hits       map[int64]int64
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// record counts a view of a movie, if it's sampled.
+func (c *viewCounter) record(id int64) {
+	if c == nil || (c.sampleRate < 1 && rand.Float64() >= c.sampleRate) {
+		return
+	}
+	c.mu.Lock()
+	c.hits[id]++
+	c.mu.Unlock()
+}
+
+// take returns the estimated view counts since the last call, and resets them.
+func (c *viewCounter) take() map[int64]int64 {
+	c.mu.Lock()
+	hits := c.hits
+	c.hits = make(map[int64]int64)
+	c.mu.Unlock()
+	counts := make(map[int64]int64, len(hits))
+	for id, n := range hits {
+		counts[id] = int64(math.Round(float64(n) / c.sampleRate))
+	}
+	return counts
+}
+
+// close stops the flush and aggregation goroutines. The flush goroutine writes the
+// counts that haven't been written yet before it exits.
+func (c *viewCounter) close() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// startViewCounter creates the view counter and starts the goroutines which flush the
+// counts to the database, and which work out the trending movies from them. Both are
+// tracked by the application WaitGroup, so that on shutdown serve() waits for the last
+// flush once the counter has been closed. Only the leader runs the aggregation job, as
+// running it on every instance would just do the same work several times over.
+func (app *application) startViewCounter() {
+	if app.config.views.sampleRate <= 0 {
+		return
+	}
+	app.views = &viewCounter{
+		sampleRate: math.Min(app.config.views.sampleRate, 1),
+		hits:       make(map[int64]int64),
+		stop:       make(chan struct{}),
+	}
+	logger := app.logger.Component("views")
+	flush := func() {
+		err := app.models.Views.Add(app.views.take(), time.Now())
+		if err != nil {
+			logger.PrintError(fmt.Errorf("writing view counts: %w", err), nil)
+		}
+	}
+	app.wg.Add(2)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.views.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-app.views.stop:
+				flush()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.views.trendingInterval)
+		defer ticker.Stop()
+		for {
+			app.runSingleton("aggregate_trending", func() {
+				start := time.Now()
+				err := app.models.Views.Aggregate()
+				if err != nil {
+					logger.PrintError(fmt.Errorf("aggregating trending movies: %w", err), nil)
+				} else {
+					logger.PrintDebug("aggregated trending movies", map[string]string{"duration": time.Since(start).String()})
+				}
+			})
+			select {
+			case <-ticker.C:
+			case <-app.views.stop:
+				return
+			}
+		}
+	}()
+}
+
+// The trendingMoviesHandler returns the movies which have been viewed the most within
+// a window (?window=1d, 7d or 30d), as of the last time that the aggregation job ran.
+func (app *application) trendingMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	window := app.readString(qs, "window", "7d")
+	limit := app.readInt(qs, "limit", 20, v)
+	_, ok := data.TrendingWindows[window]
+	v.Check(ok, "window", "must be 1d, 7d or 30d")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= data.TrendingSize, "limit", fmt.Sprintf("must be a maximum of %d", data.TrendingSize))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	movies, err := app.modelsFor(r).Views.Trending(window, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"window": window, "movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,39 @@
+package apierror
+
+// Code is a stable, machine-readable identifier for a class of error. It is included in
+// the "code" field of every error response so that API clients can branch on it rather
+// than parsing the (human-readable, and liable to change) error message.
+type Code string
+
+// Declare the codes for every error response that the API can return. Once a code has
+// been published it should never be renamed or reused for a different meaning, as
+// client SDKs will be depending on it.
+const (
+	CodeServerError                Code = "server_error"
+	CodeNotFound                   Code = "not_found"
+	CodeMethodNotAllowed           Code = "method_not_allowed"
+	CodeNotAcceptable              Code = "not_acceptable"
+	CodeBadRequest                 Code = "bad_request"
+	CodeBodyLimitExceeded          Code = "body_limit_exceeded"
+	CodeValidationFailed           Code = "validation_failed"
+	CodeSchemaValidationFailed     Code = "schema_validation_failed"
+	CodeEditConflict               Code = "edit_conflict"
+	CodeBatchAborted               Code = "batch_aborted"
+	CodeRateLimited                Code = "rate_limited"
+	CodeInvalidCredentials         Code = "invalid_credentials"
+	CodeInvalidAuthenticationToken Code = "invalid_authentication_token"
+	CodeAuthenticationRequired     Code = "authentication_required"
+	CodeInactiveAccount            Code = "inactive_account"
+	CodeNotPermitted               Code = "not_permitted"
+	CodeOwnAdminRole               Code = "own_admin_role"
+	CodeInvalidCSRFToken           Code = "invalid_csrf_token"
+	CodeLoginThrottled             Code = "login_throttled"
+	CodeCaptchaRequired            Code = "captcha_required"
+	CodeOverloaded                 Code = "overloaded"
+	CodeDatabaseUnavailable        Code = "database_unavailable"
+)
+
+// String returns the code as a plain string.
+func (c Code) String() string {
+	return string(c)
+}
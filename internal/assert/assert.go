@@ -0,0 +1,32 @@
+package assert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Equal fails the test if the actual value isn't deeply equal to the expected value.
+func Equal(t *testing.T, actual, expected interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got: %v; want: %v", actual, expected)
+	}
+}
+
+// StringContains fails the test if the actual string doesn't contain the expected
+// substring.
+func StringContains(t *testing.T, actual, expectedSubstring string) {
+	t.Helper()
+	if !strings.Contains(actual, expectedSubstring) {
+		t.Errorf("got: %q; expected to contain: %q", actual, expectedSubstring)
+	}
+}
+
+// NilError fails the test immediately if err is not nil.
+func NilError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got: %v; expected: nil", err)
+	}
+}
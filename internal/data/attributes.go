@@ -0,0 +1,121 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The Attributes type holds the descriptive attributes of a movie, like its language
+// and country, which are stored as a JSON object in the movies.attributes column. Adding
+// an attribute only needs an entry in MovieAttributes, rather than a migration.
+type Attributes map[string]string
+
+// The attributeSchema type describes one of the attributes that a movie can have: the
+// pattern that its value must match, and the validation message if it doesn't.
+type attributeSchema struct {
+	pattern *regexp.Regexp
+	message string
+}
+
+// MovieAttributes is the schema for the attributes of a movie. Attributes which aren't
+// listed here are rejected.
+var MovieAttributes = map[string]attributeSchema{
+	"language":     {regexp.MustCompile(`^[a-z]{2}$`), "must be an ISO 639-1 language code, like fr"},
+	"country":      {regexp.MustCompile(`^[A-Z]{2}$`), "must be an ISO 3166-1 country code, like FR"},
+	"imdb_id":      {regexp.MustCompile(`^tt[0-9]{7,8}$`), "must be an IMDb ID, like tt0078748"},
+	"aspect_ratio": {regexp.MustCompile(`^[0-9]{1,2}(\.[0-9]{1,2})?:1$`), "must be a ratio to 1, like 2.39:1"},
+}
+
+// ValidateAttributes checks that every attribute is in MovieAttributes and has a valid
+// value. Errors are keyed by prefix followed by the attribute's name, so that they point
+// at the field or query string parameter that the attribute came from.
+func ValidateAttributes(v *validator.Validator, prefix string, attributes Attributes) {
+	for name, value := range attributes {
+		schema, ok := MovieAttributes[name]
+		if !ok {
+			v.AddError(prefix+name, "is not a known attribute")
+			continue
+		}
+		v.Check(validator.Matches(value, schema.pattern), prefix+name, schema.message)
+	}
+}
+
+// Patch returns a copy of the attributes with a partial update applied: attributes
+// patched to a value are set, attributes patched to nil (null in JSON) are removed, and
+// attributes which aren't in the patch are left as they are. If there are no attributes
+// left it returns nil.
+func (a Attributes) Patch(patch map[string]*string) Attributes {
+	patched := make(Attributes, len(a)+len(patch))
+	for name, value := range a {
+		patched[name] = value
+	}
+	for name, value := range patch {
+		if value == nil {
+			delete(patched, name)
+			continue
+		}
+		patched[name] = *value
+	}
+	if len(patched) == 0 {
+		return nil
+	}
+	return patched
+}
+
+// contains reports whether the attributes include every one of the wanted attributes,
+// which is what the jsonb @> operator does in the listing filters.
+func (a Attributes) contains(wanted Attributes) bool {
+	for name, value := range wanted {
+		if got, ok := a[name]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a copy of the attributes, or nil if there aren't any.
+func (a Attributes) clone() Attributes {
+	return a.Patch(nil)
+}
+
+// Value implements the driver.Valuer interface, encoding the attributes as a JSON object
+// for the jsonb column. It's a string rather than a []byte, as pq would send a []byte to
+// COPY as bytea.
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(map[string]string(a))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements the sql.Scanner interface, decoding the attributes from the jsonb
+// column. An empty object scans as nil, so that it's left out of the movie's JSON.
+func (a *Attributes) Scan(src any) error {
+	var b []byte
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		*a = nil
+		return nil
+	default:
+		return errors.New("attributes: unsupported type")
+	}
+	var attributes Attributes
+	err := json.Unmarshal(b, &attributes)
+	if err != nil {
+		return err
+	}
+	*a = attributes.clone()
+	return nil
+}
@@ -0,0 +1,395 @@
+package data
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/redis"
+)
+
+// The AuthCache type caches the lookups which authenticate requests in Redis: the user
+// and token for each token plaintext (GetWithToken()) and each user's permissions
+// (Permissions.GetAllForUser()), which would otherwise cost two queries on every
+// authenticated request. Unlike the movie cache it's shared by every instance of the
+// application, so revoking a token or changing a user's roles on one instance takes
+// effect on all of them.
+//
+// Entries expire after a short TTL, and are deleted as soon as the data behind them
+// changes through the models returned by Models.WithAuthCache(). The TTL bounds how
+// long an entry can be stale if something changes the data some other way, or if a
+// lookup races with the change. Redis being unavailable only costs the cache: lookups
+// fall through to the database, and the error is passed to onError.
+//
+// The cached users don't have password hashes, so anything which checks a user's
+// password has to look the user up again rather than use the authenticated user.
+type AuthCache struct {
+	client  *redis.Client
+	ttl     time.Duration
+	onError func(error)
+}
+
+// NewAuthCache returns a cache which keeps entries in Redis for up to ttl.
+func NewAuthCache(client *redis.Client, ttl time.Duration, onError func(error)) *AuthCache {
+	return &AuthCache{client: client, ttl: ttl, onError: onError}
+}
+
+// The cache keys. Each user has a set (authUserKey) of the keys of their cached tokens,
+// so that they can all be deleted at once, and each token has a key (authTokenIDKey)
+// holding the key of its entry, so that it can be deleted by ID.
+func authTokenKey(tenantID int64, scopes []string, hash []byte) string {
+	return "greenlight:auth:" + strconv.FormatInt(tenantID, 10) + ":" + strings.Join(scopes, ",") + ":" + hex.EncodeToString(hash)
+}
+
+func authTokenIDKey(tokenID int64) string {
+	return "greenlight:auth-token:" + strconv.FormatInt(tokenID, 10)
+}
+
+func authUserKey(userID int64) string {
+	return "greenlight:auth-user:" + strconv.FormatInt(userID, 10)
+}
+
+func permissionsKey(userID int64) string {
+	return "greenlight:permissions:" + strconv.FormatInt(userID, 10)
+}
+
+// The cachedAuth type is how a user and token are stored in the cache. The User and
+// Token types leave most of their fields out of their JSON, so they're copied here.
+type cachedAuth struct {
+	UserID      int64       `json:"user_id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Email       string      `json:"email"`
+	Activated   bool        `json:"activated"`
+	Version     int         `json:"version"`
+	Preferences Preferences `json:"preferences"`
+
+	TokenID          int64       `json:"token_id"`
+	TokenCreatedAt   time.Time   `json:"token_created_at"`
+	TokenName        string      `json:"token_name"`
+	TokenScope       string      `json:"token_scope"`
+	TokenExpiry      time.Time   `json:"token_expiry"`
+	TokenPermissions Permissions `json:"token_permissions"`
+	TokenLastUsedAt  time.Time   `json:"token_last_used_at"`
+}
+
+// getAuth returns the cached user and token for a key, or false if there isn't an
+// unexpired entry.
+func (c *AuthCache) getAuth(key string, hash []byte) (*User, *Token, bool) {
+	reply, err := c.client.Do("GET", key)
+	if err != nil {
+		c.onError(err)
+		return nil, nil, false
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil, nil, false
+	}
+	var entry cachedAuth
+	err = json.Unmarshal([]byte(s), &entry)
+	if err != nil {
+		c.onError(err)
+		return nil, nil, false
+	}
+	if !entry.TokenExpiry.After(time.Now()) {
+		return nil, nil, false
+	}
+	user := &User{
+		ID:          entry.UserID,
+		CreatedAt:   entry.CreatedAt,
+		Name:        entry.Name,
+		Email:       entry.Email,
+		Activated:   entry.Activated,
+		Version:     entry.Version,
+		Preferences: entry.Preferences,
+	}
+	token := &Token{
+		Hash:        hash,
+		UserID:      entry.UserID,
+		ID:          entry.TokenID,
+		CreatedAt:   entry.TokenCreatedAt,
+		Name:        entry.TokenName,
+		Scope:       entry.TokenScope,
+		Expiry:      entry.TokenExpiry,
+		Permissions: entry.TokenPermissions,
+		LastUsedAt:  entry.TokenLastUsedAt,
+	}
+	return user, token, true
+}
+
+// setAuth caches a user and token under a key, for the TTL or until the token expires
+// if that's sooner.
+func (c *AuthCache) setAuth(key string, user *User, token *Token) {
+	ttl := min(c.ttl, time.Until(token.Expiry))
+	if ttl < time.Second {
+		return
+	}
+	b, err := json.Marshal(cachedAuth{
+		UserID:           user.ID,
+		CreatedAt:        user.CreatedAt,
+		Name:             user.Name,
+		Email:            user.Email,
+		Activated:        user.Activated,
+		Version:          user.Version,
+		Preferences:      user.Preferences,
+		TokenID:          token.ID,
+		TokenCreatedAt:   token.CreatedAt,
+		TokenName:        token.Name,
+		TokenScope:       token.Scope,
+		TokenExpiry:      token.Expiry,
+		TokenPermissions: token.Permissions,
+		TokenLastUsedAt:  token.LastUsedAt,
+	})
+	if err != nil {
+		c.onError(err)
+		return
+	}
+	seconds := strconv.Itoa(int(ttl.Seconds()))
+	idKey, userKey := authTokenIDKey(token.ID), authUserKey(user.ID)
+	c.pipeline([][]string{
+		{"SET", key, string(b), "EX", seconds},
+		{"SET", idKey, key, "EX", seconds},
+		{"SADD", userKey, key, idKey},
+		{"EXPIRE", userKey, strconv.Itoa(int(c.ttl.Seconds()))},
+	})
+}
+
+// getPermissions returns a user's cached permissions, or false if they aren't cached.
+func (c *AuthCache) getPermissions(userID int64) (Permissions, bool) {
+	reply, err := c.client.Do("GET", permissionsKey(userID))
+	if err != nil {
+		c.onError(err)
+		return nil, false
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+	var permissions Permissions
+	err = json.Unmarshal([]byte(s), &permissions)
+	if err != nil {
+		c.onError(err)
+		return nil, false
+	}
+	return permissions, true
+}
+
+// setPermissions caches a user's permissions for the TTL.
+func (c *AuthCache) setPermissions(userID int64, permissions Permissions) {
+	b, err := json.Marshal(permissions)
+	if err != nil {
+		c.onError(err)
+		return
+	}
+	c.pipeline([][]string{{"SET", permissionsKey(userID), string(b), "EX", strconv.Itoa(int(c.ttl.Seconds()))}})
+}
+
+// forgetUser deletes the cached tokens of a user, for when the user or their tokens
+// change.
+func (c *AuthCache) forgetUser(userID int64) {
+	userKey := authUserKey(userID)
+	reply, err := c.client.Do("SMEMBERS", userKey)
+	if err != nil {
+		c.onError(err)
+		return
+	}
+	members, _ := reply.([]interface{})
+	del := []string{"DEL", userKey}
+	for _, member := range members {
+		if key, ok := member.(string); ok {
+			del = append(del, key)
+		}
+	}
+	c.pipeline([][]string{del})
+}
+
+// forgetToken deletes the cached entry for a token, for when the token changes.
+func (c *AuthCache) forgetToken(tokenID int64) {
+	idKey := authTokenIDKey(tokenID)
+	reply, err := c.client.Do("GET", idKey)
+	if err != nil {
+		c.onError(err)
+		return
+	}
+	del := []string{"DEL", idKey}
+	if key, ok := reply.(string); ok {
+		del = append(del, key)
+	}
+	c.pipeline([][]string{del})
+}
+
+// forgetPermissions deletes a user's cached permissions, for when their permissions or
+// roles change.
+func (c *AuthCache) forgetPermissions(userID int64) {
+	c.pipeline([][]string{{"DEL", permissionsKey(userID)}})
+}
+
+// pipeline sends commands whose replies we don't need, passing any error to onError.
+func (c *AuthCache) pipeline(commands [][]string) {
+	replies, err := c.client.Pipeline(commands)
+	if err == nil {
+		for _, reply := range replies {
+			if replyErr, ok := reply.(redis.Error); ok {
+				err = replyErr
+			}
+		}
+	}
+	if err != nil {
+		c.onError(err)
+	}
+}
+
+// WithAuthCache returns a copy of the models in which the lookups that authenticate
+// requests are cached in Redis (see AuthCache), and the writes which change the users,
+// tokens, permissions and roles behind them invalidate the cached entries. Only the
+// PostgreSQL models support it; the others are left as they are.
+func (m Models) WithAuthCache(cache *AuthCache) Models {
+	if users, ok := m.Users.(UserModel); ok {
+		m.Users = cachedUserModel{UserModel: users, cache: cache}
+	}
+	if tokens, ok := m.Tokens.(TokenModel); ok {
+		m.Tokens = cachedTokenModel{TokenModel: tokens, cache: cache}
+	}
+	if permissions, ok := m.Permissions.(PermissionModel); ok {
+		m.Permissions = cachedPermissionModel{PermissionModel: permissions, cache: cache}
+	}
+	if roles, ok := m.Roles.(RoleModel); ok {
+		m.Roles = cachedRoleModel{RoleModel: roles, cache: cache}
+	}
+	return m
+}
+
+type cachedUserModel struct {
+	UserModel
+	cache *AuthCache
+}
+
+func (m cachedUserModel) forTenant(tenantID int64) any {
+	return cachedUserModel{UserModel: m.UserModel.forTenant(tenantID).(UserModel), cache: m.cache}
+}
+
+func (m cachedUserModel) GetWithToken(tokenPlaintext string, tokenScopes ...string) (*User, *Token, error) {
+	hash := hashTokenPlaintext(tokenPlaintext)
+	key := authTokenKey(m.tenantID, tokenScopes, hash)
+	if user, token, ok := m.cache.getAuth(key, hash); ok {
+		return user, token, nil
+	}
+	user, token, err := m.UserModel.GetWithToken(tokenPlaintext, tokenScopes...)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.cache.setAuth(key, user, token)
+	return user, token, nil
+}
+
+func (m cachedUserModel) Update(user *User) error {
+	err := m.UserModel.Update(user)
+	if err == nil {
+		m.cache.forgetUser(user.ID)
+	}
+	return err
+}
+
+func (m cachedUserModel) UpdatePreferences(userID int64, preferences Preferences) error {
+	err := m.UserModel.UpdatePreferences(userID, preferences)
+	if err == nil {
+		m.cache.forgetUser(userID)
+	}
+	return err
+}
+
+func (m cachedUserModel) RequestDeletion(userID int64) error {
+	err := m.UserModel.RequestDeletion(userID)
+	if err == nil {
+		m.cache.forgetUser(userID)
+		m.cache.forgetPermissions(userID)
+	}
+	return err
+}
+
+type cachedTokenModel struct {
+	TokenModel
+	cache *AuthCache
+}
+
+func (m cachedTokenModel) DeleteForUser(userID, id int64, scopes ...string) error {
+	err := m.TokenModel.DeleteForUser(userID, id, scopes...)
+	if err == nil {
+		m.cache.forgetToken(id)
+	}
+	return err
+}
+
+func (m cachedTokenModel) DeleteAllForUserExcept(scope string, userID, exceptID int64) (int64, error) {
+	n, err := m.TokenModel.DeleteAllForUserExcept(scope, userID, exceptID)
+	if err == nil {
+		m.cache.forgetUser(userID)
+	}
+	return n, err
+}
+
+func (m cachedTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	err := m.TokenModel.DeleteAllForUser(scope, userID)
+	if err == nil {
+		m.cache.forgetUser(userID)
+	}
+	return err
+}
+
+// Touch forgets the token too, as otherwise the cached entry would still have the old
+// last use time, and every request would touch the token again until it expired.
+func (m cachedTokenModel) Touch(id int64, ip, userAgent string) error {
+	err := m.TokenModel.Touch(id, ip, userAgent)
+	if err == nil {
+		m.cache.forgetToken(id)
+	}
+	return err
+}
+
+type cachedPermissionModel struct {
+	PermissionModel
+	cache *AuthCache
+}
+
+func (m cachedPermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if permissions, ok := m.cache.getPermissions(userID); ok {
+		return permissions, nil
+	}
+	permissions, err := m.PermissionModel.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	m.cache.setPermissions(userID, permissions)
+	return permissions, nil
+}
+
+func (m cachedPermissionModel) AddForUser(userID int64, codes ...string) error {
+	err := m.PermissionModel.AddForUser(userID, codes...)
+	if err == nil {
+		m.cache.forgetPermissions(userID)
+	}
+	return err
+}
+
+type cachedRoleModel struct {
+	RoleModel
+	cache *AuthCache
+}
+
+func (m cachedRoleModel) AddForUser(userID int64, role string) error {
+	err := m.RoleModel.AddForUser(userID, role)
+	if err == nil {
+		m.cache.forgetPermissions(userID)
+	}
+	return err
+}
+
+func (m cachedRoleModel) RemoveForUser(userID int64, role string) error {
+	err := m.RoleModel.RemoveForUser(userID, role)
+	if err == nil {
+		m.cache.forgetPermissions(userID)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The operations in the changes feed.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+	// ChangeActivated is only used for users, when they activate their account.
+	ChangeActivated = "activated"
+)
+
+// The MovieChange type is an entry in the feed of changes to movies, which lets other
+// systems (like search indexes) keep a copy of the catalog up to date. The ID is the
+// entry's position in the feed, and the version is the movie's version after the change.
+type MovieChange struct {
+	ID        int64     `json:"id"`
+	MovieID   int64     `json:"movie_id"`
+	Operation string    `json:"operation"`
+	Version   int32     `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+	TenantID  int64     `json:"-"`
+}
+
+// Changes returns up to limit of the changes to movies which come after the change with
+// the ID since, oldest first. The IDs come from a sequence, so a transaction can commit
+// a change with a lower ID than one which is already visible; if we returned the visible
+// one, a reader who carried on from it would never see the other. So the feed stops
+// short of the first change made by a transaction which might still be in progress,
+// which is any transaction at or after the xmin of our snapshot.
+func (m MovieModel) Changes(since int64, limit int) ([]*MovieChange, error) {
+	query := `
+		SELECT id, movie_id, operation, version, changed_at, tenant_id
+		FROM movie_changes
+		WHERE id > $1 AND ($3 = 0 OR tenant_id = $3)
+		AND id < coalesce((
+			SELECT min(id) FROM movie_changes
+			WHERE id > $1 AND txid >= txid_snapshot_xmin(txid_current_snapshot())
+		), 9223372036854775807)
+		ORDER BY id
+		LIMIT $2`
+	return queryList(m.DB, queryTimeout, func(row rowScanner, change *MovieChange) error {
+		return row.Scan(&change.ID, &change.MovieID, &change.Operation, &change.Version, &change.ChangedAt, &change.TenantID)
+	}, query, since, limit, m.tenantID)
+}
+
+// The UserChange type is an entry in the feed of changes to users, like MovieChange is
+// for movies. Its operation can also be ChangeActivated.
+type UserChange struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Operation string    `json:"operation"`
+	Version   int       `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+	TenantID  int64     `json:"-"`
+}
+
+// Changes returns up to limit of the changes to users which come after the change with
+// the ID since, oldest first, holding back the changes of transactions which might still
+// be in progress in the same way as MovieModel.Changes().
+func (m UserModel) Changes(since int64, limit int) ([]*UserChange, error) {
+	query := `
+		SELECT id, user_id, operation, version, changed_at, tenant_id
+		FROM user_changes
+		WHERE id > $1 AND ($3 = 0 OR tenant_id = $3)
+		AND id < coalesce((
+			SELECT min(id) FROM user_changes
+			WHERE id > $1 AND txid >= txid_snapshot_xmin(txid_current_snapshot())
+		), 9223372036854775807)
+		ORDER BY id
+		LIMIT $2`
+	return queryList(m.DB, queryTimeout, func(row rowScanner, change *UserChange) error {
+		return row.Scan(&change.ID, &change.UserID, &change.Operation, &change.Version, &change.ChangedAt, &change.TenantID)
+	}, query, since, limit, m.tenantID)
+}
+
+// The EventCursorModel type records how far through each of the changes feeds the event
+// relay has published, in the event_cursors table.
+type EventCursorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the ID of the last change in a feed ("movies" or "users") which has been
+// published.
+func (m EventCursorModel) Get(feed string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	var position int64
+	err := m.DB.QueryRowContext(ctx, "SELECT position FROM event_cursors WHERE feed = $1", feed).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return position, err
+}
+
+// Set records that the changes in a feed up to the one with the ID position have been
+// published.
+func (m EventCursorModel) Set(feed string, position int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	query := `
+		INSERT INTO event_cursors (feed, position) VALUES ($1, $2)
+		ON CONFLICT (feed) DO UPDATE SET position = EXCLUDED.position`
+	_, err := m.DB.ExecContext(ctx, query, feed, position)
+	return err
+}
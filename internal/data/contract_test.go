@@ -0,0 +1,188 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+// A contractStep is one step of a contract test, and the error that it should return.
+// The steps of a test work on the same records, so they're run in order, and the test
+// stops at the first one that fails as the steps after it would only fail too.
+type contractStep struct {
+	name    string
+	step    func(t *testing.T) error
+	wantErr error
+}
+
+func runContractSteps(t *testing.T, steps []contractStep) {
+	t.Helper()
+	for _, s := range steps {
+		ok := t.Run(s.name, func(t *testing.T) {
+			err := s.step(t)
+			if !errors.Is(err, s.wantErr) {
+				t.Fatalf("got error %v; want %v", err, s.wantErr)
+			}
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// testModelsContract runs the behaviour which every implementation of Models must share
+// against the models returned by newModels: a record can be inserted, read back and
+// updated, an update with a stale version fails with ErrEditConflict, and once the record
+// is deleted reading it fails with ErrRecordNotFound. It's run against the in-memory
+// and mock models here, and against the PostgreSQL ones by the integration tests, so
+// that they can't drift apart.
+func testModelsContract(t *testing.T, newModels func(t *testing.T) Models) {
+	t.Run("Movies", func(t *testing.T) {
+		models := newModels(t)
+		movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+		var got, stale *Movie
+		runContractSteps(t, []contractStep{
+			{name: "Insert", step: func(t *testing.T) error {
+				err := models.Movies.Insert(movie)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, movie.Version, int32(1))
+				return nil
+			}},
+			{name: "Get", step: func(t *testing.T) error {
+				var err error
+				got, err = models.Movies.Get(movie.ID)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Title, "Moana")
+				assert.Equal(t, got.Year, int32(2016))
+				assert.Equal(t, got.Runtime, Runtime(107))
+				assert.Equal(t, got.Genres, []string{"animation", "adventure"})
+				assert.Equal(t, got.Version, int32(1))
+				copied := *got
+				stale = &copied
+				return nil
+			}},
+			{name: "Update", step: func(t *testing.T) error {
+				got.Title = "Moana 2"
+				err := models.Movies.Update(got)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Version, int32(2))
+				return nil
+			}},
+			{name: "Stale update", step: func(t *testing.T) error {
+				stale.Title = "Moana 3"
+				return models.Movies.Update(stale)
+			}, wantErr: ErrEditConflict},
+			{name: "Get after conflict", step: func(t *testing.T) error {
+				got, err := models.Movies.Get(movie.ID)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Title, "Moana 2")
+				assert.Equal(t, got.Version, int32(2))
+				return nil
+			}},
+			{name: "Delete", step: func(t *testing.T) error {
+				return models.Movies.Delete(movie.ID)
+			}},
+			{name: "Get after delete", step: func(t *testing.T) error {
+				_, err := models.Movies.Get(movie.ID)
+				return err
+			}, wantErr: ErrRecordNotFound},
+			{name: "Delete again", step: func(t *testing.T) error {
+				return models.Movies.Delete(movie.ID)
+			}, wantErr: ErrRecordNotFound},
+		})
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		models := newModels(t)
+		hashing := PasswordHashing
+		PasswordHashing.BcryptCost = 4
+		t.Cleanup(func() { PasswordHashing = hashing })
+		user := &User{Name: "Alice", Email: "alice@example.com"}
+		err := user.Password.Set("pa55word1234")
+		assert.NilError(t, err)
+		var got, stale *User
+		runContractSteps(t, []contractStep{
+			{name: "Insert", step: func(t *testing.T) error {
+				err := models.Users.Insert(user)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, user.Version, 1)
+				return nil
+			}},
+			{name: "Get", step: func(t *testing.T) error {
+				var err error
+				got, err = models.Users.Get(user.ID)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Email, "alice@example.com")
+				assert.Equal(t, got.Activated, false)
+				copied := *got
+				stale = &copied
+				return nil
+			}},
+			{name: "Update", step: func(t *testing.T) error {
+				got.Activated = true
+				err := models.Users.Update(got)
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Version, 2)
+				return nil
+			}},
+			{name: "Stale update", step: func(t *testing.T) error {
+				stale.Name = "Mallory"
+				return models.Users.Update(stale)
+			}, wantErr: ErrEditConflict},
+			{name: "Get by email", step: func(t *testing.T) error {
+				got, err := models.Users.GetByEmail("alice@example.com")
+				if err != nil {
+					return err
+				}
+				assert.Equal(t, got.Name, "Alice")
+				assert.Equal(t, got.Activated, true)
+				return nil
+			}},
+			{name: "Delete", step: func(t *testing.T) error {
+				return models.Users.RequestDeletion(user.ID)
+			}},
+			{name: "Get after delete", step: func(t *testing.T) error {
+				_, err := models.Users.Get(user.ID)
+				return err
+			}, wantErr: ErrRecordNotFound},
+			{name: "Get by email after delete", step: func(t *testing.T) error {
+				_, err := models.Users.GetByEmail("alice@example.com")
+				return err
+			}, wantErr: ErrRecordNotFound},
+		})
+	})
+}
+
+// TestModelsContract runs the contract against each of the constructors for the
+// models which don't need a database. NewMockModels() is the in-memory models at the
+// moment, but the handler tests rely on it behaving like the real models, so it's
+// checked in its own right rather than assumed to.
+func TestModelsContract(t *testing.T) {
+	tests := []struct {
+		name      string
+		newModels func(t *testing.T) Models
+	}{
+		{name: "Memory", newModels: func(t *testing.T) Models { return NewMemoryModels() }},
+		{name: "Mock", newModels: func(t *testing.T) Models { return NewMockModels() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testModelsContract(t, tt.newModels)
+		})
+	}
+}
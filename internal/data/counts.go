@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// CountCacheTTL is how long a cached count is used for before it is refreshed.
+var CountCacheTTL = 30 * time.Second
+
+// The countCache type caches the total number of rows in a table, so that unfiltered
+// listings don't need to count every row in the table (which is a full scan in
+// PostgreSQL) in order to work out their pagination metadata.
+//
+// The count is adjusted whenever this instance of the application inserts or deletes
+// rows, and is refreshed from the database once it is older than CountCacheTTL, which
+// picks up changes made by any other instances. If the count is stale, we carry on
+// using it while a refresh happens in the background, so no request has to wait for a
+// count query apart from the very first one.
+type countCache struct {
+	db         *sql.DB
+	query      string
+	mu         sync.Mutex
+	count      int
+	fetched    time.Time
+	stale      bool
+	refreshing bool
+}
+
+// newCountCache returns a countCache which uses the given query to count the rows.
+func newCountCache(db *sql.DB, query string) *countCache {
+	return &countCache{db: db, query: query}
+}
+
+// get returns the cached count, fetching it from the database first if we don't have
+// one yet.
+func (c *countCache) get(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	if c.fetched.IsZero() {
+		c.mu.Unlock()
+		return c.refresh(ctx)
+	}
+	count := c.count
+	if (c.stale || time.Since(c.fetched) > CountCacheTTL) && !c.refreshing {
+		c.refreshing = true
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c.refresh(ctx)
+		}()
+	}
+	c.mu.Unlock()
+	return count, nil
+}
+
+// refresh fetches the count from the database and stores it in the cache.
+func (c *countCache) refresh(ctx context.Context) (int, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, c.query).Scan(&count)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		return 0, err
+	}
+	c.count = count
+	c.fetched = time.Now()
+	c.stale = false
+	return count, nil
+}
+
+// expire marks the cached count as stale, so that it is refreshed (in the background)
+// the next time that it's used.
+func (c *countCache) expire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = true
+}
+
+// add adjusts the cached count by delta (which may be negative) after rows have been
+// inserted or deleted.
+func (c *countCache) add(delta int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fetched.IsZero() {
+		c.count += delta
+		if c.count < 0 {
+			c.count = 0
+		}
+	}
+}
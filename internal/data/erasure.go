@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// RequestDeletion soft deletes a user's account, and deletes all of their tokens (of
+// every scope), in a single transaction. From then on the user is treated as if they
+// didn't exist: they can't log in, and Get() and GetByEmail() don't find them. Their
+// personal data is kept until PurgeDeleted() removes it after the grace period.
+func (m UserModel) RequestDeletion(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = usersTable.markDeleted(ctx, tx, "id = $1", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM tokens WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeDeleted permanently deletes the users whose deletion was requested before the
+// given time, and returns their IDs. Their tokens, permissions and roles go with them,
+// and their email and IP addresses are removed from the security events (including the
+// archived ones), which are otherwise kept (with no user) as the audit trail.
+func (m UserModel) PurgeDeleted(before time.Time) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Failed logins are recorded against the email address rather than the user, so
+	// match on both.
+	for _, table := range []string{"security_events", "security_events_archive"} {
+		query := `
+			UPDATE ` + table + ` AS e
+			SET email = '', ip = ''
+			FROM users
+			WHERE users.deleted_at < $1
+			AND (e.user_id = users.id OR e.email = users.email)`
+		_, err = tx.ExecContext(ctx, query, before)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids, err := usersTable.purge(ctx, tx, before)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"math"
 	"strings" // New import
+	"time"
 
 	"greenlight.alexedwards.net/internal/validator"
 )
@@ -11,25 +12,91 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// GenresAny holds genres of which a movie must have at least one, as opposed to the
+	// genres passed alongside the filters, which a movie must have all of.
+	GenresAny []string
+	// The ranges of release years and runtimes (in minutes) to include. Zero means
+	// that there's no limit.
+	YearMin    int
+	YearMax    int
+	RuntimeMin int
+	RuntimeMax int
+	// Attributes holds attributes which a movie must have, with the same values.
+	Attributes Attributes
+	// The range of times that movies were added to the catalog, from AddedFrom up to
+	// (but not including) AddedBefore. A zero time means that there's no limit.
+	AddedFrom   time.Time
+	AddedBefore time.Time
 }
-// Check that the client-provided Sort field matches one of the entries in our safelist
-// and if it does, extract the column name from the Sort field by stripping the leading
-// hyphen character (if one exists).
-func (f Filters) sortColumn() string {
-    for _, safeValue := range f.SortSafelist {
-        if f.Sort == safeValue {
-            return strings.TrimPrefix(f.Sort, "-")
+// The sortField type is one of the columns in a sort, which may be on several columns.
+type sortField struct {
+    column string
+    desc   bool
+}
+// The Sort field is a comma-separated list of columns, like "-year,title", each of which
+// sorts in descending order if it has a leading hyphen. Check that every one of them
+// matches an entry in our safelist, and if they do, extract the column names and
+// directions.
+func (f Filters) sortFields() []sortField {
+    var fields []sortField
+    for _, field := range strings.Split(f.Sort, ",") {
+        if !validator.In(field, f.SortSafelist...) {
+            panic("unsafe sort parameter: " + f.Sort)
         }
+        fields = append(fields, sortField{column: strings.TrimPrefix(field, "-"), desc: strings.HasPrefix(field, "-")})
     }
-    panic("unsafe sort parameter: " + f.Sort)
+    return fields
 }
-// Return the sort direction ("ASC" or "DESC") depending on the prefix character of the
-// Sort field.
-func (f Filters) sortDirection() string {
-    if strings.HasPrefix(f.Sort, "-") {
-        return "DESC"
+// Return the ORDER BY clause for the sort. Unless the sort already includes the ID, it
+// is added as the final tie-breaker, so that rows which are equal on every sort column
+// are always returned in the same order and pagination is stable. Nulls sort last in
+// either direction, so that they stay at the end of the listing.
+func (f Filters) orderBy() string {
+    var clauses []string
+    sortedByID := false
+    for _, field := range f.sortFields() {
+        direction := "ASC"
+        if field.desc {
+            direction = "DESC"
+        }
+        clauses = append(clauses, field.column+" "+direction+" NULLS LAST")
+        sortedByID = sortedByID || field.column == "id"
+    }
+    if !sortedByID {
+        clauses = append(clauses, "id ASC")
     }
-    return "ASC"
+    return strings.Join(clauses, ", ")
+}
+
+// HasLimits reports whether any of the genres_any, year, runtime, attribute or added
+// limits are set.
+func (f Filters) HasLimits() bool {
+	return len(f.GenresAny) > 0 || f.YearMin != 0 || f.YearMax != 0 || f.RuntimeMin != 0 || f.RuntimeMax != 0 || len(f.Attributes) > 0 || !f.AddedFrom.IsZero() || !f.AddedBefore.IsZero()
+}
+
+// addedBetween reports whether a movie added at the given time is in the added range.
+func (f Filters) addedBetween(createdAt time.Time) bool {
+	return (f.AddedFrom.IsZero() || !createdAt.Before(f.AddedFrom)) &&
+		(f.AddedBefore.IsZero() || createdAt.Before(f.AddedBefore))
+}
+
+// matchesGenresAny reports whether a movie has at least one of the GenresAny genres, if
+// there are any.
+func (f Filters) matchesGenresAny(genres []string) bool {
+	return len(f.GenresAny) == 0 || sharesAny(genres, f.GenresAny)
+}
+
+// matchesAttributes reports whether a movie has all of the Attributes, if there are any.
+func (f Filters) matchesAttributes(attributes Attributes) bool {
+	return attributes.contains(f.Attributes)
+}
+
+// inRanges reports whether a movie's year and runtime are within the limits.
+func (f Filters) inRanges(year int32, runtime Runtime) bool {
+	return (f.YearMin == 0 || int(year) >= f.YearMin) &&
+		(f.YearMax == 0 || int(year) <= f.YearMax) &&
+		(f.RuntimeMin == 0 || int(runtime) >= f.RuntimeMin) &&
+		(f.RuntimeMax == 0 || int(runtime) <= f.RuntimeMax)
 }
 
 func (f Filters) limit() int {
@@ -45,8 +112,31 @@ func ValidateFilters(v *validator.Validator, f Filters) {
     v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
     v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
     v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-    // Check that the sort parameter matches a value in the safelist.
-    v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+    ValidateSort(v, f)
+    ValidateRanges(v, f)
+}
+
+// ValidateSort checks that every column in the sort parameter matches a value in the
+// safelist, and that no column appears more than once.
+func ValidateSort(v *validator.Validator, f Filters) {
+    seen := make(map[string]bool)
+    for _, field := range strings.Split(f.Sort, ",") {
+        v.Check(validator.In(field, f.SortSafelist...), "sort", "invalid sort value")
+        column := strings.TrimPrefix(field, "-")
+        v.Check(!seen[column], "sort", "must not contain the same column more than once")
+        seen[column] = true
+    }
+}
+
+// ValidateRanges checks the year and runtime limits. It's separate from ValidateFilters()
+// for the endpoints which take the limits but aren't paginated.
+func ValidateRanges(v *validator.Validator, f Filters) {
+    v.Check(f.YearMin >= 0, "year_min", "must not be negative")
+    v.Check(f.YearMax >= 0, "year_max", "must not be negative")
+    v.Check(f.YearMax == 0 || f.YearMin <= f.YearMax, "year_max", "must not be less than year_min")
+    v.Check(f.RuntimeMin >= 0, "runtime_min", "must not be negative")
+    v.Check(f.RuntimeMax >= 0, "runtime_max", "must not be negative")
+    v.Check(f.RuntimeMax == 0 || f.RuntimeMin <= f.RuntimeMax, "runtime_max", "must not be less than runtime_min")
 }
 
 // Define a new Metadata struct for holding the pagination metadata.
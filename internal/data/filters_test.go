@@ -0,0 +1,74 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// FuzzFilters checks that building the ORDER BY, LIMIT and OFFSET clauses never panics
+// for filters which ValidateFilters() has accepted, and that the ORDER BY clause only
+// ever contains the columns in the safelist.
+func FuzzFilters(f *testing.F) {
+	f.Add("title", 1, 20)
+	f.Add("-year,title", 2, 100)
+	f.Add("year,-year", 1, 20)
+	f.Add("title,", 1, 20)
+	f.Add(",", 1, 20)
+	f.Add("", 1, 20)
+	f.Add("id; DROP TABLE movies", 1, 20)
+	f.Add("--title", 0, 0)
+	f.Add("runtime", 10_000_000, 101)
+	f.Fuzz(func(t *testing.T, sort string, page, pageSize int) {
+		filters := Filters{
+			Page:         page,
+			PageSize:     pageSize,
+			Sort:         sort,
+			SortSafelist: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+		}
+		v := validator.New()
+		ValidateFilters(v, filters)
+		if !v.Valid() {
+			return
+		}
+		if filters.limit() <= 0 || filters.offset() < 0 {
+			t.Fatalf("page %d, page_size %d: LIMIT %d OFFSET %d", page, pageSize, filters.limit(), filters.offset())
+		}
+		for _, clause := range strings.Split(filters.orderBy(), ", ") {
+			column, direction, _ := strings.Cut(clause, " ")
+			if !validator.In(column, "id", "title", "year", "runtime") {
+				t.Fatalf("sort %q: unexpected column in ORDER BY %s", sort, filters.orderBy())
+			}
+			if !validator.In(direction, "ASC", "ASC NULLS LAST", "DESC NULLS LAST") {
+				t.Fatalf("sort %q: unexpected direction in ORDER BY %s", sort, filters.orderBy())
+			}
+		}
+	})
+}
+
+// BenchmarkMovieListQuery measures building the SQL query for a page of the movie
+// listing, with its ORDER BY, LIMIT and OFFSET, as GetAll() does for every request.
+func BenchmarkMovieListQuery(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		sort string
+	}{
+		{name: "id", sort: "id"},
+		{name: "title", sort: "title"},
+		{name: "three_columns", sort: "-year,title,-runtime"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			filters := Filters{
+				Page:         3,
+				PageSize:     20,
+				Sort:         bm.sort,
+				SortSafelist: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				movieListQuery("count(*) OVER()", "panther", []string{"action"}, filters, DefaultTenantID)
+			}
+		})
+	}
+}
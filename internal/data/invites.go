@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The Invite type is an invite code, which lets up to MaxUses people register while
+// registration is invite-only. The plaintext code is only known when the invite is
+// created; like tokens, only its hash is stored.
+type Invite struct {
+	ID        int64     `json:"id"`
+	Plaintext string    `json:"code,omitempty"`
+	Hash      []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy int64     `json:"created_by,omitempty"`
+	Expiry    time.Time `json:"expiry"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// NewInvite generates a new invite code, in the same way as tokens are generated.
+func NewInvite(createdBy int64, ttl time.Duration, maxUses int, note string) (*Invite, error) {
+	token, err := generateToken(createdBy, ttl, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Invite{
+		Plaintext: token.Plaintext,
+		Hash:      token.Hash,
+		CreatedBy: createdBy,
+		Expiry:    token.Expiry,
+		MaxUses:   maxUses,
+		Note:      note,
+	}, nil
+}
+
+// ValidateInviteCode checks that an invite code is in the right format.
+func ValidateInviteCode(v *validator.Validator, code string) {
+	v.Check(code != "", "invite_code", "must be provided")
+	v.Check(len(code) == 26, "invite_code", "must be 26 bytes long")
+}
+
+type InviteModel struct {
+	DB *sql.DB
+}
+
+// Insert adds an invite, and sets its ID and creation time.
+func (m InviteModel) Insert(invite *Invite) error {
+	query := `
+		INSERT INTO invites (hash, created_by, expiry, max_uses, note)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	createdBy := sql.NullInt64{Int64: invite.CreatedBy, Valid: invite.CreatedBy > 0}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, invite.Hash, createdBy, invite.Expiry, invite.MaxUses, invite.Note).Scan(&invite.ID, &invite.CreatedAt)
+}
+
+// GetAll returns every invite, newest first, including the ones which have expired or
+// been used up.
+func (m InviteModel) GetAll() ([]*Invite, error) {
+	query := `
+		SELECT id, created_at, created_by, expiry, max_uses, uses, note
+		FROM invites
+		ORDER BY id DESC`
+	return queryList(m.DB, queryTimeout, func(row rowScanner, invite *Invite) error {
+		var createdBy sql.NullInt64
+		err := row.Scan(&invite.ID, &invite.CreatedAt, &createdBy, &invite.Expiry, &invite.MaxUses, &invite.Uses, &invite.Note)
+		invite.CreatedBy = createdBy.Int64
+		return err
+	}, query)
+}
+
+// Delete deletes an invite, so that it can't be used any more.
+func (m InviteModel) Delete(id int64) error {
+	return execExpectRows(m.DB, queryTimeout, "DELETE FROM invites WHERE id = $1", id)
+}
+
+// Consume uses up one of the uses of an invite, and returns its ID. The check and the
+// update happen in a single statement, so an invite can't be used more than MaxUses
+// times however many people try to register with it at once. It returns
+// ErrRecordNotFound if the code is unknown, has expired or has been used up.
+func (m InviteModel) Consume(plaintext string) (int64, error) {
+	query := `
+		UPDATE invites
+		SET uses = uses + 1
+		WHERE hash = $1 AND expiry > $2 AND uses < max_uses
+		RETURNING id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var id int64
+	err := m.DB.QueryRowContext(ctx, query, hashTokenPlaintext(plaintext), time.Now()).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// Release gives back a use of an invite which was consumed by a registration that then
+// failed, so that the person can try again.
+func (m InviteModel) Release(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, "UPDATE invites SET uses = uses - 1 WHERE id = $1 AND uses > 0", id)
+	return err
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The statuses of a job. A job is queued until a worker picks it up, and then running
+// until it has either succeeded or failed.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// The Job type is a long-running operation, like a large import, which is carried out by
+// a worker after the request which started it has been responded to. Progress and Total
+// count the units of work (like the movies in an import) which have been done and which
+// there are to do. Result is the job's JSON result once it has succeeded, and Error is
+// why it failed.
+type Job struct {
+	ID         int64           `json:"id"`
+	UserID     int64           `json:"user_id"`
+	Kind       string          `json:"kind"`
+	Status     string          `json:"status"`
+	Progress   int             `json:"progress"`
+	Total      int             `json:"total"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// The JobModel type records the status and progress of jobs in the jobs table.
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Insert records a new queued job, and sets its ID, status and creation time.
+func (m JobModel) Insert(job *Job) error {
+	query := `
+		INSERT INTO jobs (user_id, kind, total)
+		VALUES ($1, $2, $3)
+		RETURNING id, status, created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, job.UserID, job.Kind, job.Total).Scan(&job.ID, &job.Status, &job.CreatedAt)
+}
+
+// Get returns one of a user's jobs, or ErrRecordNotFound if the user doesn't have a job
+// with the ID.
+func (m JobModel) Get(id, userID int64) (*Job, error) {
+	query := `
+		SELECT id, user_id, kind, status, progress, total, result, error, created_at, started_at, finished_at
+		FROM jobs
+		WHERE id = $1 AND user_id = $2`
+	return queryOne(m.DB, queryTimeout, func(row rowScanner, job *Job) error {
+		var result []byte
+		err := row.Scan(&job.ID, &job.UserID, &job.Kind, &job.Status, &job.Progress, &job.Total, &result, &job.Error, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+		job.Result = result
+		return err
+	}, query, id, userID)
+}
+
+// Start marks a queued job as running.
+func (m JobModel) Start(id int64) error {
+	query := `
+		UPDATE jobs
+		SET status = $2, started_at = NOW()
+		WHERE id = $1 AND status = $3`
+	return execExpectRows(m.DB, queryTimeout, query, id, JobRunning, JobQueued)
+}
+
+// Progress records how much of a running job has been done.
+func (m JobModel) Progress(id int64, progress int) error {
+	query := `
+		UPDATE jobs
+		SET progress = $2
+		WHERE id = $1 AND status = $3`
+	return execExpectRows(m.DB, queryTimeout, query, id, progress, JobRunning)
+}
+
+// Finish marks a running job as succeeded with its result, or as failed if jobErr isn't
+// nil. Only the message of jobErr is kept.
+func (m JobModel) Finish(id int64, result json.RawMessage, jobErr error) error {
+	status, message := JobSucceeded, ""
+	if jobErr != nil {
+		status, message, result = JobFailed, jobErr.Error(), nil
+	}
+	query := `
+		UPDATE jobs
+		SET status = $2, result = $3, error = $4, finished_at = NOW()
+		WHERE id = $1 AND status = $5`
+	return execExpectRows(m.DB, queryTimeout, query, id, status, nullableJSON(result), message, JobRunning)
+}
+
+// nullableJSON returns a JSON value as an argument for a jsonb column, which is NULL if
+// the value is empty.
+func nullableJSON(value json.RawMessage) any {
+	if len(value) == 0 {
+		return nil
+	}
+	return []byte(value)
+}
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// JobsLeaderLock is the name of the advisory lock held by the instance which runs the
+// singleton jobs.
+const JobsLeaderLock = "greenlight:jobs"
+
+// The LeaderModel type elects one instance of the application as the leader, which is
+// the one that runs the periodic jobs that should only run once however many replicas
+// there are. The leader is the instance which holds a session-level PostgreSQL advisory
+// lock, on a connection that it keeps out of the pool for as long as it's the leader.
+// If the leader goes away its connection closes, the lock is released, and the next
+// instance to call IsLeader() takes over.
+type LeaderModel struct {
+	DB  *sql.DB
+	key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// NewLeaderModel returns a LeaderModel for the advisory lock with the given name. The
+// lock's key is a hash of the name.
+func NewLeaderModel(db *sql.DB, name string) *LeaderModel {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return &LeaderModel{DB: db, key: int64(h.Sum64())}
+}
+
+// IsLeader reports whether this instance is the leader, trying to become the leader if
+// it isn't. A leader which has lost its connection to the database isn't the leader
+// any more, as its lock went with the connection.
+func (m *LeaderModel) IsLeader() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		err := m.conn.PingContext(ctx)
+		if err == nil {
+			return true, nil
+		}
+		m.conn.Close()
+		m.conn = nil
+	}
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", m.key).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return false, err
+	}
+	m.conn = conn
+	return true, nil
+}
+
+// Resign gives up the leadership, if this instance has it, so that another instance can
+// take over straight away rather than when the connection times out.
+func (m *LeaderModel) Resign() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", m.key)
+	m.conn.Close()
+	m.conn = nil
+	return err
+}
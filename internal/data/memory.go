@@ -0,0 +1,1730 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The memoryStore type holds the data for the in-memory models. The user and token
+// models need to see each other's data (for GetForToken()), so all of the models
+// returned by NewMemoryModels() share a single store, protected by a mutex so that it's
+// safe for concurrent use.
+type memoryStore struct {
+	mu          sync.Mutex
+	movies      map[int64]Movie
+	revisions   map[int64][]MovieRevision
+	nextMovieID int64
+	users       map[int64]User
+	nextUserID  int64
+	tokens      map[[sha256.Size]byte]Token
+	nextTokenID int64
+	permissions map[int64]Permissions
+	roles       []Role
+	userRoles   map[int64][]string
+	deletions   map[int64]time.Time
+	logins      map[int64]loginActivity
+	invites     []Invite
+	usage       map[userDay]UsageCounts
+	exports     map[int64]UserExport
+	nextExport  int64
+	jobs        map[int64]Job
+	nextJobID   int64
+	nextInvite  int64
+	events      []SecurityEvent
+	views       map[movieHour]int64
+	trending    map[string][]TrendingMovie
+	nextEventID int64
+	tenants     []Tenant
+	// movieTenants and userTenants hold the tenant of each movie and user.
+	movieTenants map[int64]int64
+	userTenants  map[int64]int64
+	// movieDeletions holds the time that each soft deleted movie was deleted, like
+	// deletions does for users.
+	movieDeletions map[int64]time.Time
+	// changes is the feed of changes to movies, like the movie_changes table, with the
+	// tenant of each change.
+	changes       []MovieChange
+	changeTenants []int64
+	nextChangeID  int64
+	// userChanges is the feed of changes to users, like the user_changes table, and
+	// eventCursors holds the positions of the event relay in the feeds.
+	userChanges      []UserChange
+	nextUserChangeID int64
+	eventCursors     map[string]int64
+	// meteringPushes holds the number of rollups pushed for each day, like the
+	// metering_pushes table.
+	meteringPushes map[time.Time]int
+}
+
+// recordChange adds a change to a movie to the changes feed.
+func (s *memoryStore) recordChange(movie Movie, operation string) {
+	s.nextChangeID++
+	s.changes = append(s.changes, MovieChange{
+		ID:        s.nextChangeID,
+		MovieID:   movie.ID,
+		Operation: operation,
+		Version:   movie.Version,
+		ChangedAt: time.Now(),
+		TenantID:  s.movieTenants[movie.ID],
+	})
+	s.changeTenants = append(s.changeTenants, s.movieTenants[movie.ID])
+}
+
+// recordUserChange adds a change to a user to the feed of changes to users.
+func (s *memoryStore) recordUserChange(user User, operation string) {
+	s.nextUserChangeID++
+	s.userChanges = append(s.userChanges, UserChange{
+		ID:        s.nextUserChangeID,
+		UserID:    user.ID,
+		Operation: operation,
+		Version:   user.Version,
+		ChangedAt: time.Now(),
+		TenantID:  s.userTenants[user.ID],
+	})
+}
+
+// movieLive reports whether the movie with the given ID hasn't been soft deleted, and is
+// visible to a model scoped to tenantID.
+func (s *memoryStore) movieLive(id, tenantID int64) bool {
+	_, deleted := s.movieDeletions[id]
+	return !deleted && inTenant(s.movieTenants, id, tenantID)
+}
+
+// movieWithIdentity returns the ID of the live movie in a tenant with the given identity
+// (see MovieIdentity()), other than the movie with the ID except, or zero if there isn't
+// one. It stands in for the movies_identity_idx index.
+func (s *memoryStore) movieWithIdentity(tenantID int64, identity string, except int64) int64 {
+	for id, movie := range s.movies {
+		_, deleted := s.movieDeletions[id]
+		if id != except && !deleted && s.movieTenants[id] == tenantID && MovieIdentity(movie.Title, movie.Year) == identity {
+			return id
+		}
+	}
+	return 0
+}
+
+// inTenant reports whether the record with the given ID is visible to a model scoped to
+// tenantID, where tenants is the store's movieTenants or userTenants.
+func inTenant(tenants map[int64]int64, id, tenantID int64) bool {
+	return tenantID == 0 || tenants[id] == tenantID
+}
+
+// NewMemoryModels returns a Models struct containing in-memory implementations of every
+// model. They behave like the PostgreSQL models (including the version checks which
+// produce ErrEditConflict), but all data is lost when the application exits. They're
+// used when the API is started with -db-driver=memory, so that demos, playgrounds and
+// smoke tests can run the full binary without any external dependencies.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		movies:      make(map[int64]Movie),
+		revisions:   make(map[int64][]MovieRevision),
+		users:       make(map[int64]User),
+		tokens:      make(map[[sha256.Size]byte]Token),
+		permissions: make(map[int64]Permissions),
+		// The same roles as the migrations create.
+		roles: []Role{
+			{ID: 1, Name: RoleAdmin, Permissions: Permissions{"movies:read", "movies:write"}},
+			{ID: 2, Name: RoleEditor, Permissions: Permissions{"movies:read", "movies:write"}},
+			{ID: 3, Name: RoleViewer, Permissions: Permissions{"movies:read"}},
+		},
+		userRoles: make(map[int64][]string),
+		views:     make(map[movieHour]int64),
+		deletions: make(map[int64]time.Time),
+		logins:    make(map[int64]loginActivity),
+		trending:  make(map[string][]TrendingMovie),
+		usage:     make(map[userDay]UsageCounts),
+		exports:   make(map[int64]UserExport),
+		jobs:      make(map[int64]Job),
+		tenants:   []Tenant{{ID: DefaultTenantID, CreatedAt: time.Now(), Slug: DefaultTenantSlug, Name: "Default"}},
+
+		movieTenants: make(map[int64]int64),
+		userTenants:  make(map[int64]int64),
+
+		movieDeletions: make(map[int64]time.Time),
+		eventCursors:   make(map[string]int64),
+		meteringPushes: make(map[time.Time]int),
+	}
+	return Models{
+		Movies:         MemoryMovieModel{store: store},
+		Tokens:         MemoryTokenModel{store: store},
+		Permissions:    MemoryPermissionModel{store: store},
+		Roles:          MemoryRoleModel{store: store},
+		Users:          MemoryUserModel{store: store},
+		SecurityEvents: MemorySecurityEventModel{store: store},
+		Views:          MemoryViewModel{store: store},
+		Invites:        MemoryInviteModel{store: store},
+		Usage:          MemoryUsageModel{store: store},
+		Metering:       MemoryMeteringModel{store: store},
+		UserExports:    MemoryUserExportModel{store: store},
+		Jobs:           MemoryJobModel{store: store},
+		EventCursors:   MemoryEventCursorModel{store: store},
+		Leader:         MemoryLeaderModel{},
+		Partitions:     MemoryPartitionModel{},
+		Tenants:        MemoryTenantModel{store: store},
+	}
+}
+
+// copyMovie returns a copy of a movie which doesn't share its genres slice or attributes
+// map with the original, so that callers can't modify the data held in the store.
+func copyMovie(movie Movie) Movie {
+	if movie.Genres != nil {
+		movie.Genres = append([]string{}, movie.Genres...)
+	}
+	movie.Attributes = movie.Attributes.clone()
+	return movie
+}
+
+type MemoryMovieModel struct {
+	store    *memoryStore
+	tenantID int64
+	actorID  int64
+}
+
+func (m MemoryMovieModel) forTenant(tenantID int64) any {
+	m.tenantID = tenantID
+	return m
+}
+
+func (m MemoryMovieModel) actingAs(userID int64) any {
+	m.actorID = userID
+	return m
+}
+
+// visible returns the movies that the model can see.
+func (m MemoryMovieModel) visible() map[int64]Movie {
+	movies := make(map[int64]Movie)
+	for id, movie := range m.store.movies {
+		if m.store.movieLive(id, m.tenantID) {
+			movies[id] = movie
+		}
+	}
+	return movies
+}
+
+func (m MemoryMovieModel) Insert(movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if m.store.movieWithIdentity(insertTenant(m.tenantID), MovieIdentity(movie.Title, movie.Year), 0) != 0 {
+		return ErrDuplicateMovie
+	}
+	m.insert(movie)
+	return nil
+}
+
+// insert adds a movie to the store. The caller must hold the store's lock.
+func (m MemoryMovieModel) insert(movie *Movie) {
+	m.store.nextMovieID++
+	movie.ID = m.store.nextMovieID
+	movie.CreatedAt = time.Now()
+	movie.Version = 1
+	movie.CreatedBy, movie.UpdatedBy = m.actorID, m.actorID
+	m.store.movies[movie.ID] = copyMovie(*movie)
+	m.store.movieTenants[movie.ID] = insertTenant(m.tenantID)
+	m.store.recordChange(*movie, ChangeCreated)
+}
+
+func (m MemoryMovieModel) InsertMany(movies []*Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	// Check every movie first, so that (like the transaction in MovieModel.InsertMany())
+	// a duplicate means that none of them are inserted.
+	seen := make(map[string]bool)
+	for _, movie := range movies {
+		identity := MovieIdentity(movie.Title, movie.Year)
+		if seen[identity] || m.store.movieWithIdentity(insertTenant(m.tenantID), identity, 0) != 0 {
+			return ErrDuplicateMovie
+		}
+		seen[identity] = true
+	}
+	for _, movie := range movies {
+		m.insert(movie)
+	}
+	return nil
+}
+
+func (m MemoryMovieModel) Get(id int64) (*Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movie, ok := m.store.movies[id]
+	if !ok || !m.store.movieLive(id, m.tenantID) {
+		return nil, ErrRecordNotFound
+	}
+	movie = copyMovie(movie)
+	return &movie, nil
+}
+
+func (m MemoryMovieModel) GetMany(ids []int64) ([]*Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movies := []*Movie{}
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		movie, ok := m.store.movies[id]
+		if !ok || seen[id] || !m.store.movieLive(id, m.tenantID) {
+			continue
+		}
+		seen[id] = true
+		movie = copyMovie(movie)
+		movies = append(movies, &movie)
+	}
+	return movies, nil
+}
+
+func (m MemoryMovieModel) Update(movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	// Like the SQL query in MovieModel.Update(), a missing record and a version
+	// mismatch are both reported as an edit conflict.
+	existing, ok := m.store.movies[movie.ID]
+	if !ok || existing.Version != movie.Version || !m.store.movieLive(movie.ID, m.tenantID) {
+		return ErrEditConflict
+	}
+	if m.store.movieWithIdentity(m.store.movieTenants[movie.ID], MovieIdentity(movie.Title, movie.Year), movie.ID) != 0 {
+		return ErrDuplicateMovie
+	}
+	m.update(movie)
+	return nil
+}
+
+// update saves the revision that a movie replaces and stores the new version. The caller
+// must hold the store's lock.
+func (m MemoryMovieModel) update(movie *Movie) {
+	existing := copyMovie(m.store.movies[movie.ID])
+	m.store.revisions[movie.ID] = append(m.store.revisions[movie.ID], MovieRevision{
+		MovieID:    existing.ID,
+		Version:    existing.Version,
+		ReplacedAt: time.Now(),
+		Title:      existing.Title,
+		Year:       existing.Year,
+		Runtime:    existing.Runtime,
+		Genres:     existing.Genres,
+		Attributes: existing.Attributes,
+	})
+	movie.Version++
+	movie.UpdatedBy = m.actorID
+	m.store.movies[movie.ID] = copyMovie(*movie)
+	m.store.recordChange(*movie, ChangeUpdated)
+}
+
+func (m MemoryMovieModel) UpdateMany(movies []*Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	// Check every movie first, so that (like the transaction in MovieModel.UpdateMany())
+	// a failure means that none of them are updated.
+	failed := make(map[int]error)
+	updating := make(map[int64]bool)
+	for _, movie := range movies {
+		updating[movie.ID] = true
+	}
+	identities := make(map[string]bool)
+	for i, movie := range movies {
+		existing, ok := m.store.movies[movie.ID]
+		if !ok || existing.Version != movie.Version || !m.store.movieLive(movie.ID, m.tenantID) {
+			failed[i] = ErrEditConflict
+			continue
+		}
+		identity := strconv.FormatInt(m.store.movieTenants[movie.ID], 10) + "|" + MovieIdentity(movie.Title, movie.Year)
+		other := m.store.movieWithIdentity(m.store.movieTenants[movie.ID], MovieIdentity(movie.Title, movie.Year), movie.ID)
+		if identities[identity] || (other != 0 && !updating[other]) {
+			failed[i] = ErrDuplicateMovie
+		}
+		identities[identity] = true
+	}
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	for _, movie := range movies {
+		m.update(movie)
+	}
+	return nil
+}
+
+func (m MemoryMovieModel) Upsert(movie *Movie) (string, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	id := m.store.movieWithIdentity(insertTenant(m.tenantID), MovieIdentity(movie.Title, movie.Year), 0)
+	if id == 0 {
+		m.insert(movie)
+		return UpsertCreated, nil
+	}
+	existing := m.store.movies[id]
+	movie.ID, movie.CreatedAt, movie.Version, movie.CreatedBy = existing.ID, existing.CreatedAt, existing.Version, existing.CreatedBy
+	if sameMovieFields(existing, *movie) {
+		movie.UpdatedBy = existing.UpdatedBy
+		return UpsertUnchanged, nil
+	}
+	m.update(movie)
+	return UpsertUpdated, nil
+}
+
+func (m MemoryMovieModel) Delete(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if _, ok := m.store.movies[id]; !ok || !m.store.movieLive(id, m.tenantID) {
+		return ErrRecordNotFound
+	}
+	existing := m.store.movies[id]
+	existing.Version++
+	m.store.movies[id] = existing
+	m.store.movieDeletions[id] = time.Now()
+	m.store.recordChange(existing, ChangeDeleted)
+	return nil
+}
+
+func (m MemoryMovieModel) Changes(since int64, limit int) ([]*MovieChange, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	changes := []*MovieChange{}
+	for i, change := range m.store.changes {
+		if len(changes) == limit {
+			break
+		}
+		if change.ID <= since || (m.tenantID != 0 && m.store.changeTenants[i] != m.tenantID) {
+			continue
+		}
+		change := change
+		changes = append(changes, &change)
+	}
+	return changes, nil
+}
+
+func (m MemoryMovieModel) DeleteMatching(title string, genres []string, filters Filters, dryRun bool) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var n int64
+	for id, movie := range m.visible() {
+		if !matchesFilters(movie, title, genres, filters) {
+			continue
+		}
+		n++
+		if dryRun {
+			continue
+		}
+		movie.Version++
+		m.store.movies[id] = movie
+		m.store.movieDeletions[id] = time.Now()
+		m.store.recordChange(movie, ChangeDeleted)
+	}
+	return n, nil
+}
+
+func (m MemoryMovieModel) PurgeDeleted(before time.Time) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var n int64
+	for id, deletedAt := range m.store.movieDeletions {
+		if !deletedAt.Before(before) {
+			continue
+		}
+		delete(m.store.movies, id)
+		delete(m.store.revisions, id)
+		delete(m.store.movieTenants, id)
+		delete(m.store.movieDeletions, id)
+		for key := range m.store.views {
+			if key.movieID == id {
+				delete(m.store.views, key)
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (m MemoryMovieModel) Stats() (*MovieStats, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movies := m.visible()
+	stats := &MovieStats{Total: len(movies), ByGenre: make(map[string]int), ByDecade: make(map[string]int)}
+	var runtime int64
+	var newest, oldest *Movie
+	for _, movie := range movies {
+		movie := movie
+		for _, genre := range movie.Genres {
+			stats.ByGenre[genre]++
+		}
+		stats.ByDecade[decadeKey(movie.Year)]++
+		runtime += int64(movie.Runtime)
+		if newest == nil || movie.ID > newest.ID {
+			newest = &movie
+		}
+		if oldest == nil || movie.ID < oldest.ID {
+			oldest = &movie
+		}
+	}
+	if stats.Total > 0 {
+		stats.AverageRuntime = float64(runtime) / float64(stats.Total)
+		n, o := copyMovie(*newest), copyMovie(*oldest)
+		stats.Newest, stats.Oldest = &n, &o
+	}
+	return stats, nil
+}
+
+func (m MemoryMovieModel) Similar(id int64, limit int) ([]*SimilarMovie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movies := []*SimilarMovie{}
+	base, ok := m.store.movies[id]
+	if !ok || !m.store.movieLive(id, m.tenantID) {
+		return movies, nil
+	}
+	for _, movie := range m.store.movies {
+		if movie.ID == id || !sharesAny(movie.Genres, base.Genres) || m.store.movieTenants[movie.ID] != m.store.movieTenants[id] || !m.store.movieLive(movie.ID, 0) {
+			continue
+		}
+		movies = append(movies, &SimilarMovie{Movie: copyMovie(movie), Score: MovieSimilarity.Score(&base, &movie)})
+	}
+	sortSimilar(movies)
+	if len(movies) > limit {
+		movies = movies[:limit]
+	}
+	return movies, nil
+}
+
+// Suggest matches titles which start with q, and then titles with a word which starts
+// with q, rather than by trigram similarity like the movies_title_trgm_idx index.
+func (m MemoryMovieModel) Suggest(q string, limit int) ([]*MovieSuggestion, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	q = strings.ToLower(q)
+	var prefixed, worded []Movie
+	for _, movie := range m.visible() {
+		title := strings.ToLower(movie.Title)
+		switch {
+		case strings.HasPrefix(title, q):
+			prefixed = append(prefixed, movie)
+		case strings.Contains(" "+title, " "+q):
+			worded = append(worded, movie)
+		}
+	}
+	suggestions := []*MovieSuggestion{}
+	for _, movies := range [][]Movie{prefixed, worded} {
+		sort.Slice(movies, func(i, j int) bool {
+			if movies[i].Title != movies[j].Title {
+				return movies[i].Title < movies[j].Title
+			}
+			return movies[i].ID < movies[j].ID
+		})
+		for _, movie := range movies {
+			if len(suggestions) == limit {
+				return suggestions, nil
+			}
+			suggestions = append(suggestions, &MovieSuggestion{ID: movie.ID, Title: movie.Title, Year: movie.Year})
+		}
+	}
+	return suggestions, nil
+}
+
+// sharesAny reports whether two lists of values have any values in common.
+func sharesAny(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m MemoryMovieModel) Random(title string, genres []string, filters Filters) (*Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var matches []Movie
+	for _, movie := range m.visible() {
+		if !matchesFilters(movie, title, genres, filters) {
+			continue
+		}
+		matches = append(matches, movie)
+	}
+	if len(matches) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	movie := copyMovie(matches[rand.Intn(len(matches))])
+	return &movie, nil
+}
+
+func (m MemoryMovieModel) GetRevisions(movieID int64) ([]*MovieRevision, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if !m.store.movieLive(movieID, m.tenantID) {
+		return []*MovieRevision{}, nil
+	}
+	stored := m.store.revisions[movieID]
+	revisions := make([]*MovieRevision, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		revision := stored[i]
+		revision.Genres = append([]string(nil), revision.Genres...)
+		revision.Attributes = revision.Attributes.clone()
+		revisions = append(revisions, &revision)
+	}
+	return revisions, nil
+}
+
+func (m MemoryMovieModel) GetRevision(movieID int64, version int32) (*MovieRevision, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if !m.store.movieLive(movieID, m.tenantID) {
+		return nil, ErrRecordNotFound
+	}
+	for _, revision := range m.store.revisions[movieID] {
+		if revision.Version == version {
+			revision.Genres = append([]string(nil), revision.Genres...)
+			revision.Attributes = revision.Attributes.clone()
+			return &revision, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m MemoryMovieModel) GetAsOf(id int64, at time.Time) (*Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movie, ok := m.store.movies[id]
+	if !ok || !inTenant(m.store.movieTenants, id, m.tenantID) || movie.CreatedAt.After(at) {
+		return nil, ErrRecordNotFound
+	}
+	movie = copyMovie(movie)
+	if deletedAt, deleted := m.store.movieDeletions[id]; deleted {
+		if !deletedAt.After(at) {
+			return nil, ErrRecordNotFound
+		}
+		movie.Version--
+	}
+	// The revisions are in version order, so the first one replaced after the time is
+	// the version which was current at the time.
+	for _, revision := range m.store.revisions[id] {
+		if revision.ReplacedAt.After(at) {
+			movie.Title = revision.Title
+			movie.Year = revision.Year
+			movie.Runtime = revision.Runtime
+			movie.Genres = append([]string(nil), revision.Genres...)
+			movie.Attributes = revision.Attributes.clone()
+			movie.Version = revision.Version
+			movie.UpdatedBy = 0
+			break
+		}
+	}
+	return &movie, nil
+}
+
+func (m MemoryMovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	matches := []*Movie{}
+	for _, movie := range m.visible() {
+		if !matchesFilters(movie, title, genres, filters) {
+			continue
+		}
+		movie := copyMovie(movie)
+		matches = append(matches, &movie)
+	}
+	sortMovies(matches, filters)
+	metadata := calculateMetadata(len(matches), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + filters.limit()
+	if end > len(matches) {
+		end = len(matches)
+	}
+	return matches[start:end], metadata, nil
+}
+
+func (m MemoryMovieModel) GetAllFunc(title string, genres []string, filters Filters, fn func(movie *Movie) error) (Metadata, error) {
+	movies, metadata, err := m.GetAll(title, genres, filters)
+	if err != nil {
+		return Metadata{}, err
+	}
+	for _, movie := range movies {
+		err = fn(movie)
+		if err != nil {
+			return Metadata{}, err
+		}
+	}
+	return metadata, nil
+}
+
+// matchesFilters reports whether a movie matches the title, genres and filters passed
+// to GetAll().
+func matchesFilters(movie Movie, title string, genres []string, filters Filters) bool {
+	return matchesTitle(movie.Title, title) && containsAll(movie.Genres, genres) && filters.matchesGenresAny(movie.Genres) && filters.inRanges(movie.Year, movie.Runtime) && filters.matchesAttributes(movie.Attributes) && filters.addedBetween(movie.CreatedAt)
+}
+
+// matchesTitle approximates the full-text search used by MovieModel.GetAll(): a movie
+// matches if every word in the query appears as a word in the title (ignoring case).
+func matchesTitle(title, query string) bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(title)) {
+		words[word] = true
+	}
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !words[word] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAll returns true if values contains every element of required.
+func containsAll(values, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			if v == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sortMovies sorts movies by the columns and directions in filters, using the movie ID
+// as a tie-breaker in the same way as the ORDER BY clause in MovieModel.GetAll().
+func sortMovies(movies []*Movie, filters Filters) {
+	fields := filters.sortFields()
+	sort.SliceStable(movies, func(i, j int) bool {
+		a, b := movies[i], movies[j]
+		for _, field := range fields {
+			var cmp int
+			switch field.column {
+			case "id":
+				cmp = compareInt64(a.ID, b.ID)
+			case "title":
+				cmp = strings.Compare(a.Title, b.Title)
+			case "year":
+				cmp = compareInt64(int64(a.Year), int64(b.Year))
+			case "runtime":
+				cmp = compareInt64(int64(a.Runtime), int64(b.Runtime))
+			}
+			if field.desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type MemoryTokenModel struct {
+	store *memoryStore
+}
+
+func (m MemoryTokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m MemoryTokenModel) Insert(token *Token) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var hash [sha256.Size]byte
+	copy(hash[:], token.Hash)
+	m.store.nextTokenID++
+	token.ID = m.store.nextTokenID
+	token.CreatedAt = time.Now()
+	stored := *token
+	stored.Plaintext = ""
+	stored.Permissions = append(Permissions{}, token.Permissions...)
+	m.store.tokens[hash] = stored
+	return nil
+}
+
+func (m MemoryTokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	var hash [sha256.Size]byte
+	copy(hash[:], hashTokenPlaintext(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	token, ok := m.store.tokens[hash]
+	if !ok || token.Scope != scope || !token.Expiry.After(time.Now()) {
+		return 0, ErrRecordNotFound
+	}
+	delete(m.store.tokens, hash)
+	return token.UserID, nil
+}
+
+func (m MemoryTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for hash, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(m.store.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m MemoryTokenModel) GetAllForUser(userID int64, scopes ...string) ([]*Token, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	tokens := []*Token{}
+	now := time.Now()
+	for _, token := range m.store.tokens {
+		if token.UserID != userID || !token.Expiry.After(now) {
+			continue
+		}
+		for _, scope := range scopes {
+			if token.Scope == scope {
+				token := token
+				token.Hash = nil
+				token.Permissions = append(Permissions{}, token.Permissions...)
+				tokens = append(tokens, &token)
+				break
+			}
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+func (m MemoryTokenModel) DeleteForUser(userID, id int64, scopes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for hash, token := range m.store.tokens {
+		if token.ID == id && token.UserID == userID {
+			if len(scopes) > 0 && !containsAll(scopes, []string{token.Scope}) {
+				return ErrRecordNotFound
+			}
+			delete(m.store.tokens, hash)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m MemoryTokenModel) DeleteAllForUserExcept(scope string, userID, exceptID int64) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var deleted int64
+	for hash, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID && token.ID != exceptID {
+			delete(m.store.tokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m MemoryTokenModel) Touch(id int64, ip, userAgent string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for hash, token := range m.store.tokens {
+		if token.ID == id {
+			token.LastUsedAt = time.Now()
+			token.IP = ip
+			token.UserAgent = userAgent
+			m.store.tokens[hash] = token
+			return nil
+		}
+	}
+	return nil
+}
+
+type MemoryPermissionModel struct {
+	store *memoryStore
+}
+
+func (m MemoryPermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	permissions := append(Permissions(nil), m.store.permissions[userID]...)
+	for _, name := range m.store.userRoles[userID] {
+		for _, role := range m.store.roles {
+			if role.Name != name {
+				continue
+			}
+			for _, code := range role.Permissions {
+				if !permissions.Include(code) {
+					permissions = append(permissions, code)
+				}
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+func (m MemoryPermissionModel) AddForUser(userID int64, codes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for _, code := range codes {
+		if !m.store.permissions[userID].Include(code) {
+			m.store.permissions[userID] = append(m.store.permissions[userID], code)
+		}
+	}
+	return nil
+}
+
+type MemoryRoleModel struct {
+	store *memoryStore
+}
+
+func (m MemoryRoleModel) GetAll() ([]*Role, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	roles := make([]*Role, 0, len(m.store.roles))
+	for _, role := range m.store.roles {
+		role.Permissions = append(Permissions{}, role.Permissions...)
+		roles = append(roles, &role)
+	}
+	return roles, nil
+}
+
+func (m MemoryRoleModel) GetAllForUser(userID int64) ([]string, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	roles := append([]string{}, m.store.userRoles[userID]...)
+	sort.Strings(roles)
+	return roles, nil
+}
+
+func (m MemoryRoleModel) AddForUser(userID int64, role string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	found := false
+	for _, r := range m.store.roles {
+		found = found || r.Name == role
+	}
+	if !found {
+		return ErrRecordNotFound
+	}
+	for _, r := range m.store.userRoles[userID] {
+		if r == role {
+			return nil
+		}
+	}
+	m.store.userRoles[userID] = append(m.store.userRoles[userID], role)
+	return nil
+}
+
+func (m MemoryRoleModel) RemoveForUser(userID int64, role string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	roles := m.store.userRoles[userID]
+	for i, r := range roles {
+		if r == role {
+			m.store.userRoles[userID] = append(roles[:i:i], roles[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+type MemoryUserModel struct {
+	store    *memoryStore
+	tenantID int64
+}
+
+func (m MemoryUserModel) forTenant(tenantID int64) any {
+	return MemoryUserModel{store: m.store, tenantID: tenantID}
+}
+
+// emailTaken returns true if a user of the tenant other than the one with the given ID
+// already has the email address. Like the citext column in the users table, the
+// comparison ignores case. The caller must hold the store mutex.
+func (m MemoryUserModel) emailTaken(email string, tenantID, exceptID int64) bool {
+	for id, user := range m.store.users {
+		if id != exceptID && m.store.userTenants[id] == tenantID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m MemoryUserModel) Insert(user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if m.emailTaken(user.Email, insertTenant(m.tenantID), 0) {
+		return ErrDuplicateEmail
+	}
+	m.store.nextUserID++
+	user.ID = m.store.nextUserID
+	user.CreatedAt = time.Now()
+	user.Version = 1
+	m.store.users[user.ID] = *user
+	m.store.userTenants[user.ID] = insertTenant(m.tenantID)
+	m.store.recordUserChange(*user, ChangeCreated)
+	return nil
+}
+
+func (m MemoryUserModel) Get(id int64) (*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	user, ok := m.store.users[id]
+	if _, deleted := m.store.deletions[id]; !ok || deleted || !inTenant(m.store.userTenants, id, m.tenantID) {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (m MemoryUserModel) GetByEmail(email string) (*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for _, user := range m.store.users {
+		if _, deleted := m.store.deletions[user.ID]; !deleted && inTenant(m.store.userTenants, user.ID, m.tenantID) && strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m MemoryUserModel) Update(user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if m.emailTaken(user.Email, m.store.userTenants[user.ID], user.ID) {
+		return ErrDuplicateEmail
+	}
+	existing, ok := m.store.users[user.ID]
+	if !ok || existing.Version != user.Version || !inTenant(m.store.userTenants, user.ID, m.tenantID) {
+		return ErrEditConflict
+	}
+	user.Version++
+	m.store.users[user.ID] = *user
+	if user.Activated && !existing.Activated {
+		m.store.recordUserChange(*user, ChangeActivated)
+	} else {
+		m.store.recordUserChange(*user, ChangeUpdated)
+	}
+	return nil
+}
+
+func (m MemoryUserModel) GetWithToken(tokenPlaintext string, tokenScopes ...string) (*User, *Token, error) {
+	var tokenHash [sha256.Size]byte
+	copy(tokenHash[:], hashTokenPlaintext(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	token, ok := m.store.tokens[tokenHash]
+	if !ok || !token.Expiry.After(time.Now()) {
+		return nil, nil, ErrRecordNotFound
+	}
+	scopeOK := false
+	for _, scope := range tokenScopes {
+		scopeOK = scopeOK || token.Scope == scope
+	}
+	user, ok := m.store.users[token.UserID]
+	if !scopeOK || !ok || !inTenant(m.store.userTenants, user.ID, m.tenantID) {
+		return nil, nil, ErrRecordNotFound
+	}
+	token.Permissions = append(Permissions{}, token.Permissions...)
+	return &user, &token, nil
+}
+
+func (m MemoryUserModel) UpdatePreferences(userID int64, preferences Preferences) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	user, ok := m.store.users[userID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	user.Preferences = preferences
+	m.store.users[userID] = user
+	return nil
+}
+
+func (m MemoryUserModel) RequestDeletion(userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	user, ok := m.store.users[userID]
+	if _, deleted := m.store.deletions[userID]; !ok || deleted {
+		return ErrRecordNotFound
+	}
+	user.Version++
+	m.store.users[userID] = user
+	m.store.deletions[userID] = time.Now()
+	m.store.recordUserChange(user, ChangeDeleted)
+	for hash, token := range m.store.tokens {
+		if token.UserID == userID {
+			delete(m.store.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func (m MemoryUserModel) PurgeDeleted(before time.Time) ([]int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var ids []int64
+	for id, requestedAt := range m.store.deletions {
+		if !requestedAt.Before(before) {
+			continue
+		}
+		email := m.store.users[id].Email
+		for i, event := range m.store.events {
+			if event.UserID == id || strings.EqualFold(event.Email, email) {
+				m.store.events[i].UserID = 0
+				m.store.events[i].Email = ""
+				m.store.events[i].IP = ""
+			}
+		}
+		// Like the foreign keys on the movies table, forget that the user created or
+		// modified any movies.
+		for movieID, movie := range m.store.movies {
+			if movie.CreatedBy == id || movie.UpdatedBy == id {
+				if movie.CreatedBy == id {
+					movie.CreatedBy = 0
+				}
+				if movie.UpdatedBy == id {
+					movie.UpdatedBy = 0
+				}
+				m.store.movies[movieID] = movie
+			}
+		}
+		delete(m.store.users, id)
+		delete(m.store.userTenants, id)
+		delete(m.store.permissions, id)
+		delete(m.store.userRoles, id)
+		delete(m.store.deletions, id)
+		delete(m.store.logins, id)
+		for key := range m.store.usage {
+			if key.UserID == id {
+				delete(m.store.usage, key)
+			}
+		}
+		for exportID, export := range m.store.exports {
+			if export.UserID == id {
+				delete(m.store.exports, exportID)
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// The loginActivity type holds the login activity for a user in the in-memory model.
+type loginActivity struct {
+	at    time.Time
+	ip    string
+	count int
+}
+
+func (m MemoryUserModel) RecordLogin(userID int64, ip string, at time.Time) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if _, ok := m.store.users[userID]; !ok {
+		return nil
+	}
+	activity := m.store.logins[userID]
+	m.store.logins[userID] = loginActivity{at: at, ip: ip, count: activity.count + 1}
+	return nil
+}
+
+func (m MemoryUserModel) GetAllActivity(dormantSince time.Time, filters Filters) ([]*UserActivity, Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	users := []*UserActivity{}
+	for id, user := range m.store.users {
+		if _, deleted := m.store.deletions[id]; deleted || !inTenant(m.store.userTenants, id, m.tenantID) {
+			continue
+		}
+		activity, loggedIn := m.store.logins[id]
+		if !dormantSince.IsZero() {
+			if (loggedIn && !activity.at.Before(dormantSince)) || (!loggedIn && !user.CreatedAt.Before(dormantSince)) {
+				continue
+			}
+		}
+		u := &UserActivity{ID: id, CreatedAt: user.CreatedAt, Name: user.Name, Email: user.Email, Activated: user.Activated, LastLoginIP: activity.ip, LoginCount: activity.count}
+		if loggedIn {
+			at := activity.at
+			u.LastLoginAt = &at
+		}
+		users = append(users, u)
+	}
+	fields := filters.sortFields()
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		for _, field := range fields {
+			var cmp int
+			switch field.column {
+			case "id":
+				cmp = compareInt64(a.ID, b.ID)
+			case "created_at":
+				cmp = compareInt64(a.CreatedAt.UnixNano(), b.CreatedAt.UnixNano())
+			case "login_count":
+				cmp = compareInt64(int64(a.LoginCount), int64(b.LoginCount))
+			case "last_login_at":
+				// Users who have never logged in sort last in either direction, like
+				// NULLS LAST.
+				switch {
+				case a.LastLoginAt == nil && b.LastLoginAt == nil:
+				case a.LastLoginAt == nil:
+					return false
+				case b.LastLoginAt == nil:
+					return true
+				default:
+					cmp = compareInt64(a.LastLoginAt.UnixNano(), b.LastLoginAt.UnixNano())
+				}
+			}
+			if field.desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return a.ID < b.ID
+	})
+	metadata := calculateMetadata(len(users), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(users) {
+		start = len(users)
+	}
+	end := start + filters.limit()
+	if end > len(users) {
+		end = len(users)
+	}
+	return users[start:end], metadata, nil
+}
+
+func (m MemoryUserModel) Changes(since int64, limit int) ([]*UserChange, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	changes := []*UserChange{}
+	for _, change := range m.store.userChanges {
+		if len(changes) == limit {
+			break
+		}
+		if change.ID <= since || (m.tenantID != 0 && change.TenantID != m.tenantID) {
+			continue
+		}
+		change := change
+		changes = append(changes, &change)
+	}
+	return changes, nil
+}
+
+func (m MemoryUserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	var tokenHash [sha256.Size]byte
+	copy(tokenHash[:], hashTokenPlaintext(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	token, ok := m.store.tokens[tokenHash]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	user, ok := m.store.users[token.UserID]
+	if !ok || !inTenant(m.store.userTenants, user.ID, m.tenantID) {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+type MemorySecurityEventModel struct {
+	store *memoryStore
+}
+
+// maxMemorySecurityEvents is the number of security events kept by the in-memory model.
+// Older events are discarded, so that an attack can't use up all of the memory.
+const maxMemorySecurityEvents = 10000
+
+func (m MemorySecurityEventModel) Insert(event *SecurityEvent) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.nextEventID++
+	event.ID = m.store.nextEventID
+	event.CreatedAt = time.Now()
+	m.store.events = append(m.store.events, *event)
+	if len(m.store.events) > maxMemorySecurityEvents {
+		m.store.events = m.store.events[len(m.store.events)-maxMemorySecurityEvents:]
+	}
+	return nil
+}
+
+func (m MemorySecurityEventModel) GetAllForUser(userID int64, limit int) ([]*SecurityEvent, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	events := []*SecurityEvent{}
+	for i := len(m.store.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if m.store.events[i].UserID == userID {
+			event := m.store.events[i]
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+type MemoryViewModel struct {
+	store    *memoryStore
+	tenantID int64
+}
+
+func (m MemoryViewModel) forTenant(tenantID int64) any {
+	return MemoryViewModel{store: m.store, tenantID: tenantID}
+}
+
+// The movieHour type is the key for the view counts in the in-memory model.
+type movieHour struct {
+	movieID int64
+	hour    time.Time
+}
+
+func (m MemoryViewModel) Add(counts map[int64]int64, at time.Time) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	hour := at.UTC().Truncate(time.Hour)
+	for id, n := range counts {
+		if _, ok := m.store.movies[id]; ok && m.store.movieLive(id, 0) {
+			m.store.views[movieHour{movieID: id, hour: hour}] += n
+		}
+	}
+	return nil
+}
+
+func (m MemoryViewModel) Aggregate() error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	now := time.Now()
+	for period, window := range TrendingWindows {
+		totals := make(map[int64]int64)
+		for key, n := range m.store.views {
+			if !key.hour.Before(now.Add(-window)) {
+				totals[key.movieID] += n
+			}
+		}
+		var ranking []TrendingMovie
+		for id, n := range totals {
+			if movie, ok := m.store.movies[id]; ok && m.store.movieLive(id, 0) {
+				ranking = append(ranking, TrendingMovie{Movie: movie, Views: n})
+			}
+		}
+		sort.Slice(ranking, func(i, j int) bool {
+			if ranking[i].Views != ranking[j].Views {
+				return ranking[i].Views > ranking[j].Views
+			}
+			return ranking[i].ID < ranking[j].ID
+		})
+		// Keep the top TrendingSize movies of each tenant.
+		ranked := make(map[int64]int)
+		kept := ranking[:0]
+		for _, t := range ranking {
+			tenantID := m.store.movieTenants[t.ID]
+			if ranked[tenantID] < TrendingSize {
+				ranked[tenantID]++
+				kept = append(kept, t)
+			}
+		}
+		m.store.trending[period] = kept
+	}
+	for key := range m.store.views {
+		if key.hour.Before(now.Add(-ViewsRetention())) {
+			delete(m.store.views, key)
+		}
+	}
+	return nil
+}
+
+func (m MemoryViewModel) Trending(period string, limit int) ([]*TrendingMovie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	movies := []*TrendingMovie{}
+	for _, t := range m.store.trending[period] {
+		// Like the join in the PostgreSQL model, use the current version of the movie
+		// and skip it if it has been deleted since the ranking was worked out.
+		movie, ok := m.store.movies[t.ID]
+		if !ok || !m.store.movieLive(t.ID, m.tenantID) {
+			continue
+		}
+		if len(movies) == limit {
+			break
+		}
+		movies = append(movies, &TrendingMovie{Movie: copyMovie(movie), Views: t.Views})
+	}
+	return movies, nil
+}
+
+type MemoryInviteModel struct {
+	store *memoryStore
+}
+
+func (m MemoryInviteModel) Insert(invite *Invite) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.nextInvite++
+	invite.ID = m.store.nextInvite
+	invite.CreatedAt = time.Now()
+	stored := *invite
+	stored.Plaintext = ""
+	m.store.invites = append(m.store.invites, stored)
+	return nil
+}
+
+func (m MemoryInviteModel) GetAll() ([]*Invite, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	invites := []*Invite{}
+	for i := len(m.store.invites) - 1; i >= 0; i-- {
+		invite := m.store.invites[i]
+		invites = append(invites, &invite)
+	}
+	return invites, nil
+}
+
+func (m MemoryInviteModel) Delete(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for i, invite := range m.store.invites {
+		if invite.ID == id {
+			m.store.invites = append(m.store.invites[:i], m.store.invites[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m MemoryInviteModel) Consume(plaintext string) (int64, error) {
+	hash := hashTokenPlaintext(plaintext)
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for i, invite := range m.store.invites {
+		if string(invite.Hash) == string(hash) && invite.Expiry.After(time.Now()) && invite.Uses < invite.MaxUses {
+			m.store.invites[i].Uses++
+			return invite.ID, nil
+		}
+	}
+	return 0, ErrRecordNotFound
+}
+
+func (m MemoryInviteModel) Release(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for i, invite := range m.store.invites {
+		if invite.ID == id && invite.Uses > 0 {
+			m.store.invites[i].Uses--
+		}
+	}
+	return nil
+}
+
+type MemoryUsageModel struct {
+	store *memoryStore
+}
+
+// The userDay type is the key for the usage counts in the in-memory model.
+type userDay struct {
+	UsageKey
+	day time.Time
+}
+
+func (m MemoryUsageModel) Add(counts map[UsageKey]UsageCounts, rateLimited map[string]int64, at time.Time) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	day := at.UTC().Truncate(24 * time.Hour)
+	for key, c := range counts {
+		if _, ok := m.store.users[key.UserID]; !ok {
+			continue
+		}
+		total := m.store.usage[userDay{UsageKey: key, day: day}]
+		total.add(c)
+		m.store.usage[userDay{UsageKey: key, day: day}] = total
+	}
+	for hash, n := range rateLimited {
+		var tokenHash [sha256.Size]byte
+		copy(tokenHash[:], hash)
+		token, ok := m.store.tokens[tokenHash]
+		if !ok {
+			continue
+		}
+		key := userDay{UsageKey: UsageKey{UserID: token.UserID, TokenID: token.ID, APIKey: token.Scope == ScopeAPIKey}, day: day}
+		total := m.store.usage[key]
+		total.RateLimited += n
+		m.store.usage[key] = total
+	}
+	return nil
+}
+
+func (m MemoryUsageModel) GetForUser(userID int64, since time.Time) (*Usage, error) {
+	since = since.UTC().Truncate(24 * time.Hour)
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	days := make(map[string]UsageCounts)
+	tokens := make(map[int64]UsageCounts)
+	usage := &Usage{Days: []UsageDay{}, Tokens: []UsageToken{}}
+	for key, c := range m.store.usage {
+		if key.UserID != userID || key.day.Before(since) {
+			continue
+		}
+		day := days[key.day.Format("2006-01-02")]
+		day.add(c)
+		days[key.day.Format("2006-01-02")] = day
+		token := tokens[key.TokenID]
+		token.add(c)
+		tokens[key.TokenID] = token
+		usage.Totals.add(c)
+	}
+	for day, c := range days {
+		usage.Days = append(usage.Days, UsageDay{Day: day, UsageCounts: c})
+	}
+	sort.Slice(usage.Days, func(i, j int) bool { return usage.Days[i].Day < usage.Days[j].Day })
+	for id, c := range tokens {
+		t := UsageToken{TokenID: id, UsageCounts: c}
+		for _, token := range m.store.tokens {
+			if token.ID == id && id != 0 {
+				t.Name, t.Type = token.Name, token.Scope
+			}
+		}
+		usage.Tokens = append(usage.Tokens, t)
+	}
+	sortUsageTokens(usage.Tokens)
+	return usage, nil
+}
+
+func (m MemoryUsageModel) Prune(before time.Time) error {
+	before = before.UTC().Truncate(24 * time.Hour)
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for key := range m.store.usage {
+		if key.day.Before(before) {
+			delete(m.store.usage, key)
+		}
+	}
+	return nil
+}
+
+type MemoryMeteringModel struct {
+	store *memoryStore
+}
+
+func (m MemoryMeteringModel) GetRollups(from, to time.Time) ([]*MeteringRollup, error) {
+	from, to = from.UTC().Truncate(24*time.Hour), to.UTC().Truncate(24*time.Hour)
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	names := make(map[int64]string)
+	for _, token := range m.store.tokens {
+		names[token.ID] = token.Name
+	}
+	rollups := []*MeteringRollup{}
+	for key, c := range m.store.usage {
+		if !key.APIKey || key.day.Before(from) || key.day.After(to) {
+			continue
+		}
+		rollups = append(rollups, &MeteringRollup{
+			Day:         key.day.Format("2006-01-02"),
+			UserID:      key.UserID,
+			TenantID:    m.store.userTenants[key.UserID],
+			KeyID:       key.TokenID,
+			KeyName:     names[key.TokenID],
+			UsageCounts: c,
+		})
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.KeyID < b.KeyID
+	})
+	return rollups, nil
+}
+
+func (m MemoryMeteringModel) Pushed(day time.Time) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	_, ok := m.store.meteringPushes[day.UTC().Truncate(24*time.Hour)]
+	return ok, nil
+}
+
+func (m MemoryMeteringModel) MarkPushed(day time.Time, records int) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.meteringPushes[day.UTC().Truncate(24*time.Hour)] = records
+	return nil
+}
+
+type MemoryUserExportModel struct {
+	store *memoryStore
+}
+
+func (m MemoryUserExportModel) Insert(export *UserExport) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for id, existing := range m.store.exports {
+		if existing.UserID == export.UserID {
+			delete(m.store.exports, id)
+		}
+	}
+	m.store.nextExport++
+	export.ID = m.store.nextExport
+	export.CreatedAt = time.Now()
+	m.store.exports[export.ID] = *export
+	return nil
+}
+
+func (m MemoryUserExportModel) Get(id int64) (*UserExport, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	export, ok := m.store.exports[id]
+	if !ok || !export.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &export, nil
+}
+
+func (m MemoryUserExportModel) DeleteExpired() (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	var n int64
+	for id, export := range m.store.exports {
+		if !export.Expiry.After(time.Now()) {
+			delete(m.store.exports, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type MemoryJobModel struct {
+	store *memoryStore
+}
+
+func (m MemoryJobModel) Insert(job *Job) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.nextJobID++
+	job.ID = m.store.nextJobID
+	job.Status = JobQueued
+	job.CreatedAt = time.Now()
+	m.store.jobs[job.ID] = *job
+	return nil
+}
+
+func (m MemoryJobModel) Get(id, userID int64) (*Job, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	job, ok := m.store.jobs[id]
+	if !ok || job.UserID != userID {
+		return nil, ErrRecordNotFound
+	}
+	return &job, nil
+}
+
+// update applies a change to a job with the given status, like the WHERE clauses of the
+// JobModel updates.
+func (m MemoryJobModel) update(id int64, status string, change func(job *Job)) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	job, ok := m.store.jobs[id]
+	if !ok || job.Status != status {
+		return ErrRecordNotFound
+	}
+	change(&job)
+	m.store.jobs[id] = job
+	return nil
+}
+
+func (m MemoryJobModel) Start(id int64) error {
+	return m.update(id, JobQueued, func(job *Job) {
+		now := time.Now()
+		job.Status, job.StartedAt = JobRunning, &now
+	})
+}
+
+func (m MemoryJobModel) Progress(id int64, progress int) error {
+	return m.update(id, JobRunning, func(job *Job) {
+		job.Progress = progress
+	})
+}
+
+func (m MemoryJobModel) Finish(id int64, result json.RawMessage, jobErr error) error {
+	return m.update(id, JobRunning, func(job *Job) {
+		now := time.Now()
+		job.Status, job.Result, job.FinishedAt = JobSucceeded, append(json.RawMessage(nil), result...), &now
+		if jobErr != nil {
+			job.Status, job.Result, job.Error = JobFailed, nil, jobErr.Error()
+		}
+	})
+}
+
+type MemoryEventCursorModel struct {
+	store *memoryStore
+}
+
+func (m MemoryEventCursorModel) Get(feed string) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return m.store.eventCursors[feed], nil
+}
+
+func (m MemoryEventCursorModel) Set(feed string, position int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.eventCursors[feed] = position
+	return nil
+}
+
+// The MemoryLeaderModel type is always the leader, as the data is only ever shared by the
+// one process.
+type MemoryLeaderModel struct{}
+
+func (m MemoryLeaderModel) IsLeader() (bool, error) {
+	return true, nil
+}
+
+func (m MemoryLeaderModel) Resign() error {
+	return nil
+}
+
+// The MemoryPartitionModel type does nothing, as the in-memory tables aren't
+// partitioned; old view counts are pruned by MemoryViewModel.Aggregate() instead.
+type MemoryPartitionModel struct{}
+
+func (m MemoryPartitionModel) Maintain(table string, retention time.Duration, now time.Time) ([]string, error) {
+	return []string{}, nil
+}
+
+type MemoryTenantModel struct {
+	store *memoryStore
+}
+
+func (m MemoryTenantModel) Insert(tenant *Tenant) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for _, t := range m.store.tenants {
+		if t.Slug == tenant.Slug {
+			return ErrDuplicateSlug
+		}
+	}
+	tenant.ID = m.store.tenants[len(m.store.tenants)-1].ID + 1
+	tenant.CreatedAt = time.Now()
+	m.store.tenants = append(m.store.tenants, *tenant)
+	return nil
+}
+
+func (m MemoryTenantModel) GetBySlug(slug string) (*Tenant, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for _, tenant := range m.store.tenants {
+		if tenant.Slug == slug {
+			return &tenant, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The MeteringRollup type is the usage of one API key on one day (in UTC), for billing
+// the partners who are charged for access to the catalog. Keys which have been revoked
+// since are still included, without their name.
+type MeteringRollup struct {
+	Day      string `json:"day"`
+	UserID   int64  `json:"user_id"`
+	TenantID int64  `json:"tenant_id"`
+	KeyID    int64  `json:"key_id"`
+	KeyName  string `json:"key_name"`
+	UsageCounts
+}
+
+// The MeteringModel type reads the daily usage of API keys from the api_usage table,
+// and records which days have been pushed to the billing webhook in the
+// metering_pushes table. Usage is only kept for UsageRetention.
+type MeteringModel struct {
+	DB *sql.DB
+}
+
+// GetRollups returns the usage of each API key on each day from the day containing from
+// to the day containing to, in order of day, user and key.
+func (m MeteringModel) GetRollups(from, to time.Time) ([]*MeteringRollup, error) {
+	query := `
+		SELECT api_usage.day, api_usage.user_id, users.tenant_id, api_usage.token_id,
+			coalesce(tokens.name, ''), api_usage.requests, api_usage.errors,
+			api_usage.rate_limited, api_usage.bytes_in, api_usage.bytes_out
+		FROM api_usage
+		JOIN users ON users.id = api_usage.user_id
+		LEFT JOIN tokens ON tokens.id = api_usage.token_id
+		WHERE api_usage.api_key AND api_usage.day BETWEEN $1 AND $2
+		ORDER BY api_usage.day, api_usage.user_id, api_usage.token_id`
+	return queryList(m.DB, 10*time.Second, func(row rowScanner, rollup *MeteringRollup) error {
+		var day time.Time
+		err := row.Scan(&day, &rollup.UserID, &rollup.TenantID, &rollup.KeyID, &rollup.KeyName,
+			&rollup.Requests, &rollup.Errors, &rollup.RateLimited, &rollup.BytesIn, &rollup.BytesOut)
+		rollup.Day = day.Format("2006-01-02")
+		return err
+	}, query, from.UTC().Truncate(24*time.Hour), to.UTC().Truncate(24*time.Hour))
+}
+
+// Pushed returns true if the rollups for the day containing day have been pushed.
+func (m MeteringModel) Pushed(day time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	var pushed bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM metering_pushes WHERE day = $1)", day.UTC().Truncate(24*time.Hour)).Scan(&pushed)
+	return pushed, err
+}
+
+// MarkPushed records that the rollups for the day containing day, of which there were
+// records, have been pushed.
+func (m MeteringModel) MarkPushed(day time.Time, records int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	query := `
+		INSERT INTO metering_pushes (day, records) VALUES ($1, $2)
+		ON CONFLICT (day) DO UPDATE SET records = EXCLUDED.records, pushed_at = NOW()`
+	_, err := m.DB.ExecContext(ctx, query, day.UTC().Truncate(24*time.Hour), records)
+	return err
+}
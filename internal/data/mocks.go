@@ -0,0 +1,8 @@
+package data
+
+// NewMockModels returns a fresh set of models for use in handler tests. The mocks are the
+// in-memory models which back -db-driver=memory, so tests exercise the same behavior
+// (including version checks and ErrEditConflict) that a demo deployment sees.
+func NewMockModels() Models {
+	return NewMemoryModels()
+}
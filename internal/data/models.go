@@ -2,22 +2,164 @@ package data
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 )
 var (
     ErrRecordNotFound = errors.New("record not found")
     ErrEditConflict   = errors.New("edit conflict")
 )
 
+// The Models struct wraps the models for each of our database tables. Each field is an
+// interface containing the methods that the model needs to support, so that we can swap
+// in alternative implementations (like the mocks returned by NewMockModels()) without
+// any changes to our handlers.
 type Models struct {
-    Movies MovieModel
-    Tokens TokenModel // Add a new Tokens field.
-    Users  UserModel
+    Movies interface {
+        Insert(movie *Movie) error
+        InsertMany(movies []*Movie) error
+        Get(id int64) (*Movie, error)
+        GetMany(ids []int64) ([]*Movie, error)
+        Update(movie *Movie) error
+        UpdateMany(movies []*Movie) error
+        Upsert(movie *Movie) (string, error)
+        Delete(id int64) error
+        DeleteMatching(title string, genres []string, filters Filters, dryRun bool) (int64, error)
+        PurgeDeleted(before time.Time) (int64, error)
+        GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+        GetAllFunc(title string, genres []string, filters Filters, fn func(movie *Movie) error) (Metadata, error)
+        Stats() (*MovieStats, error)
+        Similar(id int64, limit int) ([]*SimilarMovie, error)
+        Suggest(q string, limit int) ([]*MovieSuggestion, error)
+        Random(title string, genres []string, filters Filters) (*Movie, error)
+        GetRevisions(movieID int64) ([]*MovieRevision, error)
+        GetRevision(movieID int64, version int32) (*MovieRevision, error)
+        GetAsOf(id int64, at time.Time) (*Movie, error)
+        Changes(since int64, limit int) ([]*MovieChange, error)
+    }
+    Tokens interface {
+        New(userID int64, ttl time.Duration, scope string) (*Token, error)
+        Insert(token *Token) error
+        Consume(scope, tokenPlaintext string) (int64, error)
+        DeleteAllForUser(scope string, userID int64) error
+        GetAllForUser(userID int64, scopes ...string) ([]*Token, error)
+        DeleteForUser(userID, id int64, scopes ...string) error
+        DeleteAllForUserExcept(scope string, userID, exceptID int64) (int64, error)
+        Touch(id int64, ip, userAgent string) error
+    }
+    Permissions interface {
+        GetAllForUser(userID int64) (Permissions, error)
+        AddForUser(userID int64, codes ...string) error
+    }
+    Roles interface {
+        GetAll() ([]*Role, error)
+        GetAllForUser(userID int64) ([]string, error)
+        AddForUser(userID int64, role string) error
+        RemoveForUser(userID int64, role string) error
+    }
+    Users interface {
+        Insert(user *User) error
+        Get(id int64) (*User, error)
+        GetByEmail(email string) (*User, error)
+        Update(user *User) error
+        GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+        GetWithToken(tokenPlaintext string, tokenScopes ...string) (*User, *Token, error)
+        RequestDeletion(userID int64) error
+        PurgeDeleted(before time.Time) ([]int64, error)
+        RecordLogin(userID int64, ip string, at time.Time) error
+        GetAllActivity(dormantSince time.Time, filters Filters) ([]*UserActivity, Metadata, error)
+        UpdatePreferences(userID int64, preferences Preferences) error
+        Changes(since int64, limit int) ([]*UserChange, error)
+    }
+    EventCursors interface {
+        Get(feed string) (int64, error)
+        Set(feed string, position int64) error
+    }
+    SecurityEvents interface {
+        Insert(event *SecurityEvent) error
+        GetAllForUser(userID int64, limit int) ([]*SecurityEvent, error)
+    }
+    UserExports interface {
+        Insert(export *UserExport) error
+        Get(id int64) (*UserExport, error)
+        DeleteExpired() (int64, error)
+    }
+    Jobs interface {
+        Insert(job *Job) error
+        Get(id, userID int64) (*Job, error)
+        Start(id int64) error
+        Progress(id int64, progress int) error
+        Finish(id int64, result json.RawMessage, jobErr error) error
+    }
+    Usage interface {
+        Add(counts map[UsageKey]UsageCounts, rateLimited map[string]int64, at time.Time) error
+        GetForUser(userID int64, since time.Time) (*Usage, error)
+        Prune(before time.Time) error
+    }
+    Metering interface {
+        GetRollups(from, to time.Time) ([]*MeteringRollup, error)
+        Pushed(day time.Time) (bool, error)
+        MarkPushed(day time.Time, records int) error
+    }
+    Invites interface {
+        Insert(invite *Invite) error
+        GetAll() ([]*Invite, error)
+        Delete(id int64) error
+        Consume(plaintext string) (int64, error)
+        Release(id int64) error
+    }
+    Views interface {
+        Add(counts map[int64]int64, at time.Time) error
+        Aggregate() error
+        Trending(period string, limit int) ([]*TrendingMovie, error)
+    }
+    Leader interface {
+        IsLeader() (bool, error)
+        Resign() error
+    }
+    Tenants interface {
+        Insert(tenant *Tenant) error
+        GetBySlug(slug string) (*Tenant, error)
+    }
+    Partitions interface {
+        Maintain(table string, retention time.Duration, now time.Time) ([]string, error)
+    }
 }
 func NewModels(db *sql.DB) Models {
     return Models{
-        Movies: MovieModel{DB: db},
-        Tokens: TokenModel{DB: db}, // Initialize a new TokenModel instance.
-        Users:  UserModel{DB: db},
+        Movies:         MovieModel{DB: db, counts: newCountCache(db, liveMoviesCount)},
+        Tokens:         TokenModel{DB: db}, // Initialize a new TokenModel instance.
+        Permissions:    PermissionModel{DB: db},
+        Roles:          RoleModel{DB: db},
+        Users:          UserModel{DB: db},
+        SecurityEvents: SecurityEventModel{DB: db},
+        Views:          ViewModel{DB: db},
+        Invites:        InviteModel{DB: db},
+        Usage:          UsageModel{DB: db},
+        Metering:       MeteringModel{DB: db},
+        UserExports:    UserExportModel{DB: db},
+        Jobs:           JobModel{DB: db},
+        EventCursors:   EventCursorModel{DB: db},
+        Leader:         NewLeaderModel(db, JobsLeaderLock),
+        Tenants:        TenantModel{DB: db},
+        Partitions:     PartitionModel{DB: db},
     }
-}
\ No newline at end of file
+}
+
+// ActingAs returns a copy of the models in which the movies that are created and updated
+// are attributed to a user, in their created_by and updated_by columns. The models
+// returned by NewModels() don't attribute writes to anyone.
+func (m Models) ActingAs(userID int64) Models {
+    m.Movies = actAs(m.Movies, userID)
+    return m
+}
+
+// actAs returns a copy of a model which attributes writes to a user, if the model
+// supports it.
+func actAs[T any](model T, userID int64) T {
+    if s, ok := any(model).(interface{ actingAs(userID int64) any }); ok {
+        return s.actingAs(userID).(T)
+    }
+    return model
+}
@@ -0,0 +1,235 @@
+//go:build integration
+
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+func TestJobModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	job := &Job{UserID: user.ID, Kind: "import", Total: 10}
+	err := models.Jobs.Insert(job)
+	assert.NilError(t, err)
+	assert.Equal(t, job.Status, JobQueued)
+
+	_, err = models.Jobs.Get(job.ID, user.ID+1)
+	assert.Equal(t, err, ErrRecordNotFound)
+	// Only running jobs make progress or finish, and only queued ones start.
+	err = models.Jobs.Progress(job.ID, 5)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Jobs.Finish(job.ID, nil, nil)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Jobs.Start(job.ID)
+	assert.NilError(t, err)
+	err = models.Jobs.Start(job.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Jobs.Progress(job.ID, 5)
+	assert.NilError(t, err)
+	got, err := models.Jobs.Get(job.ID, user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Status, JobRunning)
+	assert.Equal(t, got.Progress, 5)
+	assert.Equal(t, got.StartedAt != nil, true)
+
+	err = models.Jobs.Finish(job.ID, json.RawMessage(`{"imported": 10}`), nil)
+	assert.NilError(t, err)
+	got, err = models.Jobs.Get(job.ID, user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Status, JobSucceeded)
+	assert.Equal(t, string(got.Result), `{"imported": 10}`)
+	assert.Equal(t, got.FinishedAt != nil, true)
+
+	failed := &Job{UserID: user.ID, Kind: "import", Total: 10}
+	err = models.Jobs.Insert(failed)
+	assert.NilError(t, err)
+	err = models.Jobs.Start(failed.ID)
+	assert.NilError(t, err)
+	err = models.Jobs.Finish(failed.ID, json.RawMessage(`{"imported": 3}`), errors.New("import failed"))
+	assert.NilError(t, err)
+	got, err = models.Jobs.Get(failed.ID, user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Status, JobFailed)
+	assert.Equal(t, got.Error, "import failed")
+	assert.Equal(t, len(got.Result), 0)
+}
+
+func TestUsageAndMeteringModels(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	session, err := models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	apiKey, err := NewToken(user.ID, time.Hour, ScopeAPIKey)
+	assert.NilError(t, err)
+	apiKey.Name = "ci"
+	err = models.Tokens.Insert(apiKey)
+	assert.NilError(t, err)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	counts := map[UsageKey]UsageCounts{
+		{UserID: user.ID, TokenID: session.ID}:              {Requests: 2, Errors: 1, BytesIn: 10, BytesOut: 100},
+		{UserID: user.ID, TokenID: apiKey.ID, APIKey: true}: {Requests: 5, BytesOut: 500},
+		// The usage of users who don't exist is dropped.
+		{UserID: user.ID + 1, TokenID: 0}: {Requests: 1},
+	}
+	err = models.Usage.Add(counts, nil, yesterday)
+	assert.NilError(t, err)
+	err = models.Usage.Add(counts, map[string]int64{string(HashToken(apiKey.Plaintext)): 3, "no-such-token": 1}, today)
+	assert.NilError(t, err)
+
+	usage, err := models.Usage.GetForUser(user.ID, today)
+	assert.NilError(t, err)
+	assert.Equal(t, usage.Totals, UsageCounts{Requests: 7, Errors: 1, RateLimited: 3, BytesIn: 10, BytesOut: 600})
+	assert.Equal(t, len(usage.Days), 1)
+	assert.Equal(t, len(usage.Tokens), 2)
+	assert.Equal(t, usage.Tokens[0], UsageToken{TokenID: apiKey.ID, Name: "ci", Type: ScopeAPIKey, UsageCounts: UsageCounts{Requests: 5, RateLimited: 3, BytesOut: 500}})
+	usage, err = models.Usage.GetForUser(user.ID, yesterday)
+	assert.NilError(t, err)
+	assert.Equal(t, usage.Totals.Requests, int64(14))
+	assert.Equal(t, len(usage.Days), 2)
+
+	// Only API keys are metered.
+	rollups, err := models.Metering.GetRollups(yesterday, today)
+	assert.NilError(t, err)
+	assert.Equal(t, len(rollups), 2)
+	assert.Equal(t, rollups[0].Day, yesterday.Format("2006-01-02"))
+	assert.Equal(t, rollups[1].KeyID, apiKey.ID)
+	assert.Equal(t, rollups[1].KeyName, "ci")
+	assert.Equal(t, rollups[1].TenantID, int64(DefaultTenantID))
+	assert.Equal(t, rollups[1].UsageCounts, UsageCounts{Requests: 5, RateLimited: 3, BytesOut: 500})
+
+	pushed, err := models.Metering.Pushed(yesterday)
+	assert.NilError(t, err)
+	assert.Equal(t, pushed, false)
+	err = models.Metering.MarkPushed(yesterday, 1)
+	assert.NilError(t, err)
+	err = models.Metering.MarkPushed(yesterday, 1)
+	assert.NilError(t, err)
+	pushed, err = models.Metering.Pushed(yesterday.Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, pushed, true)
+
+	err = models.Usage.Prune(today)
+	assert.NilError(t, err)
+	usage, err = models.Usage.GetForUser(user.ID, yesterday)
+	assert.NilError(t, err)
+	assert.Equal(t, len(usage.Days), 1)
+}
+
+func TestViewModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	moana := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	coco := &Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}}
+	up := &Movie{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}}
+	insertTestMovies(t, models, moana, coco, up)
+
+	now := time.Now()
+	err := models.Views.Add(map[int64]int64{moana.ID: 3, coco.ID: 5}, now)
+	assert.NilError(t, err)
+	err = models.Views.Add(map[int64]int64{moana.ID: 4}, now)
+	assert.NilError(t, err)
+	// Views from before the day are only trending for the week.
+	err = models.Views.Add(map[int64]int64{up.ID: 10}, now.Add(-48*time.Hour))
+	assert.NilError(t, err)
+
+	// Nothing is trending until the rankings have been worked out.
+	movies, err := models.Views.Trending("1d", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 0)
+	err = models.Views.Aggregate()
+	assert.NilError(t, err)
+
+	movies, err = models.Views.Trending("1d", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 2)
+	assert.Equal(t, movies[0].ID, moana.ID)
+	assert.Equal(t, movies[0].Views, int64(7))
+	assert.Equal(t, movies[1].ID, coco.ID)
+	movies, err = models.Views.Trending("7d", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 1)
+	assert.Equal(t, movies[0].ID, up.ID)
+
+	err = models.Movies.Delete(up.ID)
+	assert.NilError(t, err)
+	movies, err = models.Views.Trending("7d", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 2)
+	movies, err = models.ForTenant(DefaultTenantID+1).Views.Trending("1d", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 0)
+}
+
+func TestLeaderModel(t *testing.T) {
+	db := newTestDB(t)
+	first := NewLeaderModel(db, JobsLeaderLock)
+	second := NewLeaderModel(db, JobsLeaderLock)
+	other := NewLeaderModel(db, "greenlight:other")
+
+	leader, err := first.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, true)
+	leader, err = first.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, true)
+	leader, err = second.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, false)
+	leader, err = other.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, true)
+
+	err = first.Resign()
+	assert.NilError(t, err)
+	err = first.Resign()
+	assert.NilError(t, err)
+	leader, err = second.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, true)
+	leader, err = first.IsLeader()
+	assert.NilError(t, err)
+	assert.Equal(t, leader, false)
+	assert.NilError(t, second.Resign())
+	assert.NilError(t, other.Resign())
+}
+
+func TestPartitionModel(t *testing.T) {
+	models, db := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+
+	// Maintaining the table as of three months ago creates the partitions for that month
+	// and the next. A day's retention two months on only archives the first of them.
+	now := time.Now().UTC()
+	then := monthStart(now).AddDate(0, -3, 0)
+	later := then.AddDate(0, 2, 1)
+	archived, err := models.Partitions.Maintain("movie_views", 0, then)
+	assert.NilError(t, err)
+	assert.Equal(t, len(archived), 0)
+	err = models.Views.Add(map[int64]int64{movie.ID: 2}, then)
+	assert.NilError(t, err)
+	err = models.Views.Add(map[int64]int64{movie.ID: 3}, now)
+	assert.NilError(t, err)
+
+	archived, err = models.Partitions.Maintain("movie_views", 24*time.Hour, later)
+	assert.NilError(t, err)
+	assert.Equal(t, archived, []string{partitionName("movie_views", then)})
+	archived, err = models.Partitions.Maintain("movie_views", 24*time.Hour, later)
+	assert.NilError(t, err)
+	assert.Equal(t, len(archived), 0)
+
+	var live, old int64
+	err = db.QueryRow("SELECT coalesce(sum(views), 0) FROM movie_views").Scan(&live)
+	assert.NilError(t, err)
+	assert.Equal(t, live, int64(3))
+	err = db.QueryRow("SELECT coalesce(sum(views), 0) FROM movie_views_archive").Scan(&old)
+	assert.NilError(t, err)
+	assert.Equal(t, old, int64(2))
+}
@@ -5,19 +5,29 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 	"greenlight.alexedwards.net/internal/validator" // New import
 )
 type Movie struct {
-    ID        int64     `json:"id"`
-    CreatedAt time.Time `json:"-"`
-    Title     string    `json:"title"`
-    Year      int32     `json:"year,omitempty"`
-    Runtime   Runtime   `json:"runtime,omitempty"`
-    Genres    []string  `json:"genres,omitempty"`
-    Version   int32     `json:"version"`
+    ID         int64      `json:"id"`
+    CreatedAt  time.Time  `json:"-"`
+    Title      string     `json:"title"`
+    Year       int32      `json:"year,omitempty"`
+    Runtime    Runtime    `json:"runtime,omitempty"`
+    Genres     []string   `json:"genres,omitempty"`
+    // Attributes are the movie's descriptive attributes, like its language (see
+    // MovieAttributes).
+    Attributes Attributes `json:"attributes,omitempty"`
+    Version    int32      `json:"version"`
+    // CreatedBy and UpdatedBy are the IDs of the users who created and last modified
+    // the movie, or zero if it isn't known. They're only loaded by Get(), and aren't
+    // part of the movie's JSON, as only admins get to see them.
+    CreatedBy  int64      `json:"-"`
+    UpdatedBy  int64      `json:"-"`
 }
 func ValidateMovie(v *validator.Validator, movie *Movie) {
     v.Check(movie.Title != "", "title", "must be provided")
@@ -31,47 +41,224 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
     v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
     v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
     v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+    ValidateAttributes(v, "attributes.", movie.Attributes)
 }
 
+// ErrDuplicateMovie is returned when a movie would have the same identity (see
+// MovieIdentity()) as another movie in its tenant.
+var ErrDuplicateMovie = errors.New("duplicate movie")
+
+// movieIdentityColumns are the columns (and expression) of the unique index on the
+// identity of movies, movies_identity_idx. The conflict target of Upsert() has to match
+// the index exactly.
+const movieIdentityColumns = `tenant_id, (lower(regexp_replace(btrim(title), '\s+', ' ', 'g'))), year`
+
+// MovieIdentity returns a key for the natural identity of a movie: its title, ignoring
+// case and runs of whitespace, and its release year. Movies with the same key are the
+// same movie, as far as the movies_identity_idx index is concerned.
+func MovieIdentity(title string, year int32) string {
+    return strings.ToLower(strings.Join(strings.Fields(title), " ")) + "|" + strconv.Itoa(int(year))
+}
+
+// duplicateMovie returns ErrDuplicateMovie if an error is the violation of the index
+// on the identity of movies, and the error otherwise.
+func duplicateMovie(err error) error {
+    if err != nil && err.Error() == `pq: duplicate key value violates unique constraint "movies_identity_idx"` {
+        return ErrDuplicateMovie
+    }
+    return err
+}
+
+// liveMoviesCount is the query for the count cache: the number of movies which haven't
+// been deleted.
+const liveMoviesCount = "SELECT count(*) FROM movies WHERE deleted_at IS NULL"
+
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
     DB *sql.DB
+    // counts caches the total number of movies for unfiltered listings. It may be nil,
+    // in which case we always count the movies with the listing query.
+    counts *countCache
+    // cache caches movies by ID for Get(). It may be nil, in which case nothing is
+    // cached. See NewCachedModels().
+    cache *movieCache
+    // stats caches the catalog statistics for Stats(). It may be nil, in which case they
+    // are worked out every time.
+    stats *statsCache
+    // tenantID is the tenant that the model is scoped to (see Models.ForTenant()), or
+    // zero if it sees the movies of every tenant.
+    tenantID int64
+    // actorID is the user that writes are attributed to (see Models.ActingAs()), or zero
+    // if there isn't one.
+    actorID int64
+}
+
+// forTenant returns a copy of the model scoped to a tenant. The caches hold the movies
+// of every tenant, so the copy doesn't use them.
+func (m MovieModel) forTenant(tenantID int64) any {
+    return MovieModel{DB: m.DB, tenantID: tenantID, actorID: m.actorID}
+}
+
+// actingAs returns a copy of the model which attributes writes to a user.
+func (m MovieModel) actingAs(userID int64) any {
+    m.actorID = userID
+    return m
 }
 
 func (m MovieModel) Insert(movie *Movie) error {
     query := `
-        INSERT INTO movies (title, year, runtime, genres) 
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO movies (title, year, runtime, genres, tenant_id, created_by, updated_by, attributes) 
+        VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
         RETURNING id, created_at, version`
-    args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+    args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), insertTenant(m.tenantID), nullID(m.actorID), movie.Attributes}
     // Create a context with a 3-second timeout.
     ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
     defer cancel()
+    // Insert the movie and send the movie_changed notification in a transaction, so
+    // the notification is only delivered if the insert is committed.
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
     // Use QueryRowContext() and pass the context as the first argument.
-    return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+    err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+    if err != nil {
+        return duplicateMovie(err)
+    }
+    err = notifyMovieChanged(ctx, tx, movieIDPayload(movie.ID))
+    if err != nil {
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    movie.CreatedBy, movie.UpdatedBy = m.actorID, m.actorID
+    m.counts.add(1)
+    return nil
+}
+
+// InsertMany() inserts a large number of movies at once, for imports and seeding. It uses
+// the PostgreSQL COPY protocol, which is dramatically faster than inserting the rows one
+// at a time (a 100k row import takes seconds rather than minutes). If COPY isn't
+// available (for example, behind some connection poolers) we fall back to inserting the
+// rows in batches of multi-row INSERT statements. Either way all of the movies are
+// inserted in a single transaction, so an import either fully succeeds or has no
+// effect. Note that, unlike Insert(), the system-generated fields of the movies aren't
+// populated.
+func (m MovieModel) InsertMany(movies []*Movie) error {
+    // Allow much longer than our usual 3 seconds, as large imports can take a while.
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+    defer cancel()
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    stmt, err := tx.PrepareContext(ctx, pq.CopyIn("movies", "title", "year", "runtime", "genres", "tenant_id", "created_by", "updated_by", "attributes"))
+    if err != nil {
+        // Preparing the COPY failed, so roll back (the transaction is now aborted) and
+        // try again with batched inserts instead.
+        tx.Rollback()
+        return m.insertBatches(ctx, movies)
+    }
+    for _, movie := range movies {
+        _, err = stmt.ExecContext(ctx, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), insertTenant(m.tenantID), nullID(m.actorID), nullID(m.actorID), movie.Attributes)
+        if err != nil {
+            stmt.Close()
+            return duplicateMovie(err)
+        }
+    }
+    // Calling Exec() with no arguments flushes the buffered rows to the database.
+    _, err = stmt.ExecContext(ctx)
+    if err != nil {
+        stmt.Close()
+        return duplicateMovie(err)
+    }
+    err = stmt.Close()
+    if err != nil {
+        return duplicateMovie(err)
+    }
+    err = notifyMovieChanged(ctx, tx, "*")
+    if err != nil {
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    m.counts.add(len(movies))
+    return nil
+}
+
+// insertBatches() is the fallback for InsertMany(). It inserts the movies using
+// multi-row INSERT statements of up to 1000 rows each (which keeps us well below the
+// PostgreSQL limit of 65535 parameters per statement).
+func (m MovieModel) insertBatches(ctx context.Context, movies []*Movie) error {
+    const batchSize = 1000
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for start := 0; start < len(movies); start += batchSize {
+        end := start + batchSize
+        if end > len(movies) {
+            end = len(movies)
+        }
+        var values []string
+        var args []interface{}
+        for i, movie := range movies[start:end] {
+            values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", i*8+1, i*8+2, i*8+3, i*8+4, i*8+5, i*8+6, i*8+7, i*8+8))
+            args = append(args, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), insertTenant(m.tenantID), nullID(m.actorID), nullID(m.actorID), movie.Attributes)
+        }
+        query := "INSERT INTO movies (title, year, runtime, genres, tenant_id, created_by, updated_by, attributes) VALUES " + strings.Join(values, ", ")
+        _, err = tx.ExecContext(ctx, query, args...)
+        if err != nil {
+            return duplicateMovie(err)
+        }
+    }
+    err = notifyMovieChanged(ctx, tx, "*")
+    if err != nil {
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    m.counts.add(len(movies))
+    return nil
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
     if id < 1 {
         return nil, ErrRecordNotFound
     }
+    if movie, ok := m.cache.get(id); ok {
+        return movie, nil
+    }
+    generation := m.cache.current()
     // Remove the pg_sleep(10) clause.
     query := `
-        SELECT id, created_at, title, year, runtime, genres, version
+        SELECT id, created_at, title, year, runtime, genres, attributes, version, coalesce(created_by, 0), coalesce(updated_by, 0)
         FROM movies
-        WHERE id = $1`
+        WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR tenant_id = $2)`
     var movie Movie
     ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
     defer cancel()
     // Remove &[]byte{} from the first Scan() destination.
-    err := m.DB.QueryRowContext(ctx, query, id).Scan(
+    err := m.DB.QueryRowContext(ctx, query, id, m.tenantID).Scan(
         &movie.ID,
         &movie.CreatedAt,
         &movie.Title,
         &movie.Year,
         &movie.Runtime,
         pq.Array(&movie.Genres),
+        &movie.Attributes,
         &movie.Version,
+        &movie.CreatedBy,
+        &movie.UpdatedBy,
     )
     if err != nil {
         switch {
@@ -81,15 +268,75 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
             return nil, err
         }
     }
+    m.cache.set(&movie, generation)
     return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// GetMany() fetches the movies with the given IDs in a single query, so that callers
+// which need to hydrate a list of movies (watchlists, collections etc.) don't have to
+// call Get() once for every ID. The movies are returned in the same order as the IDs,
+// with any IDs which don't match a record (and any repeated IDs) left out.
+func (m MovieModel) GetMany(ids []int64) ([]*Movie, error) {
+    movies := []*Movie{}
+    if len(ids) == 0 {
+        return movies, nil
+    }
     query := `
+        SELECT id, created_at, title, year, runtime, genres, attributes, version
+        FROM movies
+        WHERE id = ANY($1) AND deleted_at IS NULL AND ($2 = 0 OR tenant_id = $2)
+        ORDER BY array_position($1, id)`
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids), m.tenantID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var movie Movie
+        err := rows.Scan(
+            &movie.ID,
+            &movie.CreatedAt,
+            &movie.Title,
+            &movie.Year,
+            &movie.Runtime,
+            pq.Array(&movie.Genres),
+            &movie.Attributes,
+            &movie.Version,
+        )
+        if err != nil {
+            return nil, err
+        }
+        movies = append(movies, &movie)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return movies, nil
+}
+
+// updateMovieQuery updates a movie if its version still matches, for Update() and
+// UpdateMany().
+const updateMovieQuery = `
         UPDATE movies 
-        SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET title = $1, year = $2, runtime = $3, genres = $4, attributes = $9, version = version + 1, updated_by = $8
+        WHERE id = $5 AND version = $6 AND deleted_at IS NULL AND ($7 = 0 OR tenant_id = $7)
         RETURNING version`
+
+// The BatchError type is returned by UpdateMany() when some of the movies couldn't be
+// updated, in which case none of them were. Errors holds the error for each of those
+// movies (ErrEditConflict or ErrDuplicateMovie), keyed by its index.
+type BatchError struct {
+    Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+    return fmt.Sprintf("%d movies in the batch could not be updated", len(e.Errors))
+}
+
+func (m MovieModel) Update(movie *Movie) error {
+    query := updateMovieQuery
     args := []interface{}{
         movie.Title,
         movie.Year,
@@ -97,107 +344,437 @@ func (m MovieModel) Update(movie *Movie) error {
         pq.Array(movie.Genres),
         movie.ID,
         movie.Version,
+        m.tenantID,
+        nullID(m.actorID),
+        movie.Attributes,
     }
     // Create a context with a 3-second timeout.
     ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
     defer cancel()
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    // Keep a copy of the version that we're about to replace, so that the edit can be
+    // inspected and rolled back later.
+    err = saveRevision(ctx, tx, movie.ID, movie.Version)
+    if err != nil {
+        return err
+    }
     // Use QueryRowContext() and pass the context as the first argument.
-    err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+    err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
     if err != nil {
         switch {
         case errors.Is(err, sql.ErrNoRows):
             return ErrEditConflict
         default:
+            return duplicateMovie(err)
+        }
+    }
+    err = notifyMovieChanged(ctx, tx, movieIDPayload(movie.ID))
+    if err != nil {
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    movie.UpdatedBy = m.actorID
+    m.cache.remove(movie.ID)
+    return nil
+}
+
+// UpdateMany updates several movies in a single transaction, so that either all of them
+// are updated or none of them are. Like Update(), each movie's version has to match the
+// version in the database. If it doesn't for any of the movies, a *BatchError reports
+// every one which conflicted. A duplicate identity (see MovieIdentity()) aborts the
+// transaction, so only the first movie with one is reported.
+func (m MovieModel) UpdateMany(movies []*Movie) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    failed := make(map[int]error)
+    versions := make([]int32, len(movies))
+    for i, movie := range movies {
+        err = saveRevision(ctx, tx, movie.ID, movie.Version)
+        if err != nil {
+            return err
+        }
+        args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version, m.tenantID, nullID(m.actorID), movie.Attributes}
+        err = tx.QueryRowContext(ctx, updateMovieQuery, args...).Scan(&versions[i])
+        switch {
+        case errors.Is(err, sql.ErrNoRows):
+            failed[i] = ErrEditConflict
+            continue
+        case errors.Is(duplicateMovie(err), ErrDuplicateMovie):
+            failed[i] = ErrDuplicateMovie
+            return &BatchError{Errors: failed}
+        case err != nil:
+            return err
+        }
+        err = notifyMovieChanged(ctx, tx, movieIDPayload(movie.ID))
+        if err != nil {
             return err
         }
     }
+    if len(failed) > 0 {
+        return &BatchError{Errors: failed}
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    for i, movie := range movies {
+        movie.Version = versions[i]
+        movie.UpdatedBy = m.actorID
+        m.cache.remove(movie.ID)
+    }
     return nil
 }
+
+// The outcomes of Upsert().
+const (
+    UpsertCreated   = "created"
+    UpsertUpdated   = "updated"
+    UpsertUnchanged = "unchanged"
+)
+
+// Upsert inserts a movie, or updates the movie with the same identity (see
+// MovieIdentity()) if there is one, in a single INSERT ... ON CONFLICT statement, so that
+// importers which sync from other catalogs can send the same movie any number of times.
+// An update replaces the title, runtime, genres and attributes; if none of them have
+// changed the movie is left alone (with the same version) and the outcome is
+// UpsertUnchanged. Either way the movie's system-generated fields are populated.
+func (m MovieModel) Upsert(movie *Movie) (string, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+    identity := `tenant_id = $1 AND lower(regexp_replace(btrim(title), '\s+', ' ', 'g')) = lower(regexp_replace(btrim($2), '\s+', ' ', 'g')) AND year = $3 AND deleted_at IS NULL`
+    // Keep a copy of the version that the update is about to replace, like Update()
+    // does. Locking the row means that nothing can update it in between.
+    query := `
+        INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres, attributes)
+        SELECT id, version, title, year, runtime, genres, attributes
+        FROM movies
+        WHERE ` + identity + `
+        AND (title, runtime, genres, attributes) IS DISTINCT FROM ($2, $4, $5, $6::jsonb)
+        FOR UPDATE
+        ON CONFLICT (movie_id, version) DO NOTHING`
+    _, err = tx.ExecContext(ctx, query, insertTenant(m.tenantID), movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Attributes)
+    if err != nil {
+        return "", err
+    }
+    // xmax is zero for a row version which was inserted rather than updated. When the
+    // WHERE clause of DO UPDATE leaves the movie alone, no row is returned.
+    query = `
+        INSERT INTO movies (title, year, runtime, genres, tenant_id, created_by, updated_by, attributes)
+        VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+        ON CONFLICT (` + movieIdentityColumns + `) WHERE deleted_at IS NULL DO UPDATE
+        SET title = EXCLUDED.title, runtime = EXCLUDED.runtime, genres = EXCLUDED.genres, attributes = EXCLUDED.attributes,
+            version = movies.version + 1, updated_by = EXCLUDED.updated_by
+        WHERE (movies.title, movies.runtime, movies.genres, movies.attributes)
+            IS DISTINCT FROM (EXCLUDED.title, EXCLUDED.runtime, EXCLUDED.genres, EXCLUDED.attributes)
+        RETURNING id, created_at, version, coalesce(created_by, 0), xmax = 0`
+    args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), insertTenant(m.tenantID), nullID(m.actorID), movie.Attributes}
+    outcome := UpsertUpdated
+    var created bool
+    err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version, &movie.CreatedBy, &created)
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        query = `
+            SELECT id, created_at, version, coalesce(created_by, 0), coalesce(updated_by, 0)
+            FROM movies
+            WHERE ` + identity
+        err = tx.QueryRowContext(ctx, query, insertTenant(m.tenantID), movie.Title, movie.Year).Scan(&movie.ID, &movie.CreatedAt, &movie.Version, &movie.CreatedBy, &movie.UpdatedBy)
+        if err != nil {
+            return "", err
+        }
+        return UpsertUnchanged, nil
+    case err != nil:
+        return "", err
+    case created:
+        outcome = UpsertCreated
+    }
+    err = notifyMovieChanged(ctx, tx, movieIDPayload(movie.ID))
+    if err != nil {
+        return "", err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return "", err
+    }
+    movie.UpdatedBy = m.actorID
+    if outcome == UpsertCreated {
+        m.counts.add(1)
+    } else {
+        m.cache.remove(movie.ID)
+    }
+    return outcome, nil
+}
+
+// sameMovieFields reports whether two movies have the same fields which Upsert()
+// updates.
+func sameMovieFields(a, b Movie) bool {
+    if a.Title != b.Title || a.Runtime != b.Runtime || len(a.Genres) != len(b.Genres) || len(a.Attributes) != len(b.Attributes) {
+        return false
+    }
+    for i := range a.Genres {
+        if a.Genres[i] != b.Genres[i] {
+            return false
+        }
+    }
+    for name, value := range a.Attributes {
+        if got, ok := b.Attributes[name]; !ok || got != value {
+            return false
+        }
+    }
+    return true
+}
+
+// Delete soft deletes a movie. From then on it's treated as if it didn't exist, until
+// PurgeDeleted() removes it (with its revisions and view counts) for good.
 func (m MovieModel) Delete(id int64) error {
     if id < 1 {
         return ErrRecordNotFound
     }
-    query := `
-        DELETE FROM movies
-        WHERE id = $1`
     // Create a context with a 3-second timeout.
     ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
     defer cancel()
-    // Use ExecContext() and pass the context as the first argument.
-    result, err := m.DB.ExecContext(ctx, query, id)
+    tx, err := m.DB.BeginTx(ctx, nil)
     if err != nil {
         return err
     }
-    rowsAffected, err := result.RowsAffected()
+    defer tx.Rollback()
+    _, err = moviesTable.markDeleted(ctx, tx, "id = $1 AND ($2 = 0 OR tenant_id = $2)", id, m.tenantID)
     if err != nil {
         return err
     }
-    if rowsAffected == 0 {
-        return ErrRecordNotFound
+    err = notifyMovieChanged(ctx, tx, movieIDPayload(id))
+    if err != nil {
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
     }
+    m.cache.remove(id)
+    m.counts.add(-1)
     return nil
 }
 
+// DeleteMatching soft deletes the movies which match the same filters as GetAll(), and
+// returns how many there were. With dryRun it only counts them. The movies are deleted in
+// batches of 1000, each in its own transaction, so that a large delete doesn't hold locks
+// on all of the movies at once; if a batch fails, the batches before it stay deleted,
+// and their count is returned along with the error.
+func (m MovieModel) DeleteMatching(title string, genres []string, filters Filters, dryRun bool) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+    defer cancel()
+    args := movieFilterArgs(title, genres, filters, m.tenantID)
+    if dryRun {
+        var count int64
+        err := m.DB.QueryRowContext(ctx, "SELECT count(*) FROM movies WHERE "+movieFilterConditions, args...).Scan(&count)
+        return count, err
+    }
+    var deleted int64
+    for {
+        ids, err := m.deleteBatch(ctx, args)
+        if errors.Is(err, ErrRecordNotFound) {
+            return deleted, nil
+        }
+        if err != nil {
+            return deleted, err
+        }
+        deleted += int64(len(ids))
+    }
+}
+
+// deleteBatch soft deletes up to 1000 of the movies matching movieFilterConditions, in a
+// transaction, and returns their IDs.
+func (m MovieModel) deleteBatch(ctx context.Context, args []interface{}) ([]int64, error) {
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    ids, err := moviesTable.markDeleted(ctx, tx, "id IN (SELECT id FROM movies WHERE "+movieFilterConditions+" ORDER BY id LIMIT 1000)", args...)
+    if err != nil {
+        return nil, err
+    }
+    err = notifyMovieChanged(ctx, tx, "*")
+    if err != nil {
+        return nil, err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return nil, err
+    }
+    for _, id := range ids {
+        m.cache.remove(id)
+    }
+    m.counts.add(-len(ids))
+    return ids, nil
+}
+
+// PurgeDeleted permanently deletes the movies which were deleted before the given time,
+// and returns how many there were.
+func (m MovieModel) PurgeDeleted(before time.Time) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    ids, err := moviesTable.purge(ctx, tx, before)
+    if err != nil {
+        return 0, err
+    }
+    return int64(len(ids)), tx.Commit()
+}
+
 // Update the function signature to return a Metadata struct.
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-    // Update the SQL query to include the window function which counts the total
-    // (filtered) records.
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    movies := []*Movie{}
+    metadata, err := m.getAll(ctx, title, genres, filters, func(movie *Movie) error {
+        movies = append(movies, movie)
+        return nil
+    })
+    if err != nil {
+        return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+    }
+    // Include the metadata struct when returning.
+    return movies, metadata, nil
+}
+
+// GetAllFunc() is like GetAll(), except that instead of collecting the movies into a
+// slice it calls fn for each movie as the row is scanned from the database. This keeps
+// memory use flat no matter how many movies are returned, so it's what we use for large
+// pages and exports. If fn returns an error, then iteration stops and that error is
+// returned. Because the caller is probably writing each movie to a (possibly slow)
+// client, we allow a lot longer than the usual 3 seconds.
+func (m MovieModel) GetAllFunc(title string, genres []string, filters Filters, fn func(movie *Movie) error) (Metadata, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+    defer cancel()
+    return m.getAll(ctx, title, genres, filters, fn)
+}
+
+// movieFilterConditions is the WHERE clause for the listing filters, shared by the
+// listing and count queries. Its arguments are the ones returned by movieFilterArgs(); a
+// zero limit or an empty list of genres matches every movie. Movies must have all of the
+// genres in $2 (@>) and at least one of the genres in $7 (&&), both of which can use the
+// GIN index on the genres column. $8 is the tenant, with zero matching every tenant,
+// and movies must have all of the attributes in $9 (@>, with the empty object matching
+// every movie), which can use the GIN index on the attributes column. $10 and $11 are the
+// range of creation times, with NULL for no limit. Deleted movies never match.
+const movieFilterConditions = `deleted_at IS NULL
+    AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+    AND (genres @> $2 OR $2 = '{}')
+    AND (year >= $3 OR $3 = 0)
+    AND (year <= $4 OR $4 = 0)
+    AND (runtime >= $5 OR $5 = 0)
+    AND (runtime <= $6 OR $6 = 0)
+    AND (genres && $7 OR $7 = '{}')
+    AND ($8 = 0 OR tenant_id = $8)
+    AND attributes @> $9
+    AND (created_at >= $10 OR $10 IS NULL)
+    AND (created_at < $11 OR $11 IS NULL)`
+
+// movieFilterArgs returns the arguments for movieFilterConditions.
+func movieFilterArgs(title string, genres []string, filters Filters, tenantID int64) []interface{} {
+    genresAny := filters.GenresAny
+    if genresAny == nil {
+        genresAny = []string{}
+    }
+    return []interface{}{title, pq.Array(genres), filters.YearMin, filters.YearMax, filters.RuntimeMin, filters.RuntimeMax, pq.Array(genresAny), tenantID, filters.Attributes, nullTime(filters.AddedFrom), nullTime(filters.AddedBefore)}
+}
+
+// movieListQuery returns the SQL query for a page of the listing, and its arguments. The
+// first column is countColumn, which is either the window function which counts the
+// total (filtered) records or a placeholder when the count comes from elsewhere.
+func movieListQuery(countColumn, title string, genres []string, filters Filters, tenantID int64) (string, []interface{}) {
     query := fmt.Sprintf(`
-    SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+    SELECT %s, id, created_at, title, year, runtime, genres, attributes, version
     FROM movies
-    WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-    AND (genres @> $2 OR $2 = '{}')    
-    ORDER BY %s %s, id ASC
-    LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
-ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-defer cancel()
-args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-rows, err := m.DB.QueryContext(ctx, query, args...)
-if err != nil {
-    return nil, Metadata{}, err // Update this to return an empty Metadata struct.
-}
-defer rows.Close()
-// Declare a totalRecords variable.
-totalRecords := 0
-movies := []*Movie{}
-for rows.Next() {
-    var movie Movie
-    err := rows.Scan(
-        &totalRecords, // Scan the count from the window function into totalRecords.
-        &movie.ID,
-        &movie.CreatedAt,
-        &movie.Title,
-        &movie.Year,
-        &movie.Runtime,
-        pq.Array(&movie.Genres),
-        &movie.Version,
-    )
+    WHERE %s
+    ORDER BY %s
+    LIMIT $12 OFFSET $13`, countColumn, movieFilterConditions, filters.orderBy())
+    args := append(movieFilterArgs(title, genres, filters, tenantID), filters.limit(), filters.offset())
+    return query, args
+}
+
+func (m MovieModel) getAll(ctx context.Context, title string, genres []string, filters Filters, fn func(movie *Movie) error) (Metadata, error) {
+    // For unfiltered listings, the total is the number of movies in the table, which we
+    // get from the count cache rather than having the window function count every
+    // movie for every page. The total may be slightly out of date, but that's fine for
+    // pagination metadata.
+    countColumn := "count(*) OVER()"
+    unfiltered := m.counts != nil && title == "" && len(genres) == 0 && !filters.HasLimits()
+    if unfiltered {
+        countColumn = "0"
+    }
+    query, args := movieListQuery(countColumn, title, genres, filters, m.tenantID)
+    rows, err := m.DB.QueryContext(ctx, query, args...)
     if err != nil {
-        return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+        return Metadata{}, err
     }
-    movies = append(movies, &movie)
+    defer rows.Close()
+    // Declare a totalRecords variable.
+    totalRecords := 0
+    count := 0
+    for rows.Next() {
+        var movie Movie
+        err := rows.Scan(
+            &totalRecords, // Scan the count from the window function into totalRecords.
+            &movie.ID,
+            &movie.CreatedAt,
+            &movie.Title,
+            &movie.Year,
+            &movie.Runtime,
+            pq.Array(&movie.Genres),
+            &movie.Attributes,
+            &movie.Version,
+        )
+        if err != nil {
+            return Metadata{}, err
+        }
+        err = fn(&movie)
+        if err != nil {
+            return Metadata{}, err
+        }
+        count++
     }
     if err = rows.Err(); err != nil {
-        return nil, Metadata{}, err // Update this to return an empty Metadata struct.
+        return Metadata{}, err
+    }
+    // The window function only gives us a count when at least one row is returned. If
+    // the client has asked for a page beyond the last one there won't be any rows, so
+    // in that (rare) case we fall back to a separate count query. This means that the
+    // metadata still tells the client how many records and pages there actually are.
+    if unfiltered {
+        totalRecords, err = m.counts.get(ctx)
+        if err != nil {
+            return Metadata{}, err
+        }
+    } else if count == 0 && filters.Page > 1 {
+        countQuery := "SELECT count(*) FROM movies WHERE " + movieFilterConditions
+        err = m.DB.QueryRowContext(ctx, countQuery, movieFilterArgs(title, genres, filters, m.tenantID)...).Scan(&totalRecords)
+        if err != nil {
+            return Metadata{}, err
+        }
     }
     // Generate a Metadata struct, passing in the total record count and pagination
     // parameters from the client.
-    metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
-    // Include the metadata struct when returning.
-    return movies, metadata, nil
-
+    return calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
 }
-
-// type MockMovieModel struct{}
-// func (m MockMovieModel) Insert(movie *Movie) error {
-//     // Mock the action...
-// }
-// func (m MockMovieModel) Get(id int64) (*Movie, error) {
-//     // Mock the action...
-// }
-// func (m MockMovieModel) Update(movie *Movie) error {
-//     // Mock the action...
-// }
-// func (m MockMovieModel) Delete(id int64) error {
-//     // Mock the action...
-// }
\ No newline at end of file
@@ -0,0 +1,528 @@
+//go:build integration
+
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+// movieSortSafelist is the sort safelist of the movie listings.
+var movieSortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+// movieFilters returns the filters for the first page of a movie listing.
+func movieFilters(sort string) Filters {
+	return Filters{Page: 1, PageSize: 20, Sort: sort, SortSafelist: movieSortSafelist}
+}
+
+// insertTestMovies inserts movies with Insert(), failing the test if it can't.
+func insertTestMovies(t *testing.T, models Models, movies ...*Movie) {
+	t.Helper()
+	for _, movie := range movies {
+		err := models.Movies.Insert(movie)
+		assert.NilError(t, err)
+	}
+}
+
+// movieIDs returns the IDs of movies, in order.
+func movieIDs(movies []*Movie) []int64 {
+	ids := []int64{}
+	for _, movie := range movies {
+		ids = append(ids, movie.ID)
+	}
+	return ids
+}
+
+func TestMovieModelInsertAndGet(t *testing.T) {
+	models, _ := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}, Attributes: Attributes{"language": "en"}}
+	err := models.Movies.Insert(movie)
+	assert.NilError(t, err)
+	assert.Equal(t, movie.ID, int64(1))
+	assert.Equal(t, movie.Version, int32(1))
+	assert.Equal(t, movie.CreatedAt.IsZero(), false)
+
+	got, err := models.Movies.Get(movie.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Title, "Moana")
+	assert.Equal(t, got.Year, int32(2016))
+	assert.Equal(t, got.Runtime, Runtime(107))
+	assert.Equal(t, got.Genres, []string{"animation", "adventure"})
+	assert.Equal(t, got.Attributes, Attributes{"language": "en"})
+	assert.Equal(t, got.Version, int32(1))
+
+	for _, id := range []int64{0, -1, 2} {
+		_, err = models.Movies.Get(id)
+		assert.Equal(t, err, ErrRecordNotFound)
+	}
+
+	// The identity ignores case and runs of whitespace.
+	err = models.Movies.Insert(&Movie{Title: "  MOANA ", Year: 2016, Runtime: 100, Genres: []string{"animation"}})
+	assert.Equal(t, err, ErrDuplicateMovie)
+	err = models.Movies.Insert(&Movie{Title: "Moana", Year: 2017, Runtime: 100, Genres: []string{"animation"}})
+	assert.NilError(t, err)
+}
+
+func TestMovieModelInsertManyAndGetMany(t *testing.T) {
+	models, _ := newTestModels(t)
+	err := models.Movies.InsertMany([]*Movie{
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"drama"}},
+	})
+	assert.NilError(t, err)
+
+	movies, err := models.Movies.GetMany([]int64{3, 1, 99, 1})
+	assert.NilError(t, err)
+	assert.Equal(t, movieIDs(movies), []int64{3, 1})
+	assert.Equal(t, movies[0].Title, "The Breakfast Club")
+
+	movies, err = models.Movies.GetMany(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(movies), 0)
+
+	// The whole import fails if one of the movies is a duplicate.
+	err = models.Movies.InsertMany([]*Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		{Title: "deadpool", Year: 2016, Runtime: 108, Genres: []string{"action"}},
+	})
+	assert.Equal(t, err, ErrDuplicateMovie)
+	_, metadata, err := models.Movies.GetAll("", []string{}, movieFilters("id"))
+	assert.NilError(t, err)
+	assert.Equal(t, metadata.TotalRecords, 3)
+}
+
+func TestMovieModelUpdate(t *testing.T) {
+	models, _ := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+	stale := *movie
+
+	movie.Title, movie.Genres = "Moana (2016)", []string{"animation", "family"}
+	err := models.Movies.Update(movie)
+	assert.NilError(t, err)
+	assert.Equal(t, movie.Version, int32(2))
+	got, err := models.Movies.Get(movie.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Title, "Moana (2016)")
+	assert.Equal(t, got.Genres, []string{"animation", "family"})
+	assert.Equal(t, got.Version, int32(2))
+
+	// An update of a version which has been replaced since is an edit conflict, and
+	// doesn't change anything.
+	stale.Title = "Vaiana"
+	err = models.Movies.Update(&stale)
+	assert.Equal(t, err, ErrEditConflict)
+	got, err = models.Movies.Get(movie.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Title, "Moana (2016)")
+
+	err = models.Movies.Update(&Movie{ID: 99, Title: "Missing", Year: 2000, Runtime: 90, Genres: []string{"drama"}, Version: 1})
+	assert.Equal(t, err, ErrEditConflict)
+
+	other := &Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}}
+	insertTestMovies(t, models, other)
+	other.Title, other.Year = "moana (2016)", 2016
+	err = models.Movies.Update(other)
+	assert.Equal(t, err, ErrDuplicateMovie)
+}
+
+func TestMovieModelRevisions(t *testing.T) {
+	models, db := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+	movie.Title = "Moana (2016)"
+	err := models.Movies.Update(movie)
+	assert.NilError(t, err)
+	movie.Runtime = 108
+	err = models.Movies.Update(movie)
+	assert.NilError(t, err)
+
+	revisions, err := models.Movies.GetRevisions(movie.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(revisions), 2)
+	assert.Equal(t, revisions[0].Version, int32(2))
+	assert.Equal(t, revisions[1].Version, int32(1))
+	assert.Equal(t, revisions[1].Title, "Moana")
+
+	revision, err := models.Movies.GetRevision(movie.ID, 2)
+	assert.NilError(t, err)
+	assert.Equal(t, revision.Title, "Moana (2016)")
+	assert.Equal(t, revision.Runtime, Runtime(107))
+	_, err = models.Movies.GetRevision(movie.ID, 3)
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, err = models.Movies.GetRevision(99, 1)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	// The timestamps only have whole seconds, so move the history back an hour at a time
+	// to get the versions apart: created 3 hours ago, and updated 2 hours and 1 hour ago.
+	now := time.Now()
+	_, err = db.Exec("UPDATE movies SET created_at = $1", now.Add(-3*time.Hour))
+	assert.NilError(t, err)
+	_, err = db.Exec("UPDATE movie_revisions SET replaced_at = $1 + version * interval '1 hour'", now.Add(-3*time.Hour))
+	assert.NilError(t, err)
+	tests := []struct {
+		at          time.Time
+		wantTitle   string
+		wantRuntime Runtime
+		wantVersion int32
+	}{
+		{at: now.Add(-150 * time.Minute), wantTitle: "Moana", wantRuntime: 107, wantVersion: 1},
+		{at: now.Add(-90 * time.Minute), wantTitle: "Moana (2016)", wantRuntime: 107, wantVersion: 2},
+		{at: now, wantTitle: "Moana (2016)", wantRuntime: 108, wantVersion: 3},
+	}
+	for _, tt := range tests {
+		got, err := models.Movies.GetAsOf(movie.ID, tt.at)
+		assert.NilError(t, err)
+		assert.Equal(t, got.Title, tt.wantTitle)
+		assert.Equal(t, got.Runtime, tt.wantRuntime)
+		assert.Equal(t, got.Version, tt.wantVersion)
+	}
+	_, err = models.Movies.GetAsOf(movie.ID, now.Add(-4*time.Hour))
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, err = models.Movies.GetAsOf(0, now)
+	assert.Equal(t, err, ErrRecordNotFound)
+}
+
+func TestMovieModelUpdateMany(t *testing.T) {
+	models, _ := newTestModels(t)
+	moana := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	coco := &Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}}
+	insertTestMovies(t, models, moana, coco)
+
+	moana.Runtime, coco.Runtime = 108, 106
+	err := models.Movies.UpdateMany([]*Movie{moana, coco})
+	assert.NilError(t, err)
+	assert.Equal(t, moana.Version, int32(2))
+	assert.Equal(t, coco.Version, int32(2))
+
+	// If one of the movies conflicts, none of them are updated.
+	stale := *coco
+	stale.Version = 1
+	moana.Runtime = 109
+	err = models.Movies.UpdateMany([]*Movie{moana, &stale})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("got: %v; want a *BatchError", err)
+	}
+	assert.Equal(t, batchErr.Errors, map[int]error{1: ErrEditConflict})
+	got, err := models.Movies.Get(moana.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Runtime, Runtime(108))
+	assert.Equal(t, got.Version, int32(2))
+}
+
+func TestMovieModelUpsert(t *testing.T) {
+	models, _ := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	outcome, err := models.Movies.Upsert(movie)
+	assert.NilError(t, err)
+	assert.Equal(t, outcome, UpsertCreated)
+	assert.Equal(t, movie.Version, int32(1))
+	id := movie.ID
+
+	same := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	outcome, err = models.Movies.Upsert(same)
+	assert.NilError(t, err)
+	assert.Equal(t, outcome, UpsertUnchanged)
+	assert.Equal(t, same.ID, id)
+	assert.Equal(t, same.Version, int32(1))
+
+	changed := &Movie{Title: "MOANA", Year: 2016, Runtime: 108, Genres: []string{"animation", "family"}}
+	outcome, err = models.Movies.Upsert(changed)
+	assert.NilError(t, err)
+	assert.Equal(t, outcome, UpsertUpdated)
+	assert.Equal(t, changed.ID, id)
+	assert.Equal(t, changed.Version, int32(2))
+	got, err := models.Movies.Get(id)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Title, "MOANA")
+	assert.Equal(t, got.Runtime, Runtime(108))
+	revisions, err := models.Movies.GetRevisions(id)
+	assert.NilError(t, err)
+	assert.Equal(t, len(revisions), 1)
+}
+
+func TestMovieModelDelete(t *testing.T) {
+	models, _ := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+
+	err := models.Movies.Delete(movie.ID)
+	assert.NilError(t, err)
+	_, err = models.Movies.Get(movie.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Movies.Delete(movie.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Movies.Delete(0)
+	assert.Equal(t, err, ErrRecordNotFound)
+	// Deleting bumps the version, so an update which read the movie before it was
+	// deleted conflicts.
+	err = models.Movies.Update(movie)
+	assert.Equal(t, err, ErrEditConflict)
+	// A deleted movie's identity is free again.
+	err = models.Movies.Insert(&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	assert.NilError(t, err)
+}
+
+func TestMovieModelDeleteMatching(t *testing.T) {
+	models, _ := newTestModels(t)
+	insertTestMovies(t, models,
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		&Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}},
+		&Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action"}},
+	)
+
+	count, err := models.Movies.DeleteMatching("", []string{"animation"}, movieFilters("id"), true)
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(2))
+	_, metadata, err := models.Movies.GetAll("", []string{}, movieFilters("id"))
+	assert.NilError(t, err)
+	assert.Equal(t, metadata.TotalRecords, 3)
+
+	count, err = models.Movies.DeleteMatching("", []string{"animation"}, movieFilters("id"), false)
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(2))
+	movies, _, err := models.Movies.GetAll("", []string{}, movieFilters("id"))
+	assert.NilError(t, err)
+	assert.Equal(t, movieIDs(movies), []int64{3})
+
+	count, err = models.Movies.DeleteMatching("", []string{"animation"}, movieFilters("id"), false)
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(0))
+}
+
+func TestMovieModelPurgeDeleted(t *testing.T) {
+	models, db := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+	err := models.Movies.Update(movie)
+	assert.NilError(t, err)
+	err = models.Movies.Delete(movie.ID)
+	assert.NilError(t, err)
+
+	count, err := models.Movies.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(0))
+	count, err = models.Movies.PurgeDeleted(time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(1))
+
+	var rows int
+	err = db.QueryRow("SELECT (SELECT count(*) FROM movies) + (SELECT count(*) FROM movie_revisions)").Scan(&rows)
+	assert.NilError(t, err)
+	assert.Equal(t, rows, 0)
+}
+
+func TestMovieModelGetAll(t *testing.T) {
+	models, _ := newTestModels(t)
+	insertTestMovies(t, models,
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}, Attributes: Attributes{"language": "en"}},
+		&Movie{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		&Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		&Movie{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"drama"}},
+	)
+
+	yearRange := movieFilters("id")
+	yearRange.YearMin, yearRange.YearMax = 2016, 2017
+	genresAny := movieFilters("id")
+	genresAny.GenresAny = []string{"comedy", "drama"}
+	runtimeRange := movieFilters("-runtime")
+	runtimeRange.RuntimeMin = 100
+	attributes := movieFilters("id")
+	attributes.Attributes = Attributes{"language": "en"}
+	added := movieFilters("id")
+	added.AddedFrom = time.Now().Add(-time.Hour)
+	notAdded := movieFilters("id")
+	notAdded.AddedBefore = time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		title   string
+		genres  []string
+		filters Filters
+		wantIDs []int64
+	}{
+		{name: "All", filters: movieFilters("id"), wantIDs: []int64{1, 2, 3, 4}},
+		{name: "Title", title: "panther", filters: movieFilters("id"), wantIDs: []int64{2}},
+		{name: "Genres", genres: []string{"action", "adventure"}, filters: movieFilters("id"), wantIDs: []int64{2}},
+		{name: "Genres any", filters: genresAny, wantIDs: []int64{3, 4}},
+		{name: "Year range", filters: yearRange, wantIDs: []int64{1, 3}},
+		{name: "Runtime range", filters: runtimeRange, wantIDs: []int64{2, 3, 1}},
+		{name: "Attributes", filters: attributes, wantIDs: []int64{1}},
+		{name: "Added since", filters: added, wantIDs: []int64{1, 2, 3, 4}},
+		{name: "Added before", filters: notAdded, wantIDs: []int64{}},
+		{name: "Sort by year", filters: movieFilters("-year"), wantIDs: []int64{2, 1, 3, 4}},
+		{name: "Sort by year and title", filters: movieFilters("year,-title"), wantIDs: []int64{4, 1, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genres := tt.genres
+			if genres == nil {
+				genres = []string{}
+			}
+			movies, metadata, err := models.Movies.GetAll(tt.title, genres, tt.filters)
+			assert.NilError(t, err)
+			assert.Equal(t, movieIDs(movies), tt.wantIDs)
+			assert.Equal(t, metadata.TotalRecords, len(tt.wantIDs))
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		filters := movieFilters("id")
+		filters.Page, filters.PageSize = 2, 3
+		movies, metadata, err := models.Movies.GetAll("", []string{}, filters)
+		assert.NilError(t, err)
+		assert.Equal(t, movieIDs(movies), []int64{4})
+		assert.Equal(t, metadata, Metadata{CurrentPage: 2, PageSize: 3, FirstPage: 1, LastPage: 2, TotalRecords: 4})
+
+		// Beyond the last page there are no movies, but the metadata still has the total.
+		filters.Page = 3
+		movies, metadata, err = models.Movies.GetAll("", []string{"action"}, filters)
+		assert.NilError(t, err)
+		assert.Equal(t, len(movies), 0)
+		assert.Equal(t, metadata.TotalRecords, 2)
+	})
+}
+
+func TestMovieModelGetAllFunc(t *testing.T) {
+	models, _ := newTestModels(t)
+	insertTestMovies(t, models,
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		&Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}},
+	)
+
+	var titles []string
+	metadata, err := models.Movies.GetAllFunc("", []string{}, movieFilters("title"), func(movie *Movie) error {
+		titles = append(titles, movie.Title)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, titles, []string{"Coco", "Moana"})
+	assert.Equal(t, metadata.TotalRecords, 2)
+
+	errStop := errors.New("stop")
+	calls := 0
+	_, err = models.Movies.GetAllFunc("", []string{}, movieFilters("id"), func(movie *Movie) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, err, errStop)
+	assert.Equal(t, calls, 1)
+}
+
+func TestMovieModelStats(t *testing.T) {
+	models, _ := newTestModels(t)
+	stats, err := models.Movies.Stats()
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Total, 0)
+
+	insertTestMovies(t, models,
+		&Movie{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"drama", "comedy"}},
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		&Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"comedy"}},
+	)
+	stats, err = models.Movies.Stats()
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Total, 3)
+	assert.Equal(t, stats.ByGenre, map[string]int{"drama": 1, "comedy": 2, "animation": 1})
+	assert.Equal(t, stats.ByDecade, map[string]int{"1980s": 1, "2010s": 2})
+	assert.Equal(t, stats.AverageRuntime, 104.0)
+	assert.Equal(t, stats.Oldest.Title, "The Breakfast Club")
+	assert.Equal(t, stats.Newest.Title, "Deadpool")
+}
+
+func TestMovieModelSimilar(t *testing.T) {
+	models, _ := newTestModels(t)
+	insertTestMovies(t, models,
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+		&Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation", "adventure"}},
+		&Movie{Title: "Toy Story", Year: 1995, Runtime: 81, Genres: []string{"animation"}},
+		&Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action"}},
+	)
+
+	similar, err := models.Movies.Similar(1, 10)
+	assert.NilError(t, err)
+	var ids []int64
+	for _, movie := range similar {
+		ids = append(ids, movie.ID)
+	}
+	assert.Equal(t, ids, []int64{2, 3})
+	assert.Equal(t, similar[0].Score > similar[1].Score, true)
+
+	similar, err = models.Movies.Similar(1, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(similar), 1)
+	similar, err = models.Movies.Similar(99, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(similar), 0)
+}
+
+func TestMovieModelSuggest(t *testing.T) {
+	models, _ := newTestModels(t)
+	insertTestMovies(t, models,
+		&Movie{Title: "The Godfather", Year: 1972, Runtime: 175, Genres: []string{"crime"}},
+		&Movie{Title: "Godzilla", Year: 2014, Runtime: 123, Genres: []string{"action"}},
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+	)
+
+	suggestions, err := models.Movies.Suggest("GOD", 10)
+	assert.NilError(t, err)
+	var titles []string
+	for _, suggestion := range suggestions {
+		titles = append(titles, suggestion.Title)
+	}
+	// Titles which start with the query come before the ones with a similar word.
+	assert.Equal(t, titles, []string{"Godzilla", "The Godfather"})
+
+	suggestions, err = models.Movies.Suggest("100%", 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(suggestions), 0)
+}
+
+func TestMovieModelRandom(t *testing.T) {
+	models, _ := newTestModels(t)
+	_, err := models.Movies.Random("", []string{}, Filters{})
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	insertTestMovies(t, models,
+		&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}},
+		&Movie{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action"}},
+		&Movie{Title: "Coco", Year: 2017, Runtime: 105, Genres: []string{"animation"}},
+	)
+	for i := 0; i < 10; i++ {
+		movie, err := models.Movies.Random("", []string{"action"}, Filters{})
+		assert.NilError(t, err)
+		assert.Equal(t, movie.Title, "Deadpool")
+	}
+	_, err = models.Movies.Random("", []string{"drama"}, Filters{})
+	assert.Equal(t, err, ErrRecordNotFound)
+}
+
+func TestMovieModelChanges(t *testing.T) {
+	models, _ := newTestModels(t)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, models, movie)
+	err := models.Movies.Update(movie)
+	assert.NilError(t, err)
+	err = models.Movies.Delete(movie.ID)
+	assert.NilError(t, err)
+
+	changes, err := models.Movies.Changes(0, 10)
+	assert.NilError(t, err)
+	var operations []string
+	for _, change := range changes {
+		assert.Equal(t, change.MovieID, movie.ID)
+		operations = append(operations, change.Operation)
+	}
+	assert.Equal(t, operations, []string{ChangeCreated, ChangeUpdated, ChangeDeleted})
+	assert.Equal(t, changes[2].Version, int32(3))
+
+	changes, err = models.Movies.Changes(changes[0].ID, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 1)
+	assert.Equal(t, changes[0].Operation, ChangeUpdated)
+}
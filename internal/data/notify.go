@@ -0,0 +1,182 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MovieChangedChannel is the PostgreSQL notification channel that the movie model
+// notifies whenever it writes to the movies table. The payload is the ID of the movie
+// that changed, or "*" if many movies changed at once.
+const MovieChangedChannel = "movie_changed"
+
+// notifyMovieChanged sends a notification that a movie has changed. It must be called
+// inside the same transaction as the write, as PostgreSQL only delivers the notification
+// when (and if) the transaction commits.
+func notifyMovieChanged(ctx context.Context, tx *sql.Tx, payload string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", MovieChangedChannel, payload)
+	return err
+}
+
+// movieIDPayload returns the notification payload for a single movie.
+func movieIDPayload(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// The movieCache type is an in-process cache of movies by ID, used by MovieModel.Get().
+// There's no TTL: instead, entries are removed when this instance writes to a movie, or
+// when a notification says that another instance has. While we aren't connected to the
+// database to receive notifications we can't know whether the cached movies are still
+// up to date, so the cache is emptied and disabled until we reconnect.
+//
+// The generation counter is incremented every time anything is removed from the cache.
+// Readers take the generation before querying the database and pass it to set(), which
+// ignores the movie if the generation has changed since. Otherwise a query which raced
+// with an update (and its notification) could put the old version of a movie back into
+// the cache, where it would stay.
+type movieCache struct {
+	mu         sync.RWMutex
+	movies     map[int64]Movie
+	enabled    bool
+	generation uint64
+}
+
+func newMovieCache() *movieCache {
+	return &movieCache{movies: make(map[int64]Movie)}
+}
+
+// get returns a copy of the cached movie with the given ID, if there is one.
+func (c *movieCache) get(id int64) (*Movie, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	movie, ok := c.movies[id]
+	if !ok {
+		return nil, false
+	}
+	movie = copyMovie(movie)
+	return &movie, true
+}
+
+// current returns the current generation of the cache.
+func (c *movieCache) current() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// set adds a copy of a movie, which was read from the database in the given generation,
+// to the cache.
+func (c *movieCache) set(movie *Movie, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enabled && c.generation == generation {
+		c.movies[movie.ID] = copyMovie(*movie)
+	}
+}
+
+// remove removes the movie with the given ID from the cache.
+func (c *movieCache) remove(id int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.movies, id)
+	c.generation++
+}
+
+// reset empties the cache, and enables or disables it.
+func (c *movieCache) reset(enabled bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.movies = make(map[int64]Movie)
+	c.enabled = enabled
+	c.generation++
+}
+
+// The ChangeListener type listens for movie_changed notifications from every instance
+// of the application (including this one), and invalidates our in-process caches when
+// it receives them. This keeps the caches on all of the replicas coherent.
+type ChangeListener struct {
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// NewCachedModels is like NewModels(), but the movie model also caches movies (and the
+// catalog statistics) in memory. It opens a separate connection to the database with the given DSN to listen
+// for changes; errors on that connection are passed to onError.
+func NewCachedModels(db *sql.DB, dsn string, onError func(error)) (Models, *ChangeListener, error) {
+	cache := newMovieCache()
+	counts := newCountCache(db, liveMoviesCount)
+	stats := &statsCache{}
+
+	events := func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			// We may have missed notifications while we were disconnected, so start
+			// again from scratch.
+			cache.reset(true)
+			counts.expire()
+			stats.expire()
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			cache.reset(false)
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+	listener := pq.NewListener(dsn, time.Second, time.Minute, events)
+	err := listener.Listen(MovieChangedChannel)
+	if err != nil {
+		listener.Close()
+		return Models{}, nil, err
+	}
+
+	cl := &ChangeListener{listener: listener, done: make(chan struct{})}
+	go func() {
+		defer close(cl.done)
+		for n := range listener.Notify {
+			// A nil notification is sent after the connection is re-established, which
+			// the event callback has already dealt with.
+			if n == nil {
+				continue
+			}
+			counts.expire()
+			stats.expire()
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				cache.reset(true)
+				continue
+			}
+			cache.remove(id)
+		}
+	}()
+
+	models := NewModels(db)
+	models.Movies = MovieModel{DB: db, counts: counts, cache: cache, stats: stats}
+	return models, cl, nil
+}
+
+// Close stops listening for changes.
+func (cl *ChangeListener) Close() error {
+	err := cl.listener.Close()
+	<-cl.done
+	return err
+}
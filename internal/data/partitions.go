@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PartitionedTables are the tables which are partitioned by month. Each has a
+// <table>_archive table that its old partitions are moved to.
+var PartitionedTables = []string{"security_events", "movie_views"}
+
+// The PartitionModel type maintains the monthly partitions of the PartitionedTables.
+// The partitions of a table are named <table>_pYYYYMM, for the month starting at
+// midnight UTC on the first.
+type PartitionModel struct {
+	DB *sql.DB
+}
+
+// partitionName returns the name of a table's partition for the month containing t.
+func partitionName(table string, t time.Time) string {
+	return table + "_p" + t.UTC().Format("200601")
+}
+
+// monthStart returns midnight UTC on the first of the month containing t.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Maintain makes sure that a table has partitions for this month and next month (so
+// that new rows never end up in its default partition), and archives the partitions for
+// the months which ended more than retention ago, by detaching them from the table and
+// attaching them to <table>_archive. A zero retention keeps every partition. It returns
+// the names of the partitions which were archived.
+func (m PartitionModel) Maintain(table string, retention time.Duration, now time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, month := range []time.Time{monthStart(now), monthStart(now).AddDate(0, 1, 0)} {
+		stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)",
+			pq.QuoteIdentifier(partitionName(table, month)), pq.QuoteIdentifier(table),
+			pq.QuoteLiteral(month.Format(time.RFC3339)), pq.QuoteLiteral(month.AddDate(0, 1, 0).Format(time.RFC3339)))
+		_, err := m.DB.ExecContext(ctx, stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if retention <= 0 {
+		return nil, nil
+	}
+	query := `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+		ORDER BY c.relname`
+	rows, err := m.DB.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	archived := []string{}
+	for _, name := range names {
+		// The default partition (and anything else which doesn't follow the naming
+		// scheme) is left alone.
+		month, err := time.Parse("200601", strings.TrimPrefix(name, table+"_p"))
+		if err != nil || name != partitionName(table, month) {
+			continue
+		}
+		end := month.AddDate(0, 1, 0)
+		if !end.Before(now.Add(-retention)) {
+			continue
+		}
+		err = m.archive(ctx, table, name, month, end)
+		if err != nil {
+			return archived, fmt.Errorf("archiving %s: %w", name, err)
+		}
+		archived = append(archived, name)
+	}
+	return archived, nil
+}
+
+// archive moves a partition from a table to its archive table, in a transaction.
+func (m PartitionModel) archive(ctx context.Context, table, partition string, start, end time.Time) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", pq.QuoteIdentifier(table), pq.QuoteIdentifier(partition)))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (%s) TO (%s)",
+		pq.QuoteIdentifier(table+"_archive"), pq.QuoteIdentifier(partition),
+		pq.QuoteLiteral(start.Format(time.RFC3339)), pq.QuoteLiteral(end.Format(time.RFC3339))))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
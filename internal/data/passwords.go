@@ -0,0 +1,143 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The PasswordParams type holds the settings used to hash new passwords.
+type PasswordParams struct {
+	// Algorithm is either "bcrypt" or "argon2id".
+	Algorithm string
+	// BcryptCost is the bcrypt cost factor.
+	BcryptCost int
+	// Argon2Memory is the amount of memory used by Argon2id, in KiB.
+	Argon2Memory uint32
+	// Argon2Time is the number of passes over the memory.
+	Argon2Time uint32
+	// Argon2Parallelism is the number of threads used.
+	Argon2Parallelism uint8
+}
+
+// PasswordHashing holds the settings for hashing new passwords. It is set once at
+// startup (from the -password-* command-line flags) and should not be changed after the
+// application has started serving requests. Existing hashes keep working whatever the
+// settings are, as they record their own algorithm and parameters, and are upgraded the
+// next time that the user logs in (see NeedsRehash()).
+var PasswordHashing = PasswordParams{
+	Algorithm:         "bcrypt",
+	BcryptCost:        12,
+	Argon2Memory:      64 * 1024,
+	Argon2Time:        3,
+	Argon2Parallelism: 2,
+}
+
+// The lengths of the Argon2id salt and key, in bytes.
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// errInvalidHash is returned when a stored hash can't be parsed.
+var errInvalidHash = errors.New("invalid password hash")
+
+// hashPassword hashes a plaintext password with the current settings. Argon2id hashes
+// are stored in the PHC string format, like this:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<base64 salt>$<base64 key>
+func hashPassword(plaintext string) ([]byte, error) {
+	params := PasswordHashing
+	if params.Algorithm != "argon2id" {
+		return bcrypt.GenerateFromPassword([]byte(plaintext), params.BcryptCost)
+	}
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(plaintext), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Parallelism, argon2KeyLength)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Argon2Memory, params.Argon2Time, params.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return []byte(hash), nil
+}
+
+// The argon2Hash type holds the parts of a parsed Argon2id hash.
+type argon2Hash struct {
+	memory      uint32
+	time        uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// isArgon2Hash reports whether a stored hash is an Argon2id hash (rather than bcrypt).
+func isArgon2Hash(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$argon2id$")
+}
+
+// parseArgon2Hash parses an Argon2id hash in the PHC string format.
+func parseArgon2Hash(hash []byte) (*argon2Hash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errInvalidHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errInvalidHash
+	}
+	h := &argon2Hash{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.parallelism)
+	if err != nil {
+		return nil, errInvalidHash
+	}
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errInvalidHash
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 {
+		return nil, errInvalidHash
+	}
+	return h, nil
+}
+
+// matchesArgon2 checks a plaintext password against an Argon2id hash, comparing the keys
+// in constant time.
+func matchesArgon2(hash []byte, plaintext string) (bool, error) {
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(plaintext), h.salt, h.time, h.memory, h.parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// NeedsRehash reports whether the stored hash was made with a different algorithm or
+// different parameters to the current settings, so that it should be replaced with a
+// new hash the next time that we know the plaintext password (i.e. when the user logs
+// in successfully).
+func (p *password) NeedsRehash() bool {
+	params := PasswordHashing
+	if isArgon2Hash(p.hash) {
+		if params.Algorithm != "argon2id" {
+			return true
+		}
+		h, err := parseArgon2Hash(p.hash)
+		return err != nil || h.memory != params.Argon2Memory || h.time != params.Argon2Time ||
+			h.parallelism != params.Argon2Parallelism || len(h.key) != argon2KeyLength
+	}
+	if params.Algorithm == "argon2id" {
+		return true
+	}
+	cost, err := bcrypt.Cost(p.hash)
+	return err != nil || cost != params.BcryptCost
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	// Embed the timezone database, so that timezone preferences work on hosts (and in
+	// containers) which don't have one installed.
+	_ "time/tzdata"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The Preferences type holds a user's preferences, which are stored as a JSON object in
+// the preferences column of the users table. An empty field means that the user hasn't
+// set it, and the accessor methods return the default instead.
+type Preferences struct {
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	PageSize int    `json:"page_size,omitempty"`
+}
+
+// localeRX is a rough check for a BCP 47 language tag, like "en" or "pt-BR".
+var localeRX = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// ValidatePreferences checks the preferences which have been set.
+func ValidatePreferences(v *validator.Validator, p Preferences) {
+	if p.Locale != "" {
+		v.Check(len(p.Locale) <= 35, "locale", "must not be more than 35 bytes long")
+		v.Check(validator.Matches(p.Locale, localeRX), "locale", "must be a language tag like en or pt-BR")
+	}
+	if p.Timezone != "" {
+		_, err := time.LoadLocation(p.Timezone)
+		v.Check(err == nil, "timezone", "must be an IANA timezone like Europe/London")
+	}
+	if p.PageSize != 0 {
+		v.Check(p.PageSize > 0, "page_size", "must be greater than zero")
+		v.Check(p.PageSize <= 100, "page_size", "must be a maximum of 100")
+	}
+}
+
+// Location returns the user's timezone, or UTC if they haven't set one.
+func (p Preferences) Location() *time.Location {
+	if p.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// LocaleOr returns the user's locale, or fallback if they haven't set one.
+func (p Preferences) LocaleOr(fallback string) string {
+	if p.Locale == "" {
+		return fallback
+	}
+	return p.Locale
+}
+
+// PageSizeOr returns the user's default page size for listings, or fallback if they
+// haven't set one.
+func (p Preferences) PageSizeOr(fallback int) int {
+	if p.PageSize == 0 {
+		return fallback
+	}
+	return p.PageSize
+}
+
+// UpdatePreferences replaces a user's preferences. Like RecordLogin(), it doesn't bump
+// the user's version, so that changing a preference can't cause an edit conflict for a
+// concurrent update of the user's details.
+func (m UserModel) UpdatePreferences(userID int64, preferences Preferences) error {
+	b, err := json.Marshal(preferences)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, "UPDATE users SET preferences = $1 WHERE id = $2", b, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
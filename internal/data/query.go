@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// queryTimeout is the timeout that most of the models use for a single query.
+const queryTimeout = 3 * time.Second
+
+// The rowScanner interface is satisfied by both *sql.Row and *sql.Rows, so that the
+// same scan function can be used for a single record and for a list of them.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// queryOne runs a query which returns at most one row, and scans it into a new T with
+// the scan function. It returns ErrRecordNotFound if there's no row. Errors from the
+// query are returned as they are, so that callers can still check for constraint
+// violations and the like.
+func queryOne[T any](db *sql.DB, timeout time.Duration, scan func(row rowScanner, record *T) error, query string, args ...any) (*T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var record T
+	err := scan(db.QueryRowContext(ctx, query, args...), &record)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// queryList runs a query and scans each of its rows into a new T with the scan
+// function. It returns an empty (rather than nil) slice if there are no rows, so that
+// they're encoded as [] in JSON. Scan errors are wrapped with the type being scanned,
+// as they usually mean that the query and the scan function don't match.
+func queryList[T any](db *sql.DB, timeout time.Duration, scan func(row rowScanner, record *T) error, query string, args ...any) ([]*T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*T{}
+	for rows.Next() {
+		var record T
+		err := scan(rows, &record)
+		if err != nil {
+			return nil, fmt.Errorf("scanning %T: %w", record, err)
+		}
+		records = append(records, &record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// execExpectRows runs a statement which should affect at least one row, like deleting a
+// record by its ID, and returns ErrRecordNotFound if it didn't affect any.
+func execExpectRows(db *sql.DB, timeout time.Duration, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// nullID returns the value for a nullable ID column, like the users who created
+// records, with zero as NULL.
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id > 0}
+}
+
+// nullTime returns the value for a nullable timestamp argument, with the zero time as
+// NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// The softDeleteTable type is the name of a table whose rows are soft deleted. Deleting
+// a row only sets its deleted_at column; every query on the table skips the rows where
+// it's set, and a periodic job purges them for good once they've been deleted for long
+// enough. Movies and users are soft deleted.
+type softDeleteTable string
+
+const (
+	moviesTable softDeleteTable = "movies"
+	usersTable  softDeleteTable = "users"
+)
+
+// markDeleted soft deletes the rows of the table which match the where condition (with
+// placeholders for args), as part of a transaction, and bumps their version so that
+// concurrent updates fail with an edit conflict. It returns the IDs of the rows. Rows
+// which are already deleted don't match, and ErrRecordNotFound is returned if no rows
+// do.
+func (t softDeleteTable) markDeleted(ctx context.Context, tx *sql.Tx, where string, args ...any) ([]int64, error) {
+	query := fmt.Sprintf("UPDATE %s SET deleted_at = NOW(), version = version + 1 WHERE deleted_at IS NULL AND (%s) RETURNING id", t, where)
+	ids, err := scanIDs(tx.QueryContext(ctx, query, args...))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return ids, nil
+}
+
+// purge permanently deletes the rows of the table which were soft deleted before the
+// given time, as part of a transaction, and returns their IDs.
+func (t softDeleteTable) purge(ctx context.Context, tx *sql.Tx, before time.Time) ([]int64, error) {
+	return scanIDs(tx.QueryContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE deleted_at < $1 RETURNING id", t), before))
+}
+
+// scanIDs returns the IDs from the rows returned by a query (and the query's error, if
+// it had one), like the ones from a RETURNING id clause.
+func scanIDs(rows *sql.Rows, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Random returns a randomly chosen movie which matches the same title, genres, year and
+// runtime filters as GetAll() (the paging and sorting filters are ignored). It returns
+// ErrRecordNotFound if no movies match.
+//
+// Rather than ORDER BY random(), which reads and sorts every matching row, we pick a
+// random ID between the lowest and highest IDs and take the first matching movie at or
+// after it, wrapping around to the start of the table if there isn't one. Both halves are
+// index scans on the primary key which stop at the first match. The catch is that
+// movies which come straight after a gap in the IDs (or after a run of movies which
+// don't match) are more likely to be picked, which is fine for a "surprise me" feature.
+func (m MovieModel) Random(title string, genres []string, filters Filters) (*Movie, error) {
+	query := fmt.Sprintf(`
+		WITH pick AS (
+			SELECT min(id) + floor(random() * (max(id) - min(id) + 1))::bigint AS id
+			FROM movies
+			WHERE deleted_at IS NULL AND ($8 = 0 OR tenant_id = $8)
+		)
+		(SELECT movies.id, movies.created_at, title, year, runtime, genres, attributes, version
+		FROM movies, pick
+		WHERE movies.id >= pick.id AND %[1]s
+		ORDER BY movies.id
+		LIMIT 1)
+		UNION ALL
+		(SELECT movies.id, movies.created_at, title, year, runtime, genres, attributes, version
+		FROM movies, pick
+		WHERE movies.id < pick.id AND %[1]s
+		ORDER BY movies.id
+		LIMIT 1)
+		LIMIT 1`, movieFilterConditions)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var movie Movie
+	err := m.DB.QueryRowContext(ctx, query, movieFilterArgs(title, genres, filters, m.tenantID)...).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Attributes,
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &movie, nil
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The MovieRevision type is a snapshot of a movie as it was before an update. Every
+// update to a movie stores the version that it replaces, so the history of a movie is
+// its revisions followed by the current record.
+type MovieRevision struct {
+	MovieID    int64      `json:"movie_id"`
+	Version    int32      `json:"version"`
+	ReplacedAt time.Time  `json:"replaced_at"`
+	Title      string     `json:"title"`
+	Year       int32      `json:"year,omitempty"`
+	Runtime    Runtime    `json:"runtime,omitempty"`
+	Genres     []string   `json:"genres,omitempty"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// saveRevision copies the current version of a movie into the movie_revisions table,
+// as part of the transaction which updates it. If the version doesn't match it does
+// nothing, and the update which follows reports the edit conflict.
+func saveRevision(ctx context.Context, tx *sql.Tx, id int64, version int32) error {
+	query := `
+		INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres, attributes)
+		SELECT id, version, title, year, runtime, genres, attributes
+		FROM movies
+		WHERE id = $1 AND version = $2
+		ON CONFLICT (movie_id, version) DO NOTHING`
+	_, err := tx.ExecContext(ctx, query, id, version)
+	return err
+}
+
+// GetRevisions returns the earlier versions of a movie, newest first.
+func (m MovieModel) GetRevisions(movieID int64) ([]*MovieRevision, error) {
+	query := `
+		SELECT movie_id, version, replaced_at, title, year, runtime, genres, attributes
+		FROM movie_revisions
+		WHERE movie_id = $1 AND movie_id IN (SELECT id FROM movies WHERE deleted_at IS NULL AND ($2 = 0 OR tenant_id = $2))
+		ORDER BY version DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, movieID, m.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := []*MovieRevision{}
+	for rows.Next() {
+		var revision MovieRevision
+		err := rows.Scan(
+			&revision.MovieID,
+			&revision.Version,
+			&revision.ReplacedAt,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			pq.Array(&revision.Genres),
+			&revision.Attributes,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// GetRevision returns one earlier version of a movie, or ErrRecordNotFound if there's
+// no revision with that version.
+func (m MovieModel) GetRevision(movieID int64, version int32) (*MovieRevision, error) {
+	query := `
+		SELECT movie_id, version, replaced_at, title, year, runtime, genres, attributes
+		FROM movie_revisions
+		WHERE movie_id = $1 AND version = $2 AND movie_id IN (SELECT id FROM movies WHERE deleted_at IS NULL AND ($3 = 0 OR tenant_id = $3))`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var revision MovieRevision
+	err := m.DB.QueryRowContext(ctx, query, movieID, version, m.tenantID).Scan(
+		&revision.MovieID,
+		&revision.Version,
+		&revision.ReplacedAt,
+		&revision.Title,
+		&revision.Year,
+		&revision.Runtime,
+		pq.Array(&revision.Genres),
+		&revision.Attributes,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &revision, nil
+}
+
+// GetAsOf returns a movie as it was at a point in time, from its revisions: the version
+// which was replaced first after that time, or the movie as it is now if it hasn't been
+// changed since. Movies which hadn't been created yet, or had already been deleted,
+// return ErrRecordNotFound; movies which have been deleted since are still returned,
+// until they're purged. The version is the one that the movie had at the time.
+//
+// The revisions only go back as far as the movie_revisions table, so for movies which
+// were updated before it existed the oldest revision stands in for the earlier versions.
+// UpdatedBy is only known for the current version.
+func (m MovieModel) GetAsOf(id int64, at time.Time) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT m.id, m.created_at,
+			coalesce(r.title, m.title),
+			coalesce(r.year, m.year),
+			coalesce(r.runtime, m.runtime),
+			coalesce(r.genres, m.genres),
+			coalesce(r.attributes, m.attributes),
+			coalesce(r.version, CASE WHEN m.deleted_at IS NULL THEN m.version ELSE m.version - 1 END),
+			coalesce(m.created_by, 0),
+			CASE WHEN r.movie_id IS NULL THEN coalesce(m.updated_by, 0) ELSE 0 END
+		FROM movies m
+		LEFT JOIN LATERAL (
+			SELECT * FROM movie_revisions
+			WHERE movie_id = m.id AND replaced_at > $2
+			ORDER BY version
+			LIMIT 1
+		) r ON true
+		WHERE m.id = $1 AND m.created_at <= $2 AND (m.deleted_at IS NULL OR m.deleted_at > $2) AND ($3 = 0 OR m.tenant_id = $3)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var movie Movie
+	err := m.DB.QueryRowContext(ctx, query, id, at, m.tenantID).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Attributes,
+		&movie.Version,
+		&movie.CreatedBy,
+		&movie.UpdatedBy,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &movie, nil
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The names of the built-in roles. Each role groups a set of permissions, so that users
+// can be given everything they need for a job in one go.
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// The Role type is a named group of permissions.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// GetAll returns every role, along with its permissions.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Name, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetAllForUser returns the names of a user's roles.
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN user_roles ON user_roles.role_id = roles.id
+		WHERE user_roles.user_id = $1
+		ORDER BY roles.name`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AddForUser gives a user a role. It returns ErrRecordNotFound if there's no role with
+// that name, and does nothing if the user already has the role.
+func (m RoleModel) AddForUser(userID int64, role string) error {
+	query := `
+		INSERT INTO user_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = $2
+		ON CONFLICT (user_id, role_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING role_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var roleID int64
+	err := m.DB.QueryRowContext(ctx, query, userID, role).Scan(&roleID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveForUser takes a role away from a user. It returns ErrRecordNotFound if the user
+// didn't have the role.
+func (m RoleModel) RemoveForUser(userID int64, role string) error {
+	query := `
+		DELETE FROM user_roles
+		USING roles
+		WHERE user_roles.role_id = roles.id AND user_roles.user_id = $1 AND roles.name = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, role)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -3,8 +3,10 @@ package data
 import (
 	"errors" // New import
 	"fmt"
+	"math"
 	"strconv"
 	"strings" // New import
+	"time"
 )
 
 // Define an error that our UnmarshalJSON() method can return if we're unable to parse
@@ -12,8 +14,40 @@ import (
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 type Runtime int32
 
+// The RuntimeFormat type controls how a Runtime value is written out when it is encoded
+// to JSON. RuntimeFormatMins produces the "<runtime> mins" string, while
+// RuntimeFormatInteger produces a bare JSON number.
+type RuntimeFormat int
+
+const (
+	RuntimeFormatMins RuntimeFormat = iota
+	RuntimeFormatInteger
+)
+
+// OutputRuntimeFormat holds the format that MarshalJSON() uses for all Runtime values.
+// It is set once at startup (from the -runtime-format command-line flag) and should
+// not be changed after the application has started serving requests.
+var OutputRuntimeFormat = RuntimeFormatMins
+
+// ParseRuntimeFormat converts the name of a runtime format ("mins" or "integer") into
+// the corresponding RuntimeFormat value.
+func ParseRuntimeFormat(name string) (RuntimeFormat, error) {
+	switch name {
+	case "mins":
+		return RuntimeFormatMins, nil
+	case "integer":
+		return RuntimeFormatInteger, nil
+	default:
+		return 0, fmt.Errorf("unknown runtime format %q", name)
+	}
+}
 
 func (r Runtime) MarshalJSON() ([]byte, error) {
+    // If we've been configured to output a raw integer, then return the number
+    // directly without any quoting.
+    if OutputRuntimeFormat == RuntimeFormatInteger {
+        return []byte(strconv.FormatInt(int64(r), 10)), nil
+    }
     // Generate a string containing the movie runtime in the required format.
     jsonValue := fmt.Sprintf("%d mins", r)
     // Use the strconv.Quote() function on the string to wrap it in double quotes. It
@@ -28,31 +62,55 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 // receiver (our Runtime type), we must use a pointer receiver for this to work
 // correctly. Otherwise, we will only be modifying a copy (which is then discarded when
 // this method returns).
+//
+// We accept three different input formats: a plain JSON number (107), a string in the
+// format "<runtime> mins" ("107 mins"), and a Go-style duration string ("1h47m").
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// We expect that the incoming JSON value will be a string in the format
-	// "<runtime> mins", and the first thing we need to do is remove the surrounding
-	// double-quotes from this string. If we can't unquote it, then we return the
-	// ErrInvalidRuntimeFormat error.
+	// If the value isn't wrapped in double-quotes, we treat it as a plain integer
+	// number of minutes.
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+			i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+			if err != nil {
+					return ErrInvalidRuntimeFormat
+			}
+			*r = Runtime(i)
+			return nil
+	}
+	// Otherwise remove the surrounding double-quotes from the string. If we can't
+	// unquote it, then we return the ErrInvalidRuntimeFormat error.
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
 			return ErrInvalidRuntimeFormat
 	}
 	// Split the string to isolate the part containing the number.
 	parts := strings.Split(unquotedJSONValue, " ")
-	// Sanity check the parts of the string to make sure it was in the expected format.
-	// If it isn't, we return the ErrInvalidRuntimeFormat error again.
-	if len(parts) != 2 || parts[1] != "mins" {
-			return ErrInvalidRuntimeFormat
+	// If the string is in the "<runtime> mins" format, parse the part containing the
+	// number into an int32. Again, if this fails return the ErrInvalidRuntimeFormat
+	// error.
+	if len(parts) == 2 && parts[1] == "mins" {
+			i, err := strconv.ParseInt(parts[0], 10, 32)
+			if err != nil {
+					return ErrInvalidRuntimeFormat
+			}
+			// Convert the int32 to a Runtime type and assign this to the receiver. Note
+			// that we use the * operator to deference the receiver (which is a pointer to
+			// a Runtime type) in order to set the underlying value of the pointer.
+			*r = Runtime(i)
+			return nil
 	}
-	// Otherwise, parse the string containing the number into an int32. Again, if this
-	// fails return the ErrInvalidRuntimeFormat error.
-	i, err := strconv.ParseInt(parts[0], 10, 32)
-	if err != nil {
-			return ErrInvalidRuntimeFormat
+	// Finally, try to parse the string as a duration like "1h47m". We only accept
+	// durations which are a whole number of minutes and which fit in an int32.
+	if len(parts) == 1 {
+			d, err := time.ParseDuration(parts[0])
+			if err != nil || d%time.Minute != 0 {
+					return ErrInvalidRuntimeFormat
+			}
+			mins := int64(d / time.Minute)
+			if mins > math.MaxInt32 || mins < math.MinInt32 {
+					return ErrInvalidRuntimeFormat
+			}
+			*r = Runtime(mins)
+			return nil
 	}
-	// Convert the int32 to a Runtime type and assign this to the receiver. Note that we
-	// use the * operator to deference the receiver (which is a pointer to a Runtime
-	// type) in order to set the underlying value of the pointer.
-	*r = Runtime(i)
-	return nil
+	return ErrInvalidRuntimeFormat
 }
\ No newline at end of file
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+// FuzzRuntimeUnmarshalJSON checks that UnmarshalJSON() never panics, that it only ever
+// fails with ErrInvalidRuntimeFormat, and that any runtime it accepts comes back the
+// same after being written out in either of the output formats and read in again.
+func FuzzRuntimeUnmarshalJSON(f *testing.F) {
+	for _, seed := range []string{`107`, `-5`, `"107 mins"`, `"1h47m"`, `"90m"`, `"30s"`, `"107mins"`, `"mins"`, `" mins"`, `"2147483648 mins"`, `"1 mins"`, `""`, `"`, `null`, `1e3`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, jsonValue []byte) {
+		var r Runtime
+		err := r.UnmarshalJSON(jsonValue)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidRuntimeFormat) {
+				t.Fatalf("UnmarshalJSON(%q): unexpected error %v", jsonValue, err)
+			}
+			return
+		}
+		format := OutputRuntimeFormat
+		defer func() { OutputRuntimeFormat = format }()
+		for _, OutputRuntimeFormat = range []RuntimeFormat{RuntimeFormatMins, RuntimeFormatInteger} {
+			b, err := r.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var again Runtime
+			err = again.UnmarshalJSON(b)
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%q) of MarshalJSON() of %q: %v", b, jsonValue, err)
+			}
+			if again != r {
+				t.Fatalf("%q read as %d, but its output %q read as %d", jsonValue, r, b, again)
+			}
+		}
+	})
+}
+
+func BenchmarkRuntimeMarshalJSON(b *testing.B) {
+	format := OutputRuntimeFormat
+	defer func() { OutputRuntimeFormat = format }()
+	for _, bm := range []struct {
+		name   string
+		format RuntimeFormat
+	}{
+		{name: "mins", format: RuntimeFormatMins},
+		{name: "integer", format: RuntimeFormatInteger},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			OutputRuntimeFormat = bm.format
+			r := Runtime(107)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := r.MarshalJSON()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
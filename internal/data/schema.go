@@ -0,0 +1,42 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of the newest migration in the migrations directory,
+// which is the schema that this build of the application expects. It has to be bumped
+// along with every new migration.
+const SchemaVersion = 29
+
+// ErrSchemaOutdated is returned by CheckSchema() when the migrations for this build
+// haven't all been applied.
+var ErrSchemaOutdated = errors.New("database schema is out of date")
+
+// CheckSchema checks that the migrations up to SchemaVersion have been applied, using
+// the schema_migrations table kept by the migrate tool. A newer schema is fine, as
+// during a rolling deploy the old version of the application runs against the schema
+// for the new one; a dirty schema (a migration which failed halfway) isn't.
+func CheckSchema(ctx context.Context, db *sql.DB) error {
+	var version int64
+	var dirty bool
+	err := db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrSchemaOutdated
+		default:
+			return err
+		}
+	}
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version %d", version)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("%w: at version %d, need %d", ErrSchemaOutdated, version, SchemaVersion)
+	}
+	return nil
+}
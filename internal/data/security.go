@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The SecurityEvent type is a security-relevant event, like a failed login or a
+// rejected CSRF token. The email address and IP address are stored in their own columns
+// so that events can be searched by them; anything else goes in the properties.
+type SecurityEvent struct {
+	ID         int64             `json:"id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Event      string            `json:"event"`
+	UserID     int64             `json:"user_id,omitempty"`
+	Email      string            `json:"email,omitempty"`
+	IP         string            `json:"ip,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// The SecurityEventModel type records security events in the security_events table.
+type SecurityEventModel struct {
+	DB *sql.DB
+}
+
+// Insert records a security event. A UserID of zero is stored as NULL.
+func (m SecurityEventModel) Insert(event *SecurityEvent) error {
+	properties, err := json.Marshal(event.Properties)
+	if err != nil {
+		return err
+	}
+	var userID sql.NullInt64
+	if event.UserID > 0 {
+		userID = sql.NullInt64{Int64: event.UserID, Valid: true}
+	}
+	query := `
+		INSERT INTO security_events (event, user_id, email, ip, properties)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, event.Event, userID, event.Email, event.IP, properties).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAllForUser returns the most recent security events for a user, newest first, up
+// to limit of them.
+func (m SecurityEventModel) GetAllForUser(userID int64, limit int) ([]*SecurityEvent, error) {
+	query := `
+		SELECT id, created_at, event, email, ip, properties
+		FROM security_events
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2`
+	return queryList(m.DB, 5*time.Second, func(row rowScanner, event *SecurityEvent) error {
+		event.UserID = userID
+		var properties []byte
+		err := row.Scan(&event.ID, &event.CreatedAt, &event.Event, &event.Email, &event.IP, &properties)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(properties, &event.Properties)
+	}, query, userID, limit)
+}
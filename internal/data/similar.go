@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The SimilarMovie type is a movie returned by Similar(), with its similarity score.
+type SimilarMovie struct {
+	Movie
+	Score float64 `json:"score"`
+}
+
+// The SimilarityScorer interface is the scoring function which ranks movies by how
+// similar they are to another one. Higher scores are more similar. The score is worked
+// out inside the similar movies query, so the scorer provides it as an SQL expression,
+// along with the same calculation in Go for the memory model.
+type SimilarityScorer interface {
+	// SQL returns an SQL expression for the score of the candidate movie m against the
+	// movie base, which both have the columns of the movies table. It must not contain
+	// any placeholders.
+	SQL() string
+	// Score returns the score of the candidate movie against the base movie.
+	Score(base, candidate *Movie) float64
+}
+
+// The WeightedSimilarity type is the default SimilarityScorer. The score is the
+// weighted sum of the genre overlap (the number of shared genres divided by the number
+// of genres between them, from 0 to 1) and the year proximity (YearScale divided by
+// YearScale plus the number of years between them, so that movies YearScale years apart
+// get half marks).
+type WeightedSimilarity struct {
+	GenreWeight float64
+	YearWeight  float64
+	YearScale   float64
+}
+
+func (s WeightedSimilarity) SQL() string {
+	genres := `cardinality(ARRAY(SELECT unnest(m.genres) INTERSECT SELECT unnest(base.genres)))::float8
+		/ greatest(cardinality(ARRAY(SELECT unnest(m.genres) UNION SELECT unnest(base.genres))), 1)`
+	year := fmt.Sprintf("%[1]s / (%[1]s + abs(m.year - base.year))", sqlFloat(s.YearScale))
+	return fmt.Sprintf("%s * (%s) + %s * (%s)", sqlFloat(s.GenreWeight), genres, sqlFloat(s.YearWeight), year)
+}
+
+func (s WeightedSimilarity) Score(base, candidate *Movie) float64 {
+	shared, all := 0, make(map[string]bool)
+	for _, genre := range base.Genres {
+		all[genre] = true
+	}
+	for _, genre := range candidate.Genres {
+		if all[genre] {
+			shared++
+		}
+		all[genre] = true
+	}
+	genres := float64(shared) / math.Max(float64(len(all)), 1)
+	year := s.YearScale / (s.YearScale + math.Abs(float64(candidate.Year-base.Year)))
+	return s.GenreWeight*genres + s.YearWeight*year
+}
+
+// sqlFloat formats a float as an SQL literal.
+func sqlFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64) + "::float8"
+}
+
+// MovieSimilarity is the scoring function used by Similar(). It is set once at startup
+// (from the -similar-* command-line flags), and can be replaced with any other
+// SimilarityScorer.
+var MovieSimilarity SimilarityScorer = WeightedSimilarity{GenreWeight: 2, YearWeight: 1, YearScale: 10}
+
+// Similar returns up to limit movies which are similar to the movie with the given ID,
+// most similar first, scored by MovieSimilarity. Only movies sharing at least one genre
+// with it are candidates, which lets the query use the index on the genres column, and
+// only movies of the same tenant. If there's no movie with the ID, there are no similar
+// movies either.
+func (m MovieModel) Similar(id int64, limit int) ([]*SimilarMovie, error) {
+	query := fmt.Sprintf(`
+		WITH base AS (SELECT id, year, genres, tenant_id FROM movies WHERE id = $1 AND deleted_at IS NULL AND ($3 = 0 OR tenant_id = $3))
+		SELECT m.id, m.created_at, m.title, m.year, m.runtime, m.genres, m.attributes, m.version, s.score
+		FROM base, movies m, LATERAL (SELECT %s AS score) s
+		WHERE m.id <> base.id AND m.genres && base.genres AND m.tenant_id = base.tenant_id AND m.deleted_at IS NULL
+		ORDER BY s.score DESC, m.id
+		LIMIT $2`, MovieSimilarity.SQL())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, id, limit, m.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	movies := []*SimilarMovie{}
+	for rows.Next() {
+		var movie SimilarMovie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Attributes,
+			&movie.Version,
+			&movie.Score,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+// sortSimilar sorts similar movies by score, most similar first, and then by ID.
+func sortSimilar(movies []*SimilarMovie) {
+	sort.Slice(movies, func(i, j int) bool {
+		if movies[i].Score != movies[j].Score {
+			return movies[i].Score > movies[j].Score
+		}
+		return movies[i].ID < movies[j].ID
+	})
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The MovieStats type holds the statistics about the whole catalog which are shown on
+// dashboards. Decades are keyed like "1990s". Newest and oldest are the movies which
+// were added to the catalog most and least recently, and are nil if there aren't any.
+type MovieStats struct {
+	Total          int            `json:"total"`
+	ByGenre        map[string]int `json:"by_genre"`
+	ByDecade       map[string]int `json:"by_decade"`
+	AverageRuntime float64        `json:"average_runtime"`
+	Newest         *Movie         `json:"newest"`
+	Oldest         *Movie         `json:"oldest"`
+}
+
+// decadeKey returns the ByDecade key for a release year.
+func decadeKey(year int32) string {
+	return strconv.Itoa(int(year/10*10)) + "s"
+}
+
+// StatsCacheTTL is how long cached catalog statistics are used for, when the movie
+// model caches them (see NewCachedModels()).
+var StatsCacheTTL = time.Minute
+
+// The statsCache type caches the catalog statistics, which need several queries over
+// the whole movies table. Unlike the count cache they aren't adjusted as movies are
+// written: any change expires them, and the next call to Stats() works them out again.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *MovieStats
+	fetched time.Time
+}
+
+// get returns the cached statistics, if there are any and they haven't expired.
+func (c *statsCache) get() (*MovieStats, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil || time.Since(c.fetched) > StatsCacheTTL {
+		return nil, false
+	}
+	return c.stats, true
+}
+
+// set stores the statistics in the cache.
+func (c *statsCache) set(stats *MovieStats) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = stats
+	c.fetched = time.Now()
+}
+
+// expire discards the cached statistics.
+func (c *statsCache) expire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = nil
+}
+
+// Stats returns the statistics for the whole catalog, or for the tenant's catalog if the
+// model is scoped to one. The queries run in a single
+// read-only, repeatable read transaction, so that they all see the same snapshot of the
+// movies table and the numbers add up. The statistics are shared with other callers
+// while they're cached, so they must not be modified.
+func (m MovieModel) Stats() (*MovieStats, error) {
+	if stats, ok := m.stats.get(); ok {
+		return stats, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stats := &MovieStats{ByGenre: make(map[string]int), ByDecade: make(map[string]int)}
+	const tenant = "WHERE deleted_at IS NULL AND ($1 = 0 OR tenant_id = $1)"
+	err = tx.QueryRowContext(ctx, "SELECT count(*), coalesce(avg(runtime), 0) FROM movies "+tenant, m.tenantID).Scan(&stats.Total, &stats.AverageRuntime)
+	if err != nil {
+		return nil, err
+	}
+	err = scanCounts(ctx, tx, "SELECT genre, count(*) FROM movies, unnest(genres) AS genre "+tenant+" GROUP BY genre", m.tenantID, func(key string, count int) {
+		stats.ByGenre[key] = count
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanCounts(ctx, tx, "SELECT year / 10 * 10, count(*) FROM movies "+tenant+" GROUP BY 1", m.tenantID, func(key string, count int) {
+		stats.ByDecade[key+"s"] = count
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.Newest, err = scanMovie(tx.QueryRowContext(ctx, "SELECT id, created_at, title, year, runtime, genres, attributes, version FROM movies "+tenant+" ORDER BY created_at DESC, id DESC LIMIT 1", m.tenantID))
+	if err != nil {
+		return nil, err
+	}
+	stats.Oldest, err = scanMovie(tx.QueryRowContext(ctx, "SELECT id, created_at, title, year, runtime, genres, attributes, version FROM movies "+tenant+" ORDER BY created_at, id LIMIT 1", m.tenantID))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	m.stats.set(stats)
+	return stats, nil
+}
+
+// scanCounts runs a query which returns (key, count) rows, and calls fn for each row.
+func scanCounts(ctx context.Context, tx *sql.Tx, query string, tenantID int64, fn func(key string, count int)) error {
+	rows, err := tx.QueryContext(ctx, query, tenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var count int
+		err := rows.Scan(&key, &count)
+		if err != nil {
+			return err
+		}
+		fn(key, count)
+	}
+	return rows.Err()
+}
+
+// scanMovie scans a movie from a row, returning nil (and no error) if there's no row.
+func scanMovie(row *sql.Row) (*Movie, error) {
+	var movie Movie
+	err := row.Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Attributes, &movie.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &movie, nil
+}
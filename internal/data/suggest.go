@@ -0,0 +1,36 @@
+package data
+
+import (
+	"strings"
+	"time"
+)
+
+// The MovieSuggestion type is a movie returned by Suggest(), with just enough of it for
+// a typeahead to show.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year,omitempty"`
+}
+
+// likeEscaper escapes the characters which are special in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Suggest returns up to limit movies whose titles match what has been typed so far, for
+// a typeahead. Titles which start with q come first, followed by the titles with a word
+// similar to q (by pg_trgm's word similarity, so that "god" finds "The Godfather" and a
+// typo still finds something), most similar first. Matching ignores case, and both
+// conditions use the movies_title_trgm_idx index.
+func (m MovieModel) Suggest(q string, limit int) ([]*MovieSuggestion, error) {
+	query := `
+		SELECT id, title, year
+		FROM movies
+		WHERE deleted_at IS NULL AND ($3 = 0 OR tenant_id = $3)
+		AND (lower(title) LIKE $2 OR $1 <% lower(title))
+		ORDER BY lower(title) LIKE $2 DESC, word_similarity($1, lower(title)) DESC, title, id
+		LIMIT $4`
+	q = strings.ToLower(q)
+	return queryList(m.DB, time.Second, func(row rowScanner, suggestion *MovieSuggestion) error {
+		return row.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+	}, query, q, likeEscaper.Replace(q)+"%", m.tenantID, limit)
+}
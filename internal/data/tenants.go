@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// DefaultTenantID is the ID of the tenant created by the migrations. Every movie and
+// user belongs to it unless tenancy is in use, and it's the tenant that new records go
+// to when they're inserted with models which aren't scoped to a tenant.
+const DefaultTenantID = 1
+
+// DefaultTenantSlug is the slug of the default tenant.
+const DefaultTenantSlug = "default"
+
+// ErrDuplicateSlug is returned when inserting a tenant with a slug which is taken.
+var ErrDuplicateSlug = errors.New("duplicate slug")
+
+// slugRX matches the tenant slugs which can be used as a subdomain: a DNS label of
+// lowercase letters, digits and hyphens.
+var slugRX = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// The Tenant type is one of the isolated catalogs served by a deployment, each with its
+// own movies and users.
+type Tenant struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+}
+
+func ValidateTenant(v *validator.Validator, tenant *Tenant) {
+	v.Check(tenant.Slug != "", "slug", "must be provided")
+	v.Check(validator.Matches(tenant.Slug, slugRX), "slug", "must be a lowercase DNS label")
+	v.Check(tenant.Name != "", "name", "must be provided")
+	v.Check(len(tenant.Name) <= 500, "name", "must not be more than 500 bytes long")
+}
+
+// The TenantModel type looks tenants up by the slug that requests identify them with.
+type TenantModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a tenant, and sets its ID and creation time.
+func (m TenantModel) Insert(tenant *Tenant) error {
+	query := `
+		INSERT INTO tenants (slug, name)
+		VALUES ($1, $2)
+		RETURNING id, created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tenant.Slug, tenant.Name).Scan(&tenant.ID, &tenant.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "tenants_slug_key"`:
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBySlug returns the tenant with a slug, or ErrRecordNotFound.
+func (m TenantModel) GetBySlug(slug string) (*Tenant, error) {
+	query := `
+		SELECT id, created_at, slug, name
+		FROM tenants
+		WHERE slug = $1`
+	return queryOne(m.DB, queryTimeout, func(row rowScanner, tenant *Tenant) error {
+		return row.Scan(&tenant.ID, &tenant.CreatedAt, &tenant.Slug, &tenant.Name)
+	}, query, slug)
+}
+
+// ForTenant returns a copy of the models in which the movie, user and trending queries
+// only see the records belonging to a tenant, and new movies and users are created in
+// it. The models returned by NewModels() see the records of every tenant, which is what
+// the periodic jobs need. Models which don't know about tenants are left as they are;
+// tokens, roles and the like are only ever looked up by the ID of a user who has
+// already been found in the tenant.
+//
+// The movie caches (see NewCachedModels()) hold the movies of every tenant, so the
+// scoped models don't use them.
+func (m Models) ForTenant(tenantID int64) Models {
+	m.Movies = scopeToTenant(m.Movies, tenantID)
+	m.Users = scopeToTenant(m.Users, tenantID)
+	m.Views = scopeToTenant(m.Views, tenantID)
+	return m
+}
+
+// scopeToTenant returns a copy of a model scoped to a tenant, if the model supports it.
+func scopeToTenant[T any](model T, tenantID int64) T {
+	if s, ok := any(model).(interface{ forTenant(tenantID int64) any }); ok {
+		return s.forTenant(tenantID).(T)
+	}
+	return model
+}
+
+// insertTenant returns the tenant that a model scoped to tenantID inserts records into.
+func insertTenant(tenantID int64) int64 {
+	if tenantID == 0 {
+		return DefaultTenantID
+	}
+	return tenantID
+}
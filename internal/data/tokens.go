@@ -2,18 +2,24 @@ package data
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"greenlight.alexedwards.net/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	// API keys authenticate requests in the same way as authentication tokens, but are
+	// created by the user for a script or another service, and usually last longer.
+	ScopeAPIKey = "api_key"
 )
 // Add struct tags to control how the struct appears when encoded to JSON.
 type Token struct {
@@ -22,6 +28,21 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// The ID identifies the token in the token management endpoints, without revealing
+	// anything about the token itself.
+	ID        int64     `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"-"`
+	// If a token has any Permissions, then requests authenticated with it can only use
+	// the permissions in this list (and only those which the user has). A token without
+	// any can use all of the user's permissions.
+	Permissions Permissions `json:"-"`
+	// LastUsedAt is when the token last authenticated a request (roughly; see Touch()),
+	// or zero if it never has. UserAgent and IP identify the client which last used it,
+	// or which it was created for.
+	LastUsedAt time.Time `json:"-"`
+	UserAgent  string    `json:"-"`
+	IP         string    `json:"-"`
 }
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
     // Create a Token instance containing the user ID, expiry, and scope information. 
@@ -51,15 +72,61 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
     // character. We don't need this padding character for the purpose of our tokens, so
     // we use the WithPadding(base32.NoPadding) method in the line below to omit them.
     token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-    // Generate a SHA-256 hash of the plaintext token string. This will be the value
-    // that we store in the `hash` field of our database table. Note that the
-    // sha256.Sum256() function returns an *array* of length 32, so to make it easier to 
-    // work with we convert it to a slice using the [:] operator before storing it.
-    hash := sha256.Sum256([]byte(token.Plaintext))
-    token.Hash = hash[:]
+    token.Hash = hashTokenPlaintext(token.Plaintext)
     return token, nil
 }
 
+// TokenPepper is an application-level secret which is mixed into the token hashes, so
+// that a copy of the tokens table is useless without it. It is set once at startup (from
+// the -token-pepper command-line flag). Changing it invalidates every outstanding token,
+// and if it's empty the hashes are plain SHA-256 hashes, as they always used to be.
+var TokenPepper []byte
+
+// Generate a SHA-256 hash of the plaintext token string. This will be the value that we
+// store in the `hash` field of our database table. Note that the sha256.Sum256()
+// function returns an *array* of length 32, so to make it easier to work with we
+// convert it to a slice using the [:] operator before returning it. If there's a pepper,
+// we use an HMAC-SHA-256 of the token with the pepper as the key instead, which is the
+// same size.
+//
+// Tokens are always looked up by their hash, never by comparing plaintexts, so any
+// timing differences in the lookup depend on a hash the client can't predict (or, with
+// a pepper, compute at all) and don't leak anything about the stored tokens.
+func hashTokenPlaintext(tokenPlaintext string) []byte {
+    if len(TokenPepper) > 0 {
+        mac := hmac.New(sha256.New, TokenPepper)
+        mac.Write([]byte(tokenPlaintext))
+        return mac.Sum(nil)
+    }
+    hash := sha256.Sum256([]byte(tokenPlaintext))
+    return hash[:]
+}
+
+// HashToken returns the hash of a plaintext token, as it's stored in the database. It's
+// for callers which need to refer to a token without holding on to its plaintext.
+func HashToken(tokenPlaintext string) []byte {
+    return hashTokenPlaintext(tokenPlaintext)
+}
+
+// NewToken generates a new token, which the caller can add a name and permissions to
+// before inserting it.
+func NewToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+    return generateToken(userID, ttl, scope)
+}
+
+// NewTokenFromPlaintext returns a Token for a known plaintext value, hashed in the same
+// way as generated tokens. It's used for loading fixtures, where tests and developers
+// need to know the token values in advance.
+func NewTokenFromPlaintext(userID int64, tokenPlaintext string, ttl time.Duration, scope string) *Token {
+    return &Token{
+        Plaintext: tokenPlaintext,
+        Hash:      hashTokenPlaintext(tokenPlaintext),
+        UserID:    userID,
+        Expiry:    time.Now().Add(ttl),
+        Scope:     scope,
+    }
+}
+
 // Check that the plaintext token has been provided and is exactly 26 bytes long.
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
@@ -80,15 +147,128 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert() adds the data for a specific token to the tokens table.
+// Insert() adds the data for a specific token to the tokens table, and sets the ID and
+// creation time of the token.
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-			INSERT INTO tokens (hash, user_id, expiry, scope)
-			VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+			INSERT INTO tokens (hash, user_id, expiry, scope, name, permissions, user_agent, ip)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id, created_at`
+	permissions := token.Permissions
+	if permissions == nil {
+			permissions = Permissions{}
+	}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Name, pq.Array(permissions), token.UserAgent, token.IP}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+// GetAllForUser() returns the unexpired tokens with any of the given scopes which belong
+// to a user, oldest first. The plaintexts of the tokens aren't stored, so they aren't
+// set.
+func (m TokenModel) GetAllForUser(userID int64, scopes ...string) ([]*Token, error) {
+	query := `
+			SELECT id, created_at, name, scope, expiry, permissions, last_used_at, user_agent, ip
+			FROM tokens
+			WHERE user_id = $1 AND scope = ANY($2) AND expiry > $3
+			ORDER BY created_at, id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(scopes), time.Now())
+	if err != nil {
+			return nil, err
+	}
+	defer rows.Close()
+	tokens := []*Token{}
+	for rows.Next() {
+			token := Token{UserID: userID}
+			var lastUsedAt sql.NullTime
+			err := rows.Scan(&token.ID, &token.CreatedAt, &token.Name, &token.Scope, &token.Expiry, pq.Array(&token.Permissions), &lastUsedAt, &token.UserAgent, &token.IP)
+			if err != nil {
+					return nil, err
+			}
+			token.LastUsedAt = lastUsedAt.Time
+			tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+			return nil, err
+	}
+	return tokens, nil
+}
+// DeleteForUser() deletes the token with the given ID, if it belongs to the user (and
+// returns ErrRecordNotFound if it doesn't, so that users can't find out which token IDs
+// exist). If any scopes are given, the token must have one of them too.
+func (m TokenModel) DeleteForUser(userID, id int64, scopes ...string) error {
+	query := `
+			DELETE FROM tokens
+			WHERE id = $1 AND user_id = $2 AND (scope = ANY($3) OR cardinality($3::text[]) = 0)`
+	if scopes == nil {
+			scopes = []string{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID, pq.Array(scopes))
+	if err != nil {
+			return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+			return err
+	}
+	if rowsAffected == 0 {
+			return ErrRecordNotFound
+	}
+	return nil
+}
+// Consume() deletes a token, returning the ID of the user it belonged to, so that the
+// token can only ever be used once. Because the lookup and delete happen in a single
+// statement, if two requests try to use the same token at the same time only one of
+// them succeeds; the other gets ErrRecordNotFound, as does any request with an expired
+// token.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	query := `
+			DELETE FROM tokens
+			WHERE hash = $1 AND scope = $2 AND expiry > $3
+			RETURNING user_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var userID int64
+	err := m.DB.QueryRowContext(ctx, query, hashTokenPlaintext(tokenPlaintext), scope, time.Now()).Scan(&userID)
+	if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+					return 0, ErrRecordNotFound
+			default:
+					return 0, err
+			}
+	}
+	return userID, nil
+}
+// DeleteAllForUserExcept() deletes all of a user's tokens with the given scope apart from
+// the one with the given ID, and returns how many it deleted. It's used to log out every
+// other session.
+func (m TokenModel) DeleteAllForUserExcept(scope string, userID, exceptID int64) (int64, error) {
+	query := `
+			DELETE FROM tokens
+			WHERE scope = $1 AND user_id = $2 AND id <> $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, scope, userID, exceptID)
+	if err != nil {
+			return 0, err
+	}
+	return result.RowsAffected()
+}
+// Touch() records that a token has just been used, by the client with the given IP
+// address and user agent.
+func (m TokenModel) Touch(id int64, ip, userAgent string) error {
+	query := `
+			UPDATE tokens
+			SET last_used_at = NOW(), ip = $2, user_agent = $3
+			WHERE id = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err := m.DB.ExecContext(ctx, query, id, ip, userAgent)
 	return err
 }
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
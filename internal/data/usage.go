@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UsagePeriods are the periods that usage can be reported over, keyed by the names used
+// in the API, as a number of days (including today).
+var UsagePeriods = map[string]int{
+	"1d":  1,
+	"7d":  7,
+	"30d": 30,
+	"90d": 90,
+}
+
+// UsageRetention is how long usage counts are kept for. It's the longest of the
+// UsagePeriods.
+const UsageRetention = 90 * 24 * time.Hour
+
+// The UsageKey type identifies whose usage is being counted: a user, and the token they
+// used. A TokenID of zero is for tokens which aren't stored, like JWTs. APIKey is
+// whether the token is an API key, as only their usage is metered (see MeteringModel).
+type UsageKey struct {
+	UserID  int64
+	TokenID int64
+	APIKey  bool
+}
+
+// The UsageCounts type holds the number of requests made, how many of them failed with
+// a 4xx or 5xx response, and how many were turned away by the rate limiter (which
+// aren't included in the requests), along with the bytes in the bodies of the requests
+// and their responses.
+type UsageCounts struct {
+	Requests    int64 `json:"requests"`
+	Errors      int64 `json:"errors"`
+	RateLimited int64 `json:"rate_limited"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+}
+
+func (c *UsageCounts) add(other UsageCounts) {
+	c.Requests += other.Requests
+	c.Errors += other.Errors
+	c.RateLimited += other.RateLimited
+	c.BytesIn += other.BytesIn
+	c.BytesOut += other.BytesOut
+}
+
+// The UsageDay type is the usage for one day (in UTC).
+type UsageDay struct {
+	Day string `json:"day"`
+	UsageCounts
+}
+
+// The UsageToken type is the usage for one token. Tokens which have been deleted since
+// are still included, without their name and type.
+type UsageToken struct {
+	TokenID int64  `json:"token_id"`
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type,omitempty"`
+	UsageCounts
+}
+
+// The Usage type is a user's usage over a period, in total, by day and by token.
+type Usage struct {
+	Totals UsageCounts  `json:"totals"`
+	Days   []UsageDay   `json:"days"`
+	Tokens []UsageToken `json:"tokens"`
+}
+
+// The UsageModel type records the API usage of each user, as counts per user per token
+// per day in the api_usage table.
+type UsageModel struct {
+	DB *sql.DB
+}
+
+// Add adds usage counts to the counts for the day containing at. The rate-limited
+// requests are keyed by the hash of the token they were sent with (see HashToken()), as
+// the rate limiter turns them away before they're authenticated; the ones whose token
+// doesn't exist are dropped.
+func (m UsageModel) Add(counts map[UsageKey]UsageCounts, rateLimited map[string]int64, at time.Time) error {
+	if len(counts) == 0 && len(rateLimited) == 0 {
+		return nil
+	}
+	day := at.UTC().Truncate(24 * time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if len(counts) > 0 {
+		var userIDs, tokenIDs, requests, errs, limited, bytesIn, bytesOut []int64
+		var apiKeys []bool
+		for key, c := range counts {
+			userIDs = append(userIDs, key.UserID)
+			tokenIDs = append(tokenIDs, key.TokenID)
+			requests = append(requests, c.Requests)
+			errs = append(errs, c.Errors)
+			limited = append(limited, c.RateLimited)
+			bytesIn = append(bytesIn, c.BytesIn)
+			bytesOut = append(bytesOut, c.BytesOut)
+			apiKeys = append(apiKeys, key.APIKey)
+		}
+		query := `
+			INSERT INTO api_usage (user_id, token_id, day, requests, errors, rate_limited, bytes_in, bytes_out, api_key)
+			SELECT t.user_id, t.token_id, $9, t.requests, t.errors, t.rate_limited, t.bytes_in, t.bytes_out, t.api_key
+			FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::bigint[], $5::bigint[], $6::bigint[], $7::bigint[], $8::boolean[])
+				AS t(user_id, token_id, requests, errors, rate_limited, bytes_in, bytes_out, api_key)
+			JOIN users ON users.id = t.user_id
+			ON CONFLICT (user_id, day, token_id) DO UPDATE SET
+				requests = api_usage.requests + EXCLUDED.requests,
+				errors = api_usage.errors + EXCLUDED.errors,
+				rate_limited = api_usage.rate_limited + EXCLUDED.rate_limited,
+				bytes_in = api_usage.bytes_in + EXCLUDED.bytes_in,
+				bytes_out = api_usage.bytes_out + EXCLUDED.bytes_out,
+				api_key = api_usage.api_key OR EXCLUDED.api_key`
+		_, err = tx.ExecContext(ctx, query, pq.Array(userIDs), pq.Array(tokenIDs), pq.Array(requests), pq.Array(errs), pq.Array(limited), pq.Array(bytesIn), pq.Array(bytesOut), pq.Array(apiKeys), day)
+		if err != nil {
+			return err
+		}
+	}
+	if len(rateLimited) > 0 {
+		hashes := make([][]byte, 0, len(rateLimited))
+		limited := make([]int64, 0, len(rateLimited))
+		for hash, n := range rateLimited {
+			hashes = append(hashes, []byte(hash))
+			limited = append(limited, n)
+		}
+		query := `
+			INSERT INTO api_usage (user_id, token_id, day, rate_limited, api_key)
+			SELECT tokens.user_id, tokens.id, $3, t.rate_limited, tokens.scope = $4
+			FROM unnest($1::bytea[], $2::bigint[]) AS t(hash, rate_limited)
+			JOIN tokens ON tokens.hash = t.hash
+			ON CONFLICT (user_id, day, token_id) DO UPDATE SET
+				rate_limited = api_usage.rate_limited + EXCLUDED.rate_limited,
+				api_key = api_usage.api_key OR EXCLUDED.api_key`
+		_, err = tx.ExecContext(ctx, query, pq.ByteaArray(hashes), pq.Array(limited), day, ScopeAPIKey)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetForUser returns a user's usage since the start of the day containing since.
+func (m UsageModel) GetForUser(userID int64, since time.Time) (*Usage, error) {
+	since = since.UTC().Truncate(24 * time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	usage := &Usage{Days: []UsageDay{}, Tokens: []UsageToken{}}
+	query := `
+		SELECT day, sum(requests), sum(errors), sum(rate_limited), sum(bytes_in), sum(bytes_out)
+		FROM api_usage
+		WHERE user_id = $1 AND day >= $2
+		GROUP BY day
+		ORDER BY day`
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day time.Time
+		var d UsageDay
+		err := rows.Scan(&day, &d.Requests, &d.Errors, &d.RateLimited, &d.BytesIn, &d.BytesOut)
+		if err != nil {
+			return nil, err
+		}
+		d.Day = day.Format("2006-01-02")
+		usage.Totals.add(d.UsageCounts)
+		usage.Days = append(usage.Days, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	query = `
+		SELECT api_usage.token_id, coalesce(tokens.name, ''), coalesce(tokens.scope, ''),
+			sum(api_usage.requests), sum(api_usage.errors), sum(api_usage.rate_limited),
+			sum(api_usage.bytes_in), sum(api_usage.bytes_out)
+		FROM api_usage
+		LEFT JOIN tokens ON tokens.id = api_usage.token_id
+		WHERE api_usage.user_id = $1 AND api_usage.day >= $2
+		GROUP BY api_usage.token_id, tokens.name, tokens.scope
+		ORDER BY sum(api_usage.requests) DESC, api_usage.token_id`
+	tokenRows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer tokenRows.Close()
+	for tokenRows.Next() {
+		var t UsageToken
+		err := tokenRows.Scan(&t.TokenID, &t.Name, &t.Type, &t.Requests, &t.Errors, &t.RateLimited, &t.BytesIn, &t.BytesOut)
+		if err != nil {
+			return nil, err
+		}
+		usage.Tokens = append(usage.Tokens, t)
+	}
+	if err = tokenRows.Err(); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Prune deletes the usage counts for the days before the one containing before.
+func (m UsageModel) Prune(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, "DELETE FROM api_usage WHERE day < $1", before.UTC().Truncate(24*time.Hour))
+	return err
+}
+
+// sortUsageTokens sorts the per-token usage in the same order as GetForUser() does.
+func sortUsageTokens(tokens []UsageToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Requests != tokens[j].Requests {
+			return tokens[i].Requests > tokens[j].Requests
+		}
+		return tokens[i].TokenID < tokens[j].TokenID
+	})
+}
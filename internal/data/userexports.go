@@ -0,0 +1,69 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The UserExport type is an archive of a user's data, made for them to download.
+type UserExport struct {
+	ID        int64
+	UserID    int64
+	CreatedAt time.Time
+	Expiry    time.Time
+	Archive   []byte
+}
+
+// The UserExportModel type stores the archives made by user data exports in the user_exports
+// table until they expire. Each user only has one at a time.
+type UserExportModel struct {
+	DB *sql.DB
+}
+
+// Insert stores an export, replacing the user's previous one (if any), and sets its ID
+// and creation time.
+func (m UserExportModel) Insert(export *UserExport) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_exports WHERE user_id = $1", export.UserID)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO user_exports (user_id, expiry, archive)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, export.UserID, export.Expiry, export.Archive).Scan(&export.ID, &export.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get returns an export which hasn't expired, or ErrRecordNotFound.
+func (m UserExportModel) Get(id int64) (*UserExport, error) {
+	query := `
+		SELECT id, user_id, created_at, expiry, archive
+		FROM user_exports
+		WHERE id = $1 AND expiry > $2`
+	return queryOne(m.DB, 10*time.Second, func(row rowScanner, export *UserExport) error {
+		return row.Scan(&export.ID, &export.UserID, &export.CreatedAt, &export.Expiry, &export.Archive)
+	}, query, id, time.Now())
+}
+
+// DeleteExpired deletes the exports which have expired, and returns how many there were.
+func (m UserExportModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, "DELETE FROM user_exports WHERE expiry <= $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,11 +2,12 @@ package data
 
 import (
 	"context" // New import
-	"crypto/sha256"
 	"database/sql" // New import
+	"encoding/json"
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"greenlight.alexedwards.net/internal/validator"
 )
@@ -19,13 +20,15 @@ var (
 // Declare a new AnonymousUser variable.
 var AnonymousUser = &User{}
 type User struct {
-    ID        int64     `json:"id"`
-    CreatedAt time.Time `json:"created_at"`
-    Name      string    `json:"name"`
-    Email     string    `json:"email"`
-    Password  password  `json:"-"`
-    Activated bool      `json:"activated"`
-    Version   int       `json:"-"`
+    ID          int64       `json:"id"`
+    CreatedAt   time.Time   `json:"created_at"`
+    Name        string      `json:"name"`
+    Email       string      `json:"email"`
+    Password    password    `json:"-"`
+    Activated   bool        `json:"activated"`
+    Version     int         `json:"-"`
+    // Preferences is only loaded by GetWithToken(), for the authenticated user.
+    Preferences Preferences `json:"-"`
 }
 // Check if a User instance is the AnonymousUser.
 func (u *User) IsAnonymous() bool {
@@ -39,10 +42,11 @@ type password struct {
     plaintext *string
     hash      []byte
 }
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method calculates the hash of a plaintext password (with bcrypt or Argon2id,
+// depending on the PasswordHashing settings), and stores both the hash and the
+// plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-    hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+    hash, err := hashPassword(plaintextPassword)
     if err != nil {
         return err
     }
@@ -54,6 +58,9 @@ func (p *password) Set(plaintextPassword string) error {
 // hashed password stored in the struct, returning true if it matches and false
 // otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
+    if isArgon2Hash(p.hash) {
+        return matchesArgon2(p.hash, plaintextPassword)
+    }
     err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
     if err != nil {
         switch {
@@ -98,6 +105,19 @@ func ValidateUser(v *validator.Validator, user *User) {
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
 	DB *sql.DB
+	// tenantID is the tenant that the model is scoped to (see Models.ForTenant()), or
+	// zero if it sees the users of every tenant.
+	tenantID int64
+}
+
+func (m UserModel) forTenant(tenantID int64) any {
+	return UserModel{DB: m.DB, tenantID: tenantID}
+}
+
+// duplicateEmail reports whether an error is the violation of the constraint which
+// makes email addresses unique within a tenant.
+func duplicateEmail(err error) bool {
+	return err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`
 }
 // Insert a new record in the database for the user. Note that the id, created_at and
 // version fields are all automatically generated by our database, so we use the
@@ -105,20 +125,20 @@ type UserModel struct {
 // that we did when creating a movie.
 func (m UserModel) Insert(user *User) error {
 	query := `
-			INSERT INTO users (name, email, password_hash, activated)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO users (name, email, password_hash, activated, tenant_id)
+			VALUES ($1, $2, $3, $4, $5)
 			RETURNING id, created_at, version`
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, insertTenant(m.tenantID)}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	// If the table already contains a record with this email address, then when we try
-	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
-	// constraint that we set up in the previous chapter. We check for this error
-	// specifically, and return custom ErrDuplicateEmail error instead.
+	// If the tenant already has a user with this email address, then when we try to
+	// perform the insert there will be a violation of the UNIQUE
+	// "users_tenant_id_email_key" constraint. We check for this error specifically, and
+	// return custom ErrDuplicateEmail error instead.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 			switch {
-			case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			case duplicateEmail(err):
 					return ErrDuplicateEmail
 			default:
 					return err
@@ -127,17 +147,47 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 // Retrieve the User details from the database based on the user's email address.
-// Because we have a UNIQUE constraint on the email column, this SQL query will only
-// return one record (or none at all, in which case we return a ErrRecordNotFound error).
+// Because email addresses are unique within a tenant, this SQL query will only return
+// one record (or none at all, in which case we return a ErrRecordNotFound error) for a
+// scoped model.
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
 			SELECT id, created_at, name, email, password_hash, activated, version
 			FROM users
-			WHERE email = $1`
+			WHERE email = $1 AND deleted_at IS NULL AND ($2 = 0 OR tenant_id = $2)`
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.DB.QueryRowContext(ctx, query, email, m.tenantID).Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+	)
+	if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+					return nil, ErrRecordNotFound
+			default:
+					return nil, err
+			}
+	}
+	return &user, nil
+}
+// Get retrieves the details of a user by their ID. It is used to authenticate requests
+// with a JWT, which identifies the user directly rather than through a token record.
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+			SELECT id, created_at, name, email, password_hash, activated, version
+			FROM users
+			WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR tenant_id = $2)`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id, m.tenantID).Scan(
 			&user.ID,
 			&user.CreatedAt,
 			&user.Name,
@@ -158,14 +208,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
-// when updating a movie. And we also check for a violation of the "users_email_key"
-// constraint when performing the update, just like we did when inserting the user
+// when updating a movie. And we also check for a violation of the
+// "users_tenant_id_email_key" constraint when performing the update, just like we did when inserting the user
 // record originally.
 func (m UserModel) Update(user *User) error {
 	query := `
 			UPDATE users
 			SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			WHERE id = $5 AND version = $6
+			WHERE id = $5 AND version = $6 AND deleted_at IS NULL AND ($7 = 0 OR tenant_id = $7)
 			RETURNING version`
 	args := []interface{}{
 			user.Name,
@@ -174,13 +224,14 @@ func (m UserModel) Update(user *User) error {
 			user.Activated,
 			user.ID,
 			user.Version,
+			m.tenantID,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 			switch {
-			case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			case duplicateEmail(err):
 					return ErrDuplicateEmail
 				case errors.Is(err, sql.ErrNoRows):
 						return ErrEditConflict
@@ -193,8 +244,7 @@ func (m UserModel) Update(user *User) error {
 
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	// Remember that this returns a byte *array* with length 32, not a slice.
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	tokenHash := hashTokenPlaintext(tokenPlaintext)
 	// Set up the SQL query.
 	query := `
 			SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
@@ -203,12 +253,12 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			ON users.id = tokens.user_id
 			WHERE tokens.hash = $1
 			AND tokens.scope = $2
-			AND tokens.expiry > $3`
-	// Create a slice containing the query arguments. Notice how we use the [:] operator
-	// to get a slice containing the token hash, rather than passing in the array (which
-	// is not supported by the pq driver), and that we pass the current time as the
-	// value to check against the token expiry.
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+			AND tokens.expiry > $3
+			AND users.deleted_at IS NULL
+			AND ($4 = 0 OR users.tenant_id = $4)`
+	// Create a slice containing the query arguments. Notice that we pass the current
+	// time as the value to check against the token expiry.
+	args := []interface{}{tokenHash, tokenScope, time.Now(), m.tenantID}
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -233,4 +283,61 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	}
 	// Return the matching user.
 	return &user, nil
+}
+// GetWithToken() is like GetForToken(), but it accepts a token with any of the given
+// scopes, and returns the token (without its plaintext) along with the user. It's used
+// to authenticate requests, which can use an authentication token or an API key, and
+// need to know what the token has been restricted to.
+func (m UserModel) GetWithToken(tokenPlaintext string, tokenScopes ...string) (*User, *Token, error) {
+	tokenHash := hashTokenPlaintext(tokenPlaintext)
+	query := `
+			SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.preferences,
+				tokens.id, tokens.created_at, tokens.name, tokens.scope, tokens.expiry, tokens.permissions, tokens.last_used_at
+			FROM users
+			INNER JOIN tokens
+			ON users.id = tokens.user_id
+			WHERE tokens.hash = $1
+			AND tokens.scope = ANY($2)
+			AND tokens.expiry > $3
+			AND users.deleted_at IS NULL
+			AND ($4 = 0 OR users.tenant_id = $4)`
+	args := []interface{}{tokenHash, pq.Array(tokenScopes), time.Now(), m.tenantID}
+	var user User
+	token := Token{Hash: tokenHash}
+	var lastUsedAt sql.NullTime
+	var preferences []byte
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&preferences,
+			&token.ID,
+			&token.CreatedAt,
+			&token.Name,
+			&token.Scope,
+			&token.Expiry,
+			pq.Array(&token.Permissions),
+			&lastUsedAt,
+	)
+	if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+					return nil, nil, ErrRecordNotFound
+			default:
+					return nil, nil, err
+			}
+	}
+	err = json.Unmarshal(preferences, &user.Preferences)
+	if err != nil {
+			return nil, nil, err
+	}
+	token.UserID = user.ID
+	token.LastUsedAt = lastUsedAt.Time
+	return &user, &token, nil
 }
\ No newline at end of file
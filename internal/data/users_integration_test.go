@@ -0,0 +1,447 @@
+//go:build integration
+
+package data
+
+import (
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+// insertTestUser inserts an activated user with the password pa55word1234, failing the
+// test if it can't.
+func insertTestUser(t *testing.T, models Models, email string) *User {
+	t.Helper()
+	// The lowest bcrypt cost keeps the tests quick.
+	hashing := PasswordHashing
+	PasswordHashing.BcryptCost = 4
+	t.Cleanup(func() { PasswordHashing = hashing })
+	user := &User{Name: "Test User", Email: email, Activated: true}
+	err := user.Password.Set("pa55word1234")
+	assert.NilError(t, err)
+	err = models.Users.Insert(user)
+	assert.NilError(t, err)
+	return user
+}
+
+func TestUserModelInsertAndGet(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	assert.Equal(t, user.ID, int64(1))
+	assert.Equal(t, user.Version, 1)
+
+	got, err := models.Users.Get(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Email, "alice@example.com")
+	assert.Equal(t, got.Activated, true)
+	matches, err := got.Password.Matches("pa55word1234")
+	assert.NilError(t, err)
+	assert.Equal(t, matches, true)
+	_, err = models.Users.Get(99)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	got, err = models.Users.GetByEmail("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, got.ID, user.ID)
+	_, err = models.Users.GetByEmail("bob@example.com")
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	duplicate := &User{Name: "Alice", Email: "alice@example.com"}
+	err = duplicate.Password.Set("pa55word1234")
+	assert.NilError(t, err)
+	err = models.Users.Insert(duplicate)
+	assert.Equal(t, err, ErrDuplicateEmail)
+}
+
+func TestUserModelUpdate(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	insertTestUser(t, models, "bob@example.com")
+	stale := *user
+
+	user.Name = "Alice"
+	err := models.Users.Update(user)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Version, 2)
+	got, err := models.Users.Get(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Name, "Alice")
+
+	stale.Name = "Mallory"
+	err = models.Users.Update(&stale)
+	assert.Equal(t, err, ErrEditConflict)
+
+	user.Email = "bob@example.com"
+	err = models.Users.Update(user)
+	assert.Equal(t, err, ErrDuplicateEmail)
+}
+
+func TestUserModelTokens(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	err := models.Users.UpdatePreferences(user.ID, Preferences{Timezone: "Europe/London", PageSize: 50})
+	assert.NilError(t, err)
+	err = models.Users.UpdatePreferences(99, Preferences{})
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	token, err := models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	expired, err := models.Tokens.New(user.ID, -time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+
+	got, err := models.Users.GetForToken(ScopeAuthentication, token.Plaintext)
+	assert.NilError(t, err)
+	assert.Equal(t, got.ID, user.ID)
+	_, err = models.Users.GetForToken(ScopeActivation, token.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, err = models.Users.GetForToken(ScopeAuthentication, expired.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	got, gotToken, err := models.Users.GetWithToken(token.Plaintext, ScopeAuthentication, ScopeAPIKey)
+	assert.NilError(t, err)
+	assert.Equal(t, got.ID, user.ID)
+	assert.Equal(t, got.Preferences, Preferences{Timezone: "Europe/London", PageSize: 50})
+	assert.Equal(t, gotToken.ID, token.ID)
+	assert.Equal(t, gotToken.Scope, ScopeAuthentication)
+	_, _, err = models.Users.GetWithToken(token.Plaintext, ScopeAPIKey)
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, _, err = models.Users.GetWithToken(expired.Plaintext, ScopeAuthentication)
+	assert.Equal(t, err, ErrRecordNotFound)
+}
+
+func TestUserModelDeletion(t *testing.T) {
+	models, db := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	token, err := models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	err = models.SecurityEvents.Insert(&SecurityEvent{Event: "login_failed", UserID: user.ID, Email: user.Email, IP: "192.0.2.1"})
+	assert.NilError(t, err)
+
+	err = models.Users.RequestDeletion(user.ID)
+	assert.NilError(t, err)
+	_, err = models.Users.Get(user.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, err = models.Users.GetForToken(ScopeAuthentication, token.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Users.RequestDeletion(user.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	ids, err := models.Users.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(ids), 0)
+	ids, err = models.Users.PurgeDeleted(time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, ids, []int64{user.ID})
+
+	// The security events are kept, without the personal data.
+	var email, ip string
+	err = db.QueryRow("SELECT email, ip FROM security_events").Scan(&email, &ip)
+	assert.NilError(t, err)
+	assert.Equal(t, email, "")
+	assert.Equal(t, ip, "")
+}
+
+func TestUserModelActivity(t *testing.T) {
+	models, _ := newTestModels(t)
+	alice := insertTestUser(t, models, "alice@example.com")
+	bob := insertTestUser(t, models, "bob@example.com")
+	err := models.Users.RecordLogin(alice.ID, "192.0.2.1", time.Now().Add(-48*time.Hour))
+	assert.NilError(t, err)
+	err = models.Users.RecordLogin(alice.ID, "192.0.2.2", time.Now().Add(-24*time.Hour))
+	assert.NilError(t, err)
+	err = models.Users.RecordLogin(bob.ID, "192.0.2.3", time.Now())
+	assert.NilError(t, err)
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "-login_count", SortSafelist: []string{"id", "-login_count"}}
+	users, metadata, err := models.Users.GetAllActivity(time.Time{}, filters)
+	assert.NilError(t, err)
+	assert.Equal(t, metadata.TotalRecords, 2)
+	assert.Equal(t, users[0].ID, alice.ID)
+	assert.Equal(t, users[0].LoginCount, 2)
+	assert.Equal(t, users[0].LastLoginIP, "192.0.2.2")
+
+	users, _, err = models.Users.GetAllActivity(time.Now().Add(-time.Hour), filters)
+	assert.NilError(t, err)
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].ID, alice.ID)
+}
+
+func TestUserModelChanges(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+	err := user.Password.Set("pa55word1234")
+	assert.NilError(t, err)
+	err = models.Users.Insert(user)
+	assert.NilError(t, err)
+	user.Activated = true
+	err = models.Users.Update(user)
+	assert.NilError(t, err)
+	user.Name = "Alice Smith"
+	err = models.Users.Update(user)
+	assert.NilError(t, err)
+	// Logins don't change the version, so they aren't changes.
+	err = models.Users.RecordLogin(user.ID, "192.0.2.1", time.Now())
+	assert.NilError(t, err)
+	err = models.Users.RequestDeletion(user.ID)
+	assert.NilError(t, err)
+
+	changes, err := models.Users.Changes(0, 10)
+	assert.NilError(t, err)
+	var operations []string
+	for _, change := range changes {
+		operations = append(operations, change.Operation)
+	}
+	assert.Equal(t, operations, []string{ChangeCreated, ChangeActivated, ChangeUpdated, ChangeDeleted})
+	changes, err = models.Users.Changes(changes[1].ID, 1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 1)
+	assert.Equal(t, changes[0].Operation, ChangeUpdated)
+}
+
+func TestTokenModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	alice := insertTestUser(t, models, "alice@example.com")
+	bob := insertTestUser(t, models, "bob@example.com")
+
+	session, err := models.Tokens.New(alice.ID, time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	apiKey, err := NewToken(alice.ID, time.Hour, ScopeAPIKey)
+	assert.NilError(t, err)
+	apiKey.Name, apiKey.Permissions = "ci", Permissions{"movies:read"}
+	err = models.Tokens.Insert(apiKey)
+	assert.NilError(t, err)
+	_, err = models.Tokens.New(alice.ID, -time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	activation, err := models.Tokens.New(alice.ID, time.Hour, ScopeActivation)
+	assert.NilError(t, err)
+
+	tokens, err := models.Tokens.GetAllForUser(alice.ID, ScopeAuthentication, ScopeAPIKey)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 2)
+	assert.Equal(t, tokens[0].ID, session.ID)
+	assert.Equal(t, tokens[1].Name, "ci")
+	assert.Equal(t, tokens[1].Permissions, Permissions{"movies:read"})
+
+	err = models.Tokens.Touch(session.ID, "192.0.2.1", "curl/8.0")
+	assert.NilError(t, err)
+	tokens, err = models.Tokens.GetAllForUser(alice.ID, ScopeAuthentication)
+	assert.NilError(t, err)
+	assert.Equal(t, tokens[0].IP, "192.0.2.1")
+	assert.Equal(t, tokens[0].UserAgent, "curl/8.0")
+	assert.Equal(t, tokens[0].LastUsedAt.IsZero(), false)
+
+	// Activation tokens can only be used once.
+	userID, err := models.Tokens.Consume(ScopeActivation, activation.Plaintext)
+	assert.NilError(t, err)
+	assert.Equal(t, userID, alice.ID)
+	_, err = models.Tokens.Consume(ScopeActivation, activation.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+	_, err = models.Tokens.Consume(ScopeActivation, session.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	// Users can only delete their own tokens, of the given scopes.
+	err = models.Tokens.DeleteForUser(bob.ID, apiKey.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Tokens.DeleteForUser(alice.ID, apiKey.ID, ScopeAuthentication)
+	assert.Equal(t, err, ErrRecordNotFound)
+	err = models.Tokens.DeleteForUser(alice.ID, apiKey.ID, ScopeAPIKey)
+	assert.NilError(t, err)
+
+	other, err := models.Tokens.New(alice.ID, time.Hour, ScopeAuthentication)
+	assert.NilError(t, err)
+	count, err := models.Tokens.DeleteAllForUserExcept(ScopeAuthentication, alice.ID, other.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(2))
+	tokens, err = models.Tokens.GetAllForUser(alice.ID, ScopeAuthentication)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 1)
+	assert.Equal(t, tokens[0].ID, other.ID)
+
+	err = models.Tokens.DeleteAllForUser(ScopeAuthentication, alice.ID)
+	assert.NilError(t, err)
+	tokens, err = models.Tokens.GetAllForUser(alice.ID, ScopeAuthentication)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 0)
+}
+
+func TestPermissionAndRoleModels(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+
+	permissions, err := models.Permissions.GetAllForUser(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(permissions), 0)
+	err = models.Permissions.AddForUser(user.ID, "movies:read", "no-such-permission")
+	assert.NilError(t, err)
+	err = models.Permissions.AddForUser(user.ID, "movies:read")
+	assert.NilError(t, err)
+	permissions, err = models.Permissions.GetAllForUser(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, permissions, Permissions{"movies:read"})
+
+	roles, err := models.Roles.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(roles), 3)
+	assert.Equal(t, roles[0].Name, RoleAdmin)
+	assert.Equal(t, roles[0].Permissions, Permissions{"movies:read", "movies:write"})
+
+	err = models.Roles.AddForUser(user.ID, RoleEditor)
+	assert.NilError(t, err)
+	err = models.Roles.AddForUser(user.ID, RoleEditor)
+	assert.NilError(t, err)
+	err = models.Roles.AddForUser(user.ID, "no-such-role")
+	assert.Equal(t, err, ErrRecordNotFound)
+	names, err := models.Roles.GetAllForUser(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, names, []string{RoleEditor})
+	// The user has the permissions of their roles, as well as their own.
+	permissions, err = models.Permissions.GetAllForUser(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, permissions, Permissions{"movies:read", "movies:write"})
+
+	err = models.Roles.RemoveForUser(user.ID, RoleEditor)
+	assert.NilError(t, err)
+	err = models.Roles.RemoveForUser(user.ID, RoleEditor)
+	assert.Equal(t, err, ErrRecordNotFound)
+	names, err = models.Roles.GetAllForUser(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(names), 0)
+}
+
+func TestSecurityEventModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	for _, event := range []string{"login_failed", "login_succeeded", "password_changed"} {
+		err := models.SecurityEvents.Insert(&SecurityEvent{Event: event, UserID: user.ID, IP: "192.0.2.1", Properties: map[string]string{"user_agent": "curl/8.0"}})
+		assert.NilError(t, err)
+	}
+	err := models.SecurityEvents.Insert(&SecurityEvent{Event: "login_failed", Email: "nobody@example.com"})
+	assert.NilError(t, err)
+
+	events, err := models.SecurityEvents.GetAllForUser(user.ID, 2)
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Event, "password_changed")
+	assert.Equal(t, events[1].Event, "login_succeeded")
+	assert.Equal(t, events[0].Properties, map[string]string{"user_agent": "curl/8.0"})
+}
+
+func TestUserExportModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	user := insertTestUser(t, models, "alice@example.com")
+	first := &UserExport{UserID: user.ID, Expiry: time.Now().Add(time.Hour), Archive: []byte("first")}
+	err := models.UserExports.Insert(first)
+	assert.NilError(t, err)
+	// A user only has one export at a time.
+	second := &UserExport{UserID: user.ID, Expiry: time.Now().Add(time.Hour), Archive: []byte("second")}
+	err = models.UserExports.Insert(second)
+	assert.NilError(t, err)
+	_, err = models.UserExports.Get(first.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	got, err := models.UserExports.Get(second.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Archive, []byte("second"))
+
+	other := insertTestUser(t, models, "bob@example.com")
+	expired := &UserExport{UserID: other.ID, Expiry: time.Now().Add(-time.Hour), Archive: []byte("expired")}
+	err = models.UserExports.Insert(expired)
+	assert.NilError(t, err)
+	_, err = models.UserExports.Get(expired.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	count, err := models.UserExports.DeleteExpired()
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(1))
+}
+
+func TestInviteModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	admin := insertTestUser(t, models, "admin@example.com")
+	invite, err := NewInvite(admin.ID, time.Hour, 2, "beta testers")
+	assert.NilError(t, err)
+	err = models.Invites.Insert(invite)
+	assert.NilError(t, err)
+	expired, err := NewInvite(0, -time.Hour, 1, "")
+	assert.NilError(t, err)
+	err = models.Invites.Insert(expired)
+	assert.NilError(t, err)
+
+	invites, err := models.Invites.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(invites), 2)
+	assert.Equal(t, invites[0].ID, expired.ID)
+	assert.Equal(t, invites[1].CreatedBy, admin.ID)
+	assert.Equal(t, invites[1].Note, "beta testers")
+
+	for i := 0; i < 2; i++ {
+		id, err := models.Invites.Consume(invite.Plaintext)
+		assert.NilError(t, err)
+		assert.Equal(t, id, invite.ID)
+	}
+	_, err = models.Invites.Consume(invite.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+	// Releasing a use (when the registration it was for fails) makes it available again.
+	err = models.Invites.Release(invite.ID)
+	assert.NilError(t, err)
+	_, err = models.Invites.Consume(invite.Plaintext)
+	assert.NilError(t, err)
+	_, err = models.Invites.Consume(expired.Plaintext)
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	err = models.Invites.Delete(invite.ID)
+	assert.NilError(t, err)
+	err = models.Invites.Delete(invite.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+}
+
+func TestTenantModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	tenant, err := models.Tenants.GetBySlug(DefaultTenantSlug)
+	assert.NilError(t, err)
+	assert.Equal(t, tenant.ID, int64(DefaultTenantID))
+
+	acme := &Tenant{Slug: "acme", Name: "Acme"}
+	err = models.Tenants.Insert(acme)
+	assert.NilError(t, err)
+	err = models.Tenants.Insert(&Tenant{Slug: "acme", Name: "Acme again"})
+	assert.Equal(t, err, ErrDuplicateSlug)
+	got, err := models.Tenants.GetBySlug("acme")
+	assert.NilError(t, err)
+	assert.Equal(t, got.ID, acme.ID)
+	_, err = models.Tenants.GetBySlug("no-such-tenant")
+	assert.Equal(t, err, ErrRecordNotFound)
+
+	// Models scoped to a tenant only see its movies and users, and the same email address
+	// can be registered in each tenant.
+	scoped := models.ForTenant(acme.ID)
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	insertTestMovies(t, scoped, movie)
+	insertTestMovies(t, models, &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	_, err = models.ForTenant(DefaultTenantID).Movies.Get(movie.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+	got2, err := scoped.Movies.Get(movie.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, got2.Title, "Moana")
+	insertTestUser(t, models, "alice@example.com")
+	user := insertTestUser(t, scoped, "alice@example.com")
+	_, err = models.ForTenant(DefaultTenantID).Users.Get(user.ID)
+	assert.Equal(t, err, ErrRecordNotFound)
+}
+
+func TestEventCursorModel(t *testing.T) {
+	models, _ := newTestModels(t)
+	position, err := models.EventCursors.Get("movies")
+	assert.NilError(t, err)
+	assert.Equal(t, position, int64(0))
+	position, err = models.EventCursors.Get("no-such-feed")
+	assert.NilError(t, err)
+	assert.Equal(t, position, int64(0))
+
+	err = models.EventCursors.Set("movies", 42)
+	assert.NilError(t, err)
+	err = models.EventCursors.Set("movies", 43)
+	assert.NilError(t, err)
+	position, err = models.EventCursors.Get("movies")
+	assert.NilError(t, err)
+	assert.Equal(t, position, int64(43))
+}
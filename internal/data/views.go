@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TrendingWindows are the windows that trending movies are ranked over, keyed by the
+// names used in the API.
+var TrendingWindows = map[string]time.Duration{
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// TrendingSize is the number of movies kept in the ranking for each trending window.
+const TrendingSize = 100
+
+// ViewsRetention returns how long view counts are needed for: the longest of the
+// TrendingWindows, plus the hour that a window may start in the middle of.
+func ViewsRetention() time.Duration {
+	var longest time.Duration
+	for _, window := range TrendingWindows {
+		if window > longest {
+			longest = window
+		}
+	}
+	return longest + time.Hour
+}
+
+// The TrendingMovie type is a movie returned by Trending(), with the number of times
+// it was viewed within the window.
+type TrendingMovie struct {
+	Movie
+	Views int64 `json:"views"`
+}
+
+// The ViewModel type records how many times movies are viewed, and ranks the movies
+// which have been viewed the most recently. Views are stored as counts per movie per
+// hour in the movie_views table, and the rankings are worked out from them by
+// Aggregate() into the movie_trending table, so that reading them is cheap.
+type ViewModel struct {
+	DB *sql.DB
+	// tenantID is the tenant whose rankings Trending() returns (see Models.ForTenant()),
+	// or zero for the movies of every tenant.
+	tenantID int64
+}
+
+func (m ViewModel) forTenant(tenantID int64) any {
+	return ViewModel{DB: m.DB, tenantID: tenantID}
+}
+
+// Add adds view counts for a number of movies to the counts for the hour containing
+// at, in a single statement. Counts for movies which have been deleted are dropped.
+func (m ViewModel) Add(counts map[int64]int64, at time.Time) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(counts))
+	views := make([]int64, 0, len(counts))
+	for id, n := range counts {
+		ids = append(ids, id)
+		views = append(views, n)
+	}
+	query := `
+		INSERT INTO movie_views (movie_id, hour, views)
+		SELECT t.id, $3, t.views
+		FROM unnest($1::bigint[], $2::bigint[]) AS t(id, views)
+		JOIN movies ON movies.id = t.id AND movies.deleted_at IS NULL
+		ON CONFLICT (movie_id, hour) DO UPDATE SET views = movie_views.views + EXCLUDED.views`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(views), at.UTC().Truncate(time.Hour))
+	return err
+}
+
+// Aggregate works out the rankings for each of the TrendingWindows again from the view
+// counts. The counts which are too old to be in any of the windows are archived with
+// the partition for their month (see PartitionModel), rather than deleted here. Each
+// tenant gets its own ranking of up to TrendingSize movies. The
+// rankings are replaced in a transaction, so readers never see a partial ranking, and
+// running it on several instances at once is safe (if wasteful).
+func (m ViewModel) Aggregate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for period, window := range TrendingWindows {
+		_, err = tx.ExecContext(ctx, "DELETE FROM movie_trending WHERE period = $1", period)
+		if err != nil {
+			return err
+		}
+		query := `
+			INSERT INTO movie_trending (period, movie_id, views)
+			SELECT $1, movie_id, views
+			FROM (
+				SELECT movie_id, sum(views) AS views,
+					row_number() OVER (PARTITION BY movies.tenant_id ORDER BY sum(views) DESC, movie_id) AS rank
+				FROM movie_views
+				JOIN movies ON movies.id = movie_views.movie_id AND movies.deleted_at IS NULL
+				WHERE hour >= $2
+				GROUP BY movie_id, movies.tenant_id
+			) ranked
+			WHERE rank <= $3`
+		_, err = tx.ExecContext(ctx, query, period, time.Now().Add(-window), TrendingSize)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Trending returns up to limit of the most viewed movies in a trending window, as of the
+// last time that Aggregate() ran.
+func (m ViewModel) Trending(period string, limit int) ([]*TrendingMovie, error) {
+	query := `
+		SELECT movies.id, movies.created_at, title, year, runtime, genres, attributes, version, movie_trending.views
+		FROM movie_trending
+		JOIN movies ON movies.id = movie_trending.movie_id AND movies.deleted_at IS NULL
+		WHERE movie_trending.period = $1 AND ($3 = 0 OR movies.tenant_id = $3)
+		ORDER BY movie_trending.views DESC, movies.id
+		LIMIT $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, period, limit, m.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	movies := []*TrendingMovie{}
+	for rows.Next() {
+		var movie TrendingMovie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Attributes,
+			&movie.Version,
+			&movie.Views,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
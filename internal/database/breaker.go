@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrCircuitOpen is returned instead of running a query while the circuit breaker is
+// open, because the database has been failing.
+var ErrCircuitOpen = errors.New("database: circuit breaker is open")
+
+// The breaker type is a circuit breaker for the connection pool. It opens after
+// Options.BreakerThreshold consecutive failures which suggest the database is down or
+// overloaded (connection errors and timeouts, rather than errors like constraint
+// violations, which prove the database is up), and then every query fails straight away
+// with ErrCircuitOpen. Once Options.BreakerCooldown has passed the breaker is half-open:
+// queries still fail, but a probe connection is made in the background, and the breaker
+// closes again if the probe succeeds or waits for another cooldown if it doesn't.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(open bool)
+	probe     func(ctx context.Context) error
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns ErrCircuitOpen if queries shouldn't be run, and starts a probe if it's
+// time for one.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if !b.probing && time.Since(b.openedAt) >= b.cooldown {
+		b.probing = true
+		go b.runProbe()
+	}
+	return ErrCircuitOpen
+}
+
+func (b *breaker) runProbe() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := b.probe(ctx)
+	b.mu.Lock()
+	b.probing = false
+	if err != nil {
+		b.openedAt = time.Now()
+		b.mu.Unlock()
+		return
+	}
+	b.open = false
+	b.failures = 0
+	b.mu.Unlock()
+	if b.onChange != nil {
+		b.onChange(false)
+	}
+}
+
+// record counts the result of a query towards opening the breaker.
+func (b *breaker) record(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		// A cancelled query says nothing about the database, as it's usually the client
+		// that went away.
+		return
+	}
+	b.mu.Lock()
+	if !unavailable(err) {
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.failures++
+	opened := !b.open && b.failures >= b.threshold
+	if opened {
+		b.open = true
+		b.openedAt = time.Now()
+	}
+	b.mu.Unlock()
+	if opened && b.onChange != nil {
+		b.onChange(true)
+	}
+}
+
+// unavailable reports whether an error from the driver means that the database couldn't
+// be reached or didn't answer in time.
+func unavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection exceptions, 53300 is too_many_connections and 57P01-3
+		// are the server shutting down or starting up.
+		code := string(pqErr.Code)
+		return strings.HasPrefix(code, "08") || code == "53300" || strings.HasPrefix(code, "57P0")
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
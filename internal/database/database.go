@@ -0,0 +1,219 @@
+// Package database opens PostgreSQL connection pools whose connections are instrumented,
+// so that the application can find out about slow queries without any changes to the
+// models, and which can be guarded by a circuit breaker.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The Query type describes a single query which has completed.
+type Query struct {
+	SQL      string
+	Args     []interface{}
+	Duration time.Duration
+}
+
+// The Options type holds the settings for an instrumented connection pool.
+type Options struct {
+	// SlowThreshold is the duration above which a query is considered slow. If it is
+	// zero, then slow queries aren't reported.
+	SlowThreshold time.Duration
+	// OnSlow is called after every slow query. It's called synchronously by the
+	// goroutine that ran the query, so it should return quickly.
+	OnSlow func(q Query)
+	// OnQuery, if set, is called after every query, whether it's slow or not. It's meant
+	// for debug logging, and is called synchronously in the same way as OnSlow.
+	OnQuery func(q Query)
+	// BreakerThreshold is the number of consecutive failures after which the circuit
+	// breaker opens. If it is zero, then there's no circuit breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before probing the database.
+	BreakerCooldown time.Duration
+	// OnBreakerChange, if set, is called when the breaker opens or closes.
+	OnBreakerChange func(open bool)
+}
+
+// Open returns a new connection pool for the given DSN using the pq driver, with every
+// connection wrapped so that its queries are timed. Statements which are prepared
+// explicitly with Prepare() (such as pq.CopyIn() statements) aren't timed. Like
+// sql.Open(), this doesn't actually connect to the database.
+func Open(dsn string, opts Options) (*sql.DB, error) {
+	base, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c := &connector{base: base, opts: opts}
+	if opts.BreakerThreshold > 0 {
+		c.breaker = &breaker{
+			threshold: opts.BreakerThreshold,
+			cooldown:  opts.BreakerCooldown,
+			onChange:  opts.OnBreakerChange,
+			probe:     c.probe,
+		}
+	}
+	return sql.OpenDB(c), nil
+}
+
+// The connector type wraps the connections from another driver.Connector.
+type connector struct {
+	base    driver.Connector
+	opts    Options
+	breaker *breaker
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	cn, err := c.base.Connect(ctx)
+	c.breaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: cn, opts: c.opts, breaker: c.breaker}, nil
+}
+
+// probe makes a new connection straight to the database and pings it, bypassing the
+// breaker and the pool, to find out whether the database is back.
+func (c *connector) probe(ctx context.Context) error {
+	cn, err := c.base.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+	if p, ok := cn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.base.Driver()
+}
+
+// The conn type wraps a pq connection. The pq connection implements all of the optional
+// interfaces below, but we check anyway, so that database/sql can fall back to its
+// defaults if a future version doesn't.
+type conn struct {
+	driver.Conn
+	opts    Options
+	breaker *breaker
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err := b.BeginTx(ctx, opts)
+		c.breaker.record(err)
+		return tx, err
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		err := p.Ping(ctx)
+		c.breaker.record(err)
+		return err
+	}
+	return nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	c.breaker.record(err)
+	c.done(ctx, query, args, time.Since(start))
+	return result, err
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	c.breaker.record(err)
+	if err != nil {
+		c.done(ctx, query, args, time.Since(start))
+		return nil, err
+	}
+	// The query isn't finished until all of the rows have been read, so we time it
+	// until the rows are closed.
+	return &timedRows{Rows: rows, done: func() {
+		c.done(ctx, query, args, time.Since(start))
+	}}, nil
+}
+
+// done reports a query to the OnQuery hook, and to the OnSlow hook if it took longer
+// than the threshold.
+func (c *conn) done(ctx context.Context, query string, args []driver.NamedValue, d time.Duration) {
+	slow := c.opts.SlowThreshold > 0 && c.opts.OnSlow != nil && d >= c.opts.SlowThreshold
+	if !slow && c.opts.OnQuery == nil {
+		return
+	}
+	if ctx.Value(skipKey) != nil {
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	q := Query{SQL: query, Args: values, Duration: d}
+	if c.opts.OnQuery != nil {
+		c.opts.OnQuery(q)
+	}
+	if slow {
+		c.opts.OnSlow(q)
+	}
+}
+
+// The timedRows type wraps driver.Rows, calling done when the rows are closed.
+type timedRows struct {
+	driver.Rows
+	done   func()
+	closed bool
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		r.done()
+	}
+	return err
+}
+
+type contextKey string
+
+// skipKey is the context key used to mark queries which shouldn't be reported, such as
+// the EXPLAIN queries that are run for slow queries.
+const skipKey = contextKey("skip")
+
+// WithoutReporting returns a copy of ctx which stops any queries run with it from
+// being reported to the OnQuery and OnSlow hooks.
+func WithoutReporting(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipKey, true)
+}
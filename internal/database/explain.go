@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrNotExplainable is returned by Explain() for statements which can't be explained,
+// such as COPY or transaction control statements.
+var ErrNotExplainable = errors.New("statement can't be explained")
+
+// Explain runs EXPLAIN (ANALYZE, FORMAT JSON) for a query and returns the plan. Because
+// ANALYZE really executes the statement, it's run inside a transaction which is always
+// rolled back, so explaining an INSERT, UPDATE or DELETE doesn't change any data (or
+// deliver any notifications). It's still extra load on the database though, so use it
+// sparingly.
+func Explain(ctx context.Context, db *sql.DB, query string, args ...interface{}) (json.RawMessage, error) {
+	if !explainable(query) {
+		return nil, ErrNotExplainable
+	}
+	ctx = WithoutReporting(ctx)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var plan []byte
+	err = tx.QueryRowContext(ctx, "EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...).Scan(&plan)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(plan), nil
+}
+
+// explainable returns true if the query is a statement that EXPLAIN accepts.
+func explainable(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "VALUES":
+		return true
+	default:
+		return false
+	}
+}
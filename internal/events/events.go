@@ -0,0 +1,71 @@
+// Package events publishes the lifecycle events of movies and users (like movie.created
+// and user.activated) to a message broker, for other internal services to consume. The
+// events are read from the changes feeds, which are written in the same transactions as
+// the changes themselves (a transactional outbox), by the event relay in cmd/api; this
+// package only delivers them.
+//
+// Delivery is at least once: if publishing fails part way through a batch, the whole
+// batch is published again, so consumers should use the event IDs to skip the events
+// they have already seen.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The Event type is a lifecycle event. The ID is unique and stable across redeliveries,
+// the type is the kind of thing that changed and what happened to it (like
+// "movie.updated"), and the key is the ID of the thing, which brokers that partition
+// their streams (like Kafka) use to keep the events for each movie or user in order.
+// Data is the event's JSON payload.
+type Event struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Stream string          `json:"-"`
+	Key    string          `json:"-"`
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// New returns an event for a change to something in one of the streams ("movies" or
+// "users"), with a payload of data encoded as JSON. The feed and position of the change
+// make up the event ID.
+func New(stream, kind, operation string, position, key int64, at time.Time, data interface{}) (Event, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:     fmt.Sprintf("%s:%d", stream, position),
+		Type:   kind + "." + operation,
+		Stream: stream,
+		Key:    fmt.Sprint(key),
+		Time:   at.UTC(),
+		Data:   js,
+	}, nil
+}
+
+// The Publisher interface is a message broker which events can be published to.
+// Publish() returns once the broker has accepted all of the events, or with an error if
+// it didn't accept them all (in which case some of them may still have been
+// published). Implementations are safe for concurrent use.
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Open returns the publisher for a kind of broker ("nats" or "kafka") at a URL, with
+// subjects or topics named with the prefix.
+func Open(kind, url, prefix string, timeout time.Duration) (Publisher, error) {
+	switch kind {
+	case "nats":
+		return NewNATS(url, prefix, timeout)
+	case "kafka":
+		return NewKafka(url, prefix, timeout)
+	default:
+		return nil, fmt.Errorf("events: unknown publisher %q", kind)
+	}
+}
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The Kafka type publishes events to Kafka through a Kafka REST Proxy (its v2 API),
+// rather than speaking Kafka's own protocol, on a topic for each stream made of the
+// prefix and the stream (like greenlight.movies). The ID of the movie or user is the
+// record key, so all of the events for one of them go to the same partition and stay in
+// order; the record value is the event. Credentials in the URL are sent with basic
+// authentication.
+type Kafka struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+// NewKafka returns a publisher for the REST proxy at an http:// or https:// URL, like
+// http://localhost:8082. Each request to the proxy has to complete within the timeout.
+func NewKafka(rawURL, prefix string, timeout time.Duration) (*Kafka, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("events: unsupported Kafka REST proxy URL scheme %q", u.Scheme)
+	}
+	return &Kafka{
+		url:    strings.TrimSuffix(rawURL, "/"),
+		prefix: prefix,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// The kafkaRecord type is a record in a request to the REST proxy.
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+// Publish produces the events to their topics, one request for each run of events in
+// the same stream, so that the events are produced in order.
+func (p *Kafka) Publish(ctx context.Context, events []Event) error {
+	for len(events) > 0 {
+		n := 1
+		for n < len(events) && events[n].Stream == events[0].Stream {
+			n++
+		}
+		err := p.produce(ctx, p.prefix+"."+events[0].Stream, events[:n])
+		if err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// produce sends events to a topic, and checks that every one of them was written.
+func (p *Kafka) produce(ctx context.Context, topic string, events []Event) error {
+	var body struct {
+		Records []kafkaRecord `json:"records"`
+	}
+	for _, event := range events {
+		body.Records = append(body.Records, kafkaRecord{Key: event.Key, Value: event})
+	}
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/topics/"+url.PathEscape(topic), bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("events: Kafka REST proxy returned %s: %s", res.Status, bytes.TrimSpace(respBody))
+	}
+	var result struct {
+		Offsets []struct {
+			Error *string `json:"error"`
+		} `json:"offsets"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return fmt.Errorf("events: decoding Kafka REST proxy response: %w", err)
+	}
+	if len(result.Offsets) != len(events) {
+		return fmt.Errorf("events: Kafka REST proxy acknowledged %d of %d records", len(result.Offsets), len(events))
+	}
+	for i, offset := range result.Offsets {
+		if offset.Error != nil {
+			return fmt.Errorf("events: producing %s to %s: %s", events[i].ID, topic, *offset.Error)
+		}
+	}
+	return nil
+}
+
+// Close releases the proxy's idle connections.
+func (p *Kafka) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
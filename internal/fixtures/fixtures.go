@@ -0,0 +1,229 @@
+package fixtures
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// A Set holds the records from one or more fixture files. The file format is JSON, and
+// looks like this:
+//
+//	{
+//		"users": [
+//			{
+//				"name": "Alice Smith",
+//				"email": "alice@example.com",
+//				"password": "pa55word1234",
+//				"activated": true,
+//				"roles": ["editor"],
+//				"tokens": [
+//					{"plaintext": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "scope": "authentication", "ttl": "720h"}
+//				]
+//			}
+//		],
+//		"movies": [
+//			{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation", "adventure"]}
+//		]
+//	}
+//
+// Tokens are given in plaintext, so that tests and local development can use known
+// values in their Authorization headers. Users and movies belong to the default tenant,
+// unless they have a "tenant" with the slug of one of the set's "tenants" (or of a
+// tenant which is already in the database):
+//
+//	{
+//		"tenants": [{"slug": "acme", "name": "Acme Films"}],
+//		"movies": [{"tenant": "acme", "title": "Moana", ...}]
+//	}
+type Set struct {
+	Tenants []Tenant `json:"tenants"`
+	Users   []User   `json:"users"`
+	Movies  []Movie  `json:"movies"`
+}
+
+type Tenant struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+type User struct {
+	Tenant      string   `json:"tenant"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Password    string   `json:"password"`
+	Activated   bool     `json:"activated"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	Tokens      []Token  `json:"tokens"`
+}
+
+type Token struct {
+	Plaintext string `json:"plaintext"`
+	Scope     string `json:"scope"`
+	TTL       string `json:"ttl"`
+	// Name and Permissions are only needed for API keys, and tokens which are
+	// restricted to some of the user's permissions.
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type Movie struct {
+	Tenant     string          `json:"tenant"`
+	Title      string          `json:"title"`
+	Year       int32           `json:"year"`
+	Runtime    data.Runtime    `json:"runtime"`
+	Genres     []string        `json:"genres"`
+	Attributes data.Attributes `json:"attributes"`
+}
+
+// ReadFiles reads and merges the fixture files at the given paths into a single Set.
+func ReadFiles(paths ...string) (*Set, error) {
+	set := &Set{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var s Set
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		set.Tenants = append(set.Tenants, s.Tenants...)
+		set.Users = append(set.Users, s.Users...)
+		set.Movies = append(set.Movies, s.Movies...)
+	}
+	return set, nil
+}
+
+// Load validates the records in the set and inserts them using the given models. Records
+// are inserted in referential order: tenants first, then users, then the tokens
+// belonging to them (which need the generated user IDs), then movies. The models can be
+// backed by PostgreSQL or be in-memory mocks, so the same fixtures work for tests and
+// for local development.
+func (s *Set) Load(models data.Models) error {
+	for i, t := range s.Tenants {
+		tenant := &data.Tenant{Slug: t.Slug, Name: t.Name}
+		v := validator.New()
+		if data.ValidateTenant(v, tenant); !v.Valid() {
+			return fmt.Errorf("tenants[%d]: invalid fixture: %v", i, v.Errors)
+		}
+		err := models.Tenants.Insert(tenant)
+		if err != nil && !errors.Is(err, data.ErrDuplicateSlug) {
+			return fmt.Errorf("tenants[%d]: %w", i, err)
+		}
+	}
+	// tenants caches the tenant IDs by slug, with the empty slug for the default tenant.
+	tenants := map[string]int64{"": data.DefaultTenantID}
+	tenantID := func(slug string) (int64, error) {
+		if id, ok := tenants[slug]; ok {
+			return id, nil
+		}
+		tenant, err := models.Tenants.GetBySlug(slug)
+		if err != nil {
+			return 0, fmt.Errorf("tenant %q: %w", slug, err)
+		}
+		tenants[slug] = tenant.ID
+		return tenant.ID, nil
+	}
+	for i, u := range s.Users {
+		id, err := tenantID(u.Tenant)
+		if err != nil {
+			return fmt.Errorf("users[%d]: %w", i, err)
+		}
+		scoped := models.ForTenant(id)
+		user := &data.User{
+			Name:      u.Name,
+			Email:     u.Email,
+			Activated: u.Activated,
+		}
+		err = user.Password.Set(u.Password)
+		if err != nil {
+			return err
+		}
+		v := validator.New()
+		if data.ValidateUser(v, user); !v.Valid() {
+			return fmt.Errorf("users[%d]: invalid fixture: %v", i, v.Errors)
+		}
+		err = scoped.Users.Insert(user)
+		if err != nil {
+			return fmt.Errorf("users[%d]: %w", i, err)
+		}
+		for _, role := range u.Roles {
+			err = models.Roles.AddForUser(user.ID, role)
+			if err != nil {
+				return fmt.Errorf("users[%d]: role %q: %w", i, role, err)
+			}
+		}
+		if len(u.Permissions) > 0 {
+			err = models.Permissions.AddForUser(user.ID, u.Permissions...)
+			if err != nil {
+				return fmt.Errorf("users[%d]: %w", i, err)
+			}
+		}
+		for j, t := range u.Tokens {
+			token, err := newToken(user.ID, t)
+			if err != nil {
+				return fmt.Errorf("users[%d].tokens[%d]: %w", i, j, err)
+			}
+			err = models.Tokens.Insert(token)
+			if err != nil {
+				return fmt.Errorf("users[%d].tokens[%d]: %w", i, j, err)
+			}
+		}
+	}
+	// Movies don't have any dependencies, and there can be a lot of them, so we
+	// validate them all and then bulk insert them in one go for each tenant.
+	movies := make(map[int64][]*data.Movie)
+	for i, m := range s.Movies {
+		id, err := tenantID(m.Tenant)
+		if err != nil {
+			return fmt.Errorf("movies[%d]: %w", i, err)
+		}
+		movie := &data.Movie{
+			Title:      m.Title,
+			Year:       m.Year,
+			Runtime:    m.Runtime,
+			Genres:     m.Genres,
+			Attributes: m.Attributes,
+		}
+		v := validator.New()
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			return fmt.Errorf("movies[%d]: invalid fixture: %v", i, v.Errors)
+		}
+		movies[id] = append(movies[id], movie)
+	}
+	for id, list := range movies {
+		err := models.ForTenant(id).Movies.InsertMany(list)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newToken builds a token with a known plaintext value.
+func newToken(userID int64, t Token) (*data.Token, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, t.Plaintext); !v.Valid() {
+		return nil, fmt.Errorf("invalid fixture: %v", v.Errors)
+	}
+	ttl := 24 * time.Hour
+	if t.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(t.TTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token := data.NewTokenFromPlaintext(userID, t.Plaintext, ttl, t.Scope)
+	token.Name = t.Name
+	token.Permissions = t.Permissions
+	return token, nil
+}
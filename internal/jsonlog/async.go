@@ -0,0 +1,149 @@
+package jsonlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The OverflowPolicy type controls what an AsyncWriter does when its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Write() wait for space in the buffer, so that no entries are
+	// lost, at the cost of slowing down the code which logs them.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop makes Write() discard the entry, so that logging never slows down
+	// the code which logs. The number of dropped entries is reported in a later entry.
+	OverflowDrop
+)
+
+// ParseOverflowPolicy returns the policy with the given name ("block" or "drop").
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "block":
+		return OverflowBlock, nil
+	case "drop":
+		return OverflowDrop, nil
+	default:
+		return 0, fmt.Errorf("unknown log overflow policy %q", s)
+	}
+}
+
+// The AsyncWriter type is an io.WriteCloser which copies each write into a bounded
+// buffer, and writes it to the underlying writer from a dedicated goroutine. This means
+// that a slow consumer of the logs (like a container runtime reading stdout) can't add
+// latency to requests. Each write is kept whole, so log entries are never interleaved.
+type AsyncWriter struct {
+	out     io.Writer
+	policy  OverflowPolicy
+	lines   chan []byte
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+	dropped uint64
+	// handler is the handler which the entries saying how many were dropped are written
+	// with (see ReportDropsTo()).
+	handler atomic.Value
+}
+
+// NewAsyncWriter returns an AsyncWriter which buffers up to size writes to out, and
+// starts its goroutine. Close() must be called to flush the buffer.
+func NewAsyncWriter(out io.Writer, size int, policy OverflowPolicy) *AsyncWriter {
+	w := &AsyncWriter{
+		out:    out,
+		policy: policy,
+		lines:  make(chan []byte, size),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	openWriters.Store(w, struct{}{})
+	return w
+}
+
+// openWriters holds the AsyncWriters which haven't been closed, so that PrintFatal()
+// can flush them before it exits the application.
+var openWriters sync.Map
+
+// flushAll flushes and closes all of the open AsyncWriters.
+func flushAll() {
+	openWriters.Range(func(key, _ interface{}) bool {
+		key.(*AsyncWriter).Close(time.Second)
+		return true
+	})
+}
+
+// ReportDropsTo sets the handler that the entries saying how many entries were dropped
+// are written with. It should be the handler which writes to the AsyncWriter, so that
+// they're formatted like every other entry. Until it's called, drops are only counted.
+func (w *AsyncWriter) ReportDropsTo(h slog.Handler) {
+	w.handler.Store(&h)
+}
+
+// Write adds a copy of p to the buffer. It never returns an error for a dropped entry,
+// as there's nothing the caller could usefully do about it.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	line := append([]byte(nil), p...)
+	// We hold a read lock while sending, so that Close() can't close the channel under
+	// us. Writers don't block each other.
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return 0, errors.New("jsonlog: write to closed AsyncWriter")
+	}
+	if w.policy == OverflowDrop {
+		select {
+		case w.lines <- line:
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+		}
+		return len(p), nil
+	}
+	w.lines <- line
+	return len(p), nil
+}
+
+// run writes the buffered lines to the underlying writer until the buffer is closed.
+// After a line is written, if any have been dropped since, it logs an entry saying how
+// many with the handler from ReportDropsTo(). That entry comes back through Write(), so
+// if the buffer is still full it's dropped (and counted) in turn.
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+	for line := range w.lines {
+		w.out.Write(line)
+		h, ok := w.handler.Load().(*slog.Handler)
+		if !ok {
+			continue
+		}
+		if n := atomic.SwapUint64(&w.dropped, 0); n > 0 {
+			ctx := context.Background()
+			if (*h).Enabled(ctx, slog.LevelError) {
+				r := slog.NewRecord(time.Now(), slog.LevelError, fmt.Sprintf("log buffer full: dropped %d entries", n), 0)
+				(*h).Handle(ctx, r)
+			}
+		}
+	}
+}
+
+// Close stops accepting writes, and waits (for up to the given timeout) for the buffer
+// to be flushed to the underlying writer.
+func (w *AsyncWriter) Close(timeout time.Duration) error {
+	openWriters.Delete(w)
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("jsonlog: timed out flushing log buffer")
+	}
+}
@@ -0,0 +1,61 @@
+package jsonlog
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The gatedWriter type is an io.Writer which holds up its first write until it's
+// released, so that the buffer of an AsyncWriter in front of it fills up.
+type gatedWriter struct {
+	gate chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { <-w.gate })
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriterReportsDropsThroughHandler(t *testing.T) {
+	out := &gatedWriter{gate: make(chan struct{})}
+	async := NewAsyncWriter(out, 1, OverflowDrop)
+	logger := NewWithHandler(NewPrettyHandler(async, slog.LevelInfo, false))
+	async.ReportDropsTo(logger.Slog().Handler())
+
+	for i := 0; i < 10; i++ {
+		logger.PrintInfo("hello", nil)
+	}
+	close(out.gate)
+	// One more entry, after the buffer has drained, is what triggers the report.
+	time.Sleep(50 * time.Millisecond)
+	logger.PrintInfo("goodbye", nil)
+	err := async.Close(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notice string
+	for _, line := range strings.Split(strings.TrimSpace(out.buf.String()), "\n") {
+		if strings.HasPrefix(line, "{") {
+			t.Errorf("unformatted line in pretty output: %s", line)
+		}
+		if strings.Contains(line, "log buffer full: dropped") {
+			notice = line
+		}
+	}
+	if notice == "" {
+		t.Fatalf("no dropped entries notice in the output:\n%s", out.buf.String())
+	}
+	if !strings.Contains(notice, " ERR ") {
+		t.Errorf("notice isn't at the ERROR level: %s", notice)
+	}
+}
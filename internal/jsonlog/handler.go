@@ -0,0 +1,241 @@
+package jsonlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The Handler type is a slog.Handler which writes log entries in our JSON format:
+//
+//	{"level":"INFO","time":"2006-01-02T15:04:05Z","message":"...","properties":{...}}
+//
+// The attributes of a record (and any added with With()) are written as the properties
+// of the entry, and groups become nested objects within the properties. Entries at the
+// ERROR level and above include the stack trace of the code which logged them, as a
+// list of frames.
+type Handler struct {
+	out   io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	attrSet
+}
+
+// The attrSet type holds the attributes added to a handler with WithAttrs(), along with
+// the groups that were open at the time, and the currently open groups. It's shared by
+// all of our handlers.
+type attrSet struct {
+	attrs  []groupedAttr
+	groups []string
+}
+
+type groupedAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+// withAttrs returns a copy of the set with attrs added in the currently open groups.
+func (s attrSet) withAttrs(attrs []slog.Attr) attrSet {
+	s2 := attrSet{groups: s.groups, attrs: append([]groupedAttr{}, s.attrs...)}
+	for _, a := range attrs {
+		s2.attrs = append(s2.attrs, groupedAttr{groups: s.groups, attr: a})
+	}
+	return s2
+}
+
+// withGroup returns a copy of the set with a new group opened.
+func (s attrSet) withGroup(name string) attrSet {
+	return attrSet{attrs: s.attrs, groups: append(append([]string{}, s.groups...), name)}
+}
+
+// properties returns the properties for a record: the attributes in the set followed
+// by the attributes of the record itself, with groups as nested maps.
+func (s attrSet) properties(r slog.Record) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, ga := range s.attrs {
+		addAttr(properties, ga.groups, ga.attr)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(properties, s.groups, a)
+		return true
+	})
+	return properties
+}
+
+// NewHandler returns a Handler which writes entries at or above level to out.
+func NewHandler(out io.Writer, level slog.Leveler) *Handler {
+	return &Handler{out: out, mu: &sync.Mutex{}, level: level}
+}
+
+// Enabled reports whether the handler writes entries at the given level.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// WithAttrs returns a copy of the handler which includes attrs in every entry.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrSet = h.attrSet.withAttrs(attrs)
+	return &h2
+}
+
+// WithGroup returns a copy of the handler which puts all subsequent attributes in a
+// group with the given name.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.attrSet = h.attrSet.withGroup(name)
+	return &h2
+}
+
+// The entry type is a single log entry, in the format that's written by a Handler.
+type entry struct {
+	Level      string                 `json:"level"`
+	Time       string                 `json:"time"`
+	Message    string                 `json:"message"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Stack      []Frame                `json:"stack,omitempty"`
+}
+
+// newEntry returns the entry for a record with the given properties.
+func newEntry(r slog.Record, properties map[string]interface{}) entry {
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	e := entry{
+		Level:      levelName(r.Level),
+		Time:       t.UTC().Format(time.RFC3339),
+		Message:    r.Message,
+		Properties: properties,
+	}
+	// Include a stack trace for entries at the ERROR and FATAL levels.
+	if r.Level >= slog.LevelError {
+		e.Stack = captureStack()
+	}
+	return e
+}
+
+// marshal returns the entry as a line of JSON. If there was a problem creating the
+// JSON, it returns a plain-text error message instead.
+func (e entry) marshal() []byte {
+	line, err := json.Marshal(e)
+	if err != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
+	}
+	return line
+}
+
+// Handle writes a single log entry.
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	line := newEntry(r, h.properties(r)).marshal()
+	// Lock the mutex so that no two writes to the output destination can happen
+	// concurrently. The mutex is shared by all of the handlers derived from this one
+	// with WithAttrs() and WithGroup(), as they all write to the same destination.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(append(line, '\n'))
+	return err
+}
+
+// addAttr adds an attribute to the properties map, inside the given groups.
+func addAttr(properties map[string]interface{}, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	// Following the slog conventions, empty attributes are ignored...
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		// ...and the attributes of a group with an empty key are inlined.
+		if a.Key != "" {
+			groups = append(append([]string{}, groups...), a.Key)
+		}
+		for _, ga := range attrs {
+			addAttr(properties, groups, ga)
+		}
+		return
+	}
+	for _, g := range groups {
+		next, ok := properties[g].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			properties[g] = next
+		}
+		properties = next
+	}
+	properties[a.Key] = attrValue(a.Value)
+}
+
+// attrValue converts a slog.Value into a value for the JSON encoder.
+func attrValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().UTC().Format(time.RFC3339)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case json.Marshaler:
+			return x
+		case error:
+			return x.Error()
+		default:
+			return x
+		}
+	default:
+		return v.Any()
+	}
+}
+
+// flatten converts nested properties into a flat map of strings, joining the names of
+// nested keys with sep. It's used by the output formats which don't support nesting.
+func flatten(properties map[string]interface{}, prefix, sep string, out map[string]string) {
+	for key, value := range properties {
+		if prefix != "" {
+			key = prefix + sep + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(v, key, sep, out)
+		case string:
+			out[key] = v
+		case json.Marshaler:
+			js, err := v.MarshalJSON()
+			if err != nil {
+				out[key] = err.Error()
+			} else {
+				out[key] = string(js)
+			}
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// levelName returns the name used for a level in the log output.
+func levelName(level slog.Level) string {
+	switch {
+	case level >= LevelFatal.SlogLevel():
+		return LevelFatal.String()
+	case level >= slog.LevelError:
+		return LevelError.String()
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return LevelInfo.String()
+	case level >= slog.LevelDebug:
+		return LevelDebug.String()
+	default:
+		return LevelTrace.String()
+	}
+}
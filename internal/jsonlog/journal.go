@@ -0,0 +1,144 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journalSocket is the socket that journald listens on for its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// The JournalHandler type is a slog.Handler which sends log entries to systemd-journald
+// using its native protocol, so that the properties of each entry become fields in the
+// journal that can be queried with journalctl (e.g. journalctl REQUEST_METHOD=POST).
+// Property names are converted to journal field names by uppercasing them and replacing
+// anything other than letters, digits and underscores with an underscore; the names of
+// nested groups are joined with underscores.
+//
+// Note that entries larger than the maximum datagram size of the socket can't be sent
+// with this simple version of the protocol, and cause Handle() to return an error.
+type JournalHandler struct {
+	level      slog.Leveler
+	conn       *net.UnixConn
+	mu         *sync.Mutex
+	identifier string
+	attrSet
+}
+
+// NewJournalHandler returns a JournalHandler which sends entries at or above level to
+// the local journald.
+func NewJournalHandler(level slog.Leveler) (*JournalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalHandler{
+		level:      level,
+		conn:       conn,
+		mu:         &sync.Mutex{},
+		identifier: filepath.Base(os.Args[0]),
+	}, nil
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrSet = h.attrSet.withAttrs(attrs)
+	return &h2
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.attrSet = h.attrSet.withGroup(name)
+	return &h2
+}
+
+// Handle sends the record to journald.
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	properties := make(map[string]string)
+	flatten(h.properties(r), "", "_", properties)
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", r.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity(r.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", h.identifier)
+	writeJournalField(&buf, "LEVEL", levelName(r.Level))
+	if r.Level >= slog.LevelError {
+		var trace []string
+		for _, frame := range captureStack() {
+			trace = append(trace, frame.String())
+		}
+		writeJournalField(&buf, "TRACE", strings.Join(trace, "\n"))
+	}
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeJournalField(&buf, journalFieldName(key), properties[key])
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField writes a field in the journal native format. Values without
+// newlines are written as NAME=value, and other values as the name, a newline, the
+// length of the value as a little-endian uint64, and then the value itself.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journalFieldName converts a property name into a valid journal field name. Field
+// names may only contain uppercase letters, digits and underscores, mustn't start with
+// an underscore or digit (those are reserved or invalid), and are limited to 64
+// characters.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		name = "PROPERTY"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// Close closes the connection to journald.
+func (h *JournalHandler) Close() error {
+	return h.conn.Close()
+}
@@ -1,12 +1,12 @@
 package jsonlog
 
 import (
-	"encoding/json"
+	"context"
 	"io"
+	"log"
+	"log/slog"
 	"os"
-	"runtime/debug"
-	"sync"
-	"time"
+	"sort"
 )
 
 // Define a Level type to represent the severity level for a log entry.
@@ -19,9 +19,19 @@ const (
     LevelFatal              // Has the value 2.
     LevelOff                // Has the value 3.
 )
+// The DEBUG and TRACE levels come below INFO, for the chatter which is only useful
+// when debugging a particular component (see Component()).
+const (
+    LevelDebug Level = -1
+    LevelTrace Level = -2
+)
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
     switch l {
+    case LevelTrace:
+        return "TRACE"
+    case LevelDebug:
+        return "DEBUG"
     case LevelInfo:
         return "INFO"
     case LevelError:
@@ -32,79 +42,109 @@ func (l Level) String() string {
         return ""
     }
 }
-// Define a custom Logger type. This holds the output destination that the log entries
-// will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// Return the slog.Level which corresponds to the severity level. There isn't a FATAL
+// level in slog, so we use a level above ERROR, leaving a gap in the same way that slog
+// does between its own levels.
+func (l Level) SlogLevel() slog.Level {
+    switch l {
+    case LevelTrace:
+        return slog.LevelDebug - 4
+    case LevelDebug:
+        return slog.LevelDebug
+    case LevelInfo:
+        return slog.LevelInfo
+    case LevelError:
+        return slog.LevelError
+    case LevelFatal:
+        return slog.LevelError + 4
+    default:
+        return slog.Level(1 << 30)
+    }
+}
+// Define a custom Logger type. This is a thin wrapper around a slog.Logger which uses
+// our JSON Handler, so that existing code can carry on calling PrintInfo() and friends,
+// while new code can use the slog.Logger returned by Slog() directly and take advantage
+// of structured attributes and groups.
 type Logger struct {
-    out      io.Writer
-    minLevel Level
-    mu       sync.Mutex
+    slog *slog.Logger
 }
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
     return &Logger{
-        out:      out,
-        minLevel: minLevel,
+        slog: slog.New(NewHandler(out, minLevel.SlogLevel())),
+    }
+}
+// Return a new Logger instance which writes log entries with the given handler, such as
+// a SyslogHandler or JournalHandler.
+func NewWithHandler(h slog.Handler) *Logger {
+    return &Logger{
+        slog: slog.New(h),
     }
 }
+// With returns a copy of the logger which includes the given properties (as key-value
+// pairs, in the same way as slog.Logger.With()) in every entry.
+func (l *Logger) With(args ...interface{}) *Logger {
+    return &Logger{
+        slog: l.slog.With(args...),
+    }
+}
+// Slog returns the underlying slog.Logger.
+func (l *Logger) Slog() *slog.Logger {
+    return l.slog
+}
+// ErrorLog returns a standard library *log.Logger which writes each line it is given as
+// an entry at the ERROR level, for use as the ErrorLog of an http.Server.
+func (l *Logger) ErrorLog() *log.Logger {
+    return slog.NewLogLogger(l.slog.Handler(), slog.LevelError)
+}
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintTrace(message string, properties map[string]string) {
+    l.print(LevelTrace, message, properties)
+}
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+    l.print(LevelDebug, message, properties)
+}
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
     l.print(LevelInfo, message, properties)
 }
+// For errors, we also include the chain of wrapped errors (with their types) as the
+// error_chain property.
 func (l *Logger) PrintError(err error, properties map[string]string) {
-    l.print(LevelError, err.Error(), properties)
+    l.print(LevelError, err.Error(), properties, slog.Any("error_chain", errorChain(err)))
 }
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
-    l.print(LevelFatal, err.Error(), properties)
+    l.print(LevelFatal, err.Error(), properties, slog.Any("error_chain", errorChain(err)))
+    flushAll() // Make sure the entry isn't lost in a buffer...
     os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
-// Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-    // If the severity level of the log entry is below the minimum severity for the
-    // logger, then return with no further action.
-    if level < l.minLevel {
-				return 0, nil
-			}
-			// Declare an anonymous struct holding the data for the log entry.
-			aux := struct {
-					Level      string            `json:"level"`
-					Time       string            `json:"time"`
-					Message    string            `json:"message"`
-					Properties map[string]string `json:"properties,omitempty"`
-					Trace      string            `json:"trace,omitempty"`
-			}{
-					Level:      level.String(),
-					Time:       time.Now().UTC().Format(time.RFC3339),
-					Message:    message,
-					Properties: properties,
-			}
-			// Include a stack trace for entries at the ERROR and FATAL levels.
-			if level >= LevelError {
-					aux.Trace = string(debug.Stack())
-			}
-			// Declare a line variable for holding the actual log entry text.
-			var line []byte
-			// Marshal the anonymous struct to JSON and store it in the line variable. If there
-			// was a problem creating the JSON, set the contents of the log entry to be that
-			// plain-text error message instead.
-			line, err := json.Marshal(aux)
-			if err != nil {
-					line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
-			}
-			// Lock the mutex so that no two writes to the output destination can happen
-			// concurrently. If we don't do this, it's possible that the text for two or more
-			// log entries will be intermingled in the output.
-			l.mu.Lock()
-			defer l.mu.Unlock()
-			// Write the log entry followed by a newline.
-			return l.out.Write(append(line, '\n'))
-	}
-	// We also implement a Write() method on our Logger type so that it satisfies the
-	// io.Writer interface. This writes a log entry at the ERROR level with no additional
-	// properties.
-	func (l *Logger) Write(message []byte) (n int, err error) {
-			return l.print(LevelError, string(message), nil)
-	}
\ No newline at end of file
+// Enabled reports whether entries at the given level are written, so that callers can
+// skip building the properties for DEBUG and TRACE entries which would be discarded.
+func (l *Logger) Enabled(level Level) bool {
+    return l.slog.Enabled(context.Background(), level.SlogLevel())
+}
+// Print is an internal method for writing the log entry. It converts the properties
+// into slog attributes (in key order, so the output is the same every time) and hands
+// them to the handler.
+func (l *Logger) print(level Level, message string, properties map[string]string, extra ...slog.Attr) {
+    keys := make([]string, 0, len(properties))
+    for key := range properties {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    attrs := make([]slog.Attr, 0, len(keys))
+    for _, key := range keys {
+        attrs = append(attrs, slog.String(key, properties[key]))
+    }
+    attrs = append(attrs, extra...)
+    l.slog.LogAttrs(context.Background(), level.SlogLevel(), message, attrs...)
+}
+// We also implement a Write() method on our Logger type so that it satisfies the
+// io.Writer interface. This writes a log entry at the ERROR level with no additional
+// properties.
+func (l *Logger) Write(message []byte) (n int, err error) {
+    l.print(LevelError, string(message), nil)
+    return len(message), nil
+}
@@ -0,0 +1,115 @@
+package jsonlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// The Levels type holds the minimum level of the entries which are written, by
+// component. Components which aren't listed use the Default level.
+type Levels struct {
+	Default    Level
+	Components map[string]Level
+}
+
+// Min returns the lowest of the levels, which is the level that the handlers need to
+// be created with.
+func (lv Levels) Min() Level {
+	min := lv.Default
+	for _, level := range lv.Components {
+		if level < min {
+			min = level
+		}
+	}
+	return min
+}
+
+// forComponent returns the minimum level for a component.
+func (lv Levels) forComponent(name string) Level {
+	if level, ok := lv.Components[name]; ok {
+		return level
+	}
+	return lv.Default
+}
+
+// ParseLevels parses a comma-separated list of components whose verbosity should be
+// raised, like "data,mailer=trace", into a Levels with the given default. Components
+// without a level are raised to DEBUG.
+func ParseLevels(def Level, s string) (Levels, error) {
+	lv := Levels{Default: def, Components: make(map[string]Level)}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, levelName, ok := strings.Cut(item, "=")
+		level := LevelDebug
+		if ok {
+			var err error
+			level, err = ParseLevel(levelName)
+			if err != nil {
+				return Levels{}, err
+			}
+		}
+		lv.Components[strings.TrimSpace(name)] = level
+	}
+	return lv, nil
+}
+
+// ParseLevel returns the level with the given (case-insensitive) name.
+func ParseLevel(s string) (Level, error) {
+	for _, level := range []Level{LevelTrace, LevelDebug, LevelInfo, LevelError, LevelFatal} {
+		if strings.EqualFold(strings.TrimSpace(s), level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// The levelHandler type is a slog.Handler which discards the records below the minimum
+// level for its component. The handlers it passes records on to are created with the
+// lowest level of all of the components, so this is where the filtering happens.
+type levelHandler struct {
+	next   slog.Handler
+	levels Levels
+	min    slog.Level
+}
+
+// WithLevels returns a copy of the logger which filters entries using levels. Its
+// handlers must have been created with levels.Min() (or lower) as their level.
+func (l *Logger) WithLevels(levels Levels) *Logger {
+	h := &levelHandler{next: l.slog.Handler(), levels: levels, min: levels.Default.SlogLevel()}
+	return &Logger{slog: slog.New(h)}
+}
+
+// Component returns a copy of the logger for the named component (like "data" or
+// "mailer"), whose entries include the component as a property and are filtered using
+// the component's level.
+func (l *Logger) Component(name string) *Logger {
+	h := l.slog.Handler()
+	if lh, ok := h.(*levelHandler); ok {
+		h = &levelHandler{next: lh.next, levels: lh.levels, min: lh.levels.forComponent(name).SlogLevel()}
+	}
+	return &Logger{slog: slog.New(h).With("component", name)}
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.min && h.next.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < h.min {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{next: h.next.WithAttrs(attrs), levels: h.levels, min: h.min}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{next: h.next.WithGroup(name), levels: h.levels, min: h.min}
+}
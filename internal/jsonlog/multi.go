@@ -0,0 +1,55 @@
+package jsonlog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// The multiHandler type is a slog.Handler which passes every record on to several other
+// handlers, such as a Handler writing to stdout and a ShipHandler.
+type multiHandler []slog.Handler
+
+// NewMultiHandler returns a handler which passes every record on to all of handlers.
+func NewMultiHandler(handlers ...slog.Handler) slog.Handler {
+	return multiHandler(handlers)
+}
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle passes the record on to each of the handlers which are enabled for its level,
+// carrying on if one of them fails.
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	m2 := make(multiHandler, len(m))
+	for i, h := range m {
+		m2[i] = h.WithAttrs(attrs)
+	}
+	return m2
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	m2 := make(multiHandler, len(m))
+	for i, h := range m {
+		m2[i] = h.WithGroup(name)
+	}
+	return m2
+}
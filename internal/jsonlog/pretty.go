@@ -0,0 +1,166 @@
+package jsonlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ANSI escape codes used by the PrettyHandler.
+const (
+	ansiReset   = "\x1b[0m"
+	ansiDim     = "\x1b[2m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiYellow  = "\x1b[33m"
+	ansiCyan    = "\x1b[36m"
+	ansiMagenta = "\x1b[35m"
+)
+
+// The PrettyHandler type is a slog.Handler which writes log entries as single lines of
+// human-friendly text, for reading in a terminal during development:
+//
+//	15:04:05 INF starting server addr=:4000 env=development
+//
+// Properties are written as key=value pairs (with the names of nested groups joined
+// with dots), and values containing spaces or quotes are quoted. Entries at the ERROR
+// level and above are followed by their stack trace, indented underneath. It's not
+// meant to be parsed, so use a Handler in staging and production.
+type PrettyHandler struct {
+	out   io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	color bool
+	attrSet
+}
+
+// NewPrettyHandler returns a PrettyHandler which writes entries at or above level to
+// out, using colors if color is true.
+func NewPrettyHandler(out io.Writer, level slog.Leveler, color bool) *PrettyHandler {
+	return &PrettyHandler{out: out, mu: &sync.Mutex{}, level: level, color: color}
+}
+
+func (h *PrettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *PrettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrSet = h.attrSet.withAttrs(attrs)
+	return &h2
+}
+
+func (h *PrettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.attrSet = h.attrSet.withGroup(name)
+	return &h2
+}
+
+// Handle writes a single log entry.
+func (h *PrettyHandler) Handle(_ context.Context, r slog.Record) error {
+	properties := make(map[string]string)
+	flatten(h.properties(r), "", ".", properties)
+	// The error chain isn't very readable as a single value, so we write it as a list
+	// of types instead, which is usually what we want to know.
+	if chain, ok := findAttr(r, "error_chain").([]ChainError); ok {
+		types := make([]string, len(chain))
+		for i, e := range chain {
+			types[i] = e.Type
+		}
+		properties["error_chain"] = strings.Join(types, " > ")
+	}
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	var b strings.Builder
+	b.WriteString(h.paint(ansiDim, t.Format("15:04:05")))
+	b.WriteString(" ")
+	level, color := prettyLevel(r.Level)
+	b.WriteString(h.paint(color, level))
+	b.WriteString(" ")
+	if r.Level >= slog.LevelError {
+		b.WriteString(h.paint(ansiBold, r.Message))
+	} else {
+		b.WriteString(r.Message)
+	}
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString(" ")
+		b.WriteString(h.paint(ansiCyan, key+"="))
+		b.WriteString(prettyValue(properties[key]))
+	}
+	b.WriteString("\n")
+	if r.Level >= slog.LevelError {
+		for _, frame := range captureStack() {
+			b.WriteString(h.paint(ansiDim, fmt.Sprintf("    %s\n        %s:%d\n", frame.Function, frame.File, frame.Line)))
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, b.String())
+	return err
+}
+
+// paint wraps s in the given color, if colors are enabled.
+func (h *PrettyHandler) paint(color, s string) string {
+	if !h.color || color == "" {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// prettyLevel returns the three letter name and color for a level.
+func prettyLevel(level slog.Level) (string, string) {
+	switch {
+	case level >= LevelFatal.SlogLevel():
+		return "FTL", ansiMagenta
+	case level >= slog.LevelError:
+		return "ERR", ansiRed
+	case level >= slog.LevelWarn:
+		return "WRN", ansiYellow
+	case level >= slog.LevelInfo:
+		return "INF", ""
+	case level >= slog.LevelDebug:
+		return "DBG", ansiDim
+	default:
+		return "TRC", ansiDim
+	}
+}
+
+// prettyValue quotes v if it's empty or contains spaces, quotes or control characters.
+func prettyValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=\t\r\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// findAttr returns the value of the record's top-level attribute with the given key, or
+// nil if there isn't one.
+func findAttr(r slog.Record, key string) interface{} {
+	var value interface{}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			value = a.Value.Any()
+			return false
+		}
+		return true
+	})
+	return value
+}
@@ -0,0 +1,200 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The RotateOptions type holds the settings for a RotatingFile.
+type RotateOptions struct {
+	// MaxSize is the size in bytes at which the file is rotated. Zero means no limit.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it is rotated. Zero means no
+	// limit.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep. Zero means keep them all.
+	MaxBackups int
+	// Compress controls whether rotated files are compressed with gzip.
+	Compress bool
+}
+
+// The RotatingFile type is an io.WriteCloser which writes to a file, and rotates the
+// file once it gets too large or too old. Rotated files are renamed with the time of
+// the rotation (e.g. api.log becomes api-20060102T150405.000.log), optionally
+// compressed, and the oldest are deleted once there are more than MaxBackups of them.
+//
+// Rotation only happens between writes, so a log entry is never split across two files.
+type RotatingFile struct {
+	path    string
+	opts    RotateOptions
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	cleanup sync.WaitGroup
+}
+
+// OpenRotatingFile opens (or creates) the log file at path for appending.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at f.path, creating it if necessary.
+func (f *RotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	// If we're appending to an existing file, count its age from when it was last
+	// modified, as we don't know when it was created.
+	f.opened = time.Now()
+	if f.size > 0 {
+		f.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write writes p to the file, rotating the file first if writing p would take it over
+// the size limit, or if it has been open for longer than the age limit.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	tooOld := f.opts.MaxAge > 0 && time.Since(f.opened) > f.opts.MaxAge
+	if tooBig || tooOld {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, renames it and opens a new one. Compressing and
+// deleting old files happens in the background so that it doesn't hold up logging.
+// The caller must hold the mutex.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	f.file = nil
+	ext := filepath.Ext(f.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), time.Now().UTC().Format("20060102T150405.000"), ext)
+	err = os.Rename(f.path, backup)
+	if err != nil {
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	f.cleanup.Add(1)
+	go func() {
+		defer f.cleanup.Done()
+		if f.opts.Compress {
+			// If compression fails we just keep the uncompressed file.
+			if compressFile(backup) == nil {
+				os.Remove(backup)
+			}
+		}
+		f.prune()
+	}()
+	return nil
+}
+
+// prune deletes the oldest rotated files, so that at most MaxBackups of them are kept.
+func (f *RotatingFile) prune() {
+	if f.opts.MaxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(f.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// The timestamps in the names sort in time order, and a compressed file has the
+	// same name as the original apart from the .gz suffix. While a file is being
+	// compressed both exist, so we count them once.
+	backups := make(map[string][]string)
+	var names []string
+	for _, match := range matches {
+		name := strings.TrimSuffix(match, ".gz")
+		if _, ok := backups[name]; !ok {
+			names = append(names, name)
+		}
+		backups[name] = append(backups[name], match)
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-f.opts.MaxBackups; i++ {
+		for _, file := range backups[names[i]] {
+			os.Remove(file)
+		}
+	}
+}
+
+// compressFile writes a gzipped copy of the file at path to path.gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+	}
+	return err
+}
+
+// Close closes the file, after waiting for any background compression to finish.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cleanup.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
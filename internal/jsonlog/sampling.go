@@ -0,0 +1,81 @@
+package jsonlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The samplingHandler type is a slog.Handler which only passes on 1 in every N entries
+// for each of the configured messages, so that a flood of some high-volume entry (like
+// the rate limit rejections during a DDoS) can't overwhelm the log stream. Entries at
+// the ERROR level and above are never sampled. Each entry which is passed on has a
+// sample_rate property, so that anyone reading the logs knows to multiply by it.
+type samplingHandler struct {
+	next     slog.Handler
+	rates    map[string]int
+	counters *sync.Map // message -> *uint64
+}
+
+// WithSampling returns a copy of the logger which samples entries with the given
+// messages, keeping 1 in every rates[message] of them.
+func (l *Logger) WithSampling(rates map[string]int) *Logger {
+	if len(rates) == 0 {
+		return l
+	}
+	h := &samplingHandler{next: l.slog.Handler(), rates: rates, counters: &sync.Map{}}
+	return &Logger{slog: slog.New(h)}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	rate, ok := h.rates[r.Message]
+	if !ok || rate <= 1 || r.Level >= slog.LevelError {
+		return h.next.Handle(ctx, r)
+	}
+	v, _ := h.counters.LoadOrStore(r.Message, new(uint64))
+	n := atomic.AddUint64(v.(*uint64), 1)
+	// Always keep the first entry, so that the first occurrence shows up straight away.
+	if (n-1)%uint64(rate) != 0 {
+		return nil
+	}
+	r = r.Clone()
+	r.AddAttrs(slog.Int("sample_rate", rate))
+	return h.next.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), rates: h.rates, counters: h.counters}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), rates: h.rates, counters: h.counters}
+}
+
+// ParseSampleRates parses a comma-separated list of message=N pairs, like
+// "rate limit exceeded=100,slow query=10", into a map of sample rates.
+func ParseSampleRates(s string) (map[string]int, error) {
+	rates := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid sample rate %q: must be in the format message=N", pair)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil || rate < 1 {
+			return nil, fmt.Errorf("invalid sample rate %q: N must be a positive integer", pair)
+		}
+		rates[strings.TrimSpace(pair[:i])] = rate
+	}
+	return rates, nil
+}
@@ -0,0 +1,365 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SentryOptions type holds the settings for a SentryHandler.
+type SentryOptions struct {
+	// DSN is the client key of the Sentry project (or of a compatible service, like
+	// GlitchTip), like https://public@o123.ingest.sentry.io/42.
+	DSN string
+	// Environment, Release and ServerName are added to every event.
+	Environment string
+	Release     string
+	ServerName  string
+	// QueueSize is the number of events which can be waiting to be sent. Once the queue
+	// is full, new events are dropped rather than holding up the code which logged them.
+	QueueSize int
+	// OnError is called when an event can't be sent or events have been dropped. It's
+	// called from the goroutine that sends the events.
+	OnError func(err error)
+}
+
+// The SentryHandler type is a slog.Handler which reports log entries to Sentry as
+// events, with the stack trace of the code which logged them and the chain of wrapped
+// errors as the exception. The request properties which loggerFrom() adds become the
+// event's request and user, and its route, handler, request ID and component become
+// tags, so that Sentry can group and search the events by them; any other properties
+// are sent as extra data. Entries logged while a goroutine is panicking (like the ones
+// from recoverPanic()) are marked as unhandled. Like a ShipHandler, events are sent by a
+// background goroutine, and it's intended to be used together with another handler
+// (see NewMultiHandler()).
+type SentryHandler struct {
+	level  slog.Leveler
+	shared *sentryClient
+	attrSet
+}
+
+// The sentryClient type holds the queue and the state of the background goroutine. It's
+// shared by all of the handlers derived from a SentryHandler.
+type sentryClient struct {
+	opts     SentryOptions
+	endpoint string
+	auth     string
+	client   *http.Client
+	queue    chan sentryEvent
+	done     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+	dropped  int
+}
+
+// The sentryEvent type is an event in the format of Sentry's event payload. Only the
+// fields we have something to put in are included.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+type sentryRequest struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+	Mechanism  *sentryMechanism  `json:"mechanism,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryMechanism struct {
+	Type    string `json:"type"`
+	Handled bool   `json:"handled"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// NewSentryHandler returns a SentryHandler which reports entries at or above level, and
+// starts its background goroutine. Close() must be called to send any events that are
+// still queued.
+func NewSentryHandler(opts SentryOptions, level slog.Leveler) (*SentryHandler, error) {
+	// The DSN is the project's ingest URL with the public key as the user and the
+	// project ID as the last path segment.
+	u, err := url.Parse(opts.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Sentry DSN: %w", err)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || (u.Scheme != "https" && u.Scheme != "http") || i < 0 || u.Path[i+1:] == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN %q", u.Redacted())
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(error) {}
+	}
+	c := &sentryClient{
+		opts:     opts,
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, u.Path[:i], u.Path[i+1:]),
+		auth:     "Sentry sentry_version=7, sentry_client=greenlight, sentry_key=" + u.User.Username(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan sentryEvent, opts.QueueSize),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return &SentryHandler{level: level, shared: c}, nil
+}
+
+func (h *SentryHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *SentryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrSet = h.attrSet.withAttrs(attrs)
+	return &h2
+}
+
+func (h *SentryHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.attrSet = h.attrSet.withGroup(name)
+	return &h2
+}
+
+// Handle queues the entry to be reported, or drops it if the queue is full.
+func (h *SentryHandler) Handle(_ context.Context, r slog.Record) error {
+	e := h.event(r)
+	c := h.shared
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	select {
+	case c.queue <- e:
+	default:
+		c.dropped++
+	}
+	return nil
+}
+
+// event returns the Sentry event for a record.
+func (h *SentryHandler) event(r slog.Record) sentryEvent {
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	e := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   t.UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       strings.ToLower(levelName(r.Level)),
+		Release:     h.shared.opts.Release,
+		Environment: h.shared.opts.Environment,
+		ServerName:  h.shared.opts.ServerName,
+		Tags:        make(map[string]string),
+	}
+	properties := h.properties(r)
+	chain, _ := properties["error_chain"].([]ChainError)
+	delete(properties, "error_chain")
+	str := func(key string) string {
+		s, _ := properties[key].(string)
+		delete(properties, key)
+		return s
+	}
+	for _, key := range []string{"component", "route", "handler", "request_id"} {
+		if s := str(key); s != "" {
+			e.Tags[key] = s
+		}
+	}
+	e.Logger = e.Tags["component"]
+	if id := str("user_id"); id != "" {
+		e.User = &sentryUser{ID: id}
+	}
+	if method, url := str("request_method"), str("request_url"); method != "" || url != "" {
+		e.Request = &sentryRequest{Method: method, URL: url}
+	}
+	if len(properties) > 0 {
+		e.Extra = properties
+	}
+	if len(chain) == 0 {
+		// Entries which aren't for an error (like those written by ErrorLog()) are
+		// reported with their message as the exception.
+		chain = []ChainError{{Message: r.Message, Type: "error"}}
+	}
+	// Sentry wants the chain innermost first, with the stack trace on the outermost
+	// error, and the frames oldest first.
+	e.Exception = &sentryExceptions{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		e.Exception.Values = append(e.Exception.Values, sentryException{Type: chain[i].Type, Value: chain[i].Message})
+	}
+	outer := &e.Exception.Values[len(e.Exception.Values)-1]
+	stack := captureStack()
+	outer.Stacktrace = &sentryStacktrace{}
+	for i := len(stack) - 1; i >= 0; i-- {
+		outer.Stacktrace.Frames = append(outer.Stacktrace.Frames, newSentryFrame(stack[i]))
+	}
+	if panicking() {
+		outer.Mechanism = &sentryMechanism{Type: "panic", Handled: false}
+	}
+	return e
+}
+
+// newSentryFrame returns the Sentry frame for a frame of a stack trace, splitting the
+// function's package out into the module. Our own code (including the main package) is
+// marked as in app, so that Sentry can hide the frames from the standard library and
+// dependencies.
+func newSentryFrame(f Frame) sentryFrame {
+	frame := sentryFrame{Function: f.Function, AbsPath: f.File, Lineno: f.Line}
+	if i := strings.LastIndex(f.Function, "/"); i >= 0 {
+		if j := strings.Index(f.Function[i:], "."); j >= 0 {
+			frame.Module, frame.Function = f.Function[:i+j], f.Function[i+j+1:]
+		}
+	} else if j := strings.Index(f.Function, "."); j >= 0 {
+		frame.Module, frame.Function = f.Function[:j], f.Function[j+1:]
+	}
+	frame.InApp = frame.Module == "main" || strings.HasPrefix(frame.Module, "greenlight.alexedwards.net/")
+	return frame
+}
+
+// panicking returns true if the calling goroutine is panicking, which is the case when
+// the code which logged an entry was called from a deferred function that recovered
+// from a panic.
+func panicking() bool {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// run sends the queued events, until the queue is closed. If Sentry is rate limiting
+// us, the events are dropped until the time it asked us to wait for has passed.
+func (c *sentryClient) run() {
+	defer close(c.done)
+	var retryAfter time.Time
+	for e := range c.queue {
+		c.mu.Lock()
+		dropped := c.dropped
+		c.dropped = 0
+		c.mu.Unlock()
+		if dropped > 0 {
+			c.opts.OnError(fmt.Errorf("error reporting queue full: dropped %d events", dropped))
+		}
+		if time.Now().Before(retryAfter) {
+			continue
+		}
+		wait, err := c.send(e)
+		if err != nil {
+			c.opts.OnError(fmt.Errorf("reporting error to Sentry: %w", err))
+		}
+		retryAfter = time.Now().Add(wait)
+	}
+}
+
+// send posts an event to the envelope endpoint, returning how long to wait before
+// sending the next one if we're being rate limited.
+func (c *sentryClient) send(e sentryEvent) (time.Duration, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	var body bytes.Buffer
+	header, _ := json.Marshal(map[string]string{"event_id": e.EventID, "sent_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	body.Write(header)
+	fmt.Fprintf(&body, "\n{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteByte('\n')
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return wait, fmt.Errorf("rate limited for %s", wait)
+	}
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return 0, nil
+}
+
+// Close stops accepting new events, and waits (for up to the given timeout) for the
+// queued events to be sent.
+func (h *SentryHandler) Close(timeout time.Duration) error {
+	c := h.shared
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out reporting errors")
+	}
+}
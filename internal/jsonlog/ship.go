@@ -0,0 +1,312 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ShipOptions type holds the settings for a ShipHandler.
+type ShipOptions struct {
+	// URL is the endpoint that batches are sent to, like
+	// http://loki:3100/loki/api/v1/push or http://elasticsearch:9200/greenlight/_bulk.
+	URL string
+	// Format is the format of the endpoint, either "loki" or "elasticsearch".
+	Format string
+	// Labels are added to every entry. For Loki they're the labels of the stream (along
+	// with the level), and for Elasticsearch they're added as a labels field.
+	Labels map[string]string
+	// FlushInterval is how often a batch is sent, if it hasn't filled up before then.
+	FlushInterval time.Duration
+	// BatchSize is the maximum number of entries in a batch.
+	BatchSize int
+	// QueueSize is the number of entries which can be waiting to be sent. Once the queue
+	// is full, new entries are dropped rather than holding up the code which logged them.
+	QueueSize int
+	// MaxRetries is the number of times a batch is retried (with exponential backoff)
+	// if the endpoint can't be reached or returns a 429 or 5xx response.
+	MaxRetries int
+	// OnError is called when a batch can't be sent or entries have been dropped. It's
+	// called from the goroutine that sends the batches.
+	OnError func(err error)
+}
+
+// The ShipHandler type is a slog.Handler which ships log entries to Loki or
+// Elasticsearch over HTTP, for deployments which don't have a log shipper running
+// alongside the application. Entries are queued and sent in batches by a background
+// goroutine, so shipping never adds latency to the code which logs them. It's intended
+// to be used together with another handler (see NewMultiHandler()), so that the
+// entries are still written locally if the endpoint is down.
+type ShipHandler struct {
+	level  slog.Leveler
+	shared *shipper
+	attrSet
+}
+
+// The shipper type holds the queue and the state of the background goroutine. It's
+// shared by all of the handlers derived from a ShipHandler.
+type shipper struct {
+	opts    ShipOptions
+	client  *http.Client
+	queue   chan shipEntry
+	done    chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// The shipEntry type holds an entry waiting to be shipped.
+type shipEntry struct {
+	time  time.Time
+	level string
+	line  []byte
+}
+
+// NewShipHandler returns a ShipHandler which ships entries at or above level, and
+// starts its background goroutine. Close() must be called to send any entries that are
+// still queued.
+func NewShipHandler(opts ShipOptions, level slog.Leveler) (*ShipHandler, error) {
+	if opts.Format != "loki" && opts.Format != "elasticsearch" {
+		return nil, fmt.Errorf("unknown log shipping format %q", opts.Format)
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.QueueSize < opts.BatchSize {
+		opts.QueueSize = 10 * opts.BatchSize
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(error) {}
+	}
+	s := &shipper{
+		opts:   opts,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan shipEntry, opts.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return &ShipHandler{level: level, shared: s}, nil
+}
+
+func (h *ShipHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *ShipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrSet = h.attrSet.withAttrs(attrs)
+	return &h2
+}
+
+func (h *ShipHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.attrSet = h.attrSet.withGroup(name)
+	return &h2
+}
+
+// Handle queues the entry to be shipped, or drops it if the queue is full.
+func (h *ShipHandler) Handle(_ context.Context, r slog.Record) error {
+	e := newEntry(r, h.properties(r))
+	if h.shared.opts.Format == "elasticsearch" && len(h.shared.opts.Labels) > 0 {
+		if e.Properties == nil {
+			e.Properties = make(map[string]interface{})
+		}
+		e.Properties["labels"] = h.shared.opts.Labels
+	}
+	se := shipEntry{time: r.Time, level: e.Level, line: e.marshal()}
+	if se.time.IsZero() {
+		se.time = time.Now()
+	}
+
+	s := h.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	select {
+	case s.queue <- se:
+	default:
+		s.dropped++
+	}
+	return nil
+}
+
+// run sends the queued entries in batches, until the queue is closed.
+func (s *shipper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]shipEntry, 0, s.opts.BatchSize)
+	flush := func() {
+		s.mu.Lock()
+		dropped := s.dropped
+		s.dropped = 0
+		s.mu.Unlock()
+		if dropped > 0 {
+			s.opts.OnError(fmt.Errorf("log shipping queue full: dropped %d entries", dropped))
+		}
+		if len(batch) == 0 {
+			return
+		}
+		err := s.send(batch)
+		if err != nil {
+			s.opts.OnError(fmt.Errorf("shipping %d log entries: %w", len(batch), err))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= s.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send posts a batch to the endpoint, retrying on errors which might be temporary.
+func (s *shipper) send(batch []shipEntry) error {
+	body, contentType, err := s.encode(batch)
+	if err != nil {
+		return err
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = s.post(body, contentType)
+		if err == nil || !retry || attempt >= s.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single request, returning whether it's worth retrying if it fails.
+func (s *shipper) post(body []byte, contentType string) (bool, error) {
+	resp, err := s.client.Post(s.opts.URL, contentType, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	// The bulk API returns 200 OK even if some of the documents couldn't be indexed, so
+	// we need to check the response body too.
+	if s.opts.Format == "elasticsearch" {
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Errors {
+			return false, fmt.Errorf("elasticsearch rejected some entries")
+		}
+	}
+	return false, nil
+}
+
+// encode returns the request body for a batch, in the format of the endpoint.
+func (s *shipper) encode(batch []shipEntry) ([]byte, string, error) {
+	if s.opts.Format == "elasticsearch" {
+		// The bulk API takes newline-delimited JSON, with an action line before each
+		// document. The index is taken from the URL.
+		var buf bytes.Buffer
+		for _, e := range batch {
+			buf.WriteString(`{"index":{}}` + "\n")
+			buf.Write(e.line)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+
+	// Loki groups entries into streams by their labels, so we use a stream for each
+	// level. The values are [timestamp in nanoseconds, line] pairs.
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := make(map[string]*stream)
+	for _, e := range batch {
+		st, ok := streams[e.level]
+		if !ok {
+			labels := map[string]string{"level": e.level}
+			for k, v := range s.opts.Labels {
+				labels[k] = v
+			}
+			st = &stream{Stream: labels}
+			streams[e.level] = st
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), string(e.line)})
+	}
+	levels := make([]string, 0, len(streams))
+	for level := range streams {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	var push struct {
+		Streams []*stream `json:"streams"`
+	}
+	for _, level := range levels {
+		push.Streams = append(push.Streams, streams[level])
+	}
+	body, err := json.Marshal(push)
+	return body, "application/json", err
+}
+
+// Close stops accepting new entries, and waits (for up to the given timeout) for the
+// queued entries to be sent.
+func (h *ShipHandler) Close(timeout time.Duration) error {
+	s := h.shared
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out shipping log entries")
+	}
+}
+
+// ParseLabels parses a comma-separated list of name=value pairs, like
+// "app=greenlight,region=eu-west-1", into a map of labels.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid label %q: must be in the format name=value", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
@@ -0,0 +1,80 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// The Frame type is a single frame of a stack trace.
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// String returns the frame in the same format as the frames of a panic.
+func (f Frame) String() string {
+	return fmt.Sprintf("%s\n\t%s:%d", f.Function, f.File, f.Line)
+}
+
+// captureStack returns the stack of the calling goroutine, leaving out the frames from
+// inside the logging machinery (jsonlog and slog) and the runtime, so that the first
+// frame is the code which called the logger.
+func captureStack() []Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack []Frame
+	for {
+		frame, more := frames.Next()
+		if !skipFrame(frame.Function) {
+			stack = append(stack, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+func skipFrame(function string) bool {
+	for _, prefix := range []string{"runtime.", "log/slog.", "greenlight.alexedwards.net/internal/jsonlog."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The ChainError type describes one error in an error chain.
+type ChainError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// errorChain unwraps err, returning every error in the chain (depth first for errors
+// which wrap more than one error, like those from errors.Join()). This means that a log
+// entry for "creating movie: pq: deadlock detected" also tells us that the underlying
+// error was a *pq.Error, rather than just its message.
+func errorChain(err error) []ChainError {
+	var chain []ChainError
+	var walk func(err error)
+	walk = func(err error) {
+		if err == nil || len(chain) >= 32 {
+			return
+		}
+		chain = append(chain, ChainError{Message: err.Error(), Type: fmt.Sprintf("%T", err)})
+		switch x := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, e := range x.Unwrap() {
+				walk(e)
+			}
+		default:
+			walk(errors.Unwrap(err))
+		}
+	}
+	walk(err)
+	return chain
+}
@@ -0,0 +1,296 @@
+// Package jwt issues and verifies the JSON Web Tokens which can be used instead of
+// opaque authentication tokens. Tokens are signed with Ed25519 (the "EdDSA" algorithm)
+// and carry the ID of the signing key in their "kid" header, so that several keys can
+// be valid at once and keys can be rotated without invalidating every existing token.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned by Verify() for a token which is malformed, has a bad
+	// signature, or was signed with a key that isn't (or is no longer) in the key set.
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	// ErrExpiredToken is returned by Verify() for a token which has expired.
+	ErrExpiredToken = errors.New("jwt: token has expired")
+	// ErrNoSigningKey is returned by Sign() when none of the keys are currently in use
+	// for signing.
+	ErrNoSigningKey = errors.New("jwt: no signing key is active")
+)
+
+// The Key type is one signing key and its place in the rotation schedule. A key is used
+// to sign new tokens from SignFrom until the next key's SignFrom, and tokens signed with
+// it are accepted until VerifyUntil (or forever, if VerifyUntil is zero). VerifyUntil
+// should be at least one token lifetime after the key stops being used for signing.
+type Key struct {
+	ID          string
+	PrivateKey  ed25519.PrivateKey
+	SignFrom    time.Time
+	VerifyUntil time.Time
+}
+
+// The Claims type holds the claims in a token.
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Scope is a space-separated list of the permissions that the token is restricted
+	// to, if it's restricted at all.
+	Scope string `json:"scope,omitempty"`
+}
+
+// The KeySet type holds the keys in the rotation schedule. It's safe for concurrent use,
+// and the keys can be replaced while it's in use with Reload().
+type KeySet struct {
+	path string
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// The schedule file is a JSON document listing the keys, like this:
+//
+//	{"keys": [
+//	  {"kid": "2026-09", "private_key_file": "2026-09.pem", "sign_from": "2026-09-01T00:00:00Z", "verify_until": "2026-10-08T00:00:00Z"},
+//	  {"kid": "2026-10", "private_key_file": "2026-10.pem", "sign_from": "2026-10-01T00:00:00Z"}
+//	]}
+//
+// Each private key file holds a PEM-encoded PKCS #8 Ed25519 private key (as made by
+// "openssl genpkey -algorithm ed25519"). Relative paths are relative to the directory
+// of the schedule file, so the keys can live alongside it as mounted secrets.
+type scheduleFile struct {
+	Keys []struct {
+		ID             string    `json:"kid"`
+		PrivateKeyFile string    `json:"private_key_file"`
+		SignFrom       time.Time `json:"sign_from"`
+		VerifyUntil    time.Time `json:"verify_until"`
+	} `json:"keys"`
+}
+
+// LoadKeySet loads the key rotation schedule from a file.
+func LoadKeySet(path string) (*KeySet, error) {
+	s := &KeySet{path: path}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewKeySet returns a key set with the given keys, which can't be reloaded.
+func NewKeySet(keys ...Key) (*KeySet, error) {
+	s := &KeySet{}
+	err := s.set(keys)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the schedule file again, so that new keys can be added and old keys
+// removed without restarting the application. If the file can't be loaded the current
+// keys are kept.
+func (s *KeySet) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file scheduleFile
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return fmt.Errorf("jwt: parsing %s: %w", s.path, err)
+	}
+	keys := make([]Key, 0, len(file.Keys))
+	for _, k := range file.Keys {
+		keyPath := k.PrivateKeyFile
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(s.path), keyPath)
+		}
+		privateKey, err := readPrivateKey(keyPath)
+		if err != nil {
+			return fmt.Errorf("jwt: key %q: %w", k.ID, err)
+		}
+		keys = append(keys, Key{ID: k.ID, PrivateKey: privateKey, SignFrom: k.SignFrom, VerifyUntil: k.VerifyUntil})
+	}
+	return s.set(keys)
+}
+
+func (s *KeySet) set(keys []Key) error {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		switch {
+		case k.ID == "":
+			return errors.New("jwt: every key must have a kid")
+		case seen[k.ID]:
+			return fmt.Errorf("jwt: duplicate kid %q", k.ID)
+		case len(k.PrivateKey) != ed25519.PrivateKeySize:
+			return fmt.Errorf("jwt: key %q is not an Ed25519 private key", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	sorted := append([]Key{}, keys...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].SignFrom.Before(sorted[j].SignFrom) })
+	s.mu.Lock()
+	s.keys = sorted
+	s.mu.Unlock()
+	return nil
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// signingKey returns the key which should sign new tokens: the one with the latest
+// SignFrom that isn't in the future. The caller must hold the read lock.
+func (s *KeySet) signingKey(now time.Time) (Key, bool) {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		k := s.keys[i]
+		if !k.SignFrom.After(now) && (k.VerifyUntil.IsZero() || k.VerifyUntil.After(now)) {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign returns a signed token for the claims, using the current signing key.
+func (s *KeySet) Sign(claims Claims) (string, error) {
+	s.mu.RLock()
+	key, ok := s.signingKey(time.Now())
+	s.mu.RUnlock()
+	if !ok {
+		return "", ErrNoSigningKey
+	}
+	h, err := json.Marshal(header{Algorithm: "EdDSA", Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	signature := ed25519.Sign(key.PrivateKey, []byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and expiry of a token, and returns its claims.
+func (s *KeySet) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	b, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	err = json.Unmarshal(b, &h)
+	if err != nil || h.Algorithm != "EdDSA" {
+		return nil, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	s.mu.RLock()
+	var publicKey ed25519.PublicKey
+	for _, k := range s.keys {
+		if k.ID == h.KeyID && (k.VerifyUntil.IsZero() || k.VerifyUntil.After(now)) {
+			publicKey = k.PrivateKey.Public().(ed25519.PublicKey)
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if publicKey == nil || !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	b, err = encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = json.Unmarshal(b, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// The JWK type is the public part of a key, in the JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS returns the public keys which other services should accept: all of the keys
+// which haven't passed their VerifyUntil time, including the ones which aren't signing
+// yet. Publishing a key before it's used gives clients time to fetch it, so that the
+// first tokens it signs aren't rejected by a stale cache.
+func (s *KeySet) JWKS() []JWK {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jwks := make([]JWK, 0, len(s.keys))
+	for _, k := range s.keys {
+		if !k.VerifyUntil.IsZero() && !k.VerifyUntil.After(now) {
+			continue
+		}
+		jwks = append(jwks, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(k.PrivateKey.Public().(ed25519.PublicKey)),
+			KeyID:     k.ID,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+	return jwks
+}
@@ -0,0 +1,250 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+// newKey returns a key made from a fixed seed, so that every run of the tests signs
+// with the same keys.
+func newKey(id string, seed byte, signFrom, verifyUntil time.Time) Key {
+	return Key{
+		ID:          id,
+		PrivateKey:  ed25519.NewKeyFromSeed([]byte(strings.Repeat(string(rune(seed)), ed25519.SeedSize))),
+		SignFrom:    signFrom,
+		VerifyUntil: verifyUntil,
+	}
+}
+
+// forge returns a token with any header and claims, signed with key, to build the
+// tokens which Sign() would never make.
+func forge(t *testing.T, key Key, h header, claims any) string {
+	t.Helper()
+	hb, err := json.Marshal(h)
+	assert.NilError(t, err)
+	cb, err := json.Marshal(claims)
+	assert.NilError(t, err)
+	signingInput := encoding.EncodeToString(hb) + "." + encoding.EncodeToString(cb)
+	return signingInput + "." + encoding.EncodeToString(ed25519.Sign(key.PrivateKey, []byte(signingInput)))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	current := newKey("current", 1, now.Add(-time.Hour), time.Time{})
+	retired := newKey("retired", 2, now.Add(-48*time.Hour), now.Add(-time.Minute))
+	unknown := newKey("unknown", 3, now.Add(-time.Hour), time.Time{})
+	keys, err := NewKeySet(current, retired)
+	assert.NilError(t, err)
+
+	claims := Claims{Subject: "42", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+	valid := forge(t, current, header{Algorithm: "EdDSA", Type: "JWT", KeyID: "current"}, claims)
+	parts := strings.Split(valid, ".")
+	otherClaims := claims
+	otherClaims.Subject = "1"
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"Valid", valid, nil},
+		{"Signed by Sign", mustSign(t, keys, claims), nil},
+		{"Not three parts", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"Bad header encoding", "!." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"Alg HS256", forge(t, current, header{Algorithm: "HS256", KeyID: "current"}, claims), ErrInvalidToken},
+		{"Alg none", strings.Join([]string{encodeJSON(t, header{Algorithm: "none", KeyID: "current"}), parts[1], ""}, "."), ErrInvalidToken},
+		{"Unknown kid", forge(t, unknown, header{Algorithm: "EdDSA", KeyID: "unknown"}, claims), ErrInvalidToken},
+		{"Missing kid", forge(t, current, header{Algorithm: "EdDSA"}, claims), ErrInvalidToken},
+		{"Retired kid", forge(t, retired, header{Algorithm: "EdDSA", KeyID: "retired"}, claims), ErrInvalidToken},
+		{"Signed by another key", forge(t, unknown, header{Algorithm: "EdDSA", KeyID: "current"}, claims), ErrInvalidToken},
+		{"Tampered payload", parts[0] + "." + encodeJSON(t, otherClaims) + "." + parts[2], ErrInvalidToken},
+		{"Tampered signature", parts[0] + "." + parts[1] + "." + tamper(parts[2]), ErrInvalidToken},
+		{"Missing signature", parts[0] + "." + parts[1] + ".", ErrInvalidToken},
+		{"Missing exp", forge(t, current, header{Algorithm: "EdDSA", KeyID: "current"}, map[string]any{"sub": "42"}), ErrExpiredToken},
+		{"Expired", forge(t, current, header{Algorithm: "EdDSA", KeyID: "current"},
+			Claims{Subject: "42", IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()}), ErrExpiredToken},
+		{"Expires now", forge(t, current, header{Algorithm: "EdDSA", KeyID: "current"},
+			Claims{Subject: "42", IssuedAt: now.Unix(), ExpiresAt: now.Unix()}), ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keys.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				assert.Equal(t, got.Subject, "42")
+			}
+		})
+	}
+}
+
+func mustSign(t *testing.T, keys *KeySet, claims Claims) string {
+	t.Helper()
+	token, err := keys.Sign(claims)
+	assert.NilError(t, err)
+	return token
+}
+
+func encodeJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	assert.NilError(t, err)
+	return encoding.EncodeToString(b)
+}
+
+// tamper flips one bit in the first byte of a base64url-encoded value.
+func tamper(s string) string {
+	b, _ := encoding.DecodeString(s)
+	b[0] ^= 1
+	return encoding.EncodeToString(b)
+}
+
+func TestSignUsesCurrentKey(t *testing.T) {
+	now := time.Now()
+	keys, err := NewKeySet(
+		newKey("next", 3, now.Add(time.Hour), time.Time{}),
+		newKey("old", 1, now.Add(-48*time.Hour), now.Add(-time.Minute)),
+		newKey("current", 2, now.Add(-time.Hour), time.Time{}),
+	)
+	assert.NilError(t, err)
+
+	token := mustSign(t, keys, Claims{Subject: "42", ExpiresAt: now.Add(time.Hour).Unix()})
+	b, err := encoding.DecodeString(strings.Split(token, ".")[0])
+	assert.NilError(t, err)
+	var h header
+	assert.NilError(t, json.Unmarshal(b, &h))
+	assert.Equal(t, h, header{Algorithm: "EdDSA", Type: "JWT", KeyID: "current"})
+
+	var kids []string
+	for _, jwk := range keys.JWKS() {
+		kids = append(kids, jwk.KeyID)
+	}
+	assert.Equal(t, kids, []string{"current", "next"})
+
+	keys, err = NewKeySet(newKey("next", 3, now.Add(time.Hour), time.Time{}))
+	assert.NilError(t, err)
+	_, err = keys.Sign(Claims{Subject: "42"})
+	assert.Equal(t, err, ErrNoSigningKey)
+}
+
+func TestNewKeySetRejectsBadKeys(t *testing.T) {
+	key := newKey("a", 1, time.Time{}, time.Time{})
+	tests := []struct {
+		name string
+		keys []Key
+	}{
+		{"Missing kid", []Key{{PrivateKey: key.PrivateKey}}},
+		{"Duplicate kid", []Key{key, key}},
+		{"Short key", []Key{{ID: "a", PrivateKey: key.PrivateKey[:ed25519.SeedSize]}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeySet(tt.keys...)
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key := newKey("a", 1, time.Time{}, time.Time{})
+	keys, err := NewKeySet(key)
+	assert.NilError(t, err)
+	assert.Equal(t, keys.JWKS(), []JWK{{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         encoding.EncodeToString(key.PrivateKey.Public().(ed25519.PublicKey)),
+		KeyID:     "a",
+		Use:       "sig",
+		Algorithm: "EdDSA",
+	}})
+}
+
+// writeSchedule writes a schedule file, and a private key file for each of the keys,
+// to dir.
+func writeSchedule(t *testing.T, dir string, keys ...Key) string {
+	t.Helper()
+	var file strings.Builder
+	file.WriteString(`{"keys": [`)
+	for i, k := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+		assert.NilError(t, err)
+		err = os.WriteFile(filepath.Join(dir, k.ID+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+		assert.NilError(t, err)
+		if i > 0 {
+			file.WriteString(",")
+		}
+		fmt.Fprintf(&file, `{"kid": %q, "private_key_file": %q, "sign_from": %q`, k.ID, k.ID+".pem", k.SignFrom.Format(time.RFC3339))
+		if !k.VerifyUntil.IsZero() {
+			fmt.Fprintf(&file, `, "verify_until": %q`, k.VerifyUntil.Format(time.RFC3339))
+		}
+		file.WriteString("}")
+	}
+	file.WriteString("]}")
+	path := filepath.Join(dir, "keys.json")
+	assert.NilError(t, os.WriteFile(path, []byte(file.String()), 0o600))
+	return path
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := newKey("old", 1, now.Add(-48*time.Hour), now.Add(time.Hour))
+	path := writeSchedule(t, dir, old)
+	keys, err := LoadKeySet(path)
+	assert.NilError(t, err)
+	token := mustSign(t, keys, Claims{Subject: "42", ExpiresAt: now.Add(2 * time.Hour).Unix()})
+	_, err = keys.Verify(token)
+	assert.NilError(t, err)
+
+	// Rotating to a new key keeps the tokens signed with the old one valid until it
+	// reaches its verify_until time.
+	old.VerifyUntil = now.Add(time.Minute)
+	current := newKey("current", 2, now.Add(-time.Hour), time.Time{})
+	writeSchedule(t, dir, old, current)
+	assert.NilError(t, keys.Reload())
+	_, err = keys.Verify(token)
+	assert.NilError(t, err)
+	newToken := mustSign(t, keys, Claims{Subject: "42", ExpiresAt: now.Add(time.Hour).Unix()})
+	assert.Equal(t, strings.Split(newToken, ".")[0], encodeJSON(t, header{Algorithm: "EdDSA", Type: "JWT", KeyID: "current"}))
+	assert.Equal(t, len(keys.JWKS()), 2)
+
+	// Once it has, they're rejected even though they haven't expired, and the key is
+	// no longer published.
+	old.VerifyUntil = now.Add(-time.Second)
+	writeSchedule(t, dir, old, current)
+	assert.NilError(t, keys.Reload())
+	_, err = keys.Verify(token)
+	assert.Equal(t, err, ErrInvalidToken)
+	_, err = keys.Verify(newToken)
+	assert.NilError(t, err)
+	jwks := keys.JWKS()
+	assert.Equal(t, len(jwks), 1)
+	assert.Equal(t, jwks[0].KeyID, "current")
+
+	// A schedule which can't be loaded leaves the current keys in place.
+	assert.NilError(t, os.WriteFile(path, []byte(`{"keys": [{"kid": "missing", "private_key_file": "missing.pem"}]}`), 0o600))
+	if keys.Reload() == nil {
+		t.Error("reloaded a schedule with a missing key file")
+	}
+	assert.NilError(t, os.WriteFile(path, []byte(`{"keys": `), 0o600))
+	if keys.Reload() == nil {
+		t.Error("reloaded a malformed schedule")
+	}
+	_, err = keys.Verify(newToken)
+	assert.NilError(t, err)
+}
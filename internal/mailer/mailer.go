@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -23,6 +27,15 @@ var templateFS embed.FS
 type Mailer struct {
     dialer *mail.Dialer
     sender string
+    // templates holds the templates: the embedded ones, unless WithTemplateDir() has
+    // been called.
+    templates fs.FS
+}
+// The Message type is an email rendered from one of the templates.
+type Message struct {
+    Subject   string `json:"subject"`
+    PlainBody string `json:"plain_body"`
+    HTMLBody  string `json:"html_body"`
 }
 func New(host string, port int, username, password, sender string) Mailer {
     // Initialize a new mail.Dialer instance with the given SMTP server settings. We
@@ -30,38 +43,74 @@ func New(host string, port int, username, password, sender string) Mailer {
     dialer := mail.NewDialer(host, port, username, password)
     dialer.Timeout = 5 * time.Second
     // Return a Mailer instance containing the dialer and sender information.
+    templates, _ := fs.Sub(templateFS, "templates")
     return Mailer{
-        dialer: dialer,
-        sender: sender,
+        dialer:    dialer,
+        sender:    sender,
+        templates: templates,
     }
 }
-// Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an interface{} parameter.
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// WithTemplateDir returns a copy of the mailer which uses the templates in a directory
+// (like internal/mailer/templates) instead of the embedded ones. The templates are
+// parsed every time an email is sent, so changes to them take effect without a restart.
+// This is meant for development; in production the embedded templates are always the
+// ones which were built and tested with the binary.
+func (m Mailer) WithTemplateDir(dir string) Mailer {
+    m.templates = os.DirFS(dir)
+    return m
+}
+// Templates returns the names of the template files, in alphabetical order.
+func (m Mailer) Templates() ([]string, error) {
+    names, err := fs.Glob(m.templates, "*.tmpl")
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(names)
+    return names, nil
+}
+// Render renders an email from a template file, without sending it. It returns an
+// fs.ErrNotExist error if there's no template file with the name.
+func (m Mailer) Render(templateFile string, data interface{}) (*Message, error) {
+    // Template names never contain a directory or glob characters (ParseFS() takes a
+    // pattern), so that a name from a request like "../../main.go" or "*" can't reach
+    // outside the one template file.
+    if !fs.ValidPath(templateFile) || strings.ContainsAny(templateFile, `/\*?[`) {
+        return nil, &fs.PathError{Op: "open", Path: templateFile, Err: fs.ErrNotExist}
+    }
     // Use the ParseFS() method to parse the required template file from the embedded 
-    // file system.
-    tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+    // file system (or the template directory).
+    tmpl, err := template.New("email").ParseFS(m.templates, templateFile)
     if err != nil {
-        return err
+        return nil, err
     }
     // Execute the named template "subject", passing in the dynamic data and storing the
     // result in a bytes.Buffer variable.
     subject := new(bytes.Buffer)
     err = tmpl.ExecuteTemplate(subject, "subject", data)
     if err != nil {
-        return err
+        return nil, err
     }
     // Follow the same pattern to execute the "plainBody" template and store the result
     // in the plainBody variable.
     plainBody := new(bytes.Buffer)
     err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
     if err != nil {
-        return err
+        return nil, err
     }
     // And likewise with the "htmlBody" template.
     htmlBody := new(bytes.Buffer)
     err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+    if err != nil {
+        return nil, err
+    }
+    return &Message{Subject: subject.String(), PlainBody: plainBody.String(), HTMLBody: htmlBody.String()}, nil
+}
+// Define a Send() method on the Mailer type. This takes the recipient email address
+// as the first parameter, the name of the file containing the templates, and any
+// dynamic data for the templates as an interface{} parameter.
+func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+    // Render the subject and the plain-text and HTML bodies from the template file.
+    message, err := m.Render(templateFile, data)
     if err != nil {
         return err
     }
@@ -73,9 +122,9 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
     msg := mail.NewMessage()
     msg.SetHeader("To", recipient)
     msg.SetHeader("From", m.sender)
-    msg.SetHeader("Subject", subject.String())
-    msg.SetBody("text/plain", plainBody.String())
-    msg.AddAlternative("text/html", htmlBody.String())
+    msg.SetHeader("Subject", message.Subject)
+    msg.SetBody("text/plain", message.PlainBody)
+    msg.AddAlternative("text/html", message.HTMLBody)
     // Call the DialAndSend() method on the dialer, passing in the message to send. This
     // opens a connection to the SMTP server, sends the message, then closes the
     // connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
@@ -0,0 +1,255 @@
+package openapi
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The OpenAPI specification for the API is embedded in the binary, so that the
+// validation middleware always checks requests against the spec for the exact version
+// of the code that is running.
+//
+//go:embed "openapi.json"
+var specFS embed.FS
+
+// Spec holds the parts of an OpenAPI document that are needed for request validation.
+type Spec struct {
+	Paths      map[string]*PathItem `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+
+	templates []pathTemplate
+}
+
+// PathItem holds the operations for a single path template, plus any parameters shared
+// between them.
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Post       *Operation   `json:"post"`
+	Put        *Operation   `json:"put"`
+	Patch      *Operation   `json:"patch"`
+	Delete     *Operation   `json:"delete"`
+}
+
+// Operation describes a single API operation on a path.
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *Schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// Parameter describes a single path or query string parameter.
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type pathTemplate struct {
+	template string
+	rx       *regexp.Regexp
+	names    []string
+}
+
+// Load parses the embedded OpenAPI specification.
+func Load() (*Spec, error) {
+	b, err := specFS.ReadFile("openapi.json")
+	if err != nil {
+		return nil, err
+	}
+	var spec Spec
+	err = json.Unmarshal(b, &spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range spec.Components.Schemas {
+		if err := schema.compile(); err != nil {
+			return nil, err
+		}
+	}
+	// Convert each path template like /v1/movies/{id} into a regular expression that we
+	// can match request paths against, and compile any inline schemas.
+	for template, item := range spec.Paths {
+		var names []string
+		segments := strings.Split(template, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				names = append(names, strings.Trim(segment, "{}"))
+				segments[i] = `([^/]+)`
+				continue
+			}
+			segments[i] = regexp.QuoteMeta(segment)
+		}
+		spec.templates = append(spec.templates, pathTemplate{
+			template: template,
+			rx:       regexp.MustCompile("^" + strings.Join(segments, "/") + "$"),
+			names:    names,
+		})
+		for _, op := range item.operations() {
+			for _, p := range item.parameters(op) {
+				if err := p.Schema.compile(); err != nil {
+					return nil, err
+				}
+			}
+			if op.RequestBody != nil {
+				for _, c := range op.RequestBody.Content {
+					if err := c.Schema.compile(); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	// Sort the templates so that those with fewer parameters are tried first. This
+	// means a static path like /v1/users/activated always takes precedence over a
+	// parameterized one like /v1/users/{id}.
+	sort.Slice(spec.templates, func(i, j int) bool {
+		if len(spec.templates[i].names) != len(spec.templates[j].names) {
+			return len(spec.templates[i].names) < len(spec.templates[j].names)
+		}
+		return spec.templates[i].template < spec.templates[j].template
+	})
+	return &spec, nil
+}
+
+// parameters returns the parameters which apply to an operation, which are those shared
+// by all operations on the path followed by the operation's own parameters.
+func (p *PathItem) parameters(op *Operation) []*Parameter {
+	params := make([]*Parameter, 0, len(p.Parameters)+len(op.Parameters))
+	params = append(params, p.Parameters...)
+	return append(params, op.Parameters...)
+}
+
+func (p *PathItem) operations() []*Operation {
+	var ops []*Operation
+	for _, op := range []*Operation{p.Get, p.Post, p.Put, p.Patch, p.Delete} {
+		if op != nil {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func (p *PathItem) operation(method string) *Operation {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return p.Get
+	case http.MethodPost:
+		return p.Post
+	case http.MethodPut:
+		return p.Put
+	case http.MethodPatch:
+		return p.Patch
+	case http.MethodDelete:
+		return p.Delete
+	default:
+		return nil
+	}
+}
+
+// Validate checks the parameters and JSON body of a request against the operation in the
+// spec which matches its method and path. It returns a map of validation errors (which
+// will be empty if the request is valid). Requests which don't match any operation in
+// the spec aren't validated. The body is passed in separately so that the caller remains
+// in control of reading (and restoring) r.Body, and so is the path to match, so that the
+// caller can map paths which the spec doesn't list onto the ones that it does.
+func (spec *Spec) Validate(r *http.Request, path string, body []byte) map[string]string {
+	errors := make(map[string]string)
+	item, pathParams := spec.match(path)
+	if item == nil {
+		return errors
+	}
+	op := item.operation(r.Method)
+	if op == nil {
+		return errors
+	}
+
+	query := r.URL.Query()
+	for _, p := range item.parameters(op) {
+		var raw string
+		var present bool
+		switch p.In {
+		case "path":
+			raw, present = pathParams[p.Name]
+		case "query":
+			raw = query.Get(p.Name)
+			present = raw != ""
+		default:
+			continue
+		}
+		if !present {
+			if p.Required {
+				errors[p.Name] = "must be provided"
+			}
+			continue
+		}
+		p.Schema.validate(spec, p.Name, parameterValue(p.Schema.resolve(spec), raw), errors)
+	}
+
+	if op.RequestBody != nil {
+		content, ok := op.RequestBody.Content["application/json"]
+		if ok && content.Schema != nil && len(bytes.TrimSpace(body)) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			var value interface{}
+			// If the body isn't valid JSON, we leave it to the handler to send the client
+			// an appropriate error message.
+			if err := dec.Decode(&value); err == nil {
+				content.Schema.validate(spec, "", value, errors)
+			}
+		}
+	}
+	return errors
+}
+
+// match finds the path item whose template matches the request path, returning it along
+// with the values of any path parameters.
+func (spec *Spec) match(path string) (*PathItem, map[string]string) {
+	for _, t := range spec.templates {
+		m := t.rx.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		params := make(map[string]string)
+		for i, name := range t.names {
+			params[name] = m[i+1]
+		}
+		return spec.Paths[t.template], params
+	}
+	return nil, nil
+}
+
+// parameterValue converts the raw string value of a parameter into the type that its
+// schema expects, so that it can be validated in the same way as a JSON value. Values
+// which can't be converted are returned unchanged, which causes them to fail the type
+// check.
+func parameterValue(schema *Schema, raw string) interface{} {
+	if schema == nil {
+		return raw
+	}
+	switch schema.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(raw, 64); err == nil {
+			return json.Number(raw)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
@@ -0,0 +1,216 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Schema represents the subset of the OpenAPI (JSON Schema) schema object that we use
+// in our specification. Any keywords which aren't listed here are ignored.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	AnyOf                []*Schema          `json:"anyOf"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	UniqueItems          bool               `json:"uniqueItems"`
+	Pattern              string             `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// resolve follows any $ref on the schema, returning the referenced component schema.
+func (s *Schema) resolve(spec *Spec) *Schema {
+	for s != nil && s.Ref != "" {
+		s = spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validate checks a decoded JSON value (as produced by a json.Decoder with UseNumber()
+// enabled) against the schema. Any problems are recorded in the errors map, keyed by the
+// path to the offending value.
+func (s *Schema) validate(spec *Spec, path string, value interface{}, errors map[string]string) {
+	s = s.resolve(spec)
+	if s == nil {
+		return
+	}
+	addError := func(message string) {
+		key := path
+		if key == "" {
+			key = "body"
+		}
+		if _, exists := errors[key]; !exists {
+			errors[key] = message
+		}
+	}
+
+	// For anyOf, the value is valid if it matches at least one of the subschemas.
+	if len(s.AnyOf) > 0 {
+		for _, sub := range s.AnyOf {
+			subErrors := make(map[string]string)
+			sub.validate(spec, path, value, subErrors)
+			if len(subErrors) == 0 {
+				return
+			}
+		}
+		addError("does not match any of the permitted formats")
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addError("must be one of the permitted values")
+			return
+		}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			addError("must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, exists := obj[name]; !exists {
+				errors[joinPath(path, name)] = "must be provided"
+			}
+		}
+		for name, v := range obj {
+			prop, exists := s.Properties[name]
+			if !exists {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errors[joinPath(path, name)] = "is not a permitted field"
+				}
+				continue
+			}
+			prop.validate(spec, joinPath(path, name), v, errors)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			addError("must be an array")
+			return
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			addError(fmt.Sprintf("must contain at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			addError(fmt.Sprintf("must not contain more than %d items", *s.MaxItems))
+		}
+		if s.UniqueItems {
+			seen := make(map[string]bool)
+			for _, v := range arr {
+				key := fmt.Sprint(v)
+				if seen[key] {
+					addError("must not contain duplicate values")
+					break
+				}
+				seen[key] = true
+			}
+		}
+		if s.Items != nil {
+			for i, v := range arr {
+				s.Items.validate(spec, fmt.Sprintf("%s[%d]", path, i), v, errors)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			addError("must be a string")
+			return
+		}
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			addError(fmt.Sprintf("must be at least %d bytes long", *s.MinLength))
+		}
+		if s.MaxLength != nil && len(str) > *s.MaxLength {
+			addError(fmt.Sprintf("must not be more than %d bytes long", *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			addError("is not in the expected format")
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			addError("must be a number")
+			return
+		}
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				addError("must be an integer")
+				return
+			}
+		}
+		f, err := num.Float64()
+		if err != nil {
+			addError("must be a number")
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			addError(fmt.Sprintf("must be greater than or equal to %v", *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			addError(fmt.Sprintf("must be less than or equal to %v", *s.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			addError("must be a boolean")
+		}
+	case "null":
+		if value != nil {
+			addError("must be null")
+		}
+	}
+}
+
+// compile precompiles the regular expression patterns in the schema and all of its
+// subschemas.
+func (s *Schema) compile() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		rx, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = rx
+	}
+	for _, prop := range s.Properties {
+		if err := prop.compile(); err != nil {
+			return err
+		}
+	}
+	for _, sub := range s.AnyOf {
+		if err := sub.compile(); err != nil {
+			return err
+		}
+	}
+	return s.Items.compile()
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,263 @@
+// Package redis is a small Redis client, with just enough of the protocol (RESP2) for
+// the caches which are kept in Redis: commands are sent as arrays of bulk strings, and
+// every kind of reply is read. Connections are pooled, and each command (or pipeline of
+// commands) has a deadline, so that a slow or unreachable Redis server can't hold up
+// the requests which use it for longer than that.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrClosed is returned for commands sent after the client has been closed.
+var ErrClosed = errors.New("redis: client is closed")
+
+// The Error type is an error reply from the server, like "WRONGTYPE Operation against a
+// key holding the wrong kind of value".
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// The Client type is a pool of connections to a Redis server. It's safe for concurrent
+// use.
+type Client struct {
+	addr     string
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *conn
+	closed   chan struct{}
+}
+
+// The conn type is a connection to the server, with a buffered reader for its replies.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// New returns a client for the server at a redis:// URL, like
+// redis://:password@localhost:6379/0, which keeps up to poolSize idle connections open.
+// Every command has to complete within the timeout.
+func New(rawURL string, poolSize int, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("redis: unsupported URL scheme %q", u.Scheme)
+	}
+	c := &Client{
+		addr:    u.Host,
+		timeout: timeout,
+		idle:    make(chan *conn, poolSize),
+		closed:  make(chan struct{}),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		c.db, err = strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid database number %q", path)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply: a string for a simple or bulk string, an
+// int64 for an integer, a []interface{} for an array, and nil for a null bulk string
+// or array. An error reply is returned as an Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	replies, err := c.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands at once and returns their replies, in order, in the
+// same form as Do(). An error reply to one of the commands is returned in its place
+// among the replies, rather than as the error.
+func (c *Client) Pipeline(commands [][]string) ([]interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.roundTrip(cn, commands)
+	c.put(cn, err)
+	return replies, err
+}
+
+// Close closes the idle connections, and stops any more commands from being sent.
+// Connections which are in use are closed when they're returned to the pool.
+func (c *Client) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Ping checks that the server can be reached.
+func (c *Client) Ping() error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// get returns an idle connection from the pool, or dials a new one if there aren't
+// any. New connections are authenticated and switched to the client's database.
+func (c *Client) get() (*conn, error) {
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	var setup [][]string
+	switch {
+	case c.username != "" && c.password != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := c.roundTrip(cn, setup)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(Error); ok {
+					err = replyErr
+				}
+			}
+		}
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put returns a connection to the pool, unless the command sent on it failed (which
+// may have left a reply unread) or the pool is full.
+func (c *Client) put(cn *conn, err error) {
+	if err != nil {
+		cn.Close()
+		return
+	}
+	select {
+	case <-c.closed:
+		cn.Close()
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// roundTrip writes commands to a connection and reads their replies.
+func (c *Client) roundTrip(cn *conn, commands [][]string) ([]interface{}, error) {
+	err := cn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(cn)
+	for _, args := range commands {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		replies[i], err = readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// readReply reads one reply from the server.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return Error(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			elements[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
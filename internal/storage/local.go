@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalPathPrefix is the path that the API serves the objects of a Local store under.
+// The presigned URLs point at LocalPathPrefix + key.
+const LocalPathPrefix = "/v1/files/"
+
+// The Local type is a Store which keeps each object in a file under a directory. Its
+// presigned URLs point back at the API (see LocalPathPrefix), which has to check them
+// with Verify() before serving the file or accepting the upload.
+type Local struct {
+	dir        string
+	baseURL    string
+	signingKey []byte
+}
+
+// NewLocal returns a Local store which keeps its files under dir, creating it if it
+// doesn't exist. Its presigned URLs start with baseURL, and are signed with signingKey.
+func NewLocal(dir, baseURL string, signingKey []byte) (*Local, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/"), signingKey: signingKey}, nil
+}
+
+// path returns the path of the file for a key.
+func (l *Local) path(key string) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes an object to a temporary file and then renames it into place, so that
+// readers never see a partly written object.
+func (l *Local) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, body)
+	if err == nil && n != size {
+		err = fmt.Errorf("storage: wrote %d bytes, expected %d", n, size)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Object, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Object{}, ErrNotFound
+		}
+		return Object{}, err
+	}
+	if info.IsDir() {
+		return Object{}, ErrNotFound
+	}
+	return Object{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Open opens the file for an object, to serve it from.
+func (l *Local) Open(key string) (*os.File, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) PresignGet(key string, ttl time.Duration) (string, error) {
+	return l.presign("GET", key, "", ttl)
+}
+
+func (l *Local) PresignPut(key, contentType string, ttl time.Duration) (string, error) {
+	return l.presign("PUT", key, contentType, ttl)
+}
+
+// presign returns a URL for a request to LocalPathPrefix + key, with its expiry time and
+// signature in the query string.
+func (l *Local) presign(method, key, contentType string, ttl time.Duration) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	err = checkTTL(ttl)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {l.signature(method, key, contentType, expires)},
+	}
+	return l.baseURL + LocalPathPrefix + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// signature returns the signature for a presigned URL, which covers the method, the
+// key, the Content-Type that an upload has to have and the expiry time.
+func (l *Local) signature(method, key, contentType string, expires int64) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "storage:%s:%s:%s:%d", method, key, contentType, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the query string of a request has the signature of a URL
+// returned by PresignGet() (for a GET or HEAD request) or PresignPut() (for a PUT
+// request, along with its Content-Type header) and hasn't expired.
+func (l *Local) Verify(method, key, contentType string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires || checkKey(key) != nil {
+		return false
+	}
+	switch method {
+	case "GET", "HEAD":
+		method, contentType = "GET", ""
+	case "PUT":
+	default:
+		return false
+	}
+	expected := l.signature(method, key, contentType, expires)
+	return hmac.Equal([]byte(query.Get("signature")), []byte(expected))
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/assert"
+)
+
+func TestLocalObjects(t *testing.T) {
+	l, err := NewLocal(t.TempDir(), "http://localhost:4000/", []byte("secret"))
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	_, err = l.Stat(ctx, "posters/12")
+	assert.Equal(t, err, ErrNotFound)
+	err = l.Put(ctx, "posters/12", strings.NewReader("poster"), 6, "image/png")
+	assert.NilError(t, err)
+	object, err := l.Stat(ctx, "posters/12")
+	assert.NilError(t, err)
+	assert.Equal(t, object.Size, int64(6))
+	err = l.Put(ctx, "posters/13", strings.NewReader("poster"), 7, "image/png")
+	if err == nil {
+		t.Error("stored an object which is shorter than its size")
+	}
+	_, err = l.Stat(ctx, "posters/13")
+	assert.Equal(t, err, ErrNotFound)
+	err = l.Delete(ctx, "posters/12")
+	assert.NilError(t, err)
+	err = l.Delete(ctx, "posters/12")
+	assert.NilError(t, err)
+	_, err = l.Open("posters/12")
+	assert.Equal(t, err, ErrNotFound)
+
+	for _, key := range []string{"", "/posters/12", "posters//12", "posters/../../etc/passwd", "posters/."} {
+		_, err = l.Stat(ctx, key)
+		assert.Equal(t, err, ErrInvalidKey)
+	}
+}
+
+func TestLocalPresign(t *testing.T) {
+	l, err := NewLocal(t.TempDir(), "http://localhost:4000/", []byte("secret"))
+	assert.NilError(t, err)
+
+	link, err := l.PresignGet("posters/12", time.Minute)
+	assert.NilError(t, err)
+	assert.StringContains(t, link, "http://localhost:4000/v1/files/posters/12?")
+	u, err := url.Parse(link)
+	assert.NilError(t, err)
+	query := u.Query()
+	assert.Equal(t, l.Verify("GET", "posters/12", "", query), true)
+	assert.Equal(t, l.Verify("HEAD", "posters/12", "image/png", query), true)
+	assert.Equal(t, l.Verify("GET", "posters/13", "", query), false)
+	assert.Equal(t, l.Verify("PUT", "posters/12", "", query), false)
+
+	link, err = l.PresignPut("posters/12", "image/png", time.Minute)
+	assert.NilError(t, err)
+	u, err = url.Parse(link)
+	assert.NilError(t, err)
+	query = u.Query()
+	assert.Equal(t, l.Verify("PUT", "posters/12", "image/png", query), true)
+	assert.Equal(t, l.Verify("PUT", "posters/12", "image/jpeg", query), false)
+	assert.Equal(t, l.Verify("GET", "posters/12", "", query), false)
+
+	query.Set("expires", "1")
+	assert.Equal(t, l.Verify("PUT", "posters/12", "image/png", query), false)
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is the payload hash for requests whose body isn't signed. The body
+// of an upload is streamed, so we can't hash it before sending the request.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// The S3Config type holds the settings for an S3-compatible object store. Endpoint is
+// the URL of the service, which defaults to https://s3.<region>.amazonaws.com. With
+// PathStyle set, the bucket goes in the path of the object URLs rather than in their
+// host name, which is what MinIO and most other S3-compatible services need.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Timeout   time.Duration
+}
+
+// The S3 type is a Store which keeps the objects in a bucket of an S3-compatible object
+// store. Requests are signed with AWS Signature Version 4 (SigV4).
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	// now returns the time that requests are signed at. It's only replaced in the tests.
+	now func() time.Time
+}
+
+// The S3Error type is an error response from the object store, like "NoSuchBucket The
+// specified bucket does not exist".
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("storage: s3 responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("storage: s3 %s: %s", e.Code, e.Message)
+}
+
+// NewS3 returns an S3 store for cfg. It doesn't connect to the object store, so a
+// misconfigured bucket or credentials only show up when it's first used.
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Region == "" || cfg.Bucket == "" {
+		return nil, errors.New("storage: s3 needs a region and a bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("storage: s3 needs an access key and a secret key")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: cfg.Timeout}, now: time.Now}, nil
+}
+
+// objectURL returns the URL of an object, with the bucket in either its path or its
+// host name.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	path := "/" + key
+	if s.cfg.PathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = u.Path + path
+	u.RawPath = s.endpoint.EscapedPath() + uriEncode(path, false)
+	return &u
+}
+
+// do signs and sends a request for an object, and turns the error responses into
+// S3Errors.
+func (s *S3) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, unsignedPayload, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		// HEAD responses have no body, and some errors don't either, so the code and
+		// the message may well be left empty.
+		xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(s3Err)
+		if resp.StatusCode == http.StatusNotFound && (s3Err.Code == "" || s3Err.Code == "NoSuchKey") {
+			return nil, ErrNotFound
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	resp, err := s.do(ctx, http.MethodPut, key, body, size, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) PresignGet(key string, ttl time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, nil, ttl)
+}
+
+// PresignPut signs the Content-Type header along with the URL, so the upload has to
+// be sent with the same one. S3 can't limit the size of the objects uploaded with a
+// presigned PUT, so if that matters it has to be checked with Stat() afterwards.
+func (s *S3) PresignPut(key, contentType string, ttl time.Duration) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	return s.presign(http.MethodPut, key, header, ttl)
+}
+
+// presign returns a URL for a request for an object which is signed in its query
+// string, so that it can be used without the credentials. Any headers given have to be
+// sent with the request, with the same values.
+func (s *S3) presign(method, key string, header http.Header, ttl time.Duration) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	err = checkTTL(ttl)
+	if err != nil {
+		return "", err
+	}
+	u := s.objectURL(key)
+	t := s.now().UTC()
+	names := signedHeaderNames(u.Host, header)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(ttl/time.Second), 10)},
+		"X-Amz-SignedHeaders": {strings.Join(names, ";")},
+	}
+	u.RawQuery = canonicalQuery(query)
+	signature := s.signature(t, s.canonicalRequest(method, u, header, names, unsignedPayload))
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// sign adds the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers to a
+// request, signing it and all of its other headers.
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	names := signedHeaderNames(req.URL.Host, req.Header)
+	signature := s.signature(t, s.canonicalRequest(req.Method, req.URL, req.Header, names, payloadHash))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.cfg.AccessKey, s.scope(t), strings.Join(names, ";"), signature))
+}
+
+// scope returns the credential scope of the requests signed at a time.
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// canonicalRequest returns the canonical form of a request, which is what gets signed:
+// the method, the path, the query string, the signed headers and the hash of the body,
+// each encoded and ordered in the way that SigV4 requires.
+func (s *S3) canonicalRequest(method string, u *url.URL, header http.Header, names []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(method + "\n")
+	b.WriteString(u.EscapedPath() + "\n")
+	query, _ := url.ParseQuery(u.RawQuery)
+	b.WriteString(canonicalQuery(query) + "\n")
+	for _, name := range names {
+		value := u.Host
+		if name != "host" {
+			value = strings.Join(strings.Fields(strings.Join(header.Values(name), ",")), " ")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	b.WriteString("\n" + strings.Join(names, ";") + "\n")
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+// signature returns the hex-encoded signature of a canonical request, made with a key
+// derived from the secret key and the credential scope.
+func (s *S3) signature(t time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{t.Format("20060102"), s.cfg.Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// signedHeaderNames returns the lower-case names of the host header and the headers in
+// header, sorted, which is the order they're signed in.
+func signedHeaderNames(host string, header http.Header) []string {
+	names := []string{"host"}
+	for name := range header {
+		if name := strings.ToLower(name); name != "host" && name != "authorization" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// canonicalQuery returns a query string with its parameters sorted by name and then
+// value, and URI-encoded.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte of s except the unreserved characters (letters,
+// digits, '-', '.', '_' and '~'), and slashes unless encodeSlash is set, as SigV4
+// requires. url.QueryEscape() and url.PathEscape() leave other characters alone too.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
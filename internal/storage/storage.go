@@ -0,0 +1,62 @@
+// Package storage stores uploaded files, like movie posters, as objects named by keys
+// such as "posters/12". The objects are kept either on the local disk or in an
+// S3-compatible object store (AWS S3 or MinIO, for example). Either way, clients
+// download them, and can upload them, with presigned URLs which expire, so that large
+// files don't have to go through the API.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when there's no object with a key.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrInvalidKey is returned for keys which aren't made up of one or more non-empty
+// segments separated by slashes, or which contain a "." or ".." segment.
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// MaxPresignTTL is the longest that a presigned URL can be valid for, which is the
+// limit set by S3.
+const MaxPresignTTL = 7 * 24 * time.Hour
+
+// The Object type describes a stored object.
+type Object struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// The Store interface is implemented by each storage backend. PresignGet() returns a
+// URL that the object can be downloaded from with a GET request, and PresignPut() one
+// that it can be uploaded to with a PUT request, which has to have the given
+// Content-Type header. Both work until the TTL is up. Deleting an object which doesn't
+// exist isn't an error.
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Stat(ctx context.Context, key string) (Object, error)
+	Delete(ctx context.Context, key string) error
+	PresignGet(key string, ttl time.Duration) (string, error)
+	PresignPut(key, contentType string, ttl time.Duration) (string, error)
+}
+
+// checkKey returns ErrInvalidKey if a key isn't valid.
+func checkKey(key string) error {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "\\\x00") {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// checkTTL returns an error if a presigned URL can't be valid for ttl.
+func checkTTL(ttl time.Duration) error {
+	if ttl < time.Second || ttl > MaxPresignTTL {
+		return errors.New("storage: presigned URLs must be valid for between 1 second and 7 days")
+	}
+	return nil
+}
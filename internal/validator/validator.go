@@ -2,6 +2,7 @@ package validator
 
 import (
 	"regexp"
+	"time"
 )
 
 // Declare a regular expression for sanity checking the format of email addresses (we'll
@@ -58,4 +59,48 @@ func Unique(values []string) bool {
 			uniqueValues[value] = true
 	}
 	return len(values) == len(uniqueValues)
+}
+// RequiredIf returns true if a value is present whenever a condition holds. It's used for
+// conditional rules like "field B is required when field A is set", for example:
+//
+//	v.Check(validator.RequiredIf(input.EndsAt != nil, input.StartsAt != nil), "starts_at", "must be provided when ends_at is set")
+func RequiredIf(condition bool, present bool) bool {
+	return !condition || present
+}
+// AllOrNone returns true if either all or none of the given fields are present.
+func AllOrNone(present ...bool) bool {
+	count := 0
+	for _, p := range present {
+		if p {
+			count++
+		}
+	}
+	return count == 0 || count == len(present)
+}
+// MutuallyExclusive returns true if at most one of the given fields is present.
+func MutuallyExclusive(present ...bool) bool {
+	count := 0
+	for _, p := range present {
+		if p {
+			count++
+		}
+	}
+	return count <= 1
+}
+// Before returns true if time a is strictly before time b. If either time is the zero
+// value (i.e. it wasn't provided) the check passes, so that this can be used with
+// optional fields; combine it with RequiredIf() if both values must be present.
+func Before(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return true
+	}
+	return a.Before(b)
+}
+// NotAfter returns true if time a is before or equal to time b. As with Before(), the
+// check passes if either time is the zero value.
+func NotAfter(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return true
+	}
+	return !a.After(b)
 }
\ No newline at end of file
@@ -1,2 +1,6 @@
 CREATE INDEX IF NOT EXISTS movies_title_idx ON movies USING GIN (to_tsvector('simple', title));
+-- The default GIN operator class for arrays supports @> (genres_all), && (genres_any),
+-- <@ and =, so this one index covers both kinds of genre filter. If the genre filters are
+-- usually combined with a title search or a year range, consider a multicolumn index with
+-- the btree_gin extension instead, rather than adding more indexes here.
 CREATE INDEX IF NOT EXISTS movies_genres_idx ON movies USING GIN (genres);
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS security_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    email text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT '',
+    properties jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS security_events_event_created_at_idx ON security_events (event, created_at);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    id bigserial PRIMARY KEY,
+    code text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+-- Add the two permissions to the table.
+INSERT INTO permissions (code)
+VALUES
+    ('movies:read'),
+    ('movies:write');
+
+-- Every movie endpoint was public before this, so give the existing users the
+-- permission to read movies, as new users get when they register. Changing movies
+-- needs the movies:write permission to be granted explicitly.
+INSERT INTO users_permissions
+SELECT users.id, permissions.id
+FROM users, permissions
+WHERE permissions.code = 'movies:read';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS tokens_user_id_idx;
+ALTER TABLE tokens DROP COLUMN IF EXISTS permissions;
+ALTER TABLE tokens DROP COLUMN IF EXISTS name;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS id;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name)
+VALUES
+    ('admin'),
+    ('editor'),
+    ('viewer');
+
+-- Viewers can read movies, and editors and admins can change them too.
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+OR (roles.name IN ('editor', 'admin') AND permissions.code IN ('movies:read', 'movies:write'));
+
+-- Everyone who could read movies before is a viewer now.
+INSERT INTO user_roles
+SELECT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+CROSS JOIN roles
+WHERE permissions.code = 'movies:read' AND roles.name = 'viewer'
+ON CONFLICT DO NOTHING;
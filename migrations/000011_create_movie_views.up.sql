@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS movie_views (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    hour timestamp(0) with time zone NOT NULL,
+    views bigint NOT NULL,
+    PRIMARY KEY (movie_id, hour)
+);
+
+CREATE INDEX IF NOT EXISTS movie_views_hour_idx ON movie_views (hour);
+
+CREATE TABLE IF NOT EXISTS movie_trending (
+    period text NOT NULL,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    views bigint NOT NULL,
+    PRIMARY KEY (period, movie_id)
+);
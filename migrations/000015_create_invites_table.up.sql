@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS invites (
+    id bigserial PRIMARY KEY,
+    hash bytea UNIQUE NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    created_by bigint REFERENCES users ON DELETE SET NULL,
+    expiry timestamp(0) with time zone NOT NULL,
+    max_uses integer NOT NULL CHECK (max_uses > 0),
+    uses integer NOT NULL DEFAULT 0,
+    note text NOT NULL DEFAULT ''
+);
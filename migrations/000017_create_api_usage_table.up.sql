@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS api_usage (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    token_id bigint NOT NULL DEFAULT 0,
+    day date NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    errors bigint NOT NULL DEFAULT 0,
+    rate_limited bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day, token_id)
+);
+
+CREATE INDEX IF NOT EXISTS api_usage_day_idx ON api_usage (day);
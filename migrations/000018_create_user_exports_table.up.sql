@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_exports (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    archive bytea NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_exports_user_id_idx ON user_exports (user_id);
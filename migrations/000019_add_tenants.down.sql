@@ -0,0 +1,6 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_tenant_id_email_key;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+DROP INDEX IF EXISTS movies_tenant_id_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE movies DROP COLUMN IF EXISTS tenant_id;
+DROP TABLE IF EXISTS tenants;
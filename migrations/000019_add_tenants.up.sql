@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS tenants (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug text UNIQUE NOT NULL,
+    name text NOT NULL
+);
+
+-- Every existing movie and user belongs to the default tenant.
+INSERT INTO tenants (id, slug, name) VALUES (1, 'default', 'Default') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('tenants', 'id'), (SELECT max(id) FROM tenants));
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS tenant_id bigint NOT NULL DEFAULT 1 REFERENCES tenants ON DELETE CASCADE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id bigint NOT NULL DEFAULT 1 REFERENCES tenants ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS movies_tenant_id_idx ON movies (tenant_id);
+
+-- Email addresses only have to be unique within a tenant.
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+ALTER TABLE users ADD CONSTRAINT users_tenant_id_email_key UNIQUE (tenant_id, email);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS movies_deleted_at_idx;
+DELETE FROM movies WHERE deleted_at IS NOT NULL;
+ALTER TABLE movies DROP COLUMN IF EXISTS deleted_at;
+
+ALTER INDEX IF EXISTS users_deleted_at_idx RENAME TO users_deletion_requested_at_idx;
+ALTER TABLE users RENAME COLUMN deleted_at TO deletion_requested_at;
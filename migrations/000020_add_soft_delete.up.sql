@@ -0,0 +1,7 @@
+-- Movies and users are both soft deleted, with the same deleted_at column.
+ALTER TABLE users RENAME COLUMN deletion_requested_at TO deleted_at;
+ALTER INDEX IF EXISTS users_deletion_requested_at_idx RENAME TO users_deleted_at_idx;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON movies (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE movies DROP COLUMN IF EXISTS updated_by;
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
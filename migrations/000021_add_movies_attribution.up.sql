@@ -0,0 +1,4 @@
+-- The users who created and last modified each movie. Movies created before these
+-- columns existed, or by imports without a user, have NULL.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_by bigint REFERENCES users ON DELETE SET NULL;
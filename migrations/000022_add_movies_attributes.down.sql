@@ -0,0 +1,3 @@
+ALTER TABLE movie_revisions DROP COLUMN IF EXISTS attributes;
+DROP INDEX IF EXISTS movies_attributes_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS attributes;
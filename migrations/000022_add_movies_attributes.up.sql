@@ -0,0 +1,6 @@
+-- Descriptive attributes of each movie, like its language and country, as a JSON object
+-- of strings. The schema is enforced by the application, so adding an attribute doesn't
+-- need a migration. The jsonb_path_ops index supports the @> filters in the listings.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS movies_attributes_idx ON movies USING GIN (attributes jsonb_path_ops);
+ALTER TABLE movie_revisions ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}';
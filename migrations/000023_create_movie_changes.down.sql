@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movies_update_change ON movies;
+DROP TRIGGER IF EXISTS movies_insert_change ON movies;
+DROP FUNCTION IF EXISTS record_movie_change();
+DROP TABLE IF EXISTS movie_changes;
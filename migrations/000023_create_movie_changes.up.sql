@@ -0,0 +1,48 @@
+-- An append-only feed of the changes to movies, for GET /v1/changes. The rows are
+-- written by triggers, so that every write is recorded (including COPY imports, whose
+-- movie IDs the application never sees) in the same transaction as the change itself.
+-- txid is the transaction that made the change, so that readers can hold back the
+-- changes of transactions which might still be in progress (see MovieModel.Changes()).
+CREATE TABLE IF NOT EXISTS movie_changes (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL,
+    tenant_id bigint NOT NULL,
+    operation text NOT NULL,
+    version integer NOT NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    txid bigint NOT NULL DEFAULT txid_current()
+);
+
+CREATE OR REPLACE FUNCTION record_movie_change() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO movie_changes (movie_id, tenant_id, operation, version)
+    VALUES (
+        NEW.id,
+        NEW.tenant_id,
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'created'
+            WHEN NEW.deleted_at IS NOT NULL THEN 'deleted'
+            ELSE 'updated'
+        END,
+        NEW.version
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_insert_change AFTER INSERT ON movies
+    FOR EACH ROW EXECUTE FUNCTION record_movie_change();
+
+-- Only updates which bump the version are changes to the movie; this leaves out the
+-- updates made by ON DELETE SET NULL when the user who created a movie is purged.
+CREATE TRIGGER movies_update_change AFTER UPDATE ON movies
+    FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version)
+    EXECUTE FUNCTION record_movie_change();
+
+-- Start the feed with the movies which already exist, so that a consumer can build its
+-- copy of the catalog by reading the feed from the beginning.
+INSERT INTO movie_changes (movie_id, tenant_id, operation, version)
+SELECT id, tenant_id, 'created', version
+FROM movies
+WHERE deleted_at IS NULL
+ORDER BY id;
@@ -0,0 +1,32 @@
+-- Put the archived rows back along with the live ones.
+ALTER TABLE security_events RENAME TO security_events_partitioned;
+ALTER TABLE security_events_partitioned RENAME CONSTRAINT security_events_pkey TO security_events_partitioned_pkey;
+CREATE TABLE security_events (
+    id bigint PRIMARY KEY DEFAULT nextval('security_events_id_seq'),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    email text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT '',
+    properties jsonb NOT NULL DEFAULT '{}'
+);
+ALTER SEQUENCE security_events_id_seq OWNED BY security_events.id;
+INSERT INTO security_events SELECT * FROM security_events_partitioned;
+INSERT INTO security_events SELECT * FROM security_events_archive;
+DROP TABLE security_events_partitioned;
+DROP TABLE security_events_archive;
+CREATE INDEX IF NOT EXISTS security_events_event_created_at_idx ON security_events (event, created_at);
+
+ALTER TABLE movie_views RENAME TO movie_views_partitioned;
+ALTER TABLE movie_views_partitioned RENAME CONSTRAINT movie_views_pkey TO movie_views_partitioned_pkey;
+CREATE TABLE movie_views (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    hour timestamp(0) with time zone NOT NULL,
+    views bigint NOT NULL,
+    PRIMARY KEY (movie_id, hour)
+);
+INSERT INTO movie_views SELECT * FROM movie_views_partitioned;
+INSERT INTO movie_views SELECT * FROM movie_views_archive;
+DROP TABLE movie_views_partitioned;
+DROP TABLE movie_views_archive;
+CREATE INDEX IF NOT EXISTS movie_views_hour_idx ON movie_views (hour);
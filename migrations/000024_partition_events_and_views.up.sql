@@ -0,0 +1,72 @@
+-- Partition the security events (the audit log) and the movie view counts by month, so
+-- that old months can be detached and archived as a whole (see data.PartitionModel)
+-- instead of slowly growing the tables, or being deleted row by row. Partitions are
+-- named <table>_pYYYYMM, for the month starting at midnight UTC on the first. The
+-- default partitions catch any rows for months which don't have a partition yet.
+--
+-- Archived partitions are attached to the <table>_archive tables, which have no indexes,
+-- so that they're out of the way of the live tables but can still be queried, and their
+-- personal data is still removed when users are purged.
+
+ALTER TABLE security_events RENAME TO security_events_unpartitioned;
+ALTER TABLE security_events_unpartitioned RENAME CONSTRAINT security_events_pkey TO security_events_unpartitioned_pkey;
+ALTER INDEX security_events_event_created_at_idx RENAME TO security_events_unpartitioned_event_created_at_idx;
+
+CREATE TABLE security_events (
+    id bigint NOT NULL DEFAULT nextval('security_events_id_seq'),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    email text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT '',
+    properties jsonb NOT NULL DEFAULT '{}',
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+ALTER SEQUENCE security_events_id_seq OWNED BY security_events.id;
+CREATE INDEX IF NOT EXISTS security_events_event_created_at_idx ON security_events (event, created_at);
+CREATE TABLE IF NOT EXISTS security_events_default PARTITION OF security_events DEFAULT;
+CREATE TABLE IF NOT EXISTS security_events_archive (LIKE security_events) PARTITION BY RANGE (created_at);
+
+ALTER TABLE movie_views RENAME TO movie_views_unpartitioned;
+ALTER TABLE movie_views_unpartitioned RENAME CONSTRAINT movie_views_pkey TO movie_views_unpartitioned_pkey;
+ALTER INDEX movie_views_hour_idx RENAME TO movie_views_unpartitioned_hour_idx;
+
+CREATE TABLE movie_views (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    hour timestamp(0) with time zone NOT NULL,
+    views bigint NOT NULL,
+    PRIMARY KEY (movie_id, hour)
+) PARTITION BY RANGE (hour);
+CREATE INDEX IF NOT EXISTS movie_views_hour_idx ON movie_views (hour);
+CREATE TABLE IF NOT EXISTS movie_views_default PARTITION OF movie_views DEFAULT;
+CREATE TABLE IF NOT EXISTS movie_views_archive (LIKE movie_views) PARTITION BY RANGE (hour);
+
+-- Create the partitions for every month from the oldest row up to next month, before
+-- copying the rows across, so that none of them end up in the default partitions.
+DO $$
+DECLARE
+    t record;
+    month timestamp;
+BEGIN
+    FOR t IN
+        SELECT 'security_events' AS name, (SELECT min(created_at) FROM security_events_unpartitioned) AS oldest
+        UNION ALL
+        SELECT 'movie_views', (SELECT min(hour) FROM movie_views_unpartitioned)
+    LOOP
+        FOR month IN
+            SELECT generate_series(
+                date_trunc('month', coalesce(t.oldest, now()) AT TIME ZONE 'UTC'),
+                date_trunc('month', now() AT TIME ZONE 'UTC') + interval '1 month',
+                interval '1 month')
+        LOOP
+            EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                t.name || '_p' || to_char(month, 'YYYYMM'), t.name,
+                month AT TIME ZONE 'UTC', (month + interval '1 month') AT TIME ZONE 'UTC');
+        END LOOP;
+    END LOOP;
+END $$;
+
+INSERT INTO security_events SELECT * FROM security_events_unpartitioned;
+DROP TABLE security_events_unpartitioned;
+INSERT INTO movie_views SELECT * FROM movie_views_unpartitioned;
+DROP TABLE movie_views_unpartitioned;
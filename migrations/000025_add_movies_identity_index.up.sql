@@ -0,0 +1,32 @@
+-- A movie's natural identity is its title (ignoring case and runs of whitespace) and
+-- release year, which is what PUT /v1/movies/by-identity upserts on. Each live movie in
+-- a tenant must have a different identity. The expression has to match
+-- movieIdentityColumns.
+--
+-- Before upgrading, list the movies which share an identity with:
+--
+--   SELECT tenant_id, lower(regexp_replace(btrim(title), '\s+', ' ', 'g')) AS identity,
+--          year, array_agg(id ORDER BY id) AS ids
+--   FROM movies WHERE deleted_at IS NULL
+--   GROUP BY 1, 2, 3 HAVING count(*) > 1;
+--
+-- and merge or delete them. Any that are left are soft deleted here, keeping the oldest
+-- movie with each identity, so that the index can be built. Like other deleted movies
+-- they stay in the table, and can be recovered by hand (after changing their title or
+-- year), until they're purged at the end of the -movie-deletion-grace period.
+UPDATE movies SET deleted_at = NOW(), version = version + 1
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id, row_number() OVER (
+            PARTITION BY tenant_id, lower(regexp_replace(btrim(title), '\s+', ' ', 'g')), year
+            ORDER BY id
+        ) AS n
+        FROM movies
+        WHERE deleted_at IS NULL
+    ) duplicates
+    WHERE n > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS movies_identity_idx
+    ON movies (tenant_id, (lower(regexp_replace(btrim(title), '\s+', ' ', 'g'))), year)
+    WHERE deleted_at IS NULL;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    kind text NOT NULL,
+    status text NOT NULL DEFAULT 'queued',
+    progress integer NOT NULL DEFAULT 0,
+    total integer NOT NULL DEFAULT 0,
+    result jsonb,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    started_at timestamp(0) with time zone,
+    finished_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS jobs_user_id_idx ON jobs (user_id);
@@ -0,0 +1,8 @@
+-- The index behind GET /v1/movies/suggest, which matches the lowercased title by prefix
+-- (LIKE) and by trigram word similarity (<%). Creating the pg_trgm extension needs a
+-- role which is allowed to; it's left in place by the down migration.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS movies_title_trgm_idx
+    ON movies USING GIN (lower(title) gin_trgm_ops)
+    WHERE deleted_at IS NULL;
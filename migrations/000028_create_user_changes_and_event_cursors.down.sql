@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS event_cursors;
+DROP TRIGGER IF EXISTS users_update_change ON users;
+DROP TRIGGER IF EXISTS users_insert_change ON users;
+DROP FUNCTION IF EXISTS record_user_change();
+DROP TABLE IF EXISTS user_changes;
@@ -0,0 +1,52 @@
+-- An append-only feed of the changes to users, written by triggers in the same way as
+-- movie_changes. Together the two feeds are the outbox for the lifecycle events which
+-- the event relay publishes (see cmd/api/events.go): a change is only published once
+-- the transaction which made it has committed.
+CREATE TABLE IF NOT EXISTS user_changes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    tenant_id bigint NOT NULL,
+    operation text NOT NULL,
+    version integer NOT NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    txid bigint NOT NULL DEFAULT txid_current()
+);
+
+CREATE OR REPLACE FUNCTION record_user_change() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO user_changes (user_id, tenant_id, operation, version)
+    VALUES (
+        NEW.id,
+        NEW.tenant_id,
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'created'
+            WHEN NEW.deleted_at IS NOT NULL THEN 'deleted'
+            WHEN NEW.activated AND NOT OLD.activated THEN 'activated'
+            ELSE 'updated'
+        END,
+        NEW.version
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_insert_change AFTER INSERT ON users
+    FOR EACH ROW EXECUTE FUNCTION record_user_change();
+
+-- Like movies, only the updates which bump the version are changes; logins and
+-- preference changes aren't.
+CREATE TRIGGER users_update_change AFTER UPDATE ON users
+    FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version)
+    EXECUTE FUNCTION record_user_change();
+
+-- The position in each feed up to which the changes have been published. The movies
+-- feed starts at its current end, so that the changes from before there was a relay
+-- aren't all published at once.
+CREATE TABLE IF NOT EXISTS event_cursors (
+    feed text PRIMARY KEY,
+    position bigint NOT NULL
+);
+
+INSERT INTO event_cursors (feed, position)
+VALUES ('movies', (SELECT coalesce(max(id), 0) FROM movie_changes)), ('users', 0)
+ON CONFLICT DO NOTHING;
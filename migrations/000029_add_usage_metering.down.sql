@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS metering_pushes;
+ALTER TABLE api_usage DROP COLUMN IF EXISTS api_key;
+ALTER TABLE api_usage DROP COLUMN IF EXISTS bytes_out;
+ALTER TABLE api_usage DROP COLUMN IF EXISTS bytes_in;
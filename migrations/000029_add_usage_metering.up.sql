@@ -0,0 +1,14 @@
+-- The data volume of each user's requests, for metering, and whether the token they
+-- were made with is an API key. Only the usage of API keys is metered (see
+-- MeteringModel).
+ALTER TABLE api_usage ADD COLUMN IF NOT EXISTS bytes_in bigint NOT NULL DEFAULT 0;
+ALTER TABLE api_usage ADD COLUMN IF NOT EXISTS bytes_out bigint NOT NULL DEFAULT 0;
+ALTER TABLE api_usage ADD COLUMN IF NOT EXISTS api_key boolean NOT NULL DEFAULT false;
+
+-- The days whose metering rollups have been pushed to the billing webhook, so that each
+-- day is pushed once.
+CREATE TABLE IF NOT EXISTS metering_pushes (
+    day date PRIMARY KEY,
+    records integer NOT NULL,
+    pushed_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);